@@ -0,0 +1,194 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+	openmetrics_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/openmetrics"
+	tsdb_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/tsdb"
+	"wouldgo.me/meteotrentino-exporter/pkg/options"
+	"wouldgo.me/meteotrentino-exporter/pkg/pipeline"
+	"wouldgo.me/meteotrentino-exporter/pkg/tsdb"
+)
+
+func backfillCommand() *command {
+	return &command{
+		name:        "backfill",
+		description: "Fetches the last 24h of observations, or reads an older range from the tsdb sink, and writes them as OpenMetrics blocks for promtool tsdb create-blocks-from openmetrics.",
+		run:         backfill,
+	}
+}
+
+// parseTime parses an RFC3339 flag value, empty is the zero time.
+func parseTime(name, value string) (time.Time, error) {
+	if value == "" {
+		return time.Time{}, nil
+	}
+
+	t, err := time.Parse(time.RFC3339, value)
+	if err != nil {
+		return time.Time{}, errors.Join(options.ErrWrongParam(name), err)
+	}
+
+	return t, nil
+}
+
+func backfill(fs *flag.FlagSet, args []string) error {
+	opts := options.NewOptions(fs, env)
+	tsdbOpts := tsdb_metrics.NewTsdbOptions(fs, env)
+
+	var dir, blockDuration, from, to string
+	fs.StringVar(&dir, "output-dir", "backfill", "directory receiving a file per block, - writes a single stream to stdout (default: backfill)")
+	fs.StringVar(&blockDuration, "block-duration", openmetrics_metrics.DefaultBlockDuration.String(), "span of every file, match the promtool --max-block-duration (default: 2h)")
+	fs.StringVar(&from, "from", "", "drop the observations before this RFC3339 time, one before the last 24h served upstream is read from the tsdb sink")
+	fs.StringVar(&to, "to", "", "drop the observations from this RFC3339 time on, one before the last 24h served upstream is read from the tsdb sink")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	c, err := loadConfig(opts, tsdbOpts)
+	if err != nil {
+		return err
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return err
+	}
+
+	block, err := time.ParseDuration(blockDuration)
+	if err != nil || block <= 0 {
+		return errors.Join(options.ErrWrongParam("block-duration"), err)
+	}
+
+	fromTime, err := parseTime("from", from)
+	if err != nil {
+		return err
+	}
+	toTime, err := parseTime("to", to)
+	if err != nil {
+		return err
+	}
+
+	// meteotrentino has no history endpoint, a range before its window is
+	// read from the tsdb sink, without it would silently come out empty
+	oldest := time.Now().Add(-api.Window)
+	history := (!fromTime.IsZero() && fromTime.Before(oldest)) || (!toTime.IsZero() && !toTime.After(oldest))
+	if history && c.Sinks.Tsdb == nil {
+		param := "from"
+		if fromTime.IsZero() || !fromTime.Before(oldest) {
+			param = "to"
+		}
+		return errors.Join(options.ErrWrongParam(param), fmt.Errorf("the range reaches before %s, meteotrentino only serves the last 24h, set the tsdb sink to read older observations", oldest.Format(time.RFC3339)))
+	}
+	upstream := toTime.IsZero() || toTime.After(oldest)
+
+	logger, _, err := options.NewLogger(c.Logging)
+	if err != nil {
+		return err
+	}
+	defer syncLogger(logger)
+
+	ctx, stop := context.WithTimeout(context.Background(), time.Minute)
+	defer stop()
+
+	m, err := openmetrics_metrics.NewOpenMetrics(openmetrics_metrics.MetricsConfig{
+		Logger:        logger,
+		Dir:           dir,
+		BlockDuration: block,
+		From:          fromTime,
+		To:            toTime,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating openmetrics output: %w", err)
+	}
+
+	if history {
+		err = backfillHistory(ctx, logger, c, m, fromTime, toTime)
+		if err != nil {
+			return errors.Join(err, m.Close())
+		}
+	}
+
+	if !upstream {
+		return m.Close()
+	}
+
+	stations := make([]pipeline.Station, 0, len(c.Stations))
+	for _, s := range c.Stations {
+		station, err := pipeline.NewStation(pipeline.StationOptions{
+			Code:      s.Code,
+			Logger:    logger,
+			Variables: s.Variables,
+			BaseUrl:   c.Upstream.BaseUrl,
+			Timeout:   c.Upstream.Timeout,
+		})
+		if err != nil {
+			return errors.Join(err, m.Close())
+		}
+		stations = append(stations, station)
+	}
+
+	p, err := pipeline.NewPipeline(pipeline.PipelineConfig{
+		Logger:   logger,
+		Stations: stations,
+		Sinks:    []pipeline.Sink{{Sink: m}},
+	})
+	if err != nil {
+		return errors.Join(fmt.Errorf("error creating pipeline: %w", err), m.Close())
+	}
+
+	// the blocks are written on close, with what was fetched and read
+	err = p.RunOnce(ctx)
+	if err != nil {
+		logger.Error("error fetching stations", zap.Error(err))
+	}
+
+	return errors.Join(err, p.Close())
+}
+
+// backfillHistory writes to m the observations of the stations of c stored
+// in [from, to] by the tsdb sink, which is opened read-only, as a running
+// exporter may be writing it.
+func backfillHistory(ctx context.Context, logger *zap.Logger, c *config.Config, m metrics.Sink, from, to time.Time) error {
+	logger.Info("reading history from tsdb", zap.String("dir", c.Sinks.Tsdb.Dir))
+	db, err := tsdb.NewDB(tsdb.Options{
+		Dir:      c.Sinks.Tsdb.Dir,
+		Logger:   logger,
+		ReadOnly: true,
+	})
+	if err != nil {
+		return fmt.Errorf("error opening tsdb: %w", err)
+	}
+	defer func() {
+		_ = db.Close()
+	}()
+
+	for _, s := range c.Stations {
+		code := strings.ToUpper(s.Code)
+		stats, err := tsdb_metrics.Stats(db, code, from, to)
+		if err != nil {
+			return err
+		}
+
+		err = m.Write(ctx, metrics.StationStats{
+			Station: api.Station{Code: code},
+			Stats:   api.SelectVariables(stats, s.Variables),
+		})
+		if err != nil {
+			return fmt.Errorf("error writing history of %s: %w", code, err)
+		}
+	}
+
+	return nil
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"fmt"
+
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	"wouldgo.me/meteotrentino-exporter/pkg/options"
+)
+
+// applier is implemented by the options overriding a section of the
+// configuration.
+type applier interface {
+	Apply(c *config.Config) error
+}
+
+// loadConfig reads the configuration file and overrides it with env vars and
+// flags, in the order of appliers. Validation is left to the caller, which
+// may still fill in command specific defaults.
+func loadConfig(opts *options.Options, appliers ...applier) (*config.Config, error) {
+	c, err := opts.Load()
+	if err != nil {
+		return nil, fmt.Errorf("error on parsing options: %w", err)
+	}
+
+	for _, a := range appliers {
+		err := a.Apply(c)
+		if err != nil {
+			return nil, fmt.Errorf("error on parsing options: %w", err)
+		}
+	}
+
+	return c, nil
+}
+
+// applierFunc adapts a function to applier, e.g. for command defaults.
+type applierFunc func(c *config.Config) error
+
+func (f applierFunc) Apply(c *config.Config) error {
+	return f(c)
+}
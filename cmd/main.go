@@ -0,0 +1,115 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"syscall"
+
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/options"
+)
+
+const binaryName = "meteotrentino-exporter"
+
+var errMissingCommand = errors.New("missing command")
+
+// version is set at build time through -ldflags "-X main.version=..."
+var version = "dev"
+
+// env resolves the env vars of every command, from the process environment
+// and without prefix.
+var env = options.Env{}
+
+// command is a node of the command tree, leaves have run set while the
+// others dispatch to their subcommands.
+type command struct {
+	name        string
+	description string
+	run         func(fs *flag.FlagSet, args []string) error
+	subcommands []*command
+}
+
+func (c *command) usage(w io.Writer, path string) {
+	_, _ = fmt.Fprintf(w, "%s\n\nUsage:\n", c.description)
+	if c.run != nil {
+		_, _ = fmt.Fprintf(w, "  %s [flags]\n", path)
+		return
+	}
+
+	_, _ = fmt.Fprintf(w, "  %s <command> [flags]\n\nCommands:\n", path)
+	for _, sub := range c.subcommands {
+		_, _ = fmt.Fprintf(w, "  %-12s %s\n", sub.name, sub.description)
+	}
+	_, _ = fmt.Fprintf(w, "\nRun '%s <command> -h' for the command flags.\n", path)
+}
+
+func (c *command) execute(path string, args []string) error {
+	if c.run != nil {
+		fs := flag.NewFlagSet(path, flag.ContinueOnError)
+		fs.Usage = func() {
+			c.usage(fs.Output(), path)
+			_, _ = fmt.Fprintln(fs.Output(), "\nFlags:")
+			fs.PrintDefaults()
+		}
+
+		return c.run(fs, args)
+	}
+
+	if len(args) == 0 || args[0] == "-h" || args[0] == "--help" || args[0] == "help" {
+		c.usage(os.Stderr, path)
+		if len(args) == 0 {
+			return errMissingCommand
+		}
+		return nil
+	}
+
+	for _, sub := range c.subcommands {
+		if sub.name == args[0] {
+			return sub.execute(path+" "+sub.name, args[1:])
+		}
+	}
+
+	c.usage(os.Stderr, path)
+	return fmt.Errorf("unknown command %q", strings.Join(append([]string{path}, args[0]), " "))
+}
+
+// syncLogger flushes the logger, stderr does not support sync on every
+// platform so EINVAL is expected.
+func syncLogger(logger *zap.Logger) {
+	logger.Info("bye")
+	err := logger.Sync()
+	if err != nil && !errors.Is(err, syscall.EINVAL) && !errors.Is(err, syscall.ENOTTY) {
+		_, _ = fmt.Fprintf(os.Stderr, "error syncing logger: %v\n", err)
+	}
+}
+
+func main() {
+	root := &command{
+		name:        binaryName,
+		description: "Exports the observations of the Meteo Trentino weather stations.",
+		subcommands: []*command{
+			serveCommand(),
+			pushCommand(),
+			backfillCommand(),
+			migrateCommand(),
+			stationsCommand(),
+			versionCommand(),
+		},
+	}
+
+	err := root.execute(binaryName, os.Args[1:])
+	if errors.Is(err, flag.ErrHelp) {
+		return
+	}
+	if errors.Is(err, errMissingCommand) {
+		os.Exit(2)
+	}
+	if err != nil {
+		_, _ = fmt.Fprintf(os.Stderr, "error: %v\n", err)
+		os.Exit(1)
+	}
+}
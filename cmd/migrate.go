@@ -0,0 +1,84 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	postgres_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/postgres"
+	"wouldgo.me/meteotrentino-exporter/pkg/options"
+)
+
+func migrateCommand() *command {
+	return &command{
+		name:        "migrate",
+		description: "Brings the schema of the postgres sink to the version of the exporter, creating the TimescaleDB hypertable when enabled.",
+		run:         migrate,
+	}
+}
+
+// migrate needs no station, so it reads the configuration file on its own
+// instead of through options.Options.
+func migrate(fs *flag.FlagSet, args []string) error {
+	logOpts := options.NewLogOptions(fs, env)
+	postgresOpts := postgres_metrics.NewPostgresOptions(fs, env)
+
+	var configPath string
+	fs.StringVar(&configPath, "config", "", "yaml configuration file holding the postgres sink, env vars and then flags take precedence over it")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	c := config.Default()
+	if path, ok := options.Override(fs, "config", &configPath, env, options.ConfigEnv); ok && path != "" {
+		c, err = config.Load(path)
+		if err != nil {
+			return fmt.Errorf("error on parsing options: %w", err)
+		}
+	}
+
+	for _, a := range []applier{postgresOpts, logOpts} {
+		err = a.Apply(c)
+		if err != nil {
+			return fmt.Errorf("error on parsing options: %w", err)
+		}
+	}
+
+	if c.Sinks.Postgres == nil || c.Sinks.Postgres.Url == "" {
+		return errMissingPostgres
+	}
+
+	logger, _, err := options.NewLogger(c.Logging)
+	if err != nil {
+		return err
+	}
+	defer syncLogger(logger)
+
+	ctx, stop := context.WithTimeout(context.Background(), 10*time.Minute)
+	defer stop()
+
+	conf := c.Sinks.Postgres
+	pool, err := postgres_metrics.NewPool(ctx, conf.Url, conf.Password)
+	if err != nil {
+		return err
+	}
+	defer pool.Close()
+
+	schema := postgres_metrics.DefaultSchema
+	if conf.Schema != "" {
+		schema = conf.Schema
+	}
+
+	err = postgres_metrics.Migrate(ctx, logger, pool, schema, conf.Timescale)
+	if err != nil {
+		return err
+	}
+
+	logger.Info("postgres schema migrated", zap.String("schema", schema), zap.Int("version", postgres_metrics.Version))
+	return nil
+}
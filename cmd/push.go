@@ -0,0 +1,277 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"time"
+
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	"wouldgo.me/meteotrentino-exporter/pkg/exporter"
+	file_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/file"
+	influxdb_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/influxdb"
+	mqtt_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/mqtt"
+	otlp_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/otlp"
+	postgres_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/postgres"
+	prometheus_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/prometheus"
+	pushgateway_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/pushgateway"
+	remotewrite_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/remotewrite"
+	textfile_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/textfile"
+	tsdb_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/tsdb"
+	"wouldgo.me/meteotrentino-exporter/pkg/options"
+	"wouldgo.me/meteotrentino-exporter/pkg/tracing"
+)
+
+func pushCommand() *command {
+	return &command{
+		name:        "push",
+		description: "Fetches the last 24h of observations once and pushes them to a sink.",
+		subcommands: []*command{
+			{
+				name:        "influxdb",
+				description: "Writes the observations to influxdb.",
+				run: pushTo(func(fs *flag.FlagSet) []applier {
+					return []applier{influxdb_metrics.NewInfluxDbOptions(fs, env), influxdb_metrics.NewSchemaOptions(fs, env)}
+				}, func(s config.Sinks) config.Sinks { return config.Sinks{InfluxDb: s.InfluxDb} }, errMissingInfluxDb),
+			},
+			{
+				name:        "file",
+				description: "Writes the observations as line protocol or json to stdout, a file or a rotating directory.",
+				run: pushTo(func(fs *flag.FlagSet) []applier {
+					return []applier{applierFunc(defaultToStdout), file_metrics.NewFileOptions(fs, env), influxdb_metrics.NewSchemaOptions(fs, env)}
+				}, func(s config.Sinks) config.Sinks { return config.Sinks{File: s.File} }, nil),
+			},
+			{
+				name:        "otlp",
+				description: "Pushes the observations as metrics to an OpenTelemetry collector.",
+				run: pushTo(func(fs *flag.FlagSet) []applier {
+					return []applier{otlp_metrics.NewOtlpOptions(fs, env)}
+				}, func(s config.Sinks) config.Sinks { return config.Sinks{Otlp: s.Otlp} }, errMissingOtlp),
+			},
+			{
+				name:        "remotewrite",
+				description: "Writes every observation with its timestamp to a prometheus remote write endpoint.",
+				run: pushTo(func(fs *flag.FlagSet) []applier {
+					return []applier{remotewrite_metrics.NewRemoteWriteOptions(fs, env)}
+				}, func(s config.Sinks) config.Sinks { return config.Sinks{RemoteWrite: s.RemoteWrite} }, errMissingRemoteWrite),
+			},
+			{
+				name:        "pushgateway",
+				description: "Pushes the latest observation of every station to a pushgateway, or deletes the station groups.",
+				run:         pushPushgateway,
+			},
+			{
+				name:        "textfile",
+				description: "Writes the latest observation of every station for the node_exporter textfile collector.",
+				run: pushTo(func(fs *flag.FlagSet) []applier {
+					return []applier{textfile_metrics.NewTextfileOptions(fs, env)}
+				}, func(s config.Sinks) config.Sinks { return config.Sinks{Textfile: s.Textfile} }, errMissingTextfile),
+			},
+			{
+				name:        "mqtt",
+				description: "Publishes the latest observation of every station to an mqtt broker, with Home Assistant discovery.",
+				run: pushTo(func(fs *flag.FlagSet) []applier {
+					return []applier{mqtt_metrics.NewMqttOptions(fs, env)}
+				}, func(s config.Sinks) config.Sinks { return config.Sinks{Mqtt: s.Mqtt} }, errMissingMqtt),
+			},
+			{
+				name:        "pws",
+				description: "Uploads the latest observation of the mirrored stations to Weather Underground and Windy.",
+				run: pushTo(nil, func(s config.Sinks) config.Sinks {
+					return config.Sinks{Wunderground: s.Wunderground, Windy: s.Windy}
+				}, errMissingPws),
+			},
+			{
+				name:        "aprs",
+				description: "Sends the latest observation of the configured stations as APRS weather packets, e.g. to CWOP.",
+				run:         pushTo(nil, func(s config.Sinks) config.Sinks { return config.Sinks{Aprs: s.Aprs} }, errMissingAprs),
+			},
+			{
+				name:        "postgres",
+				description: "Writes the observations to PostgreSQL, optionally as a TimescaleDB hypertable.",
+				run: pushTo(func(fs *flag.FlagSet) []applier {
+					return []applier{postgres_metrics.NewPostgresOptions(fs, env)}
+				}, func(s config.Sinks) config.Sinks { return config.Sinks{Postgres: s.Postgres} }, errMissingPostgres),
+			},
+			{
+				name:        "tsdb",
+				description: "Stores the observations in the embedded time-series store, e.g. from cron to build a history.",
+				run: pushTo(func(fs *flag.FlagSet) []applier {
+					return []applier{tsdb_metrics.NewTsdbOptions(fs, env)}
+				}, func(s config.Sinks) config.Sinks { return config.Sinks{Tsdb: s.Tsdb} }, errMissingTsdb),
+			},
+		},
+	}
+}
+
+var (
+	errMissingInfluxDb = errors.New("missing influxdb configuration, set --influxdb-url or the influxdb sink in the configuration file")
+	errMissingOtlp     = errors.New("missing otlp configuration, set --otlp-endpoint or the otlp sink in the configuration file")
+
+	errMissingRemoteWrite = errors.New("missing remote write configuration, set --remote-write-url or the remote_write sink in the configuration file")
+	errMissingPushgateway = errors.New("missing pushgateway configuration, set --pushgateway-url or the pushgateway sink in the configuration file")
+	errMissingTextfile    = errors.New("missing textfile configuration, set --textfile-path or the textfile sink in the configuration file")
+	errMissingMqtt        = errors.New("missing mqtt configuration, set --mqtt-url or the mqtt sink in the configuration file")
+	errMissingPws         = errors.New("missing pws configuration, set the wunderground or windy sink in the configuration file")
+	errMissingAprs        = errors.New("missing aprs configuration, set the aprs sink in the configuration file")
+	errMissingPostgres    = errors.New("missing postgres configuration, set --postgres-url or the postgres sink in the configuration file")
+	errMissingTsdb        = errors.New("missing tsdb configuration, set --tsdb-dir or the tsdb sink in the configuration file")
+)
+
+// pushOnce runs a single exporter round feeding the sinks of c.
+func pushOnce(ctx context.Context, logger *zap.Logger, c *config.Config) error {
+	shutdownTracing, err := setupTracing(ctx, logger, c.Tracing)
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing()
+
+	e, err := exporter.NewExporter(exporter.ExporterConfig{
+		Config: c,
+		Logger: logger,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = e.RunOnce(ctx)
+
+	// nothing to stop when the sinks could not be built
+	stopErr := e.Stop(ctx)
+	if stopErr != nil && !errors.Is(stopErr, exporter.ErrNotStarted) {
+		logger.Error("error closing sinks", zap.Error(stopErr))
+	}
+
+	if err != nil {
+		return fmt.Errorf("error storing data: %w", err)
+	}
+
+	return nil
+}
+
+// pushTo returns the run of a push subcommand feeding only the sinks kept
+// by only. flags registers the options of those sinks, applied over the
+// configuration file, and missing is returned when none is configured.
+func pushTo(flags func(fs *flag.FlagSet) []applier, only func(config.Sinks) config.Sinks, missing error) func(fs *flag.FlagSet, args []string) error {
+	return func(fs *flag.FlagSet, args []string) error {
+		c, logger, err := loadPushConfig(fs, args, flags, only, missing)
+		if err != nil {
+			return err
+		}
+		defer syncLogger(logger)
+
+		ctx, stop := context.WithTimeout(context.Background(), time.Minute)
+		defer stop()
+
+		return pushOnce(ctx, logger, c)
+	}
+}
+
+// loadPushConfig parses the flags of a push subcommand and loads its
+// configuration, see pushTo.
+func loadPushConfig(fs *flag.FlagSet, args []string, flags func(fs *flag.FlagSet) []applier, only func(config.Sinks) config.Sinks, missing error) (*config.Config, *zap.Logger, error) {
+	opts := options.NewOptions(fs, env)
+	var appliers []applier
+	if flags != nil {
+		appliers = flags(fs)
+	}
+	appliers = append(appliers, tracing.NewTracingOptions(fs, env))
+
+	err := fs.Parse(args)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c, err := loadConfig(opts, appliers...)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	c.Sinks = only(c.Sinks)
+	if c.Sinks == (config.Sinks{}) {
+		return nil, nil, missing
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return nil, nil, err
+	}
+
+	logger, _, err := options.NewLogger(c.Logging)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	return c, logger, nil
+}
+
+// defaultToStdout makes push file write to stdout unless told otherwise, it
+// comes before the file options enabling the sink.
+func defaultToStdout(c *config.Config) error {
+	if c.Sinks.File == nil {
+		c.Sinks.File = &config.File{}
+	}
+	if c.Sinks.File.Path == "" {
+		c.Sinks.File.Path = file_metrics.Stdout
+	}
+	return nil
+}
+
+func pushPushgateway(fs *flag.FlagSet, args []string) error {
+	deleteGroups := fs.Bool("pushgateway-delete", false, "delete the groups of the stations, e.g. once decommissioned, instead of pushing")
+
+	c, logger, err := loadPushConfig(fs, args, func(fs *flag.FlagSet) []applier {
+		return []applier{pushgateway_metrics.NewPushgatewayOptions(fs, env)}
+	}, func(s config.Sinks) config.Sinks { return config.Sinks{Pushgateway: s.Pushgateway} }, errMissingPushgateway)
+	if err != nil {
+		return err
+	}
+	defer syncLogger(logger)
+
+	if *deleteGroups {
+		return deletePushgatewayGroups(logger, c)
+	}
+
+	ctx, stop := context.WithTimeout(context.Background(), time.Minute)
+	defer stop()
+
+	return pushOnce(ctx, logger, c)
+}
+
+// deletePushgatewayGroups deletes the pushgateway group of every station of
+// c.
+func deletePushgatewayGroups(logger *zap.Logger, c *config.Config) error {
+	prom, err := prometheus_metrics.NewPrometheusMetrics(prometheus_metrics.MetricsConfig{
+		Logger: logger,
+	})
+	if err != nil {
+		return err
+	}
+
+	conf := c.Sinks.Pushgateway
+	m, err := pushgateway_metrics.NewPushgatewayMetrics(pushgateway_metrics.MetricsConfig{
+		Logger:     logger,
+		Prometheus: prom,
+		Url:        conf.Url,
+		Job:        conf.Job,
+		Method:     pushgateway_metrics.Method(conf.Method),
+		Grouping:   conf.Grouping,
+		Username:   conf.Username,
+		Password:   conf.Password,
+		Timeout:    conf.Timeout,
+	})
+	if err != nil {
+		return err
+	}
+	defer func() { _ = m.Close() }()
+
+	errs := make([]error, 0, len(c.Stations))
+	for _, station := range c.Stations {
+		logger.Info("deleting station group", zap.String("station", station.Code))
+		errs = append(errs, m.DeleteGroup(station.Code))
+	}
+
+	return errors.Join(errs...)
+}
@@ -0,0 +1,229 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/prometheus/exporter-toolkit/web"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.uber.org/zap"
+	"go.uber.org/zap/exp/zapslog"
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	"wouldgo.me/meteotrentino-exporter/pkg/exporter"
+	file_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/file"
+	influxdb_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/influxdb"
+	mqtt_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/mqtt"
+	otlp_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/otlp"
+	postgres_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/postgres"
+	prometheus_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/prometheus"
+	pushgateway_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/pushgateway"
+	remotewrite_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/remotewrite"
+	textfile_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/textfile"
+	tsdb_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/tsdb"
+	"wouldgo.me/meteotrentino-exporter/pkg/options"
+	"wouldgo.me/meteotrentino-exporter/pkg/tracing"
+)
+
+func serveCommand() *command {
+	return &command{
+		name:        "serve",
+		description: "Polls the stations and serves their latest observations as Prometheus metrics, optionally writing them to influxdb, a file, an OpenTelemetry collector, a remote write endpoint, a pushgateway, a node_exporter textfile, an mqtt broker, postgres and the embedded time-series store too.",
+		run:         serve,
+	}
+}
+
+func serve(fs *flag.FlagSet, args []string) error {
+	opts := options.NewOptions(fs, env)
+	promOpts := prometheus_metrics.NewPrometheusOptions(fs, env)
+	adminOpts := options.NewAdminOptions(fs, env)
+	influxOpts := influxdb_metrics.NewInfluxDbOptions(fs, env)
+	fileOpts := file_metrics.NewFileOptions(fs, env)
+	otlpOpts := otlp_metrics.NewOtlpOptions(fs, env)
+	remoteWriteOpts := remotewrite_metrics.NewRemoteWriteOptions(fs, env)
+	pushgatewayOpts := pushgateway_metrics.NewPushgatewayOptions(fs, env)
+	textfileOpts := textfile_metrics.NewTextfileOptions(fs, env)
+	mqttOpts := mqtt_metrics.NewMqttOptions(fs, env)
+	postgresOpts := postgres_metrics.NewPostgresOptions(fs, env)
+	tsdbOpts := tsdb_metrics.NewTsdbOptions(fs, env)
+	schemaOpts := influxdb_metrics.NewSchemaOptions(fs, env)
+	tracingOpts := tracing.NewTracingOptions(fs, env)
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	load := func() (*config.Config, error) {
+		return loadConfig(opts, promOpts, adminOpts, influxOpts, fileOpts, otlpOpts, remoteWriteOpts, pushgatewayOpts, textfileOpts, mqttOpts, postgresOpts, tsdbOpts, schemaOpts, tracingOpts)
+	}
+
+	c, err := load()
+	if err != nil {
+		return err
+	}
+
+	watch, err := opts.ConfigWatch()
+	if err != nil {
+		return err
+	}
+
+	err = c.Validate()
+	if err != nil {
+		return err
+	}
+
+	logger, level, err := options.NewLogger(c.Logging)
+	if err != nil {
+		return err
+	}
+	defer syncLogger(logger)
+
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM, syscall.SIGINT)
+	logger.Info("waiting for SIGTERM or SIGINT, SIGHUP reloads the configuration")
+	defer stop()
+
+	shutdownTracing, err := setupTracing(ctx, logger, c.Tracing)
+	if err != nil {
+		return err
+	}
+	defer shutdownTracing()
+
+	e, err := exporter.NewExporter(exporter.ExporterConfig{
+		Config: c,
+		Logger: logger,
+		Load:   load,
+		Level:  &level,
+	})
+	if err != nil {
+		return err
+	}
+
+	err = e.Start(ctx)
+	if err != nil {
+		return err
+	}
+
+	defer func() {
+		stopCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err := e.Stop(stopCtx)
+		if err != nil {
+			logger.Error("error stopping exporter", zap.Error(err))
+		}
+	}()
+
+	if path := opts.ConfigPath(); path != "" && watch > 0 {
+		go e.Watch(ctx, path, watch)
+	}
+	go reloadOnHangup(ctx, logger, e)
+
+	if c.Server.WebConfig != "" {
+		err = web.Validate(c.Server.WebConfig)
+		if err != nil {
+			return fmt.Errorf("error validating web configuration: %w", err)
+		}
+	}
+
+	servers := make([]*http.Server, 0, 2)
+	if c.Server.Address != "" {
+		router := http.NewServeMux()
+		// a scrape joins the trace of the caller, if any
+		router.Handle("GET /metrics", otelhttp.NewHandler(e.Handler(), "GET /metrics"))
+		router.Handle("/api/v1/", otelhttp.NewHandler(e.APIHandler(), "/api/v1"))
+		router.HandleFunc("GET /up", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusNoContent)
+		})
+
+		server := &http.Server{
+			Addr:    c.Server.Address,
+			Handler: router,
+		}
+		servers = append(servers, server)
+
+		go func() {
+			err := listen(logger, server, c.Server.WebConfig)
+			if err != nil {
+				logger.Error("error starting http server", zap.String("addr", server.Addr), zap.Error(err))
+				stop()
+			}
+		}()
+	} else {
+		logger.Info("metrics server disabled")
+	}
+
+	if c.Admin.Address != "" {
+		admin := &http.Server{
+			Addr:    c.Admin.Address,
+			Handler: e.AdminHandler(),
+		}
+		servers = append(servers, admin)
+
+		// the admin server is protected like the metrics one
+		go func() {
+			err := listen(logger, admin, c.Server.WebConfig)
+			if err != nil {
+				logger.Error("error starting admin server", zap.String("addr", admin.Addr), zap.Error(err))
+				stop()
+			}
+		}()
+	}
+
+	<-ctx.Done()
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	logger.Info("terminating")
+	defer cancel()
+
+	for _, server := range servers {
+		err = server.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.Warn("error shutting down http server", zap.String("addr", server.Addr), zap.Error(err))
+		}
+	}
+
+	return nil
+}
+
+// reloadOnHangup reloads the configuration of e on every SIGHUP, until ctx
+// is done.
+func reloadOnHangup(ctx context.Context, logger *zap.Logger, e *exporter.Exporter) {
+	hup := make(chan os.Signal, 1)
+	signal.Notify(hup, syscall.SIGHUP)
+	defer signal.Stop(hup)
+
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-hup:
+			logger.Info("reloading configuration on SIGHUP")
+			_ = e.Reload(ctx)
+		}
+	}
+}
+
+// listen serves server, with the TLS and basic auth of the exporter-toolkit
+// webConfig file when set. The file is read again on every connection, so
+// rotated certificates are picked up.
+func listen(logger *zap.Logger, server *http.Server, webConfig string) error {
+	addresses := []string{server.Addr}
+	systemdSocket := false
+	err := web.ListenAndServe(server, &web.FlagConfig{
+		WebListenAddresses: &addresses,
+		WebSystemdSocket:   &systemdSocket,
+		WebConfigFile:      &webConfig,
+	}, slog.New(zapslog.NewHandler(logger.Core())))
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
+		return err
+	}
+
+	return nil
+}
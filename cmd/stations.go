@@ -0,0 +1,91 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	"wouldgo.me/meteotrentino-exporter/pkg/options"
+)
+
+func stationsCommand() *command {
+	return &command{
+		name:        "stations",
+		description: "Lists the stations of the meteotrentino catalog.",
+		run:         stations,
+	}
+}
+
+func stations(fs *flag.FlagSet, args []string) error {
+	logOpts := options.NewLogOptions(fs, env)
+
+	var format, filter string
+	fs.StringVar(&format, "format", "table", "output format: table or json (default: table)")
+	fs.StringVar(&filter, "filter", "", "show only the stations whose code or name contains this text")
+
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+
+	c := config.Default()
+	err = logOpts.Apply(c)
+	if err != nil {
+		return fmt.Errorf("error on parsing options: %w", err)
+	}
+
+	logger, _, err := options.NewLogger(c.Logging)
+	if err != nil {
+		return err
+	}
+	defer syncLogger(logger)
+
+	catalog, err := api.NewStationCatalog(api.StationCatalogOptions{
+		Logger:          logger,
+		TimeoutDuration: c.Upstream.Timeout,
+	})
+	if err != nil {
+		return fmt.Errorf("error creating station catalog: %w", err)
+	}
+
+	ctx, stop := context.WithTimeout(context.Background(), time.Minute)
+	defer stop()
+
+	all, err := catalog.Stations(ctx)
+	if err != nil {
+		return fmt.Errorf("error fetching stations: %w", err)
+	}
+
+	filtered := make([]api.Station, 0, len(all))
+	for _, station := range all {
+		if filter == "" ||
+			strings.Contains(strings.ToLower(station.Code), strings.ToLower(filter)) ||
+			strings.Contains(strings.ToLower(station.Name), strings.ToLower(filter)) {
+			filtered = append(filtered, station)
+		}
+	}
+
+	switch format {
+	case "json":
+		encoder := json.NewEncoder(os.Stdout)
+		encoder.SetIndent("", "  ")
+		return encoder.Encode(filtered)
+	case "table":
+		w := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		_, _ = fmt.Fprintln(w, "CODE\tNAME\tELEVATION\tLATITUDE\tLONGITUDE")
+		for _, station := range filtered {
+			_, _ = fmt.Fprintf(w, "%s\t%s\t%g\t%g\t%g\n",
+				station.Code, station.Name, station.Elevation, station.Latitude, station.Longitude)
+		}
+		return w.Flush()
+	}
+
+	return options.ErrWrongParam("format")
+}
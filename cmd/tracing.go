@@ -0,0 +1,50 @@
+package main
+
+import (
+	"context"
+	"time"
+
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/propagation"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	"wouldgo.me/meteotrentino-exporter/pkg/tracing"
+)
+
+// setupTracing installs the global tracer provider and propagator when an
+// endpoint is configured. The returned function flushes the pending spans
+// and must be called before exiting.
+func setupTracing(ctx context.Context, logger *zap.Logger, t config.Tracing) (func(), error) {
+	if t.Endpoint == "" {
+		return func() {}, nil
+	}
+
+	provider, err := tracing.NewTracerProvider(ctx, tracing.TracingConfig{
+		Logger:      logger,
+		Endpoint:    t.Endpoint,
+		SampleRatio: t.SampleRatio,
+		Version:     version,
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	otel.SetTracerProvider(provider)
+	otel.SetTextMapPropagator(propagation.NewCompositeTextMapPropagator(
+		propagation.TraceContext{},
+		propagation.Baggage{},
+	))
+	otel.SetErrorHandler(otel.ErrorHandlerFunc(func(err error) {
+		logger.Warn("tracing error", zap.Error(err))
+	}))
+
+	return func() {
+		shutdownCtx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+		defer cancel()
+
+		err := provider.Shutdown(shutdownCtx)
+		if err != nil {
+			logger.Warn("error flushing traces", zap.Error(err))
+		}
+	}, nil
+}
@@ -0,0 +1,23 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"runtime"
+)
+
+func versionCommand() *command {
+	return &command{
+		name:        "version",
+		description: "Prints the version of the exporter.",
+		run: func(fs *flag.FlagSet, args []string) error {
+			err := fs.Parse(args)
+			if err != nil {
+				return err
+			}
+
+			fmt.Printf("%s %s (%s, %s/%s)\n", binaryName, version, runtime.Version(), runtime.GOOS, runtime.GOARCH)
+			return nil
+		},
+	}
+}
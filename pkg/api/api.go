@@ -2,18 +2,28 @@ package api
 
 import (
 	"bufio"
+	"bytes"
 	"context"
 	"encoding/xml"
 	"errors"
 	"fmt"
 	"io"
 	"net/http"
+	"net/http/httptrace"
 	"net/url"
+	"strings"
 	"sync"
 	"time"
 
 	"github.com/go-playground/validator/v10"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/httptrace/otelhttptrace"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/secret"
+	"wouldgo.me/meteotrentino-exporter/pkg/tracing"
 )
 
 type WeatherStat interface {
@@ -21,37 +31,79 @@ type WeatherStat interface {
 	Value() float64
 }
 
+// WindStat is a wind observation, speeds are in m/s and the direction in
+// degrees.
+type WindStat interface {
+	Time() time.Time
+	Speed() float64
+	Gust() float64
+	Direction() float64
+}
+
 type WeatherStats interface {
 	Temperature() []WeatherStat
 	Humidity() []WeatherStat
 	Precipitation() []WeatherStat
 	Radiation() []WeatherStat
+	Wind() []WindStat
 }
 
 var (
 	validate = validator.New(validator.WithRequiredStructEnabled())
+	tracer   = otel.Tracer("wouldgo.me/meteotrentino-exporter/pkg/api")
 
 	_ MeteoTrentino = (*meteotrentino)(nil)
+	_ PayloadKeeper = (*meteotrentino)(nil)
 	_ WeatherStat   = (*meteoTrentinoStat)(nil)
+	_ WindStat      = (*meteoTrentinoWind)(nil)
 	_ WeatherStats  = (*meteoTrentinoStats)(nil)
 
 	ErrParsing   = errors.New("parsing error")
 	ErrUnMarshal = fmt.Errorf("json unmarshal in error")
 )
 
-const stationLastData string = "http://dati.meteotrentino.it/service.asmx/getLastDataOfMeteoStation"
+// maxPayloadSize bounds the raw payload kept for debugging.
+const maxPayloadSize = 4 * 1024 * 1024
+
+const (
+	// DefaultBaseUrl is the meteotrentino service, every endpoint is below it.
+	DefaultBaseUrl string = "http://dati.meteotrentino.it/service.asmx"
+
+	// Window is how far back the service serves the observations of a
+	// station, there is no endpoint for older ones.
+	Window = 24 * time.Hour
+
+	stationLastData string = "/getLastDataOfMeteoStation"
+)
 
 type MeteoTrentinoOptions struct {
 	StationCode string      `validate:"required"`
 	Logger      *zap.Logger `validate:"required"`
 
+	BaseUrl         string `validate:"omitempty,url"`
 	TimeoutDuration time.Duration
+	// KeepPayload keeps the last raw response, see PayloadKeeper.
+	KeepPayload bool
 }
 
 type MeteoTrentino interface {
 	FetchData(ctx context.Context) (WeatherStats, error)
 }
 
+// Payload is a raw upstream response, kept for debugging.
+type Payload struct {
+	Url    string
+	Status int
+	Time   time.Time
+	Body   []byte
+}
+
+// PayloadKeeper is implemented by clients keeping their last raw payload.
+// ok is false until a response is received.
+type PayloadKeeper interface {
+	LastPayload() (payload Payload, ok bool)
+}
+
 type meteotrentino struct {
 	client          *http.Client
 	timeoutDuration time.Duration
@@ -60,7 +112,12 @@ type meteotrentino struct {
 
 	logger *zap.Logger
 
+	stationCode        string
 	stationLastDataUrl string
+
+	keepPayload bool
+	payloadMu   sync.Mutex
+	payload     *Payload
 }
 
 func NewMeteoTrentino(opts MeteoTrentinoOptions) (MeteoTrentino, error) {
@@ -83,9 +140,14 @@ func NewMeteoTrentino(opts MeteoTrentinoOptions) (MeteoTrentino, error) {
 		return nil, err
 	}
 
-	httpClient := &http.Client{}
+	httpClient := newTracedClient()
+
+	baseUrl := DefaultBaseUrl
+	if opts.BaseUrl != "" {
+		baseUrl = strings.TrimSuffix(opts.BaseUrl, "/")
+	}
 
-	u, err := url.Parse(stationLastData)
+	u, err := url.Parse(baseUrl + stationLastData)
 	if err != nil {
 		return nil, errors.Join(ErrParsing, err)
 	}
@@ -102,8 +164,10 @@ func NewMeteoTrentino(opts MeteoTrentinoOptions) (MeteoTrentino, error) {
 	return &meteotrentino{
 		client:             httpClient,
 		timeoutDuration:    timeoutDuration,
+		stationCode:        strings.ToUpper(opts.StationCode),
 		stationLastDataUrl: u.String(),
 		logger:             opts.Logger,
+		keepPayload:        opts.KeepPayload,
 		dataPool: sync.Pool{
 			New: func() any {
 				return new(meteotrentinoResponse)
@@ -117,6 +181,17 @@ func NewMeteoTrentino(opts MeteoTrentinoOptions) (MeteoTrentino, error) {
 	}, nil
 }
 
+// newTracedClient returns a client whose spans break the requests down into
+// dns, connect and transfer.
+func newTracedClient() *http.Client {
+	return &http.Client{
+		Transport: otelhttp.NewTransport(http.DefaultTransport,
+			otelhttp.WithClientTrace(func(ctx context.Context) *httptrace.ClientTrace {
+				return otelhttptrace.NewClientTrace(ctx)
+			})),
+	}
+}
+
 type meteoTrentinoStat struct {
 	time  time.Time
 	value float64
@@ -129,8 +204,27 @@ func (m *meteoTrentinoStat) Value() float64 {
 	return m.value
 }
 
+type meteoTrentinoWind struct {
+	time                   time.Time
+	speed, gust, direction float64
+}
+
+func (m *meteoTrentinoWind) Time() time.Time {
+	return m.time
+}
+func (m *meteoTrentinoWind) Speed() float64 {
+	return m.speed
+}
+func (m *meteoTrentinoWind) Gust() float64 {
+	return m.gust
+}
+func (m *meteoTrentinoWind) Direction() float64 {
+	return m.direction
+}
+
 type meteoTrentinoStats struct {
 	temperature, precipitation, radiation, humidity []WeatherStat
+	wind                                            []WindStat
 }
 
 func fromMeteoTrentinoResponse(response *meteotrentinoResponse) (WeatherStats, error) {
@@ -139,6 +233,7 @@ func fromMeteoTrentinoResponse(response *meteotrentinoResponse) (WeatherStats, e
 		precipitation: make([]WeatherStat, 0, len(response.Precipitation)),
 		radiation:     make([]WeatherStat, 0, len(response.Radiation)),
 		humidity:      make([]WeatherStat, 0, len(response.Humidity)),
+		wind:          make([]WindStat, 0, len(response.Wind)),
 	}
 	for _, v := range response.Temperature {
 		aStat := meteoTrentinoStat{
@@ -172,6 +267,16 @@ func fromMeteoTrentinoResponse(response *meteotrentinoResponse) (WeatherStats, e
 		toReturn.humidity = append(toReturn.humidity, &aStat)
 	}
 
+	for _, v := range response.Wind {
+		aStat := meteoTrentinoWind{
+			time:      v.Date.Time,
+			speed:     v.Speed,
+			gust:      v.Windgust,
+			direction: v.Direction,
+		}
+		toReturn.wind = append(toReturn.wind, &aStat)
+	}
+
 	return toReturn, nil
 }
 
@@ -191,8 +296,17 @@ func (mTS *meteoTrentinoStats) Radiation() []WeatherStat {
 	return mTS.radiation
 }
 
-func (m *meteotrentino) FetchData(ctx context.Context) (WeatherStats, error) {
-	m.logger.Info("fetching data from", zap.String("url", m.stationLastDataUrl))
+func (mTS *meteoTrentinoStats) Wind() []WindStat {
+	return mTS.wind
+}
+
+func (m *meteotrentino) FetchData(ctx context.Context) (stats WeatherStats, err error) {
+	ctx, span := tracer.Start(ctx, "meteotrentino.fetch", trace.WithAttributes(
+		tracing.StationKey.String(m.stationCode),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	m.logger.Info("fetching data from", zap.String("url", secret.RedactUrl(m.stationLastDataUrl)))
 	innerCtx, cancel := context.WithTimeout(ctx, m.timeoutDuration)
 	defer cancel()
 	req, err := http.NewRequestWithContext(innerCtx, http.MethodGet, m.stationLastDataUrl, nil)
@@ -205,9 +319,6 @@ func (m *meteotrentino) FetchData(ctx context.Context) (WeatherStats, error) {
 		return nil, err
 	}
 
-	if response.StatusCode != http.StatusOK {
-		return nil, fmt.Errorf("received non-200 response code: %d", response.StatusCode)
-	}
 	defer func() {
 		err := response.Body.Close()
 		if err != nil {
@@ -215,6 +326,21 @@ func (m *meteotrentino) FetchData(ctx context.Context) (WeatherStats, error) {
 		}
 	}()
 
+	var body io.Reader = response.Body
+	if m.keepPayload {
+		payload := new(bytes.Buffer)
+		body = io.TeeReader(response.Body, payload)
+		defer func() {
+			// drain what the decoder left, e.g. on errors
+			_, _ = io.Copy(io.Discard, body)
+			m.storePayload(response.StatusCode, payload.Bytes())
+		}()
+	}
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received non-200 response code: %d", response.StatusCode)
+	}
+
 	data, ok := m.dataPool.Get().(*meteotrentinoResponse)
 	if !ok {
 		return nil, fmt.Errorf("different struct type from data pool")
@@ -228,9 +354,37 @@ func (m *meteotrentino) FetchData(ctx context.Context) (WeatherStats, error) {
 	}
 	defer m.readerPool.Put(br)
 
-	br.Reset(response.Body)
+	br.Reset(body)
 
-	decoder := xml.NewDecoder(br)
+	err = m.decode(ctx, br, data)
+	if err != nil {
+		return nil, err
+	}
+
+	_, convertSpan := tracer.Start(ctx, "meteotrentino.convert", trace.WithAttributes(
+		tracing.StationKey.String(m.stationCode),
+	))
+	stats, err = fromMeteoTrentinoResponse(data)
+	tracing.End(convertSpan, err)
+	if err != nil {
+		return nil, fmt.Errorf("error converting api stats to weather stats")
+	}
+
+	return stats, nil
+}
+
+// decode reads the observations of the xml document in r into data.
+func (m *meteotrentino) decode(ctx context.Context, r io.Reader, data *meteotrentinoResponse) (err error) {
+	_, span := tracer.Start(ctx, "meteotrentino.decode", trace.WithAttributes(
+		tracing.StationKey.String(m.stationCode),
+	))
+	defer func() {
+		span.SetAttributes(attribute.Int("meteotrentino.observations",
+			len(data.Temperature)+len(data.Precipitation)+len(data.Wind)+len(data.Radiation)+len(data.Humidity)))
+		tracing.End(span, err)
+	}()
+
+	decoder := xml.NewDecoder(r)
 
 	decoder.Strict = false
 	decoder.AutoClose = xml.HTMLAutoClose
@@ -250,7 +404,7 @@ func (m *meteotrentino) FetchData(ctx context.Context) (WeatherStats, error) {
 				var v temperature
 				err := decoder.DecodeElement(&v, &se)
 				if err != nil {
-					return nil, fmt.Errorf("error decoding air_temperature element: %w", err)
+					return fmt.Errorf("error decoding air_temperature element: %w", err)
 				}
 
 				data.Temperature = append(data.Temperature, v)
@@ -258,7 +412,7 @@ func (m *meteotrentino) FetchData(ctx context.Context) (WeatherStats, error) {
 				var v precipitation
 				err := decoder.DecodeElement(&v, &se)
 				if err != nil {
-					return nil, fmt.Errorf("error decoding precipitation element: %w", err)
+					return fmt.Errorf("error decoding precipitation element: %w", err)
 				}
 
 				data.Precipitation = append(data.Precipitation, v)
@@ -266,7 +420,7 @@ func (m *meteotrentino) FetchData(ctx context.Context) (WeatherStats, error) {
 				var v wind
 				err := decoder.DecodeElement(&v, &se)
 				if err != nil {
-					return nil, fmt.Errorf("error decoding wind10m element: %w", err)
+					return fmt.Errorf("error decoding wind10m element: %w", err)
 				}
 
 				data.Wind = append(data.Wind, v)
@@ -274,7 +428,7 @@ func (m *meteotrentino) FetchData(ctx context.Context) (WeatherStats, error) {
 				var v radiation
 				err := decoder.DecodeElement(&v, &se)
 				if err != nil {
-					return nil, fmt.Errorf("error decoding global_radiation element: %w", err)
+					return fmt.Errorf("error decoding global_radiation element: %w", err)
 				}
 
 				data.Radiation = append(data.Radiation, v)
@@ -282,7 +436,7 @@ func (m *meteotrentino) FetchData(ctx context.Context) (WeatherStats, error) {
 				var v humidity
 				err := decoder.DecodeElement(&v, &se)
 				if err != nil {
-					return nil, fmt.Errorf("error decoding relative_humidity element: %w", err)
+					return fmt.Errorf("error decoding relative_humidity element: %w", err)
 				}
 
 				data.Humidity = append(data.Humidity, v)
@@ -290,10 +444,126 @@ func (m *meteotrentino) FetchData(ctx context.Context) (WeatherStats, error) {
 		}
 	}
 
-	stats, err := fromMeteoTrentinoResponse(data)
-	if err != nil {
-		return nil, fmt.Errorf("error converting api stats to weather stats")
+	return nil
+}
+
+func (m *meteotrentino) storePayload(status int, body []byte) {
+	m.payloadMu.Lock()
+	defer m.payloadMu.Unlock()
+
+	m.payload = &Payload{
+		Url:    m.stationLastDataUrl,
+		Status: status,
+		Time:   time.Now(),
+		Body:   bytes.Clone(body[:min(len(body), maxPayloadSize)]),
 	}
+}
 
-	return stats, nil
+func (m *meteotrentino) LastPayload() (Payload, bool) {
+	m.payloadMu.Lock()
+	defer m.payloadMu.Unlock()
+
+	if m.payload == nil {
+		return Payload{}, false
+	}
+
+	return *m.payload, true
+}
+
+type selectedStats struct {
+	WeatherStats
+	variables map[string]bool
+}
+
+func (s *selectedStats) Temperature() []WeatherStat {
+	if !s.variables["temperature"] {
+		return nil
+	}
+	return s.WeatherStats.Temperature()
+}
+
+func (s *selectedStats) Humidity() []WeatherStat {
+	if !s.variables["humidity"] {
+		return nil
+	}
+	return s.WeatherStats.Humidity()
+}
+
+func (s *selectedStats) Precipitation() []WeatherStat {
+	if !s.variables["precipitation"] {
+		return nil
+	}
+	return s.WeatherStats.Precipitation()
+}
+
+func (s *selectedStats) Radiation() []WeatherStat {
+	if !s.variables["radiation"] {
+		return nil
+	}
+	return s.WeatherStats.Radiation()
+}
+
+func (s *selectedStats) Wind() []WindStat {
+	if !s.variables["wind"] {
+		return nil
+	}
+	return s.WeatherStats.Wind()
+}
+
+// SelectVariables restricts stats to the given variables, e.g. temperature
+// or humidity, the others read as empty. No variables means all of them.
+func SelectVariables(stats WeatherStats, variables []string) WeatherStats {
+	if len(variables) == 0 {
+		return stats
+	}
+
+	selected := &selectedStats{
+		WeatherStats: stats,
+		variables:    make(map[string]bool, len(variables)),
+	}
+	for _, variable := range variables {
+		selected.variables[variable] = true
+	}
+
+	return selected
+}
+
+// windComponent is a component of a wind observation read as a WeatherStat.
+type windComponent struct {
+	WindStat
+	value float64
+}
+
+func (w windComponent) Value() float64 {
+	return w.value
+}
+
+func windSeries(stats WeatherStats, component func(WindStat) float64) []WeatherStat {
+	wind := stats.Wind()
+	if len(wind) == 0 {
+		return nil
+	}
+
+	series := make([]WeatherStat, 0, len(wind))
+	for _, w := range wind {
+		series = append(series, windComponent{WindStat: w, value: component(w)})
+	}
+
+	return series
+}
+
+// WindSpeed is the wind speed of stats in m/s, for the sinks writing every
+// variable as a plain series.
+func WindSpeed(stats WeatherStats) []WeatherStat {
+	return windSeries(stats, WindStat.Speed)
+}
+
+// WindGust is the wind gust of stats in m/s.
+func WindGust(stats WeatherStats) []WeatherStat {
+	return windSeries(stats, WindStat.Gust)
+}
+
+// WindDirection is the wind direction of stats in degrees.
+func WindDirection(stats WeatherStats) []WeatherStat {
+	return windSeries(stats, WindStat.Direction)
 }
@@ -0,0 +1,264 @@
+package api
+
+import (
+	"context"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/secret"
+)
+
+var (
+	_ StationCatalog = (*stationCatalog)(nil)
+
+	ErrStationNotFound   = errors.New("station not found")
+	ErrUnknownAttribute  = errors.New("unknown station attribute")
+	StationAttributeKeys = []string{"code", "name", "short_name", "elevation", "latitude", "longitude", "east", "north", "basin"}
+)
+
+const stationList string = "/listaStazioni"
+
+// Station is an entry of the meteotrentino station catalog, Basin is the
+// river basin the station belongs to.
+type Station struct {
+	Code      string
+	Name      string
+	ShortName string
+	Elevation float64
+	Latitude  float64
+	Longitude float64
+	East      float64
+	North     float64
+	Basin     string
+	Start     time.Time
+	End       time.Time
+}
+
+// Attribute returns the catalog attribute identified by key, formatted as a
+// string, so it can be used as a tag or label value.
+func (s Station) Attribute(key string) (string, error) {
+	switch key {
+	case "code":
+		return s.Code, nil
+	case "name":
+		return s.Name, nil
+	case "short_name":
+		return s.ShortName, nil
+	case "elevation":
+		return strconv.FormatFloat(s.Elevation, 'f', -1, 64), nil
+	case "latitude":
+		return strconv.FormatFloat(s.Latitude, 'f', -1, 64), nil
+	case "longitude":
+		return strconv.FormatFloat(s.Longitude, 'f', -1, 64), nil
+	case "east":
+		return strconv.FormatFloat(s.East, 'f', -1, 64), nil
+	case "north":
+		return strconv.FormatFloat(s.North, 'f', -1, 64), nil
+	case "basin":
+		return s.Basin, nil
+	}
+
+	return "", fmt.Errorf("%w: %s (valid ones: %s)", ErrUnknownAttribute, key, strings.Join(StationAttributeKeys, ", "))
+}
+
+type StationCatalogOptions struct {
+	Logger *zap.Logger `validate:"required"`
+
+	BaseUrl         string `validate:"omitempty,url"`
+	TimeoutDuration time.Duration
+}
+
+type StationCatalog interface {
+	Stations(ctx context.Context) ([]Station, error)
+	Station(ctx context.Context, code string) (Station, error)
+}
+
+type stationCatalog struct {
+	client          *http.Client
+	timeoutDuration time.Duration
+
+	logger *zap.Logger
+
+	stationListUrl string
+}
+
+func NewStationCatalog(opts StationCatalogOptions) (StationCatalog, error) {
+	err := validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return nil, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return nil, errors.Join(errs...)
+		}
+
+		return nil, err
+	}
+
+	timeoutDuration := 5 * time.Second
+	if opts.TimeoutDuration != 0 {
+		timeoutDuration = opts.TimeoutDuration
+	}
+
+	baseUrl := DefaultBaseUrl
+	if opts.BaseUrl != "" {
+		baseUrl = strings.TrimSuffix(opts.BaseUrl, "/")
+	}
+
+	return &stationCatalog{
+		client:          newTracedClient(),
+		timeoutDuration: timeoutDuration,
+		logger:          opts.Logger,
+		stationListUrl:  baseUrl + stationList,
+	}, nil
+}
+
+type anagrafica struct {
+	Code      string `xml:"codice"`
+	Name      string `xml:"nome"`
+	ShortName string `xml:"nomebreve"`
+	Elevation string `xml:"quota"`
+	Latitude  string `xml:"latitudine"`
+	Longitude string `xml:"longitudine"`
+	East      string `xml:"est"`
+	North     string `xml:"nord"`
+	Basin     string `xml:"bacino"`
+	Start     string `xml:"inizio"`
+	End       string `xml:"fine"`
+}
+
+// parseDecimal accepts both dot and comma as decimal separator, the catalog
+// is not consistent about it.
+func parseDecimal(s string) float64 {
+	s = strings.TrimSpace(strings.ReplaceAll(s, ",", "."))
+	if s == "" {
+		return 0
+	}
+
+	v, err := strconv.ParseFloat(s, 64)
+	if err != nil {
+		return 0
+	}
+
+	return v
+}
+
+func parseDate(s string) time.Time {
+	s = strings.TrimSpace(s)
+	for _, l := range layouts {
+		if tt, err := time.Parse(l, s); err == nil {
+			return tt
+		}
+	}
+
+	return time.Time{}
+}
+
+func (a anagrafica) station() Station {
+	return Station{
+		Code:      strings.ToUpper(strings.TrimSpace(a.Code)),
+		Name:      strings.TrimSpace(a.Name),
+		ShortName: strings.TrimSpace(a.ShortName),
+		Elevation: parseDecimal(a.Elevation),
+		Latitude:  parseDecimal(a.Latitude),
+		Longitude: parseDecimal(a.Longitude),
+		East:      parseDecimal(a.East),
+		North:     parseDecimal(a.North),
+		Basin:     strings.TrimSpace(a.Basin),
+		Start:     parseDate(a.Start),
+		End:       parseDate(a.End),
+	}
+}
+
+func (s *stationCatalog) Stations(ctx context.Context) ([]Station, error) {
+	s.logger.Info("fetching stations from", zap.String("url", secret.RedactUrl(s.stationListUrl)))
+	innerCtx, cancel := context.WithTimeout(ctx, s.timeoutDuration)
+	defer cancel()
+	req, err := http.NewRequestWithContext(innerCtx, http.MethodGet, s.stationListUrl, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := s.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		err := response.Body.Close()
+		if err != nil {
+			s.logger.Warn("error closing body", zap.Error(err))
+		}
+	}()
+
+	if response.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("received non-200 response code: %d", response.StatusCode)
+	}
+
+	decoder := xml.NewDecoder(response.Body)
+	decoder.Strict = false
+	decoder.AutoClose = xml.HTMLAutoClose
+	decoder.Entity = xml.HTMLEntity
+
+	stations := make([]Station, 0, 256)
+	for {
+		tok, err := decoder.Token()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return nil, errors.Join(ErrParsing, err)
+		}
+
+		se, ok := tok.(xml.StartElement)
+		if !ok || se.Name.Local != "anagrafica" {
+			continue
+		}
+
+		var a anagrafica
+		err = decoder.DecodeElement(&a, &se)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding anagrafica element: %w", err)
+		}
+
+		stations = append(stations, a.station())
+	}
+
+	return stations, nil
+}
+
+// Station fetches the whole catalog to look up the station with code, use
+// FindStation on the result of Stations to look up more than one.
+func (s *stationCatalog) Station(ctx context.Context, code string) (Station, error) {
+	stations, err := s.Stations(ctx)
+	if err != nil {
+		return Station{}, err
+	}
+
+	return FindStation(stations, code)
+}
+
+// FindStation looks up the station with code in stations.
+func FindStation(stations []Station, code string) (Station, error) {
+	for _, station := range stations {
+		if strings.EqualFold(station.Code, code) {
+			return station, nil
+		}
+	}
+
+	return Station{}, fmt.Errorf("%w: %s", ErrStationNotFound, code)
+}
@@ -0,0 +1,452 @@
+package config
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/go-playground/validator/v10"
+	"gopkg.in/yaml.v3"
+	"wouldgo.me/meteotrentino-exporter/pkg/secret"
+)
+
+var (
+	validate = newValidator()
+
+	ErrInvalid = errors.New("invalid configuration")
+
+	// Variables are the weather variables a station can be restricted to.
+	Variables = []string{"temperature", "humidity", "precipitation", "radiation", "wind"}
+)
+
+// newValidator names fields after their yaml keys, so that validation errors
+// speak the language of the configuration file.
+func newValidator() *validator.Validate {
+	v := validator.New(validator.WithRequiredStructEnabled())
+	v.RegisterTagNameFunc(func(field reflect.StructField) string {
+		name, _, _ := strings.Cut(field.Tag.Get("yaml"), ",")
+		if name == "-" {
+			return ""
+		}
+		return name
+	})
+
+	return v
+}
+
+type Logging struct {
+	Env   string `yaml:"env" validate:"omitempty,oneof=production development"`
+	Level string `yaml:"level"`
+}
+
+// Server is the metrics listener, disabled without an address, e.g. when
+// node_exporter serves the textfile sink instead.
+type Server struct {
+	Address string        `yaml:"address"`
+	Timeout time.Duration `yaml:"timeout" validate:"gte=0"`
+	// WebConfig is a prometheus exporter-toolkit web configuration file,
+	// enabling TLS and basic auth.
+	WebConfig string `yaml:"web_config"`
+}
+
+// Admin is the optional debugging listener, disabled without an address.
+type Admin struct {
+	Address string `yaml:"address"`
+}
+
+// Tracing exports OpenTelemetry spans over OTLP, disabled without an
+// endpoint.
+type Tracing struct {
+	// Endpoint is the OTLP/HTTP collector url, e.g. http://localhost:4318.
+	Endpoint    string  `yaml:"endpoint" validate:"omitempty,url"`
+	SampleRatio float64 `yaml:"sample_ratio" validate:"gte=0,lte=1"`
+}
+
+type Upstream struct {
+	// BaseUrl points to the meteotrentino service, e.g. a caching mirror.
+	BaseUrl string        `yaml:"base_url" validate:"omitempty,url"`
+	Timeout time.Duration `yaml:"timeout" validate:"gte=0"`
+}
+
+type Station struct {
+	Code string `yaml:"code" validate:"required"`
+	// Interval overrides the global polling interval for the station.
+	Interval time.Duration `yaml:"interval" validate:"gte=0"`
+	// Variables restricts the variables handed to the sinks, all when empty.
+	Variables []string `yaml:"variables" validate:"dive,oneof=temperature humidity precipitation radiation wind"`
+}
+
+type Schema struct {
+	Measurement string            `yaml:"measurement"`
+	Layout      string            `yaml:"layout" validate:"omitempty,oneof=wide narrow"`
+	Tags        map[string]string `yaml:"tags"`
+	CatalogTags map[string]string `yaml:"catalog_tags" validate:"dive,oneof=code name short_name elevation latitude longitude east north basin"`
+}
+
+type Queue struct {
+	Dir     string        `yaml:"dir" validate:"required"`
+	MaxSize int64         `yaml:"max_size" validate:"eq=0|gte=8388608"`
+	MaxAge  time.Duration `yaml:"max_age" validate:"gte=0"`
+}
+
+type InfluxDb struct {
+	Url      string        `yaml:"url" validate:"required,url"`
+	Database string        `yaml:"database" validate:"required"`
+	Org      string        `yaml:"org"`
+	Token    secret.Secret `yaml:"token" validate:"required"`
+	Timeout  time.Duration `yaml:"timeout" validate:"gte=0"`
+	Schema   `yaml:",inline"`
+	Queue    *Queue `yaml:"queue"`
+}
+
+type File struct {
+	Path    string        `yaml:"path" validate:"required"`
+	Format  string        `yaml:"format" validate:"omitempty,oneof=lineprotocol json"`
+	Rotate  time.Duration `yaml:"rotate" validate:"gte=0"`
+	Keep    int           `yaml:"keep" validate:"gte=0"`
+	Timeout time.Duration `yaml:"timeout" validate:"gte=0"`
+	Schema  `yaml:",inline"`
+}
+
+type Otlp struct {
+	Endpoint    string        `yaml:"endpoint" validate:"required,url"`
+	Protocol    string        `yaml:"protocol" validate:"omitempty,oneof=grpc http"`
+	Temporality string        `yaml:"temporality" validate:"omitempty,oneof=cumulative delta"`
+	Timeout     time.Duration `yaml:"timeout" validate:"gte=0"`
+}
+
+type RemoteWrite struct {
+	Url         string            `yaml:"url" validate:"required,url"`
+	BearerToken secret.Secret     `yaml:"bearer_token"`
+	Headers     map[string]string `yaml:"headers"`
+	Labels      map[string]string `yaml:"labels"`
+	MaxRetries  int               `yaml:"max_retries" validate:"gte=0"`
+	Timeout     time.Duration     `yaml:"timeout" validate:"gte=0"`
+}
+
+type Pushgateway struct {
+	Url      string            `yaml:"url" validate:"required,url"`
+	Job      string            `yaml:"job"`
+	Method   string            `yaml:"method" validate:"omitempty,oneof=put post"`
+	Grouping map[string]string `yaml:"grouping"`
+	Username string            `yaml:"username"`
+	Password secret.Secret     `yaml:"password"`
+	Timeout  time.Duration     `yaml:"timeout" validate:"gte=0"`
+}
+
+// Textfile is a file in the node_exporter textfile collector directory.
+type Textfile struct {
+	Path    string        `yaml:"path" validate:"required,endswith=.prom"`
+	Timeout time.Duration `yaml:"timeout" validate:"gte=0"`
+}
+
+type Mqtt struct {
+	Url                string        `yaml:"url" validate:"required,url"`
+	ClientId           string        `yaml:"client_id"`
+	Username           string        `yaml:"username"`
+	Password           secret.Secret `yaml:"password"`
+	CaFile             string        `yaml:"ca_file" validate:"omitempty,file"`
+	CertFile           string        `yaml:"cert_file" validate:"required_with=KeyFile,omitempty,file"`
+	KeyFile            string        `yaml:"key_file" validate:"required_with=CertFile,omitempty,file"`
+	InsecureSkipVerify bool          `yaml:"insecure_skip_verify"`
+	TopicPrefix        string        `yaml:"topic_prefix"`
+	Qos                byte          `yaml:"qos" validate:"lte=2"`
+	Discovery          bool          `yaml:"discovery"`
+	DiscoveryPrefix    string        `yaml:"discovery_prefix"`
+	Timeout            time.Duration `yaml:"timeout" validate:"gte=0"`
+}
+
+// Pws mirrors stations to a personal weather station network, Stations maps
+// the code of every station mirrored to its credentials.
+type Pws struct {
+	Url      string                `yaml:"url" validate:"omitempty,url"`
+	Stations map[string]PwsStation `yaml:"stations" validate:"required,min=1,dive"`
+	Timeout  time.Duration         `yaml:"timeout" validate:"gte=0"`
+}
+
+type PwsStation struct {
+	Id       string        `yaml:"id" validate:"required"`
+	Password secret.Secret `yaml:"password" validate:"required"`
+}
+
+// Aprs sends APRS weather packets to an APRS-IS server, Stations maps the
+// code of every station sent to its APRS identity.
+type Aprs struct {
+	Server   string                 `yaml:"server" validate:"omitempty,hostname_port"`
+	Stations map[string]AprsStation `yaml:"stations" validate:"required,min=1,dive"`
+	Timeout  time.Duration          `yaml:"timeout" validate:"gte=0"`
+}
+
+// AprsStation is the APRS identity of a station, its position is taken from
+// the catalog unless set.
+type AprsStation struct {
+	Callsign  string        `yaml:"callsign" validate:"required"`
+	Passcode  secret.Secret `yaml:"passcode"`
+	Latitude  *float64      `yaml:"latitude" validate:"required_with=Longitude,omitempty,gte=-90,lte=90"`
+	Longitude *float64      `yaml:"longitude" validate:"required_with=Latitude,omitempty,gte=-180,lte=180"`
+}
+
+// Postgres writes the observations to a PostgreSQL database, Migrate brings
+// its schema up to date on start.
+type Postgres struct {
+	Url       string        `yaml:"url" validate:"required"`
+	Password  secret.Secret `yaml:"password"`
+	Schema    string        `yaml:"schema"`
+	Migrate   bool          `yaml:"migrate"`
+	Timescale bool          `yaml:"timescale"`
+	Timeout   time.Duration `yaml:"timeout" validate:"gte=0"`
+}
+
+// Tsdb is the embedded time-series store kept in Dir, Downsample replaces
+// the observations older than After with their aggregates over Resolution.
+type Tsdb struct {
+	Dir        string           `yaml:"dir" validate:"required"`
+	Retention  time.Duration    `yaml:"retention" validate:"gte=0"`
+	Downsample []TsdbDownsample `yaml:"downsample" validate:"dive"`
+	Timeout    time.Duration    `yaml:"timeout" validate:"gte=0"`
+}
+
+type TsdbDownsample struct {
+	After      time.Duration `yaml:"after" validate:"gt=0"`
+	Resolution time.Duration `yaml:"resolution" validate:"gt=0"`
+}
+
+type Sinks struct {
+	InfluxDb     *InfluxDb    `yaml:"influxdb"`
+	File         *File        `yaml:"file"`
+	Otlp         *Otlp        `yaml:"otlp"`
+	RemoteWrite  *RemoteWrite `yaml:"remote_write"`
+	Pushgateway  *Pushgateway `yaml:"pushgateway"`
+	Textfile     *Textfile    `yaml:"textfile"`
+	Mqtt         *Mqtt        `yaml:"mqtt"`
+	Wunderground *Pws         `yaml:"wunderground"`
+	Windy        *Pws         `yaml:"windy"`
+	Aprs         *Aprs        `yaml:"aprs"`
+	Postgres     *Postgres    `yaml:"postgres"`
+	Tsdb         *Tsdb        `yaml:"tsdb"`
+}
+
+// Config is the whole exporter configuration. It is read from a file with
+// Load, or built by hand, and then overridden by env vars and flags.
+type Config struct {
+	// Interval is the default polling interval of the stations.
+	Interval time.Duration `yaml:"interval" validate:"gt=0"`
+	Stations []Station     `yaml:"stations" validate:"required,min=1,dive"`
+	Sinks    Sinks         `yaml:"sinks"`
+	Server   Server        `yaml:"server"`
+	Admin    Admin         `yaml:"admin"`
+	Logging  Logging       `yaml:"logging"`
+	Upstream Upstream      `yaml:"upstream"`
+	Tracing  Tracing       `yaml:"tracing"`
+
+	// source is the parsed file, kept to point validation errors to lines.
+	source *yaml.Node
+	path   string
+}
+
+// Default returns the configuration used when nothing is set.
+func Default() *Config {
+	return &Config{
+		Interval: 15 * time.Minute,
+		Server: Server{
+			Address: ":3000",
+			Timeout: 5 * time.Second,
+		},
+		Logging: Logging{
+			Env:   "development",
+			Level: "debug",
+		},
+		Upstream: Upstream{
+			Timeout: 5 * time.Second,
+		},
+		Tracing: Tracing{
+			SampleRatio: 1,
+		},
+	}
+}
+
+// Load reads the yaml file at path over the defaults. Unknown keys are
+// rejected.
+func Load(path string) (*Config, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("error reading configuration: %w", err)
+	}
+
+	return Parse(path, data)
+}
+
+// Parse reads a yaml configuration over the defaults, path is only used in
+// error messages.
+func Parse(path string, data []byte) (*Config, error) {
+	c := Default()
+
+	decoder := yaml.NewDecoder(bytes.NewReader(data))
+	decoder.KnownFields(true)
+	err := decoder.Decode(c)
+	if err != nil && !errors.Is(err, io.EOF) {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalid, path, err)
+	}
+
+	var source yaml.Node
+	err = yaml.Unmarshal(data, &source)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %s: %w", ErrInvalid, path, err)
+	}
+
+	c.source = &source
+	c.path = path
+	return c, nil
+}
+
+// Redacted returns a copy of c safe to show, with the credentials of its
+// urls and the values of the remote write headers hidden. Secrets hide
+// themselves.
+func (c *Config) Redacted() *Config {
+	r := *c
+	r.Upstream.BaseUrl = secret.RedactUrl(r.Upstream.BaseUrl)
+	r.Tracing.Endpoint = secret.RedactUrl(r.Tracing.Endpoint)
+
+	if s := c.Sinks.InfluxDb; s != nil {
+		copied := *s
+		copied.Url = secret.RedactUrl(s.Url)
+		r.Sinks.InfluxDb = &copied
+	}
+	if s := c.Sinks.Otlp; s != nil {
+		copied := *s
+		copied.Endpoint = secret.RedactUrl(s.Endpoint)
+		r.Sinks.Otlp = &copied
+	}
+	if s := c.Sinks.RemoteWrite; s != nil {
+		copied := *s
+		copied.Url = secret.RedactUrl(s.Url)
+		copied.Headers = secret.RedactValues(s.Headers)
+		r.Sinks.RemoteWrite = &copied
+	}
+	if s := c.Sinks.Pushgateway; s != nil {
+		copied := *s
+		copied.Url = secret.RedactUrl(s.Url)
+		r.Sinks.Pushgateway = &copied
+	}
+	if s := c.Sinks.Mqtt; s != nil {
+		copied := *s
+		copied.Url = secret.RedactUrl(s.Url)
+		r.Sinks.Mqtt = &copied
+	}
+	if s := c.Sinks.Wunderground; s != nil {
+		copied := *s
+		copied.Url = secret.RedactUrl(s.Url)
+		r.Sinks.Wunderground = &copied
+	}
+	if s := c.Sinks.Windy; s != nil {
+		copied := *s
+		copied.Url = secret.RedactUrl(s.Url)
+		r.Sinks.Windy = &copied
+	}
+	if s := c.Sinks.Postgres; s != nil {
+		copied := *s
+		copied.Url = secret.RedactUrl(s.Url)
+		r.Sinks.Postgres = &copied
+	}
+
+	return &r
+}
+
+// Validate checks c, when it was loaded from a file every error points to
+// the line of the offending key.
+func (c *Config) Validate() error {
+	err := validate.Struct(c)
+	if err == nil {
+		return nil
+	}
+
+	var validateErrs validator.ValidationErrors
+	if !errors.As(err, &validateErrs) {
+		return err
+	}
+
+	errs := make([]error, 0, len(validateErrs)+1)
+	errs = append(errs, ErrInvalid)
+	for _, e := range validateErrs {
+		// drop the root struct name and inlined structs, which keep their
+		// go name as they have no yaml one
+		_, namespace, _ := strings.Cut(e.Namespace(), ".")
+		segments := make([]string, 0, strings.Count(namespace, ".")+1)
+		for segment := range strings.SplitSeq(namespace, ".") {
+			if segment != "" && unicode.IsUpper(rune(segment[0])) {
+				continue
+			}
+			segments = append(segments, segment)
+		}
+		path := strings.Join(segments, ".")
+
+		msg := fmt.Sprintf("%s: failed on '%s'", path, e.Tag())
+		if e.Param() != "" {
+			msg += fmt.Sprintf(" (%s)", e.Param())
+		}
+		if value := fmt.Sprint(e.Value()); value != "" && !strings.Contains(e.Tag(), "required") {
+			msg += fmt.Sprintf(", got %q", value)
+		}
+
+		if line, column, ok := c.position(path); ok {
+			msg = fmt.Sprintf("%s:%d:%d: %s", c.path, line, column, msg)
+		}
+
+		errs = append(errs, errors.New(msg))
+	}
+
+	return errors.Join(errs...)
+}
+
+// position finds the line of a validator path, e.g. stations[1].interval,
+// in the source file. Keys missing from the file resolve to their closest
+// parent, unknown segments (inlined structs) are skipped.
+func (c *Config) position(path string) (int, int, bool) {
+	if c.source == nil || len(c.source.Content) == 0 {
+		return 0, 0, false
+	}
+
+	node := c.source.Content[0]
+	for segment := range strings.SplitSeq(path, ".") {
+		key, subscript := segment, ""
+		if open := strings.Index(segment, "["); open >= 0 && strings.HasSuffix(segment, "]") {
+			key, subscript = segment[:open], segment[open+1:len(segment)-1]
+		}
+
+		node = lookup(node, key)
+		if subscript == "" {
+			continue
+		}
+
+		// slices are indexed by position, maps by key
+		index, err := strconv.Atoi(subscript)
+		if err == nil && node.Kind == yaml.SequenceNode && index < len(node.Content) {
+			node = node.Content[index]
+			continue
+		}
+		node = lookup(node, subscript)
+	}
+
+	return node.Line, node.Column, true
+}
+
+func lookup(node *yaml.Node, key string) *yaml.Node {
+	if node.Kind != yaml.MappingNode {
+		return node
+	}
+
+	for i := 0; i+1 < len(node.Content); i += 2 {
+		if node.Content[i].Value == key {
+			return node.Content[i+1]
+		}
+	}
+
+	return node
+}
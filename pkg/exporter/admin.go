@@ -0,0 +1,124 @@
+package exporter
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/pprof"
+	"slices"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"gopkg.in/yaml.v3"
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+)
+
+type payloadSummary struct {
+	Station string    `json:"station"`
+	Url     string    `json:"url"`
+	Status  int       `json:"status"`
+	Time    time.Time `json:"time"`
+	Size    int       `json:"size"`
+}
+
+// AdminHandler serves the debugging endpoints, meant for a listener apart
+// from Handler:
+//
+//   - /debug/pprof/ the runtime profiles
+//   - GET /config the configuration in use, secrets, url credentials and
+//     remote write headers redacted
+//   - GET, PUT /loglevel the log level, e.g. {"level":"info"}, when the
+//     exporter was given one
+//   - GET /payloads the last upstream response of every station, and
+//     /payloads/{station} its raw body
+func (e *Exporter) AdminHandler() http.Handler {
+	router := http.NewServeMux()
+
+	router.HandleFunc("/debug/pprof/", pprof.Index)
+	router.HandleFunc("/debug/pprof/cmdline", pprof.Cmdline)
+	router.HandleFunc("/debug/pprof/profile", pprof.Profile)
+	router.HandleFunc("/debug/pprof/symbol", pprof.Symbol)
+	router.HandleFunc("/debug/pprof/trace", pprof.Trace)
+
+	router.HandleFunc("GET /config", e.serveConfig)
+	if e.level != nil {
+		router.Handle("/loglevel", e.level)
+	}
+	router.HandleFunc("GET /payloads", e.servePayloads)
+	router.HandleFunc("GET /payloads/{station}", e.servePayload)
+
+	return router
+}
+
+func (e *Exporter) serveConfig(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	data, err := yaml.Marshal(e.config.Redacted())
+	e.mu.Unlock()
+	if err != nil {
+		e.logger.Error("error marshalling configuration", zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/yaml")
+	_, _ = w.Write(data)
+}
+
+// payloads collects the last payload of every station.
+func (e *Exporter) payloads() map[string]api.Payload {
+	e.mu.Lock()
+	p := e.pipeline
+	e.mu.Unlock()
+
+	payloads := make(map[string]api.Payload)
+	if p == nil {
+		return payloads
+	}
+
+	for _, station := range p.Stations() {
+		keeper, ok := station.Api.(api.PayloadKeeper)
+		if !ok {
+			continue
+		}
+
+		payload, ok := keeper.LastPayload()
+		if ok {
+			payloads[strings.ToUpper(station.Station.Code)] = payload
+		}
+	}
+
+	return payloads
+}
+
+func (e *Exporter) servePayloads(w http.ResponseWriter, r *http.Request) {
+	payloads := e.payloads()
+
+	summaries := make([]payloadSummary, 0, len(payloads))
+	for station, payload := range payloads {
+		summaries = append(summaries, payloadSummary{
+			Station: station,
+			Url:     payload.Url,
+			Status:  payload.Status,
+			Time:    payload.Time,
+			Size:    len(payload.Body),
+		})
+	}
+	slices.SortFunc(summaries, func(a, b payloadSummary) int {
+		return strings.Compare(a.Station, b.Station)
+	})
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(summaries)
+}
+
+func (e *Exporter) servePayload(w http.ResponseWriter, r *http.Request) {
+	payload, ok := e.payloads()[strings.ToUpper(r.PathValue("station"))]
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/xml; charset=utf-8")
+	w.Header().Set("Last-Modified", payload.Time.UTC().Format(http.TimeFormat))
+	_, _ = w.Write(payload.Body)
+}
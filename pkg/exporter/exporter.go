@@ -0,0 +1,386 @@
+package exporter
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+	prometheus_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/prometheus"
+	pws_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/pws"
+	tsdb_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/tsdb"
+	"wouldgo.me/meteotrentino-exporter/pkg/pipeline"
+	"wouldgo.me/meteotrentino-exporter/pkg/tsdb"
+)
+
+var (
+	validate = validator.New(validator.WithRequiredStructEnabled())
+
+	ErrNotStarted     = errors.New("exporter not started")
+	ErrAlreadyStarted = errors.New("exporter already started")
+	ErrNoReload       = errors.New("exporter has no configuration loader")
+)
+
+type ExporterConfig struct {
+	Config *config.Config `validate:"required"`
+	Logger *zap.Logger    `validate:"required"`
+
+	// Load reads the configuration again on Reload, reloading is disabled
+	// when nil.
+	Load func() (*config.Config, error)
+	// Hooks observe the weather stats of every fetch.
+	Hooks []pipeline.Hook
+	// Level, when set, is changed by reloads and served by AdminHandler.
+	Level *zap.AtomicLevel
+}
+
+// Exporter polls the configured stations and feeds the prometheus gauges
+// served by Handler, and the configured sinks. It is what the serve and push
+// commands run, and can be embedded in another service.
+type Exporter struct {
+	logger     *zap.Logger
+	load       func() (*config.Config, error)
+	hooks      []pipeline.Hook
+	level      *zap.AtomicLevel
+	prometheus *prometheus_metrics.PrometheusMetrics
+
+	mu       sync.Mutex
+	config   *config.Config
+	pipeline *pipeline.Pipeline
+	cancel   context.CancelFunc
+	done     chan struct{}
+	// store is the database of the tsdb sink, when configured, queried by
+	// APIHandler.
+	store *tsdb.DB
+
+	// observations holds the last fetch of every station, served by
+	// APIHandler.
+	observationsMu sync.Mutex
+	observations   map[string]observation
+	stream         *stream
+
+	reloadSuccessful prometheus.Gauge
+	reloadTimestamp  prometheus.Gauge
+}
+
+func NewExporter(opts ExporterConfig) (*Exporter, error) {
+	err := validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return nil, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return nil, errors.Join(errs...)
+		}
+
+		return nil, err
+	}
+
+	err = opts.Config.Validate()
+	if err != nil {
+		return nil, err
+	}
+
+	m, err := prometheus_metrics.NewPrometheusMetrics(prometheus_metrics.MetricsConfig{
+		Logger:          opts.Logger,
+		TimeoutDuration: opts.Config.Server.Timeout,
+	})
+	if err != nil {
+		return nil, fmt.Errorf("error creating metrics: %w", err)
+	}
+
+	e := &Exporter{
+		logger:       opts.Logger,
+		load:         opts.Load,
+		hooks:        opts.Hooks,
+		level:        opts.Level,
+		prometheus:   m,
+		config:       opts.Config,
+		observations: make(map[string]observation),
+		stream:       newStream(),
+		reloadSuccessful: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "config_last_reload_successful",
+			Help: "Whether the last configuration reload attempt was successful",
+		}),
+		reloadTimestamp: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "config_last_reload_success_timestamp_seconds",
+			Help: "Unix time of the last successful configuration reload",
+		}),
+	}
+
+	err = errors.Join(
+		m.Registry().Register(e.reloadSuccessful),
+		m.Registry().Register(e.reloadTimestamp),
+		m.Registry().Register(e.stream.clients),
+		m.Registry().Register(e.stream.disconnected),
+	)
+	if err != nil {
+		return nil, fmt.Errorf("error registering exporter metrics: %w", err)
+	}
+
+	// the configuration in use at start counts as loaded
+	e.reloadSuccessful.Set(1)
+	e.reloadTimestamp.SetToCurrentTime()
+	return e, nil
+}
+
+// Registry holds the metrics served by Handler, collectors of the embedding
+// service can be registered there too.
+func (e *Exporter) Registry() *prometheus.Registry {
+	return e.prometheus.Registry()
+}
+
+// Handler serves the metrics in the prometheus exposition format, it can be
+// mounted on any mux.
+func (e *Exporter) Handler() http.Handler {
+	return e.prometheus.Handler()
+}
+
+// build creates the stations, the sinks and the pipeline feeding them. It
+// must be called holding mu.
+func (e *Exporter) build(ctx context.Context) error {
+	if e.pipeline != nil {
+		return nil
+	}
+
+	c := e.config
+	stations, err := newStations(ctx, e.logger, c, c.Stations)
+	if err != nil {
+		return err
+	}
+
+	e.logger.Info("starting prometheus exporter", zap.Strings("stations", stationCodes(c)))
+	sinks := []pipeline.Sink{{Sink: e.prometheus}}
+
+	closeSinks := func() {
+		for _, sink := range sinks[1:] {
+			_ = sink.Sink.Close()
+		}
+	}
+
+	if c.Sinks.InfluxDb != nil {
+		influx, err := newInfluxDbSink(e.logger, e.Registry(), c.Sinks.InfluxDb)
+		if err != nil {
+			return err
+		}
+		sinks = append(sinks, influx)
+	}
+
+	if c.Sinks.File != nil {
+		file, err := newFileSink(e.logger, c.Sinks.File)
+		if err != nil {
+			closeSinks()
+			return err
+		}
+		sinks = append(sinks, file)
+	}
+
+	if c.Sinks.Otlp != nil {
+		otlp, err := newOtlpSink(ctx, e.logger, c.Sinks.Otlp)
+		if err != nil {
+			closeSinks()
+			return err
+		}
+		sinks = append(sinks, otlp)
+	}
+
+	if c.Sinks.RemoteWrite != nil {
+		remoteWrite, err := newRemoteWriteSink(e.logger, c.Sinks.RemoteWrite)
+		if err != nil {
+			closeSinks()
+			return err
+		}
+		sinks = append(sinks, remoteWrite)
+	}
+
+	if c.Sinks.Pushgateway != nil {
+		pushgateway, err := newPushgatewaySink(e.logger, e.prometheus, c.Sinks.Pushgateway)
+		if err != nil {
+			closeSinks()
+			return err
+		}
+		sinks = append(sinks, pushgateway)
+	}
+
+	if c.Sinks.Textfile != nil {
+		textfile, err := newTextfileSink(e.logger, c.Sinks.Textfile)
+		if err != nil {
+			closeSinks()
+			return err
+		}
+		sinks = append(sinks, textfile)
+	}
+
+	if c.Sinks.Mqtt != nil {
+		mqtt, err := newMqttSink(e.logger, c.Sinks.Mqtt)
+		if err != nil {
+			closeSinks()
+			return err
+		}
+		sinks = append(sinks, mqtt)
+	}
+
+	for _, network := range []struct {
+		name pws_metrics.Network
+		conf *config.Pws
+	}{
+		{pws_metrics.NetworkWunderground, c.Sinks.Wunderground},
+		{pws_metrics.NetworkWindy, c.Sinks.Windy},
+	} {
+		if network.conf == nil {
+			continue
+		}
+
+		pws, err := newPwsSink(e.logger, network.name, network.conf)
+		if err != nil {
+			closeSinks()
+			return err
+		}
+		sinks = append(sinks, pws)
+	}
+
+	if c.Sinks.Aprs != nil {
+		aprs, err := newAprsSink(e.logger, c.Sinks.Aprs)
+		if err != nil {
+			closeSinks()
+			return err
+		}
+		sinks = append(sinks, aprs)
+	}
+
+	if c.Sinks.Postgres != nil {
+		postgres, err := newPostgresSink(ctx, e.logger, c.Sinks.Postgres)
+		if err != nil {
+			closeSinks()
+			return err
+		}
+		sinks = append(sinks, postgres)
+	}
+
+	if c.Sinks.Tsdb != nil {
+		store, err := newTsdbSink(e.logger, e.Registry(), c.Sinks.Tsdb)
+		if err != nil {
+			closeSinks()
+			return err
+		}
+		sinks = append(sinks, store)
+
+		e.store = store.Sink.(*tsdb_metrics.TsdbMetrics).DB()
+		e.restore(ctx, e.store, stationCodes(c))
+	}
+
+	p, err := pipeline.NewPipeline(pipeline.PipelineConfig{
+		Logger:     e.logger,
+		Stations:   stations,
+		Sinks:      sinks,
+		Hooks:      append(slices.Clone(e.hooks), e.observe),
+		Interval:   c.Interval,
+		Registerer: e.Registry(),
+	})
+	if err != nil {
+		closeSinks()
+		return fmt.Errorf("error creating pipeline: %w", err)
+	}
+
+	e.pipeline = p
+	return nil
+}
+
+// restore sets the gauges to the latest observations stored in the last
+// head window, so a restart serves them before the first fetch completes.
+func (e *Exporter) restore(ctx context.Context, db *tsdb.DB, codes []string) {
+	now := time.Now()
+	for _, code := range codes {
+		stats, err := tsdb_metrics.Stats(db, code, now.Add(-tsdb.DefaultHeadWindow), now)
+		if err != nil {
+			e.logger.Warn("error restoring station from tsdb", zap.String("station", code), zap.Error(err))
+			continue
+		}
+
+		station := metrics.StationStats{Station: api.Station{Code: code}, Stats: stats}
+		_ = e.prometheus.Write(ctx, station)
+		e.observe(ctx, station)
+	}
+}
+
+// Start polls every station on its interval until Stop is called, ctx only
+// bounds the setup, e.g. the station catalog lookup.
+func (e *Exporter) Start(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.cancel != nil {
+		return ErrAlreadyStarted
+	}
+
+	err := e.build(ctx)
+	if err != nil {
+		return err
+	}
+
+	runCtx, cancel := context.WithCancel(context.WithoutCancel(ctx))
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		e.pipeline.Run(runCtx)
+	}()
+
+	e.cancel = cancel
+	e.done = done
+	return nil
+}
+
+// RunOnce fetches every station once and writes the results to every sink,
+// without starting the exporter.
+func (e *Exporter) RunOnce(ctx context.Context) error {
+	e.mu.Lock()
+	err := e.build(ctx)
+	p := e.pipeline
+	e.mu.Unlock()
+	if err != nil {
+		return err
+	}
+
+	return p.RunOnce(ctx)
+}
+
+// Stop stops polling, waiting for the fetches in flight until ctx is done,
+// and closes the sinks.
+func (e *Exporter) Stop(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	if e.pipeline == nil {
+		return ErrNotStarted
+	}
+
+	var err error
+	if e.cancel != nil {
+		e.cancel()
+		select {
+		case <-e.done:
+		case <-ctx.Done():
+			err = ctx.Err()
+		}
+	}
+
+	err = errors.Join(err, e.pipeline.Close())
+	e.pipeline, e.cancel, e.done, e.store = nil, nil, nil, nil
+	return err
+}
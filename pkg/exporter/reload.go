@@ -0,0 +1,353 @@
+package exporter
+
+import (
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"os"
+	"reflect"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"go.uber.org/zap/zapcore"
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	pws_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/pws"
+	tsdb_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/tsdb"
+	"wouldgo.me/meteotrentino-exporter/pkg/pipeline"
+)
+
+// Watch reloads the configuration whenever the content of the file at path
+// changes, checking every interval, until ctx is done.
+func (e *Exporter) Watch(ctx context.Context, path string, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	digest := fileDigest(path)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+
+		next := fileDigest(path)
+		if next == digest {
+			continue
+		}
+		digest = next
+
+		e.logger.Info("reloading configuration on file change", zap.String("path", path))
+		_ = e.Reload(ctx)
+	}
+}
+
+func fileDigest(path string) [sha256.Size]byte {
+	if path == "" {
+		return [sha256.Size]byte{}
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return [sha256.Size]byte{}
+	}
+
+	return sha256.Sum256(data)
+}
+
+// Reload loads the configuration again and applies it to the running
+// exporter. Only the stations and sinks that changed are touched, an invalid
+// configuration is rejected as a whole.
+func (e *Exporter) Reload(ctx context.Context) error {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+
+	err := e.reload(ctx)
+	if err != nil {
+		e.logger.Error("error reloading configuration", zap.Error(err))
+		e.reloadSuccessful.Set(0)
+		return err
+	}
+
+	e.logger.Info("configuration reloaded")
+	e.reloadSuccessful.Set(1)
+	e.reloadTimestamp.SetToCurrentTime()
+	return nil
+}
+
+func (e *Exporter) reload(ctx context.Context) error {
+	if e.load == nil {
+		return ErrNoReload
+	}
+
+	next, err := e.load()
+	if err != nil {
+		return err
+	}
+
+	err = next.Validate()
+	if err != nil {
+		return err
+	}
+
+	current := e.config
+	if e.pipeline == nil {
+		// not started yet, the new configuration is used by Start
+		e.config = next
+		return nil
+	}
+
+	if !reflect.DeepEqual(current.Server, next.Server) ||
+		!reflect.DeepEqual(current.Admin, next.Admin) ||
+		!reflect.DeepEqual(current.Tracing, next.Tracing) ||
+		current.Logging.Env != next.Logging.Env {
+		e.logger.Warn("server, admin, tracing and logging env changes take effect on restart")
+	}
+
+	setLevel := e.level != nil && current.Logging.Level != next.Logging.Level
+	var level zapcore.Level
+	if setLevel {
+		level, err = zapcore.ParseLevel(next.Logging.Level)
+		if err != nil {
+			return err
+		}
+	}
+
+	// stations are all rebuilt when what they share changes
+	rebuild := !reflect.DeepEqual(current.Upstream, next.Upstream) || withCatalog(current) != withCatalog(next)
+
+	previous := make(map[string]config.Station, len(current.Stations))
+	for _, s := range current.Stations {
+		s.Interval = stationInterval(current, s)
+		previous[strings.ToUpper(s.Code)] = s
+	}
+
+	changed := make([]config.Station, 0, len(next.Stations))
+	for _, s := range next.Stations {
+		code := strings.ToUpper(s.Code)
+		old, ok := previous[code]
+		delete(previous, code)
+
+		effective := s
+		effective.Interval = stationInterval(next, s)
+		if !rebuild && ok && reflect.DeepEqual(old, effective) {
+			continue
+		}
+		changed = append(changed, s)
+	}
+
+	// everything is built before touching the pipeline, so that a failure
+	// leaves it running the configuration in use
+	stations, err := newStations(ctx, e.logger, next, changed)
+	if err != nil {
+		return err
+	}
+
+	// the influxdb queue and the tsdb own a directory and metrics, they
+	// cannot be opened twice
+	queued := current.Sinks.InfluxDb != nil && current.Sinks.InfluxDb.Queue != nil
+
+	var changes []sinkChange
+	changes = sinkChanged(changes, "influxdb", current.Sinks.InfluxDb, next.Sinks.InfluxDb, queued, func(conf *config.InfluxDb) (pipeline.Sink, error) {
+		return newInfluxDbSink(e.logger, e.Registry(), conf)
+	})
+	changes = sinkChanged(changes, "file", current.Sinks.File, next.Sinks.File, false, func(conf *config.File) (pipeline.Sink, error) {
+		return newFileSink(e.logger, conf)
+	})
+	changes = sinkChanged(changes, "otlp", current.Sinks.Otlp, next.Sinks.Otlp, false, func(conf *config.Otlp) (pipeline.Sink, error) {
+		return newOtlpSink(ctx, e.logger, conf)
+	})
+	changes = sinkChanged(changes, "remotewrite", current.Sinks.RemoteWrite, next.Sinks.RemoteWrite, false, func(conf *config.RemoteWrite) (pipeline.Sink, error) {
+		return newRemoteWriteSink(e.logger, conf)
+	})
+	changes = sinkChanged(changes, "pushgateway", current.Sinks.Pushgateway, next.Sinks.Pushgateway, false, func(conf *config.Pushgateway) (pipeline.Sink, error) {
+		return newPushgatewaySink(e.logger, e.prometheus, conf)
+	})
+	changes = sinkChanged(changes, "textfile", current.Sinks.Textfile, next.Sinks.Textfile, false, func(conf *config.Textfile) (pipeline.Sink, error) {
+		return newTextfileSink(e.logger, conf)
+	})
+	changes = sinkChanged(changes, "mqtt", current.Sinks.Mqtt, next.Sinks.Mqtt, false, func(conf *config.Mqtt) (pipeline.Sink, error) {
+		return newMqttSink(e.logger, conf)
+	})
+	changes = sinkChanged(changes, "wunderground", current.Sinks.Wunderground, next.Sinks.Wunderground, false, func(conf *config.Pws) (pipeline.Sink, error) {
+		return newPwsSink(e.logger, pws_metrics.NetworkWunderground, conf)
+	})
+	changes = sinkChanged(changes, "windy", current.Sinks.Windy, next.Sinks.Windy, false, func(conf *config.Pws) (pipeline.Sink, error) {
+		return newPwsSink(e.logger, pws_metrics.NetworkWindy, conf)
+	})
+	changes = sinkChanged(changes, "aprs", current.Sinks.Aprs, next.Sinks.Aprs, false, func(conf *config.Aprs) (pipeline.Sink, error) {
+		return newAprsSink(e.logger, conf)
+	})
+	changes = sinkChanged(changes, "postgres", current.Sinks.Postgres, next.Sinks.Postgres, false, func(conf *config.Postgres) (pipeline.Sink, error) {
+		return newPostgresSink(ctx, e.logger, conf)
+	})
+	changes = sinkChanged(changes, "tsdb", current.Sinks.Tsdb, next.Sinks.Tsdb, true, func(conf *config.Tsdb) (pipeline.Sink, error) {
+		return newTsdbSink(e.logger, e.Registry(), conf)
+	})
+
+	err = e.prepareSinks(changes)
+	if err != nil {
+		return err
+	}
+
+	if setLevel {
+		e.level.SetLevel(level)
+	}
+
+	for code := range previous {
+		e.logger.Info("removing station", zap.String("station", code))
+		e.pipeline.RemoveStation(code)
+	}
+	for _, station := range stations {
+		e.logger.Info("updating station", zap.String("station", station.Station.Code))
+		e.pipeline.AddStation(station)
+	}
+
+	e.swapSinks(changes)
+	e.config = next
+	return nil
+}
+
+// sinkChange is a sink whose configuration changed in a reload.
+type sinkChange struct {
+	name string
+	// build creates the sink from the new configuration, restore from the
+	// one in use. build is nil when the sink is removed, restore when it is
+	// added.
+	build, restore func() (pipeline.Sink, error)
+	// exclusive sinks are closed before their replacement is built.
+	exclusive bool
+
+	sink  pipeline.Sink
+	built bool
+	// closed is set once the running sink of an exclusive change is closed.
+	closed bool
+}
+
+// sinkChanged appends the change of the sink called name to changes, when
+// its configuration changed from current to next. An exclusive sink is
+// closed before its replacement is built.
+func sinkChanged[T any](changes []sinkChange, name string, current, next *T, exclusive bool, build func(conf *T) (pipeline.Sink, error)) []sinkChange {
+	if reflect.DeepEqual(current, next) {
+		return changes
+	}
+
+	change := sinkChange{name: name, exclusive: exclusive && current != nil && next != nil}
+	if next != nil {
+		change.build = func() (pipeline.Sink, error) {
+			return build(next)
+		}
+	}
+	if current != nil {
+		change.restore = func() (pipeline.Sink, error) {
+			return build(current)
+		}
+	}
+
+	return append(changes, change)
+}
+
+// prepareSinks builds the changed sinks aside the running ones. Exclusive
+// sinks are closed and replaced, they are built again from the
+// configuration in use when any build fails. Either all changes are ready
+// to be swapped or none, and the running sinks are left as they were. It
+// must be called holding mu.
+func (e *Exporter) prepareSinks(changes []sinkChange) error {
+	var err error
+	for i := range changes {
+		change := &changes[i]
+		if change.build == nil || change.exclusive {
+			continue
+		}
+
+		change.sink, err = change.build()
+		if err != nil {
+			return e.abortSinks(changes, fmt.Errorf("error building sink %s: %w", change.name, err))
+		}
+		change.built = true
+	}
+
+	for i := range changes {
+		change := &changes[i]
+		if change.build == nil || !change.exclusive {
+			continue
+		}
+
+		e.logger.Info("closing sink before its replacement", zap.String("sink", change.name))
+		if change.name == "tsdb" {
+			e.store = nil
+		}
+		err = e.pipeline.RemoveSink(change.name)
+		if err != nil {
+			e.logger.Warn("error closing sink", zap.String("sink", change.name), zap.Error(err))
+		}
+		change.closed = true
+
+		change.sink, err = change.build()
+		if err != nil {
+			return e.abortSinks(changes, fmt.Errorf("error building sink %s: %w", change.name, err))
+		}
+		change.built = true
+	}
+
+	return nil
+}
+
+// abortSinks closes the sinks built for changes, and builds again the
+// running ones that were closed, returning err.
+func (e *Exporter) abortSinks(changes []sinkChange, err error) error {
+	for _, change := range changes {
+		if change.built {
+			_ = change.sink.Sink.Close()
+		}
+		if !change.closed {
+			continue
+		}
+
+		e.logger.Info("restoring sink", zap.String("sink", change.name))
+		sink, restoreErr := change.restore()
+		if restoreErr != nil {
+			err = errors.Join(err, fmt.Errorf("error restoring sink %s: %w", change.name, restoreErr))
+			continue
+		}
+
+		err = errors.Join(err, e.pipeline.AddSink(sink))
+		e.setStore(change.name, sink)
+	}
+
+	return err
+}
+
+// swapSinks replaces the running sinks with the ones prepared, closing
+// them. It must be called holding mu.
+func (e *Exporter) swapSinks(changes []sinkChange) {
+	for _, change := range changes {
+		e.logger.Info("updating sink", zap.String("sink", change.name))
+
+		var err error
+		if change.build == nil {
+			if change.name == "tsdb" {
+				e.store = nil
+			}
+			err = e.pipeline.RemoveSink(change.name)
+		} else {
+			err = e.pipeline.AddSink(change.sink)
+			e.setStore(change.name, change.sink)
+		}
+
+		// the replacement is running, a failure to close the old sink does
+		// not fail the reload
+		if err != nil {
+			e.logger.Warn("error closing sink", zap.String("sink", change.name), zap.Error(err))
+		}
+	}
+}
+
+// setStore points APIHandler to the database of sink, when it is the tsdb
+// one.
+func (e *Exporter) setStore(name string, sink pipeline.Sink) {
+	if name == "tsdb" {
+		e.store = sink.Sink.(*tsdb_metrics.TsdbMetrics).DB()
+	}
+}
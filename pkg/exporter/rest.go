@@ -0,0 +1,563 @@
+package exporter
+
+import (
+	"bytes"
+	"context"
+	_ "embed"
+	"encoding/csv"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"mime"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+	tsdb_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/tsdb"
+	"wouldgo.me/meteotrentino-exporter/pkg/pipeline"
+	"wouldgo.me/meteotrentino-exporter/pkg/tsdb"
+)
+
+const (
+	formatJson = "application/json"
+	formatCsv  = "text/csv"
+
+	// defaultRange is queried by observations without a from.
+	defaultRange = 24 * time.Hour
+)
+
+//go:embed openapi.yaml
+var openapi []byte
+
+// units of the variables of tsdb_metrics.Variables.
+var units = map[string]string{
+	"temperature":    "°C",
+	"humidity":       "%",
+	"precipitation":  "mm",
+	"radiation":      "W/m²",
+	"wind_speed":     "m/s",
+	"wind_gust":      "m/s",
+	"wind_direction": "°",
+}
+
+// observation is the last fetch of a station.
+type observation struct {
+	time   time.Time
+	series map[string][]tsdb.Point
+}
+
+type stationResponse struct {
+	Code            string     `json:"code"`
+	Name            string     `json:"name,omitempty"`
+	ShortName       string     `json:"short_name,omitempty"`
+	Elevation       float64    `json:"elevation,omitempty"`
+	Latitude        float64    `json:"latitude,omitempty"`
+	Longitude       float64    `json:"longitude,omitempty"`
+	IntervalSeconds int64      `json:"interval_seconds"`
+	Updated         *time.Time `json:"updated,omitempty"`
+}
+
+type valueResponse struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+	Unit  string    `json:"unit"`
+}
+
+type latestResponse struct {
+	Station      string                   `json:"station"`
+	Updated      time.Time                `json:"updated"`
+	Observations map[string]valueResponse `json:"observations"`
+}
+
+type pointResponse struct {
+	Time  time.Time `json:"time"`
+	Value float64   `json:"value"`
+}
+
+type seriesResponse struct {
+	Variable string          `json:"variable"`
+	Unit     string          `json:"unit"`
+	Points   []pointResponse `json:"points"`
+}
+
+type observationsResponse struct {
+	Station string           `json:"station"`
+	From    time.Time        `json:"from"`
+	To      time.Time        `json:"to"`
+	Series  []seriesResponse `json:"series"`
+}
+
+// APIHandler serves the observations of the stations as JSON, or CSV when
+// the Accept header prefers text/csv:
+//
+//   - GET /api/v1/stations the polled stations and their last fetch
+//   - GET /api/v1/stations/{code}/latest the latest value of every variable
+//   - GET /api/v1/stations/{code}/observations?from=&to=&variables= the
+//     values in a range, from the tsdb sink when configured and from the
+//     last fetch otherwise
+//   - GET /api/v1/stream?stations=&variables= the new observations as they
+//     are fetched, as server-sent events or websocket messages
+//   - GET /api/v1/openapi.yaml the OpenAPI document of the above
+//
+// Responses but the stream carry an ETag and may be cached until the next
+// fetch.
+func (e *Exporter) APIHandler() http.Handler {
+	router := http.NewServeMux()
+
+	router.HandleFunc("GET /api/v1/stations", e.serveStations)
+	router.HandleFunc("GET /api/v1/stations/{code}/latest", e.serveLatest)
+	router.HandleFunc("GET /api/v1/stations/{code}/observations", e.serveObservations)
+	router.HandleFunc("GET /api/v1/stream", e.serveStream)
+	router.HandleFunc("GET /api/v1/openapi.yaml", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/yaml")
+		_, _ = w.Write(openapi)
+	})
+
+	return router
+}
+
+// observe keeps the last fetch of a station for APIHandler and streams its
+// new timestamps, it is a pipeline hook.
+func (e *Exporter) observe(_ context.Context, stats metrics.StationStats) {
+	series := tsdb_metrics.Points(stats.Stats)
+	for _, points := range series {
+		slices.SortFunc(points, func(a, b tsdb.Point) int {
+			return a.Time.Compare(b.Time)
+		})
+	}
+
+	code := strings.ToUpper(stats.Station.Code)
+
+	e.observationsMu.Lock()
+	previous := e.observations[code]
+	e.observations[code] = observation{
+		time:   time.Now().UTC().Truncate(time.Second),
+		series: series,
+	}
+	e.observationsMu.Unlock()
+
+	var since time.Time
+	for _, points := range previous.series {
+		if len(points) > 0 && points[len(points)-1].Time.After(since) {
+			since = points[len(points)-1].Time
+		}
+	}
+	e.stream.publish(newEvents(code, series, since)...)
+}
+
+func (e *Exporter) lastObservation(code string) (observation, bool) {
+	e.observationsMu.Lock()
+	defer e.observationsMu.Unlock()
+
+	o, ok := e.observations[code]
+	return o, ok
+}
+
+// apiStation looks up the polled station with code, and the tsdb to query.
+func (e *Exporter) apiStation(code string) (pipeline.Station, *tsdb.DB, bool) {
+	e.mu.Lock()
+	p, store := e.pipeline, e.store
+	e.mu.Unlock()
+
+	if p == nil {
+		return pipeline.Station{}, nil, false
+	}
+
+	for _, station := range p.Stations() {
+		if strings.EqualFold(station.Station.Code, code) {
+			return station, store, true
+		}
+	}
+
+	return pipeline.Station{}, nil, false
+}
+
+func (e *Exporter) serveStations(w http.ResponseWriter, r *http.Request) {
+	e.mu.Lock()
+	p := e.pipeline
+	e.mu.Unlock()
+
+	var stations []pipeline.Station
+	if p != nil {
+		stations = p.Stations()
+	}
+	slices.SortFunc(stations, func(a, b pipeline.Station) int {
+		return strings.Compare(strings.ToUpper(a.Station.Code), strings.ToUpper(b.Station.Code))
+	})
+
+	now := time.Now()
+	var updated time.Time
+	maxAge := time.Duration(-1)
+	response := make([]stationResponse, 0, len(stations))
+	for _, station := range stations {
+		code := strings.ToUpper(station.Station.Code)
+		s := stationResponse{
+			Code:            code,
+			Name:            station.Station.Name,
+			ShortName:       station.Station.ShortName,
+			Elevation:       station.Station.Elevation,
+			Latitude:        station.Station.Latitude,
+			Longitude:       station.Station.Longitude,
+			IntervalSeconds: int64(station.Interval / time.Second),
+		}
+
+		age := time.Duration(0)
+		if o, ok := e.lastObservation(code); ok {
+			s.Updated = &o.time
+			if o.time.After(updated) {
+				updated = o.time
+			}
+			age = untilNextFetch(now, o.time, station.Interval)
+		}
+		// the list is stale as soon as any station is fetched again
+		if maxAge < 0 || age < maxAge {
+			maxAge = age
+		}
+
+		response = append(response, s)
+	}
+
+	e.respond(w, r, updated, max(maxAge, 0), response, func(cw *csv.Writer) error {
+		err := cw.Write([]string{"code", "name", "short_name", "elevation", "latitude", "longitude", "interval_seconds", "updated"})
+		if err != nil {
+			return err
+		}
+
+		for _, s := range response {
+			var updated string
+			if s.Updated != nil {
+				updated = s.Updated.UTC().Format(time.RFC3339)
+			}
+
+			err = cw.Write([]string{
+				s.Code,
+				s.Name,
+				s.ShortName,
+				formatOptional(s.Elevation),
+				formatOptional(s.Latitude),
+				formatOptional(s.Longitude),
+				strconv.FormatInt(s.IntervalSeconds, 10),
+				updated,
+			})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (e *Exporter) serveLatest(w http.ResponseWriter, r *http.Request) {
+	station, _, ok := e.apiStation(r.PathValue("code"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	code := strings.ToUpper(station.Station.Code)
+	o, ok := e.lastObservation(code)
+	if !ok {
+		w.Header().Set("Retry-After", strconv.FormatInt(int64(station.Interval/time.Second), 10))
+		http.Error(w, "no observations yet", http.StatusServiceUnavailable)
+		return
+	}
+
+	response := latestResponse{
+		Station:      code,
+		Updated:      o.time,
+		Observations: make(map[string]valueResponse, len(o.series)),
+	}
+	for variable, points := range o.series {
+		if len(points) == 0 {
+			continue
+		}
+
+		last := points[len(points)-1]
+		response.Observations[variable] = valueResponse{Time: last.Time.UTC(), Value: last.Value, Unit: units[variable]}
+	}
+
+	e.respond(w, r, o.time, untilNextFetch(time.Now(), o.time, station.Interval), response, func(cw *csv.Writer) error {
+		err := cw.Write([]string{"station", "variable", "time", "value", "unit"})
+		if err != nil {
+			return err
+		}
+
+		for _, variable := range tsdb_metrics.Variables {
+			value, ok := response.Observations[variable]
+			if !ok {
+				continue
+			}
+
+			err = cw.Write([]string{code, variable, value.Time.UTC().Format(time.RFC3339), formatValue(value.Value), value.Unit})
+			if err != nil {
+				return err
+			}
+		}
+
+		return nil
+	})
+}
+
+func (e *Exporter) serveObservations(w http.ResponseWriter, r *http.Request) {
+	station, store, ok := e.apiStation(r.PathValue("code"))
+	if !ok {
+		http.NotFound(w, r)
+		return
+	}
+
+	code := strings.ToUpper(station.Station.Code)
+	o, _ := e.lastObservation(code)
+
+	// without a to the range ends at the last fetch, nothing newer is
+	// stored, so that the response and its ETag hold until the next one
+	query := r.URL.Query()
+	to := time.Now().UTC().Truncate(time.Second)
+	if !o.time.IsZero() {
+		to = o.time.UTC().Truncate(time.Second)
+	}
+	if v := query.Get("to"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid to: %s", err), http.StatusBadRequest)
+			return
+		}
+		to = t.UTC()
+	}
+
+	from := to.Add(-defaultRange)
+	if v := query.Get("from"); v != "" {
+		t, err := time.Parse(time.RFC3339, v)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid from: %s", err), http.StatusBadRequest)
+			return
+		}
+		from = t.UTC()
+	}
+
+	if from.After(to) {
+		http.Error(w, "from is after to", http.StatusBadRequest)
+		return
+	}
+
+	variables := tsdb_metrics.Variables
+	if v := query.Get("variables"); v != "" {
+		variables = nil
+		for variable := range strings.SplitSeq(v, ",") {
+			variable = strings.TrimSpace(variable)
+			if !slices.Contains(tsdb_metrics.Variables, variable) {
+				http.Error(w, fmt.Sprintf("unknown variable %q, expected one of %s", variable, strings.Join(tsdb_metrics.Variables, ", ")), http.StatusBadRequest)
+				return
+			}
+			if !slices.Contains(variables, variable) {
+				variables = append(variables, variable)
+			}
+		}
+	}
+
+	response := observationsResponse{
+		Station: code,
+		From:    from,
+		To:      to,
+		Series:  make([]seriesResponse, 0, len(variables)),
+	}
+	for _, variable := range variables {
+		var points []tsdb.Point
+		if store != nil {
+			var err error
+			points, err = store.Query(code, variable, from, to, tsdb.QueryOptions{})
+			if err != nil {
+				e.logger.Error("error querying tsdb", zap.String("station", code), zap.String("variable", variable), zap.Error(err))
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		} else {
+			for _, p := range o.series[variable] {
+				if !p.Time.Before(from) && !p.Time.After(to) {
+					points = append(points, p)
+				}
+			}
+		}
+
+		series := seriesResponse{Variable: variable, Unit: units[variable], Points: make([]pointResponse, 0, len(points))}
+		for _, p := range points {
+			series.Points = append(series.Points, pointResponse{Time: p.Time.UTC(), Value: p.Value})
+		}
+		response.Series = append(response.Series, series)
+	}
+
+	// a range ending before the last fetch does not change until it is
+	// compacted, but is revalidated like the rest for simplicity
+	maxAge := time.Duration(0)
+	if !o.time.IsZero() {
+		maxAge = untilNextFetch(time.Now(), o.time, station.Interval)
+	}
+
+	e.respond(w, r, o.time, maxAge, response, func(cw *csv.Writer) error {
+		err := cw.Write([]string{"station", "variable", "time", "value", "unit"})
+		if err != nil {
+			return err
+		}
+
+		for _, series := range response.Series {
+			for _, p := range series.Points {
+				err = cw.Write([]string{code, series.Variable, p.Time.UTC().Format(time.RFC3339), formatValue(p.Value), series.Unit})
+				if err != nil {
+					return err
+				}
+			}
+		}
+
+		return nil
+	})
+}
+
+// respond writes v in the format negotiated with the Accept header of r, as
+// JSON or with writeCsv. The response is cacheable for maxAge, and
+// revalidated with its ETag, or the time the data was updated when not zero.
+func (e *Exporter) respond(w http.ResponseWriter, r *http.Request, updated time.Time, maxAge time.Duration, v any, writeCsv func(cw *csv.Writer) error) {
+	format, ok := negotiate(r.Header.Get("Accept"), formatJson, formatCsv)
+	if !ok {
+		http.Error(w, fmt.Sprintf("unsupported media type, expected %s or %s", formatJson, formatCsv), http.StatusNotAcceptable)
+		return
+	}
+
+	var body bytes.Buffer
+	var err error
+	switch format {
+	case formatCsv:
+		cw := csv.NewWriter(&body)
+		err = writeCsv(cw)
+		cw.Flush()
+		err = errors.Join(err, cw.Error())
+	default:
+		err = json.NewEncoder(&body).Encode(v)
+	}
+	if err != nil {
+		e.logger.Error("error encoding api response", zap.String("format", format), zap.Error(err))
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	h := fnv.New64a()
+	_, _ = h.Write(body.Bytes())
+	etag := fmt.Sprintf(`"%016x"`, h.Sum64())
+
+	header := w.Header()
+	header.Set("Content-Type", format+"; charset=utf-8")
+	header.Set("ETag", etag)
+	header.Set("Vary", "Accept")
+	header.Set("Cache-Control", fmt.Sprintf("public, max-age=%d", int64(maxAge/time.Second)))
+	if !updated.IsZero() {
+		header.Set("Last-Modified", updated.UTC().Format(http.TimeFormat))
+	}
+
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	_, _ = w.Write(body.Bytes())
+}
+
+// untilNextFetch is how long the data fetched at updated stays current,
+// given the interval of its station.
+func untilNextFetch(now, updated time.Time, interval time.Duration) time.Duration {
+	return max(updated.Add(interval).Sub(now), 0)
+}
+
+// negotiate picks the offer preferred by the accept header, the first one
+// when the header is empty or on ties. Each offer gets the q value of the
+// most specific media range matching it, so text/csv;q=0 excludes CSV even
+// with */*.
+func negotiate(accept string, offers ...string) (string, bool) {
+	if strings.TrimSpace(accept) == "" {
+		return offers[0], true
+	}
+
+	qs := make([]float64, len(offers))
+	specificities := make([]int, len(offers))
+	for i := range specificities {
+		specificities[i] = -1
+	}
+
+	for mediaRange := range strings.SplitSeq(accept, ",") {
+		mediaType, params, err := mime.ParseMediaType(strings.TrimSpace(mediaRange))
+		if err != nil {
+			continue
+		}
+
+		q := 1.0
+		if v, ok := params["q"]; ok {
+			q, err = strconv.ParseFloat(v, 64)
+			if err != nil {
+				continue
+			}
+		}
+
+		for i, offer := range offers {
+			specificity := matchMediaType(mediaType, offer)
+			if specificity > specificities[i] {
+				qs[i], specificities[i] = q, specificity
+			}
+		}
+	}
+
+	best := -1
+	for i, q := range qs {
+		if q > 0 && (best < 0 || q > qs[best]) {
+			best = i
+		}
+	}
+	if best < 0 {
+		return "", false
+	}
+
+	return offers[best], true
+}
+
+// matchMediaType returns how specifically mediaRange matches offer, from 0
+// for */* to 2 for an exact match, or -1 when it does not.
+func matchMediaType(mediaRange, offer string) int {
+	switch {
+	case mediaRange == offer:
+		return 2
+	case mediaRange == "*/*":
+		return 0
+	case strings.HasSuffix(mediaRange, "/*") && strings.HasPrefix(offer, strings.TrimSuffix(mediaRange, "*")):
+		return 1
+	default:
+		return -1
+	}
+}
+
+// etagMatches reports whether the If-None-Match header lists etag, weak
+// validators included.
+func etagMatches(ifNoneMatch, etag string) bool {
+	for candidate := range strings.SplitSeq(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+
+	return false
+}
+
+func formatValue(v float64) string {
+	return strconv.FormatFloat(v, 'f', -1, 64)
+}
+
+// formatOptional leaves out the zero values omitted in JSON, e.g. catalog
+// attributes when the catalog is disabled.
+func formatOptional(v float64) string {
+	if v == 0 {
+		return ""
+	}
+	return formatValue(v)
+}
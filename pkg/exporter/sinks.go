@@ -0,0 +1,378 @@
+package exporter
+
+import (
+	"context"
+	"fmt"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	aprs_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/aprs"
+	file_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/file"
+	influxdb_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/influxdb"
+	mqtt_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/mqtt"
+	otlp_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/otlp"
+	postgres_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/postgres"
+	prometheus_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/prometheus"
+	pushgateway_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/pushgateway"
+	pws_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/pws"
+	remotewrite_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/remotewrite"
+	textfile_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/textfile"
+	tsdb_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/tsdb"
+	"wouldgo.me/meteotrentino-exporter/pkg/pipeline"
+	"wouldgo.me/meteotrentino-exporter/pkg/queue"
+	"wouldgo.me/meteotrentino-exporter/pkg/secret"
+	"wouldgo.me/meteotrentino-exporter/pkg/tsdb"
+)
+
+// withCatalog tells if any sink needs the station catalog to resolve catalog
+// derived tags or station positions.
+func withCatalog(c *config.Config) bool {
+	if c.Sinks.Aprs != nil {
+		for _, station := range c.Sinks.Aprs.Stations {
+			if station.Latitude == nil {
+				return true
+			}
+		}
+	}
+
+	return (c.Sinks.InfluxDb != nil && len(c.Sinks.InfluxDb.CatalogTags) > 0) ||
+		(c.Sinks.File != nil && len(c.Sinks.File.CatalogTags) > 0)
+}
+
+// newStations builds the pipeline stations for the given entries of c, the
+// catalog is fetched, once, only when needed to resolve catalog derived
+// tags.
+func newStations(ctx context.Context, logger *zap.Logger, c *config.Config, entries []config.Station) ([]pipeline.Station, error) {
+	var catalog []api.Station
+	if withCatalog(c) && len(entries) > 0 {
+		logger.Info("initialize station catalog")
+		stationCatalog, err := api.NewStationCatalog(api.StationCatalogOptions{
+			Logger:          logger,
+			BaseUrl:         c.Upstream.BaseUrl,
+			TimeoutDuration: c.Upstream.Timeout,
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error creating station catalog: %w", err)
+		}
+
+		catalog, err = stationCatalog.Stations(ctx)
+		if err != nil {
+			return nil, fmt.Errorf("error fetching station catalog: %w", err)
+		}
+	}
+
+	stations := make([]pipeline.Station, 0, len(entries))
+	for _, s := range entries {
+		logger.Info("initialize station API", zap.String("station", s.Code))
+		station, err := pipeline.NewStation(pipeline.StationOptions{
+			Code:      s.Code,
+			Logger:    logger,
+			Catalog:   catalog,
+			Interval:  stationInterval(c, s),
+			Variables: s.Variables,
+			BaseUrl:   c.Upstream.BaseUrl,
+			Timeout:   c.Upstream.Timeout,
+			// raw payloads are only shown by the admin server
+			KeepPayload: c.Admin.Address != "",
+		})
+		if err != nil {
+			return nil, err
+		}
+
+		stations = append(stations, station)
+	}
+
+	return stations, nil
+}
+
+// stationInterval is the polling interval of s, the global one unless
+// overridden.
+func stationInterval(c *config.Config, s config.Station) time.Duration {
+	if s.Interval != 0 {
+		return s.Interval
+	}
+
+	return c.Interval
+}
+
+// stationCodes lists the codes of the configured stations.
+func stationCodes(c *config.Config) []string {
+	codes := make([]string, 0, len(c.Stations))
+	for _, s := range c.Stations {
+		codes = append(codes, s.Code)
+	}
+
+	return codes
+}
+
+func newInfluxDbSink(logger *zap.Logger, reg prometheus.Registerer, conf *config.InfluxDb) (pipeline.Sink, error) {
+	var q *queue.Queue
+	if conf.Queue != nil {
+		logger.Info("initialize write-ahead queue", zap.String("dir", conf.Queue.Dir))
+		var err error
+		q, err = queue.NewQueue(queue.QueueOptions{
+			Dir:        conf.Queue.Dir,
+			Logger:     logger,
+			Name:       "influxdb",
+			Registerer: reg,
+			MaxSize:    conf.Queue.MaxSize,
+			MaxAge:     conf.Queue.MaxAge,
+		})
+		if err != nil {
+			return pipeline.Sink{}, fmt.Errorf("error creating write-ahead queue: %w", err)
+		}
+	}
+
+	logger.Info("starting influxdb ingestion metrics", zap.String("url", secret.RedactUrl(conf.Url)))
+	m, err := influxdb_metrics.NewInfluxDbMetrics(influxdb_metrics.MetricsConfig{
+		Logger: logger,
+
+		Database: conf.Database,
+		Org:      conf.Org,
+		Token:    conf.Token,
+		Url:      conf.Url,
+
+		Measurement: conf.Measurement,
+		Layout:      influxdb_metrics.Layout(conf.Layout),
+		Tags:        conf.Tags,
+		CatalogTags: conf.CatalogTags,
+
+		Queue: q,
+	})
+	if err != nil {
+		if q != nil {
+			_ = q.Close()
+		}
+		return pipeline.Sink{}, fmt.Errorf("error creating influxdb client metrics: %w", err)
+	}
+
+	return pipeline.Sink{Sink: m, Timeout: conf.Timeout}, nil
+}
+
+func newFileSink(logger *zap.Logger, conf *config.File) (pipeline.Sink, error) {
+	schema, err := influxdb_metrics.NewSchema(conf.Measurement, influxdb_metrics.Layout(conf.Layout), conf.Tags, conf.CatalogTags)
+	if err != nil {
+		return pipeline.Sink{}, fmt.Errorf("error creating schema: %w", err)
+	}
+
+	format := file_metrics.FormatLineProtocol
+	if conf.Format != "" {
+		format = file_metrics.Format(conf.Format)
+	}
+
+	logger.Info("starting file output", zap.String("path", conf.Path))
+	m, err := file_metrics.NewFileMetrics(file_metrics.MetricsConfig{
+		Logger: logger,
+		Schema: schema,
+		Format: format,
+		Path:   conf.Path,
+		Rotate: conf.Rotate,
+		Keep:   conf.Keep,
+	})
+	if err != nil {
+		return pipeline.Sink{}, fmt.Errorf("error creating file output: %w", err)
+	}
+
+	return pipeline.Sink{Sink: m, Timeout: conf.Timeout}, nil
+}
+
+func newOtlpSink(ctx context.Context, logger *zap.Logger, conf *config.Otlp) (pipeline.Sink, error) {
+	protocol := otlp_metrics.ProtocolGrpc
+	if conf.Protocol != "" {
+		protocol = otlp_metrics.Protocol(conf.Protocol)
+	}
+
+	temporality := otlp_metrics.TemporalityCumulative
+	if conf.Temporality != "" {
+		temporality = otlp_metrics.Temporality(conf.Temporality)
+	}
+
+	logger.Info("starting otlp metrics", zap.String("endpoint", secret.RedactUrl(conf.Endpoint)), zap.String("protocol", string(protocol)))
+	m, err := otlp_metrics.NewOtlpMetrics(ctx, otlp_metrics.MetricsConfig{
+		Logger:      logger,
+		Endpoint:    conf.Endpoint,
+		Protocol:    protocol,
+		Temporality: temporality,
+	})
+	if err != nil {
+		return pipeline.Sink{}, fmt.Errorf("error creating otlp metrics: %w", err)
+	}
+
+	return pipeline.Sink{Sink: m, Timeout: conf.Timeout}, nil
+}
+
+func newRemoteWriteSink(logger *zap.Logger, conf *config.RemoteWrite) (pipeline.Sink, error) {
+	logger.Info("starting remote write metrics", zap.String("url", secret.RedactUrl(conf.Url)))
+	m, err := remotewrite_metrics.NewRemoteWriteMetrics(remotewrite_metrics.MetricsConfig{
+		Logger:      logger,
+		Url:         conf.Url,
+		BearerToken: conf.BearerToken,
+		Headers:     conf.Headers,
+		Labels:      conf.Labels,
+		MaxRetries:  conf.MaxRetries,
+	})
+	if err != nil {
+		return pipeline.Sink{}, fmt.Errorf("error creating remote write metrics: %w", err)
+	}
+
+	return pipeline.Sink{Sink: m, Timeout: conf.Timeout}, nil
+}
+
+func newPushgatewaySink(logger *zap.Logger, prom *prometheus_metrics.PrometheusMetrics, conf *config.Pushgateway) (pipeline.Sink, error) {
+	logger.Info("starting pushgateway metrics", zap.String("url", secret.RedactUrl(conf.Url)))
+	m, err := pushgateway_metrics.NewPushgatewayMetrics(pushgateway_metrics.MetricsConfig{
+		Logger:     logger,
+		Prometheus: prom,
+		Url:        conf.Url,
+		Job:        conf.Job,
+		Method:     pushgateway_metrics.Method(conf.Method),
+		Grouping:   conf.Grouping,
+		Username:   conf.Username,
+		Password:   conf.Password,
+		Timeout:    conf.Timeout,
+	})
+	if err != nil {
+		return pipeline.Sink{}, fmt.Errorf("error creating pushgateway metrics: %w", err)
+	}
+
+	return pipeline.Sink{Sink: m, Timeout: conf.Timeout}, nil
+}
+
+func newTextfileSink(logger *zap.Logger, conf *config.Textfile) (pipeline.Sink, error) {
+	logger.Info("starting textfile metrics", zap.String("path", conf.Path))
+	m, err := textfile_metrics.NewTextfileMetrics(textfile_metrics.MetricsConfig{
+		Logger: logger,
+		Path:   conf.Path,
+	})
+	if err != nil {
+		return pipeline.Sink{}, fmt.Errorf("error creating textfile metrics: %w", err)
+	}
+
+	return pipeline.Sink{Sink: m, Timeout: conf.Timeout}, nil
+}
+
+func newMqttSink(logger *zap.Logger, conf *config.Mqtt) (pipeline.Sink, error) {
+	tlsConfig, err := mqtt_metrics.NewTLSConfig(conf.CaFile, conf.CertFile, conf.KeyFile, conf.InsecureSkipVerify)
+	if err != nil {
+		return pipeline.Sink{}, fmt.Errorf("error creating mqtt tls configuration: %w", err)
+	}
+
+	logger.Info("starting mqtt metrics", zap.String("url", secret.RedactUrl(conf.Url)), zap.Bool("discovery", conf.Discovery))
+	m, err := mqtt_metrics.NewMqttMetrics(mqtt_metrics.MetricsConfig{
+		Logger:          logger,
+		Url:             conf.Url,
+		ClientId:        conf.ClientId,
+		Username:        conf.Username,
+		Password:        conf.Password,
+		TLSConfig:       tlsConfig,
+		TopicPrefix:     conf.TopicPrefix,
+		Qos:             conf.Qos,
+		Discovery:       conf.Discovery,
+		DiscoveryPrefix: conf.DiscoveryPrefix,
+		Timeout:         conf.Timeout,
+	})
+	if err != nil {
+		return pipeline.Sink{}, fmt.Errorf("error creating mqtt metrics: %w", err)
+	}
+
+	return pipeline.Sink{Sink: m, Timeout: conf.Timeout}, nil
+}
+
+func newPwsSink(logger *zap.Logger, network pws_metrics.Network, conf *config.Pws) (pipeline.Sink, error) {
+	stations := make(map[string]pws_metrics.Station, len(conf.Stations))
+	for code, station := range conf.Stations {
+		stations[code] = pws_metrics.Station{Id: station.Id, Password: station.Password}
+	}
+
+	logger.Info("starting pws uploads", zap.String("network", string(network)), zap.Int("stations", len(stations)))
+	m, err := pws_metrics.NewPwsMetrics(pws_metrics.MetricsConfig{
+		Logger:   logger,
+		Network:  network,
+		Url:      conf.Url,
+		Stations: stations,
+	})
+	if err != nil {
+		return pipeline.Sink{}, fmt.Errorf("error creating %s uploads: %w", network, err)
+	}
+
+	return pipeline.Sink{Sink: m, Timeout: conf.Timeout}, nil
+}
+
+func newAprsSink(logger *zap.Logger, conf *config.Aprs) (pipeline.Sink, error) {
+	stations := make(map[string]aprs_metrics.Station, len(conf.Stations))
+	for code, station := range conf.Stations {
+		stations[code] = aprs_metrics.Station{
+			Callsign:  station.Callsign,
+			Passcode:  station.Passcode,
+			Latitude:  station.Latitude,
+			Longitude: station.Longitude,
+		}
+	}
+
+	logger.Info("starting aprs packets", zap.String("server", conf.Server), zap.Int("stations", len(stations)))
+	m, err := aprs_metrics.NewAprsMetrics(aprs_metrics.MetricsConfig{
+		Logger:   logger,
+		Server:   conf.Server,
+		Stations: stations,
+	})
+	if err != nil {
+		return pipeline.Sink{}, fmt.Errorf("error creating aprs packets: %w", err)
+	}
+
+	return pipeline.Sink{Sink: m, Timeout: conf.Timeout}, nil
+}
+
+func newPostgresSink(ctx context.Context, logger *zap.Logger, conf *config.Postgres) (pipeline.Sink, error) {
+	logger.Info("starting postgres metrics", zap.String("schema", conf.Schema), zap.Bool("timescale", conf.Timescale))
+	m, err := postgres_metrics.NewPostgresMetrics(ctx, postgres_metrics.MetricsConfig{
+		Logger:    logger,
+		Url:       conf.Url,
+		Password:  conf.Password,
+		Schema:    conf.Schema,
+		Migrate:   conf.Migrate,
+		Timescale: conf.Timescale,
+	})
+	if err != nil {
+		return pipeline.Sink{}, fmt.Errorf("error creating postgres metrics: %w", err)
+	}
+
+	return pipeline.Sink{Sink: m, Timeout: conf.Timeout}, nil
+}
+
+// tsdbCompactInterval is how often the tsdb cuts, merges, downsamples and
+// drops its blocks, off the write path.
+const tsdbCompactInterval = 5 * time.Minute
+
+func newTsdbSink(logger *zap.Logger, reg prometheus.Registerer, conf *config.Tsdb) (pipeline.Sink, error) {
+	downsample := make([]tsdb.Downsample, len(conf.Downsample))
+	for i, policy := range conf.Downsample {
+		downsample[i] = tsdb.Downsample{After: policy.After, Resolution: policy.Resolution}
+	}
+
+	logger.Info("opening tsdb", zap.String("dir", conf.Dir), zap.Duration("retention", conf.Retention))
+	db, err := tsdb.NewDB(tsdb.Options{
+		Dir:        conf.Dir,
+		Logger:     logger,
+		Registerer: reg,
+		Retention:  conf.Retention,
+		Downsample: downsample,
+	})
+	if err != nil {
+		return pipeline.Sink{}, fmt.Errorf("error opening tsdb: %w", err)
+	}
+
+	m, err := tsdb_metrics.NewTsdbMetrics(tsdb_metrics.MetricsConfig{
+		Logger:          logger,
+		DB:              db,
+		CompactInterval: tsdbCompactInterval,
+	})
+	if err != nil {
+		_ = db.Close()
+		return pipeline.Sink{}, fmt.Errorf("error creating tsdb metrics: %w", err)
+	}
+
+	return pipeline.Sink{Sink: m, Timeout: conf.Timeout}, nil
+}
@@ -0,0 +1,400 @@
+package exporter
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/websocket"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	tsdb_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/tsdb"
+	"wouldgo.me/meteotrentino-exporter/pkg/tsdb"
+)
+
+const (
+	// streamBuffer is how many events are kept for the clients resuming
+	// with Last-Event-ID.
+	streamBuffer = 1024
+	// streamQueue is how many events a client may lag behind before it is
+	// disconnected, to resume later.
+	streamQueue = 64
+
+	streamKeepAlive    = 30 * time.Second
+	streamWriteTimeout = 10 * time.Second
+)
+
+// event is a new observation timestamp of a station, with the value of
+// every variable observed then.
+type event struct {
+	id      uint64
+	station string
+	time    time.Time
+	values  map[string]float64
+}
+
+type eventResponse struct {
+	Id           uint64                   `json:"id"`
+	Station      string                   `json:"station"`
+	Time         time.Time                `json:"time"`
+	Observations map[string]valueResponse `json:"observations"`
+}
+
+// subscriber is a streaming client, receiving the events it matches. They
+// are closed when it falls behind.
+type subscriber struct {
+	stations  []string
+	variables []string
+	events    chan event
+}
+
+// matches reports whether ev holds any variable of a station s filters.
+func (s *subscriber) matches(ev event) bool {
+	if len(s.stations) > 0 && !slices.Contains(s.stations, ev.station) {
+		return false
+	}
+
+	for variable := range ev.values {
+		if len(s.variables) == 0 || slices.Contains(s.variables, variable) {
+			return true
+		}
+	}
+
+	return false
+}
+
+// response is ev with just the variables s filters.
+func (s *subscriber) response(ev event) eventResponse {
+	response := eventResponse{
+		Id:           ev.id,
+		Station:      ev.station,
+		Time:         ev.time,
+		Observations: make(map[string]valueResponse, len(ev.values)),
+	}
+	for variable, value := range ev.values {
+		if len(s.variables) == 0 || slices.Contains(s.variables, variable) {
+			response.Observations[variable] = valueResponse{Time: ev.time, Value: value, Unit: units[variable]}
+		}
+	}
+
+	return response
+}
+
+// stream fans the events out to the subscribers, keeping the last ones for
+// those resuming. Publishing never blocks, a subscriber too slow to take an
+// event is dropped instead.
+type stream struct {
+	mu          sync.Mutex
+	seq         uint64
+	buffer      []event
+	subscribers map[*subscriber]struct{}
+
+	clients      *prometheus.GaugeVec
+	disconnected prometheus.Counter
+}
+
+func newStream() *stream {
+	return &stream{
+		// ids keep growing across restarts, so a client resuming from a
+		// previous run gets the events buffered since
+		seq:         uint64(time.Now().UnixMilli()),
+		subscribers: make(map[*subscriber]struct{}),
+		clients: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "api_stream_clients",
+			Help: "Number of clients streaming observations",
+		}, []string{"protocol"}),
+		disconnected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "api_stream_slow_disconnects_total",
+			Help: "Number of streaming clients disconnected for falling behind",
+		}),
+	}
+}
+
+func (s *stream) publish(events ...event) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	for _, ev := range events {
+		s.seq++
+		ev.id = s.seq
+
+		s.buffer = append(s.buffer, ev)
+		if len(s.buffer) > streamBuffer {
+			s.buffer = s.buffer[len(s.buffer)-streamBuffer:]
+		}
+
+		for sub := range s.subscribers {
+			if !sub.matches(ev) {
+				continue
+			}
+
+			select {
+			case sub.events <- ev:
+			default:
+				delete(s.subscribers, sub)
+				close(sub.events)
+				s.disconnected.Inc()
+			}
+		}
+	}
+}
+
+// subscribe adds sub, returning the buffered events after lastId it missed.
+func (s *stream) subscribe(sub *subscriber, lastId uint64) []event {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	var missed []event
+	if lastId > 0 {
+		for _, ev := range s.buffer {
+			if ev.id > lastId && sub.matches(ev) {
+				missed = append(missed, ev)
+			}
+		}
+	}
+
+	s.subscribers[sub] = struct{}{}
+	return missed
+}
+
+func (s *stream) unsubscribe(sub *subscriber) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	if _, ok := s.subscribers[sub]; ok {
+		delete(s.subscribers, sub)
+		close(sub.events)
+	}
+}
+
+// newEvents returns the events of the timestamps of series newer than
+// since, or of the latest one when since is zero, sorted by time.
+func newEvents(station string, series map[string][]tsdb.Point, since time.Time) []event {
+	byTime := make(map[time.Time]map[string]float64)
+	latest := since
+	for variable, points := range series {
+		for _, p := range points {
+			if since.IsZero() || p.Time.After(since) {
+				t := p.Time.UTC()
+				if byTime[t] == nil {
+					byTime[t] = make(map[string]float64)
+				}
+				byTime[t][variable] = p.Value
+			}
+			if p.Time.After(latest) {
+				latest = p.Time
+			}
+		}
+	}
+
+	events := make([]event, 0, len(byTime))
+	for t, values := range byTime {
+		if since.IsZero() && !t.Equal(latest) {
+			continue
+		}
+		events = append(events, event{station: station, time: t, values: values})
+	}
+	slices.SortFunc(events, func(a, b event) int {
+		return a.time.Compare(b.time)
+	})
+
+	return events
+}
+
+// serveStream streams the new observations of the stations as server-sent
+// events, or websocket messages when upgraded, filtered by the stations
+// and variables query parameters. Clients resume after the event in the
+// Last-Event-ID header, or the last_event_id parameter.
+func (e *Exporter) serveStream(w http.ResponseWriter, r *http.Request) {
+	query := r.URL.Query()
+	sub := &subscriber{events: make(chan event, streamQueue)}
+
+	for station := range strings.SplitSeq(query.Get("stations"), ",") {
+		if station = strings.ToUpper(strings.TrimSpace(station)); station != "" {
+			sub.stations = append(sub.stations, station)
+		}
+	}
+
+	for variable := range strings.SplitSeq(query.Get("variables"), ",") {
+		variable = strings.TrimSpace(variable)
+		if variable == "" {
+			continue
+		}
+		if !slices.Contains(tsdb_metrics.Variables, variable) {
+			http.Error(w, fmt.Sprintf("unknown variable %q, expected one of %s", variable, strings.Join(tsdb_metrics.Variables, ", ")), http.StatusBadRequest)
+			return
+		}
+		sub.variables = append(sub.variables, variable)
+	}
+
+	lastEventId := r.Header.Get("Last-Event-ID")
+	if lastEventId == "" {
+		lastEventId = query.Get("last_event_id")
+	}
+
+	var lastId uint64
+	if lastEventId != "" {
+		var err error
+		lastId, err = strconv.ParseUint(lastEventId, 10, 64)
+		if err != nil {
+			http.Error(w, fmt.Sprintf("invalid last event id: %s", err), http.StatusBadRequest)
+			return
+		}
+	}
+
+	if websocket.IsWebSocketUpgrade(r) {
+		e.serveWebSocket(w, r, sub, lastId)
+		return
+	}
+
+	e.serveEvents(w, r, sub, lastId)
+}
+
+func (e *Exporter) serveEvents(w http.ResponseWriter, r *http.Request, sub *subscriber, lastId uint64) {
+	rc := http.NewResponseController(w)
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	// proxies like nginx would buffer the stream otherwise
+	w.Header().Set("X-Accel-Buffering", "no")
+	w.WriteHeader(http.StatusOK)
+
+	write := func(format string, args ...any) error {
+		// a client not reading blocks the write until the deadline, where
+		// it is disconnected
+		_ = rc.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		_, err := fmt.Fprintf(w, format, args...)
+		if err != nil {
+			return err
+		}
+		return rc.Flush()
+	}
+
+	send := func(ev event) error {
+		response := sub.response(ev)
+		data, err := json.Marshal(response)
+		if err != nil {
+			return err
+		}
+		return write("id: %d\nevent: observation\ndata: %s\n\n", response.Id, data)
+	}
+
+	e.stream.clients.WithLabelValues("sse").Inc()
+	defer e.stream.clients.WithLabelValues("sse").Dec()
+
+	missed := e.stream.subscribe(sub, lastId)
+	defer e.stream.unsubscribe(sub)
+
+	err := write(": streaming observations\n\n")
+	for _, ev := range missed {
+		if err != nil {
+			break
+		}
+		err = send(ev)
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for err == nil {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-keepAlive.C:
+			err = write(": keepalive\n\n")
+		case ev, ok := <-sub.events:
+			if !ok {
+				e.logger.Debug("disconnecting slow stream client", zap.String("remote", r.RemoteAddr))
+				return
+			}
+			err = send(ev)
+		}
+	}
+
+	e.logger.Debug("error streaming events", zap.String("remote", r.RemoteAddr), zap.Error(err))
+}
+
+// upgrader accepts any origin, the stream is as public as the rest of the
+// api.
+var upgrader = websocket.Upgrader{
+	CheckOrigin: func(r *http.Request) bool {
+		return true
+	},
+}
+
+func (e *Exporter) serveWebSocket(w http.ResponseWriter, r *http.Request, sub *subscriber, lastId uint64) {
+	conn, err := upgrader.Upgrade(w, r, nil)
+	if err != nil {
+		// the upgrader already replied
+		e.logger.Debug("error upgrading stream to websocket", zap.String("remote", r.RemoteAddr), zap.Error(err))
+		return
+	}
+	defer func() {
+		_ = conn.Close()
+	}()
+
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+
+	// messages from the client are discarded, reading handles the pongs
+	// and the close
+	conn.SetReadLimit(512)
+	_ = conn.SetReadDeadline(time.Now().Add(2 * streamKeepAlive))
+	conn.SetPongHandler(func(string) error {
+		return conn.SetReadDeadline(time.Now().Add(2 * streamKeepAlive))
+	})
+	go func() {
+		defer cancel()
+		for {
+			_, _, err := conn.NextReader()
+			if err != nil {
+				return
+			}
+		}
+	}()
+
+	send := func(ev event) error {
+		_ = conn.SetWriteDeadline(time.Now().Add(streamWriteTimeout))
+		return conn.WriteJSON(sub.response(ev))
+	}
+
+	e.stream.clients.WithLabelValues("websocket").Inc()
+	defer e.stream.clients.WithLabelValues("websocket").Dec()
+
+	missed := e.stream.subscribe(sub, lastId)
+	defer e.stream.unsubscribe(sub)
+
+	for _, ev := range missed {
+		if err != nil {
+			break
+		}
+		err = send(ev)
+	}
+
+	keepAlive := time.NewTicker(streamKeepAlive)
+	defer keepAlive.Stop()
+
+	for err == nil {
+		select {
+		case <-ctx.Done():
+			return
+		case <-keepAlive.C:
+			err = conn.WriteControl(websocket.PingMessage, nil, time.Now().Add(streamWriteTimeout))
+		case ev, ok := <-sub.events:
+			if !ok {
+				e.logger.Debug("disconnecting slow stream client", zap.String("remote", r.RemoteAddr))
+				_ = conn.WriteControl(websocket.CloseMessage, websocket.FormatCloseMessage(websocket.CloseTryAgainLater, "too slow"), time.Now().Add(streamWriteTimeout))
+				return
+			}
+			err = send(ev)
+		}
+	}
+
+	e.logger.Debug("error streaming events", zap.String("remote", r.RemoteAddr), zap.Error(err))
+}
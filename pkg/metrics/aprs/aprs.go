@@ -0,0 +1,193 @@
+package aprs_metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+	"wouldgo.me/meteotrentino-exporter/pkg/secret"
+)
+
+// DefaultServer is the CWOP APRS-IS server.
+const DefaultServer = "cwop.aprs.net:14580"
+
+var (
+	_ metrics.Sink           = (*AprsMetrics)(nil)
+	_ metrics.StationDeleter = (*AprsMetrics)(nil)
+
+	ErrNoPosition = errors.New("no station position")
+)
+
+// Station is the APRS identity of a station. Passcode defaults to -1, as
+// used by CWOP stations. Latitude and Longitude override the catalog
+// position.
+type Station struct {
+	Callsign  string `validate:"required"`
+	Passcode  secret.Secret
+	Latitude  *float64 `validate:"omitempty,gte=-90,lte=90"`
+	Longitude *float64 `validate:"omitempty,gte=-180,lte=180"`
+}
+
+type MetricsConfig struct {
+	Logger *zap.Logger `validate:"required"`
+	// Server defaults to DefaultServer.
+	Server string `validate:"omitempty,hostname_port"`
+	// Stations maps the code of the stations sent to their identity, the
+	// others are not sent.
+	Stations map[string]Station `validate:"required,min=1,dive"`
+}
+
+// AprsMetrics sends the latest observation of a station as an APRS weather
+// packet to an APRS-IS server, e.g. to feed CWOP, when newer than the last
+// one sent.
+type AprsMetrics struct {
+	logger   *zap.Logger
+	dialer   *net.Dialer
+	server   string
+	stations map[string]Station
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+func NewAprsMetrics(opts MetricsConfig) (*AprsMetrics, error) {
+	err := metrics.Validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return nil, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return nil, errors.Join(errs...)
+		}
+
+		return nil, err
+	}
+
+	server := DefaultServer
+	if opts.Server != "" {
+		server = opts.Server
+	}
+
+	stations := make(map[string]Station, len(opts.Stations))
+	for code, station := range opts.Stations {
+		stations[strings.ToUpper(code)] = station
+	}
+
+	return &AprsMetrics{
+		logger:   opts.Logger,
+		dialer:   &net.Dialer{},
+		server:   server,
+		stations: stations,
+		sent:     make(map[string]time.Time),
+	}, nil
+}
+
+func (m *AprsMetrics) Name() string {
+	return "aprs"
+}
+
+// Write sends the latest observation of a station, unless it was already
+// sent.
+func (m *AprsMetrics) Write(ctx context.Context, stats metrics.StationStats) error {
+	code := strings.ToUpper(stats.Station.Code)
+
+	station, ok := m.stations[code]
+	if !ok {
+		return nil
+	}
+
+	weather, ok := newWeather(stats.Stats)
+	if !ok {
+		return nil
+	}
+
+	// the catalog is only queried for the stations without a position
+	switch {
+	case station.Latitude != nil && station.Longitude != nil:
+		weather.Latitude, weather.Longitude = *station.Latitude, *station.Longitude
+	case stats.Station.Latitude != 0 || stats.Station.Longitude != 0:
+		weather.Latitude, weather.Longitude = stats.Station.Latitude, stats.Station.Longitude
+	default:
+		return fmt.Errorf("error sending %s: %w", code, ErrNoPosition)
+	}
+
+	m.mu.Lock()
+	sent := m.sent[code]
+	m.mu.Unlock()
+
+	if !weather.Time.After(sent) {
+		m.logger.Debug("no new observation to send", zap.String("station", code), zap.Time("time", weather.Time))
+		return nil
+	}
+
+	passcode := "-1"
+	if !station.Passcode.IsZero() {
+		var err error
+		passcode, err = station.Passcode.Value()
+		if err != nil {
+			return fmt.Errorf("error reading aprs passcode: %w", err)
+		}
+	}
+
+	packet := EncodeWeather(station.Callsign, weather)
+	m.logger.Debug("sending aprs packet", zap.String("station", code), zap.String("packet", packet))
+
+	err := m.send(ctx, strings.ToUpper(station.Callsign), passcode, packet)
+	if err != nil {
+		return fmt.Errorf("error sending %s to %s: %w", code, m.server, err)
+	}
+
+	m.mu.Lock()
+	m.sent[code] = weather.Time
+	m.mu.Unlock()
+
+	return nil
+}
+
+// newWeather builds the weather of the latest observation in stats, ok is
+// false when there is none. The position is left to the caller.
+func newWeather(stats api.WeatherStats) (Weather, bool) {
+	obs, ok := metrics.NewObservation(stats)
+	if !ok {
+		return Weather{}, false
+	}
+
+	return Weather{
+		Time:          obs.Time,
+		WindDirection: obs.WindDirection,
+		WindSpeed:     obs.WindSpeed,
+		WindGust:      obs.WindGust,
+		Temperature:   obs.Temperature,
+		RainHour:      obs.RainHour,
+		RainMidnight:  obs.RainDay,
+		Humidity:      obs.Humidity,
+		Radiation:     obs.Radiation,
+	}, true
+}
+
+// Delete forgets the packets sent for a station no longer exported.
+func (m *AprsMetrics) Delete(station string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sent, strings.ToUpper(station))
+}
+
+func (m *AprsMetrics) Close() error {
+	return nil
+}
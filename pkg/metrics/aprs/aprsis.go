@@ -0,0 +1,90 @@
+package aprs_metrics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"runtime/debug"
+	"strings"
+)
+
+var ErrLogin = errors.New("aprs-is login failed")
+
+// software names the client on login, with its module version when built
+// from one.
+var software = func() string {
+	version := "dev"
+	if info, ok := debug.ReadBuildInfo(); ok && info.Main.Version != "" && info.Main.Version != "(devel)" {
+		version = info.Main.Version
+	}
+	return Comment + " " + version
+}()
+
+// send logs in to the APRS-IS server as callsign and sends the packets, the
+// connection only lasts for them as CWOP recommends.
+func (m *AprsMetrics) send(ctx context.Context, callsign, passcode string, packets ...string) (err error) {
+	conn, err := m.dialer.DialContext(ctx, "tcp", m.server)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		err = errors.Join(err, conn.Close())
+	}()
+
+	if deadline, ok := ctx.Deadline(); ok {
+		err = conn.SetDeadline(deadline)
+		if err != nil {
+			return err
+		}
+	}
+
+	r := bufio.NewReader(conn)
+
+	// the server greets first, e.g. # aprsc 2.1.14
+	_, err = r.ReadString('\n')
+	if err != nil {
+		return fmt.Errorf("error reading aprs-is greeting: %w", err)
+	}
+
+	_, err = fmt.Fprintf(conn, "user %s pass %s vers %s\r\n", callsign, passcode, software)
+	if err != nil {
+		return err
+	}
+
+	err = readLogin(r)
+	if err != nil {
+		return err
+	}
+
+	for _, packet := range packets {
+		_, err = fmt.Fprintf(conn, "%s\r\n", packet)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// readLogin waits for the login response, e.g. # logresp CW1234 unverified,
+// server CWOP-1. Unverified logins, like the ones of CWOP stations, are
+// accepted.
+func readLogin(r *bufio.Reader) error {
+	for {
+		line, err := r.ReadString('\n')
+		if err != nil {
+			return fmt.Errorf("error reading aprs-is login response: %w", err)
+		}
+
+		line = strings.TrimSpace(line)
+		if !strings.HasPrefix(line, "# logresp") {
+			continue
+		}
+
+		if strings.Contains(line, "verified") {
+			return nil
+		}
+		return fmt.Errorf("%w: %s", ErrLogin, line)
+	}
+}
@@ -0,0 +1,148 @@
+package aprs_metrics
+
+import (
+	"fmt"
+	"math"
+	"strings"
+	"time"
+)
+
+// Weather is an observation of a station, in metric units as fetched.
+// Missing variables are nil and sent as dots.
+type Weather struct {
+	Time      time.Time
+	Latitude  float64
+	Longitude float64
+
+	// WindDirection is in degrees, WindSpeed and WindGust in m/s.
+	WindDirection *float64
+	WindSpeed     *float64
+	WindGust      *float64
+
+	// Temperature is in celsius.
+	Temperature *float64
+	// RainHour is the precipitation of the last hour, RainMidnight the one
+	// since local midnight, both in mm.
+	RainHour     *float64
+	RainMidnight *float64
+	// Humidity is in percent.
+	Humidity *float64
+	// Radiation is in W/m².
+	Radiation *float64
+}
+
+// Comment ends every packet, naming the software as CWOP asks.
+const Comment = "meteotrentino-exporter"
+
+// EncodeWeather formats w as an APRS complete weather report with position
+// and timestamp sent by callsign over APRS-IS, e.g.
+//
+//	CW1234>APRS,TCPIP*:@181015z4553.40N/01102.40E_270/007g012t055r001P010h71L310meteotrentino-exporter
+func EncodeWeather(callsign string, w Weather) string {
+	var b strings.Builder
+
+	b.WriteString(strings.ToUpper(callsign))
+	b.WriteString(">APRS,TCPIP*:@")
+	b.WriteString(w.Time.UTC().Format("021504"))
+	b.WriteString("z")
+	b.WriteString(latitude(w.Latitude))
+	b.WriteString("/")
+	b.WriteString(longitude(w.Longitude))
+	b.WriteString("_")
+
+	b.WriteString(field("", 3, w.WindDirection, direction))
+	b.WriteString(field("/", 3, w.WindSpeed, mph))
+	b.WriteString(field("g", 3, w.WindGust, mph))
+	b.WriteString(field("t", 3, w.Temperature, fahrenheit))
+	b.WriteString(field("r", 3, w.RainHour, hundredthsOfInch))
+	b.WriteString(field("P", 3, w.RainMidnight, hundredthsOfInch))
+	b.WriteString(field("h", 2, w.Humidity, humidity))
+	if w.Radiation != nil {
+		b.WriteString(luminosity(*w.Radiation))
+	}
+
+	b.WriteString(Comment)
+	return b.String()
+}
+
+// field formats value with prefix on width digits, dots when nil.
+func field(prefix string, width int, value *float64, convert func(float64) int) string {
+	if value == nil {
+		return prefix + strings.Repeat(".", width)
+	}
+
+	v := convert(*value)
+	// the fixed width bounds the value, e.g. 999 hundredths of inch
+	v = min(v, int(math.Pow10(width))-1)
+	v = max(v, -int(math.Pow10(width-1))+1)
+
+	return fmt.Sprintf("%s%0*d", prefix, width, v)
+}
+
+// latitude formats degrees as DDMM.mmN.
+func latitude(degrees float64) string {
+	hemisphere := "N"
+	if degrees < 0 {
+		hemisphere = "S"
+	}
+
+	d, m := degreesMinutes(math.Abs(degrees))
+	return fmt.Sprintf("%02d%05.2f%s", d, m, hemisphere)
+}
+
+// longitude formats degrees as DDDMM.mmE.
+func longitude(degrees float64) string {
+	hemisphere := "E"
+	if degrees < 0 {
+		hemisphere = "W"
+	}
+
+	d, m := degreesMinutes(math.Abs(degrees))
+	return fmt.Sprintf("%03d%05.2f%s", d, m, hemisphere)
+}
+
+// degreesMinutes splits degrees, rounding the minutes to two decimals
+// without reaching 60.
+func degreesMinutes(degrees float64) (int, float64) {
+	hundredths := int(math.Round(degrees * 60 * 100))
+	return hundredths / 6000, float64(hundredths%6000) / 100
+}
+
+// direction is 001 to 360, north being 360 as 000 reads as no direction.
+func direction(degrees float64) int {
+	d := int(math.Round(degrees)) % 360
+	if d <= 0 {
+		d += 360
+	}
+	return d
+}
+
+func mph(metersPerSecond float64) int {
+	return int(math.Round(metersPerSecond * 2.236936))
+}
+
+func fahrenheit(celsius float64) int {
+	return int(math.Round(celsius*9/5 + 32))
+}
+
+func hundredthsOfInch(mm float64) int {
+	return int(math.Round(mm / 25.4 * 100))
+}
+
+// humidity is 01 to 99, 100% being 00.
+func humidity(percent float64) int {
+	h := int(math.Round(percent))
+	if h >= 100 {
+		return 0
+	}
+	return max(h, 1)
+}
+
+// luminosity is L for less than 1000 W/m², l for the thousands above.
+func luminosity(wattsPerSquareMeter float64) string {
+	l := max(int(math.Round(wattsPerSquareMeter)), 0)
+	if l >= 1000 {
+		return fmt.Sprintf("l%03d", min(l-1000, 999))
+	}
+	return fmt.Sprintf("L%03d", l)
+}
@@ -0,0 +1,148 @@
+package aprs_metrics
+
+import (
+	"testing"
+	"time"
+)
+
+func value(v float64) *float64 {
+	return &v
+}
+
+func TestEncodeWeather(t *testing.T) {
+	at := time.Date(2026, 10, 18, 10, 15, 0, 0, time.UTC)
+
+	tests := []struct {
+		name string
+		w    Weather
+		want string
+	}{
+		{
+			name: "full packet",
+			w: Weather{
+				Time:          at,
+				Latitude:      45.89,
+				Longitude:     11.04,
+				WindDirection: value(270),
+				WindSpeed:     value(3.1),
+				WindGust:      value(5.2),
+				Temperature:   value(12.9),
+				RainHour:      value(0.2),
+				RainMidnight:  value(2.5),
+				Humidity:      value(71),
+				Radiation:     value(310),
+			},
+			want: "CW1234>APRS,TCPIP*:@181015z4553.40N/01102.40E_270/007g012t055r001P010h71L310meteotrentino-exporter",
+		},
+		{
+			name: "missing variables as dots",
+			w: Weather{
+				Time:      at,
+				Latitude:  45.89,
+				Longitude: 11.04,
+			},
+			want: "CW1234>APRS,TCPIP*:@181015z4553.40N/01102.40E_.../...g...t...r...P...h..meteotrentino-exporter",
+		},
+		{
+			name: "negative fahrenheit",
+			w: Weather{
+				Time:        at,
+				Latitude:    45.89,
+				Longitude:   11.04,
+				Temperature: value(-25),
+			},
+			want: "CW1234>APRS,TCPIP*:@181015z4553.40N/01102.40E_.../...g...t-13r...P...h..meteotrentino-exporter",
+		},
+		{
+			name: "negative fahrenheit padded",
+			w: Weather{
+				Time:        at,
+				Latitude:    45.89,
+				Longitude:   11.04,
+				Temperature: value(-20.6),
+			},
+			want: "CW1234>APRS,TCPIP*:@181015z4553.40N/01102.40E_.../...g...t-05r...P...h..meteotrentino-exporter",
+		},
+		{
+			name: "humidity 100 as 00",
+			w: Weather{
+				Time:      at,
+				Latitude:  45.89,
+				Longitude: 11.04,
+				Humidity:  value(100),
+			},
+			want: "CW1234>APRS,TCPIP*:@181015z4553.40N/01102.40E_.../...g...t...r...P...h00meteotrentino-exporter",
+		},
+		{
+			name: "luminosity below 1000",
+			w: Weather{
+				Time:      at,
+				Latitude:  45.89,
+				Longitude: 11.04,
+				Radiation: value(999),
+			},
+			want: "CW1234>APRS,TCPIP*:@181015z4553.40N/01102.40E_.../...g...t...r...P...h..L999meteotrentino-exporter",
+		},
+		{
+			name: "luminosity from 1000",
+			w: Weather{
+				Time:      at,
+				Latitude:  45.89,
+				Longitude: 11.04,
+				Radiation: value(1234),
+			},
+			want: "CW1234>APRS,TCPIP*:@181015z4553.40N/01102.40E_.../...g...t...r...P...h..l234meteotrentino-exporter",
+		},
+		{
+			name: "direction 0 as 360",
+			w: Weather{
+				Time:          at,
+				Latitude:      45.89,
+				Longitude:     11.04,
+				WindDirection: value(0),
+				WindSpeed:     value(0),
+			},
+			want: "CW1234>APRS,TCPIP*:@181015z4553.40N/01102.40E_360/000g...t...r...P...h..meteotrentino-exporter",
+		},
+		{
+			name: "south west",
+			w: Weather{
+				Time:      at,
+				Latitude:  -33.5,
+				Longitude: -70.25,
+			},
+			want: "CW1234>APRS,TCPIP*:@181015z3330.00S/07015.00W_.../...g...t...r...P...h..meteotrentino-exporter",
+		},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := EncodeWeather("cw1234", tt.w)
+			if got != tt.want {
+				t.Errorf("EncodeWeather() = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestPosition(t *testing.T) {
+	tests := []struct {
+		name      string
+		latitude  float64
+		longitude float64
+		want      string
+	}{
+		{"north east", 45.89, 11.04, "4553.40N/01102.40E"},
+		{"south west", -33.5, -70.25, "3330.00S/07015.00W"},
+		{"minutes rounded below 60", 45.99999, -0.99999, "4600.00N/00100.00W"},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := latitude(tt.latitude) + "/" + longitude(tt.longitude)
+			if got != tt.want {
+				t.Errorf("position = %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
@@ -0,0 +1,227 @@
+package file_metrics
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	influxdb "github.com/InfluxCommunity/influxdb3-go/v2/influxdb3"
+	"github.com/go-playground/validator/v10"
+	"github.com/influxdata/line-protocol/v2/lineprotocol"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+	influxdb_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/influxdb"
+)
+
+type Format string
+
+const (
+	FormatLineProtocol Format = "lineprotocol"
+	FormatJSON         Format = "json"
+
+	// Stdout is the path selecting the standard output.
+	Stdout = "-"
+
+	rotatedPrefix = "meteotrentino-"
+	rotatedLayout = "20060102T150405Z"
+)
+
+var _ metrics.Sink = (*FileMetrics)(nil)
+
+type MetricsConfig struct {
+	Logger *zap.Logger             `validate:"required"`
+	Schema influxdb_metrics.Schema `validate:"required"`
+	Format Format                  `validate:"required,oneof=lineprotocol json"`
+
+	// Path is Stdout, a file the points are appended to or, when Rotate is
+	// set, a directory where a new file is started every Rotate interval.
+	Path   string `validate:"required"`
+	Rotate time.Duration
+	// Keep is the number of rotated files retained, zero keeps them all.
+	Keep int `validate:"gte=0"`
+}
+
+type FileMetrics struct {
+	logger *zap.Logger
+	schema influxdb_metrics.Schema
+	format Format
+
+	path   string
+	rotate time.Duration
+	keep   int
+
+	mu sync.Mutex
+}
+
+type jsonPoint struct {
+	Measurement string            `json:"measurement"`
+	Tags        map[string]string `json:"tags"`
+	Fields      map[string]any    `json:"fields"`
+	Time        time.Time         `json:"time"`
+}
+
+func NewFileMetrics(opts MetricsConfig) (*FileMetrics, error) {
+	err := metrics.Validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return nil, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return nil, errors.Join(errs...)
+		}
+
+		return nil, err
+	}
+
+	if opts.Rotate != 0 {
+		if opts.Path == Stdout {
+			return nil, fmt.Errorf("rotation needs a directory, not stdout")
+		}
+
+		err = os.MkdirAll(opts.Path, 0o750)
+		if err != nil {
+			return nil, fmt.Errorf("error creating output directory: %w", err)
+		}
+	}
+
+	return &FileMetrics{
+		logger: opts.Logger,
+		schema: opts.Schema,
+		format: opts.Format,
+		path:   opts.Path,
+		rotate: opts.Rotate,
+		keep:   opts.Keep,
+	}, nil
+}
+
+func (f *FileMetrics) encode(points []*influxdb.Point) ([]byte, error) {
+	if f.format == FormatLineProtocol {
+		return influxdb_metrics.LineProtocol(points, lineprotocol.Second)
+	}
+
+	buf := make([]byte, 0, 256*len(points))
+	for _, point := range points {
+		line, err := json.Marshal(jsonPoint{
+			Measurement: point.Values.MeasurementName,
+			Tags:        point.Values.Tags,
+			Fields:      point.Values.Fields,
+			Time:        point.Values.Timestamp.UTC(),
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error encoding point: %w", err)
+		}
+
+		buf = append(buf, line...)
+		buf = append(buf, '\n')
+	}
+
+	return buf, nil
+}
+
+func (f *FileMetrics) extension() string {
+	if f.format == FormatLineProtocol {
+		return ".lp"
+	}
+
+	return ".ndjson"
+}
+
+// target opens the writer for the current write, the returned closer must be
+// called once done.
+func (f *FileMetrics) target(now time.Time) (io.Writer, func() error, error) {
+	if f.path == Stdout {
+		return os.Stdout, func() error { return nil }, nil
+	}
+
+	path := f.path
+	if f.rotate != 0 {
+		name := rotatedPrefix + now.UTC().Truncate(f.rotate).Format(rotatedLayout) + f.extension()
+		path = filepath.Join(f.path, name)
+	}
+
+	file, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, nil, fmt.Errorf("error opening output file: %w", err)
+	}
+
+	return file, file.Close, nil
+}
+
+// prune removes the oldest rotated files beyond the configured ones to keep,
+// the timestamp in their names makes lexical and chronological order match.
+func (f *FileMetrics) prune() error {
+	if f.rotate == 0 || f.keep == 0 {
+		return nil
+	}
+
+	entries, err := os.ReadDir(f.path)
+	if err != nil {
+		return fmt.Errorf("error reading output directory: %w", err)
+	}
+
+	rotated := make([]string, 0, len(entries))
+	for _, entry := range entries {
+		name := entry.Name()
+		if !entry.IsDir() && strings.HasPrefix(name, rotatedPrefix) && strings.HasSuffix(name, f.extension()) {
+			rotated = append(rotated, name)
+		}
+	}
+
+	slices.Sort(rotated)
+	for len(rotated) > f.keep {
+		f.logger.Debug("removing rotated file", zap.String("file", rotated[0]))
+		err := os.Remove(filepath.Join(f.path, rotated[0]))
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("error removing rotated file: %w", err)
+		}
+		rotated = rotated[1:]
+	}
+
+	return nil
+}
+
+func (f *FileMetrics) Name() string {
+	return "file"
+}
+
+func (f *FileMetrics) Write(ctx context.Context, stats metrics.StationStats) error {
+	buf, err := f.encode(f.schema.Points(stats.Station, stats.Stats))
+	if err != nil {
+		return err
+	}
+
+	f.mu.Lock()
+	defer f.mu.Unlock()
+
+	w, closer, err := f.target(time.Now())
+	if err != nil {
+		return err
+	}
+
+	_, err = w.Write(buf)
+	err = errors.Join(err, closer())
+	if err != nil {
+		return fmt.Errorf("error writing points: %w", err)
+	}
+
+	return f.prune()
+}
+
+func (f *FileMetrics) Close() error {
+	return nil
+}
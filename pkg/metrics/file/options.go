@@ -0,0 +1,82 @@
+package file_metrics
+
+import (
+	"errors"
+	"flag"
+	"strconv"
+	"time"
+
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	"wouldgo.me/meteotrentino-exporter/pkg/options"
+)
+
+const (
+	formatEnv = "OUTPUT_FORMAT"
+	pathEnv   = "OUTPUT_PATH"
+	rotateEnv = "OUTPUT_ROTATE"
+	keepEnv   = "OUTPUT_KEEP"
+)
+
+type FileOptions struct {
+	fs                         *flag.FlagSet
+	env                        options.Env
+	format, path, rotate, keep *string
+}
+
+// NewFileOptions registers the file output flags, the schema ones are
+// registered apart by influxdb_metrics.NewSchemaOptions.
+func NewFileOptions(fs *flag.FlagSet, env options.Env) *FileOptions {
+	var format, path, rotate, keep string
+	fs.StringVar(&format, "output-format", string(FormatLineProtocol), "output format: lineprotocol or json, newline delimited (default: lineprotocol)")
+	fs.StringVar(&path, "output-path", "", "output path: - for stdout, a file or a directory when rotating")
+	fs.StringVar(&rotate, "output-rotate", "0", "start a new file in the output directory every interval, e.g. 24h, disabled if 0 (default: 0)")
+	fs.StringVar(&keep, "output-keep", "0", "number of rotated files kept, 0 keeps them all (default: 0)")
+
+	return &FileOptions{
+		fs,
+		env,
+		&format,
+		&path,
+		&rotate,
+		&keep,
+	}
+}
+
+// Apply overrides the file sink of c, creating it when its path is set. Its
+// other settings only apply to a sink enabled this way or by the
+// configuration file.
+func (fo *FileOptions) Apply(c *config.Config) error {
+	if v, ok := options.Override(fo.fs, "output-path", fo.path, fo.env, pathEnv); ok && v != "" {
+		if c.Sinks.File == nil {
+			c.Sinks.File = &config.File{}
+		}
+		c.Sinks.File.Path = v
+	}
+
+	sink := c.Sinks.File
+	if sink == nil {
+		return nil
+	}
+
+	if v, ok := options.Override(fo.fs, "output-format", fo.format, fo.env, formatEnv); ok {
+		sink.Format = v
+	}
+
+	if v, ok := options.Override(fo.fs, "output-rotate", fo.rotate, fo.env, rotateEnv); ok {
+		rotate, err := time.ParseDuration(v)
+		if err != nil {
+			return errors.Join(options.ErrWrongParam("output-rotate"), err)
+		}
+		sink.Rotate = rotate
+	}
+
+	if v, ok := options.Override(fo.fs, "output-keep", fo.keep, fo.env, keepEnv); ok {
+		keep, err := strconv.Atoi(v)
+		if err != nil {
+			return errors.Join(options.ErrWrongParam("output-keep"), err)
+		}
+		sink.Keep = keep
+	}
+
+	return nil
+}
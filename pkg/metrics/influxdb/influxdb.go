@@ -4,36 +4,59 @@ import (
 	"context"
 	"errors"
 	"fmt"
-	"maps"
-	"slices"
-	"strings"
+	"net/http"
+	"sync"
 	"time"
 
 	influxdb "github.com/InfluxCommunity/influxdb3-go/v2/influxdb3"
 	"github.com/go-playground/validator/v10"
 	"github.com/influxdata/line-protocol/v2/lineprotocol"
 
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
 	"go.uber.org/zap"
-	"wouldgo.me/meteotrentino-exporter/pkg/api"
 	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+	"wouldgo.me/meteotrentino-exporter/pkg/queue"
+	"wouldgo.me/meteotrentino-exporter/pkg/secret"
 )
 
+var _ metrics.Sink = (*InfluxDbMetrics)(nil)
+
+// drainInterval is how often the queue is drained between writes, so that
+// points kept during an outage reach influxdb once it recovers.
+const drainInterval = time.Minute
+
 type MetricsConfig struct {
-	Logger  *zap.Logger `validate:"required"`
-	Station string      `validate:"required"`
+	Logger *zap.Logger `validate:"required"`
 
 	Database string `validate:"required"`
 	Org      string
-	Token    string `validate:"required"`
-	Url      string `validate:"required"`
+	Token    secret.Secret `validate:"required"`
+	Url      string        `validate:"required"`
+
+	Measurement string
+	Layout      Layout `validate:"omitempty,oneof=wide narrow"`
+	Tags        map[string]string
+	// CatalogTags maps a tag name to an attribute of the written station,
+	// see api.Station.Attribute for the available ones.
+	CatalogTags map[string]string
+
+	// Queue, when set, buffers the encoded points on disk so that they
+	// survive influxdb outages and are written once it recovers, it is
+	// drained after every write and every minute. It is closed along with
+	// the metrics.
+	Queue *queue.Queue
 }
 
 type InfluxDbMetrics struct {
 	client *influxdb.Client
 	logger *zap.Logger
 
-	measure string
-	station string
+	schema Schema
+	queue  *queue.Queue
+
+	// stop and draining end the background drain of queue.
+	stop     context.CancelFunc
+	draining sync.WaitGroup
 }
 
 func NewInfluxDbMetrics(opts MetricsConfig) (*InfluxDbMetrics, error) {
@@ -56,87 +79,121 @@ func NewInfluxDbMetrics(opts MetricsConfig) (*InfluxDbMetrics, error) {
 		return nil, err
 	}
 
+	schema, err := NewSchema(opts.Measurement, opts.Layout, opts.Tags, opts.CatalogTags)
+	if err != nil {
+		return nil, fmt.Errorf("error creating influxdb schema: %w", err)
+	}
+
+	token, err := opts.Token.Value()
+	if err != nil {
+		return nil, fmt.Errorf("error reading influxdb token: %w", err)
+	}
+
+	// the token is set again on every request, to follow rotations
 	client, err := influxdb.New(influxdb.ClientConfig{
 		Host:     opts.Url,
-		Token:    opts.Token,
+		Token:    token,
 		Database: opts.Database,
+		HTTPClient: &http.Client{
+			Transport: &tokenTransport{
+				next:  otelhttp.NewTransport(http.DefaultTransport),
+				token: opts.Token,
+			},
+		},
 	})
 	if err != nil {
 		return nil, fmt.Errorf("error creating influxdb client: %w", err)
 	}
 
-	return &InfluxDbMetrics{
-		client:  client,
-		logger:  opts.Logger,
-		measure: "meteotrentino",
-		station: strings.ToUpper(opts.Station),
-	}, nil
-}
+	m := &InfluxDbMetrics{
+		client: client,
+		logger: opts.Logger,
+		schema: schema,
+		queue:  opts.Queue,
+	}
 
-func (i InfluxDbMetrics) Write(ctx context.Context, latestMetrics api.WeatherStats) error {
-	temps := latestMetrics.Temperature()
-	hums := latestMetrics.Humidity()
-	prec := latestMetrics.Precipitation()
-	rad := latestMetrics.Radiation()
-	maxNum := max(max(max(max(0, len(temps)), len(hums)), len(prec)), len(rad))
-
-	points := make(map[time.Time]*influxdb.Point, maxNum)
-	for _, v := range temps {
-		point := influxdb.NewPointWithMeasurement(i.measure).
-			SetTag("station", i.station).
-			SetTimestamp(v.Time()).
-			SetField("temperature_celsius", v.Value())
-
-		points[v.Time()] = point
+	if m.queue != nil {
+		var ctx context.Context
+		ctx, m.stop = context.WithCancel(context.Background())
+		m.draining.Go(func() {
+			m.queue.Run(ctx, drainInterval, m.deliver)
+		})
 	}
 
-	for _, v := range hums {
-		point, ok := points[v.Time()]
-		if !ok {
-			point = influxdb.NewPointWithMeasurement(i.measure).
-				SetTag("station", i.station).
-				SetTimestamp(v.Time())
-		}
+	return m, nil
+}
 
-		point.
-			SetField("humidity_percent", v.Value())
+func (i *InfluxDbMetrics) Name() string {
+	return "influxdb"
+}
 
-		points[v.Time()] = point
+func (i *InfluxDbMetrics) Write(ctx context.Context, stats metrics.StationStats) error {
+	points := i.schema.Points(stats.Station, stats.Stats)
+	if i.queue == nil {
+		return i.client.WritePoints(ctx, points,
+			influxdb.WithPrecision(lineprotocol.Second),
+		)
 	}
 
-	for _, v := range prec {
-		point, ok := points[v.Time()]
-		if !ok {
-			point = influxdb.NewPointWithMeasurement(i.measure).
-				SetTag("station", i.station).
-				SetTimestamp(v.Time())
-		}
+	record, err := LineProtocol(points, lineprotocol.Second)
+	if err != nil {
+		return err
+	}
 
-		point.
-			SetField("precipitation_mm", v.Value())
+	err = i.queue.Append(record)
+	if err != nil {
+		return fmt.Errorf("error queueing points: %w", err)
+	}
 
-		points[v.Time()] = point
+	err = i.queue.Drain(ctx, i.deliver)
+	if err != nil {
+		return fmt.Errorf("error draining queue, %d records kept for the next run: %w", i.queue.Len(), err)
 	}
 
-	for _, v := range rad {
-		point, ok := points[v.Time()]
-		if !ok {
-			point = influxdb.NewPointWithMeasurement(i.measure).
-				SetTag("station", i.station).
-				SetTimestamp(v.Time())
+	return nil
+}
+
+// deliver writes a queued record, one influxdb refuses to parse or store is
+// dropped rather than retried forever.
+func (i *InfluxDbMetrics) deliver(ctx context.Context, record []byte) error {
+	err := i.client.Write(ctx, record,
+		influxdb.WithPrecision(lineprotocol.Second),
+	)
+
+	var serverErr *influxdb.ServerError
+	if errors.As(err, &serverErr) {
+		switch serverErr.StatusCode {
+		case http.StatusBadRequest, http.StatusRequestEntityTooLarge, http.StatusUnprocessableEntity:
+			return queue.Permanent(err)
 		}
+	}
 
-		point.
-			SetField("radiation_watts_per_square_meter", v.Value())
+	return err
+}
 
-		points[v.Time()] = point
+func (i *InfluxDbMetrics) Close() error {
+	if i.queue == nil {
+		return i.client.Close()
 	}
 
-	return i.client.WritePoints(ctx, slices.Collect(maps.Values(points)),
-		influxdb.WithPrecision(lineprotocol.Second),
-	)
+	i.stop()
+	i.draining.Wait()
+	return errors.Join(i.queue.Close(), i.client.Close())
+}
+
+// tokenTransport authorizes every request with the current value of token.
+type tokenTransport struct {
+	next  http.RoundTripper
+	token secret.Secret
 }
 
-func (i InfluxDbMetrics) Close() error {
-	return i.client.Close()
+func (t *tokenTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	token, err := t.token.Value()
+	if err != nil {
+		return nil, fmt.Errorf("error reading influxdb token: %w", err)
+	}
+
+	req = req.Clone(req.Context())
+	req.Header.Set("Authorization", "Token "+token)
+	return t.next.RoundTrip(req)
 }
@@ -1,71 +1,211 @@
 package influxdb_metrics
 
 import (
+	"errors"
 	"flag"
 	"fmt"
-	"os"
+	"strconv"
+	"time"
 
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
 	"wouldgo.me/meteotrentino-exporter/pkg/options"
 )
 
-var (
-	databaseEnv, databaseEnvSet = os.LookupEnv("INFLUXDB_DATABASE")
-	orgEnv, orgEnvSet           = os.LookupEnv("INFLUXDB_ORG")
-	tokenEnv, tokenEnvSet       = os.LookupEnv("INFLUXDB_TOKEN")
-	urlEnv, urlEnvSet           = os.LookupEnv("INFLUXDB_URL")
+const (
+	databaseEnv = "INFLUXDB_DATABASE"
+	orgEnv      = "INFLUXDB_ORG"
+	tokenEnv    = "INFLUXDB_TOKEN"
+	urlEnv      = "INFLUXDB_URL"
+
+	measurementEnv = "INFLUXDB_MEASUREMENT"
+	layoutEnv      = "INFLUXDB_LAYOUT"
+	tagsEnv        = "INFLUXDB_TAGS"
+	catalogTagsEnv = "INFLUXDB_CATALOG_TAGS"
+
+	queueDirEnv     = "INFLUXDB_QUEUE_DIR"
+	queueMaxSizeEnv = "INFLUXDB_QUEUE_MAX_SIZE"
+	queueMaxAgeEnv  = "INFLUXDB_QUEUE_MAX_AGE"
 )
 
-type InfluxDbOptions struct {
-	*options.Options
-	database, org, token, url *string
+// SchemaOptions holds the flags shaping influxdb points, they are shared by
+// every output speaking line protocol.
+type SchemaOptions struct {
+	fs                                     *flag.FlagSet
+	env                                    options.Env
+	measurement, layout, tags, catalogTags *string
+}
+
+func NewSchemaOptions(fs *flag.FlagSet, env options.Env) *SchemaOptions {
+	var measurement, layout, tags, catalogTags string
+	fs.StringVar(&measurement, "influxdb-measurement", defaultMeasurement, "influxdb measurement name, in narrow layout it is used as prefix (default: meteotrentino)")
+	fs.StringVar(&layout, "influxdb-layout", string(LayoutWide), "influxdb points layout: wide, one point per timestamp, or narrow, one measurement per variable (default: wide)")
+	fs.StringVar(&tags, "influxdb-tags", "", "influxdb static tags as comma separated key=value pairs, e.g. site=rovereto,team=ops")
+	fs.StringVar(&catalogTags, "influxdb-catalog-tags", "", "influxdb tags taken from the station catalog as comma separated tag=attribute pairs, e.g. name=name,elevation=elevation")
+
+	return &SchemaOptions{
+		fs,
+		env,
+		&measurement,
+		&layout,
+		&tags,
+		&catalogTags,
+	}
+}
+
+// Apply overrides the schema of every line protocol sink in c, so it must be
+// called after the options creating those sinks.
+func (so *SchemaOptions) Apply(c *config.Config) error {
+	schemas := make([]*config.Schema, 0, 2)
+	if c.Sinks.InfluxDb != nil {
+		schemas = append(schemas, &c.Sinks.InfluxDb.Schema)
+	}
+	if c.Sinks.File != nil {
+		schemas = append(schemas, &c.Sinks.File.Schema)
+	}
+
+	if v, ok := options.Override(so.fs, "influxdb-measurement", so.measurement, so.env, measurementEnv); ok {
+		for _, schema := range schemas {
+			schema.Measurement = v
+		}
+	}
+
+	if v, ok := options.Override(so.fs, "influxdb-layout", so.layout, so.env, layoutEnv); ok {
+		for _, schema := range schemas {
+			schema.Layout = v
+		}
+	}
+
+	if v, ok := options.Override(so.fs, "influxdb-tags", so.tags, so.env, tagsEnv); ok {
+		tags, err := options.ParseKeyValues(v)
+		if err != nil {
+			return fmt.Errorf("error on parsing influxdb tags: %w", err)
+		}
+		for _, schema := range schemas {
+			schema.Tags = tags
+		}
+	}
+
+	if v, ok := options.Override(so.fs, "influxdb-catalog-tags", so.catalogTags, so.env, catalogTagsEnv); ok {
+		catalogTags, err := options.ParseKeyValues(v)
+		if err != nil {
+			return fmt.Errorf("error on parsing influxdb catalog tags: %w", err)
+		}
+		for _, schema := range schemas {
+			schema.CatalogTags = catalogTags
+		}
+	}
+
+	return nil
 }
 
-type InfluxDbConfig struct {
-	*options.Config
-	Database, Org, Token, Url string
+type InfluxDbOptions struct {
+	fs                                   *flag.FlagSet
+	env                                  options.Env
+	database, org, token, tokenFile, url *string
+
+	queueDir, queueMaxSize, queueMaxAge *string
 }
 
-func NewInfluxDbOptions() *InfluxDbOptions {
-	opts := options.NewOptions()
+// NewInfluxDbOptions registers the influxdb flags, the schema ones are
+// registered apart by NewSchemaOptions as other outputs share them.
+func NewInfluxDbOptions(fs *flag.FlagSet, env options.Env) *InfluxDbOptions {
+	var database, org, token, tokenFile, url string
+	fs.StringVar(&database, "influxdb-database", "", "influxdb database")
+	fs.StringVar(&org, "influxdb-org", "", "influxdb organization")
+	fs.StringVar(&token, "influxdb-token", "", "influxdb token, visible in the process list: prefer --influxdb-token-file")
+	fs.StringVar(&tokenFile, "influxdb-token-file", "", "file holding the influxdb token, read again when it changes")
+	fs.StringVar(&url, "influxdb-url", "", "influxdb url")
 
-	var database, org, token, url string
-	flag.StringVar(&database, "influxdb-database", "", "influxdb database")
-	flag.StringVar(&org, "influxdb-org", "", "influxdb organization")
-	flag.StringVar(&token, "influxdb-token", "", "influxdb token")
-	flag.StringVar(&url, "influxdb-url", "", "influxdb url")
+	var queueDir, queueMaxSize, queueMaxAge string
+	fs.StringVar(&queueDir, "influxdb-queue-dir", "", "directory of the write-ahead queue buffering points while influxdb is unreachable, disabled if empty")
+	fs.StringVar(&queueMaxSize, "influxdb-queue-max-size", "268435456", "write-ahead queue size cap in bytes, at least 8MiB, oldest records are dropped first (default: 256MiB)")
+	fs.StringVar(&queueMaxAge, "influxdb-queue-max-age", "168h", "write-ahead queue age cap, older records are dropped (default: 168h)")
 
 	return &InfluxDbOptions{
-		opts,
+		fs,
+		env,
 		&database,
 		&org,
 		&token,
+		&tokenFile,
 		&url,
+		&queueDir,
+		&queueMaxSize,
+		&queueMaxAge,
 	}
 }
 
-func (io *InfluxDbOptions) Read() (*InfluxDbConfig, error) {
-	conf, err := io.Options.Read()
-	if err != nil {
-		return nil, fmt.Errorf("error on parsing influxdb metrics options: %w", err)
+// Apply overrides the influxdb sink of c, creating it when its url is set.
+// Its other settings only apply to a sink enabled this way or by the
+// configuration file.
+func (io *InfluxDbOptions) Apply(c *config.Config) error {
+	if v, ok := options.Override(io.fs, "influxdb-url", io.url, io.env, urlEnv); ok && v != "" {
+		if c.Sinks.InfluxDb == nil {
+			c.Sinks.InfluxDb = &config.InfluxDb{}
+		}
+		c.Sinks.InfluxDb.Url = v
 	}
-	if databaseEnvSet {
-		io.database = &databaseEnv
+
+	sink := c.Sinks.InfluxDb
+	if sink == nil {
+		return nil
+	}
+
+	if v, ok := options.Override(io.fs, "influxdb-database", io.database, io.env, databaseEnv); ok {
+		sink.Database = v
 	}
-	if orgEnvSet {
-		io.org = &orgEnv
+	if v, ok := options.Override(io.fs, "influxdb-org", io.org, io.env, orgEnv); ok {
+		sink.Org = v
 	}
-	if tokenEnvSet {
-		io.token = &tokenEnv
+	if v, ok := options.OverrideSecret(io.fs, "influxdb-token", io.token, io.tokenFile, io.env, tokenEnv); ok {
+		sink.Token = v
 	}
-	if urlEnvSet {
-		io.url = &urlEnv
+
+	queue := func() (*config.Queue, error) {
+		if sink.Queue == nil {
+			// the flag defaults hold for a queue enabled by env vars or flags
+			maxSize, err := strconv.ParseInt(*io.queueMaxSize, 10, 64)
+			if err != nil {
+				return nil, errors.Join(options.ErrWrongParam("influxdb-queue-max-size"), err)
+			}
+
+			maxAge, err := time.ParseDuration(*io.queueMaxAge)
+			if err != nil {
+				return nil, errors.Join(options.ErrWrongParam("influxdb-queue-max-age"), err)
+			}
+
+			sink.Queue = &config.Queue{MaxSize: maxSize, MaxAge: maxAge}
+		}
+		return sink.Queue, nil
+	}
+
+	if v, ok := options.Override(io.fs, "influxdb-queue-dir", io.queueDir, io.env, queueDirEnv); ok && v != "" {
+		q, err := queue()
+		if err != nil {
+			return err
+		}
+		q.Dir = v
+	}
+
+	if v, ok := options.Override(io.fs, "influxdb-queue-max-size", io.queueMaxSize, io.env, queueMaxSizeEnv); ok {
+		maxSize, err := strconv.ParseInt(v, 10, 64)
+		if err != nil {
+			return errors.Join(options.ErrWrongParam("influxdb-queue-max-size"), err)
+		}
+		if sink.Queue != nil {
+			sink.Queue.MaxSize = maxSize
+		}
+	}
+
+	if v, ok := options.Override(io.fs, "influxdb-queue-max-age", io.queueMaxAge, io.env, queueMaxAgeEnv); ok {
+		maxAge, err := time.ParseDuration(v)
+		if err != nil {
+			return errors.Join(options.ErrWrongParam("influxdb-queue-max-age"), err)
+		}
+		if sink.Queue != nil {
+			sink.Queue.MaxAge = maxAge
+		}
 	}
 
-	return &InfluxDbConfig{
-		conf,
-		*io.database,
-		*io.org,
-		*io.token,
-		*io.url,
-	}, nil
+	return nil
 }
@@ -0,0 +1,189 @@
+package influxdb_metrics
+
+import (
+	"fmt"
+	"maps"
+	"slices"
+	"strings"
+	"time"
+
+	influxdb "github.com/InfluxCommunity/influxdb3-go/v2/influxdb3"
+	"github.com/influxdata/line-protocol/v2/lineprotocol"
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+)
+
+type Layout string
+
+const (
+	// LayoutWide writes one point per timestamp carrying every variable as a field.
+	LayoutWide Layout = "wide"
+	// LayoutNarrow writes one measurement per variable with a single `value` field.
+	LayoutNarrow Layout = "narrow"
+
+	defaultMeasurement = "meteotrentino"
+	narrowField        = "value"
+	stationTag         = "station"
+)
+
+type variable struct {
+	field  string
+	series func(api.WeatherStats) []api.WeatherStat
+}
+
+var variables = []variable{
+	{"temperature_celsius", api.WeatherStats.Temperature},
+	{"humidity_percent", api.WeatherStats.Humidity},
+	{"precipitation_mm", api.WeatherStats.Precipitation},
+	{"radiation_watts_per_square_meter", api.WeatherStats.Radiation},
+	{"wind_speed_meters_per_second", api.WindSpeed},
+	{"wind_gust_meters_per_second", api.WindGust},
+	{"wind_direction_degrees", api.WindDirection},
+}
+
+// Schema describes how weather stats are shaped into influxdb points.
+type Schema struct {
+	Measurement string
+	Layout      Layout
+	Tags        map[string]string
+	// CatalogTags maps a tag name to an attribute of the station, see
+	// api.Station.Attribute for the available ones.
+	CatalogTags map[string]string
+}
+
+// NewSchema validates layout, tags and catalog attributes, filling in
+// defaults. The station tag is reserved, it is always set.
+func NewSchema(measurement string, layout Layout, tags, catalogTags map[string]string) (Schema, error) {
+	if measurement == "" {
+		measurement = defaultMeasurement
+	}
+
+	switch layout {
+	case "":
+		layout = LayoutWide
+	case LayoutWide, LayoutNarrow:
+	default:
+		return Schema{}, fmt.Errorf("unknown layout %q", layout)
+	}
+
+	if _, ok := tags[stationTag]; ok {
+		return Schema{}, fmt.Errorf("reserved tag %q", stationTag)
+	}
+	if _, ok := catalogTags[stationTag]; ok {
+		return Schema{}, fmt.Errorf("reserved catalog tag %q", stationTag)
+	}
+
+	for tag, attribute := range catalogTags {
+		_, err := api.Station{}.Attribute(attribute)
+		if err != nil {
+			return Schema{}, fmt.Errorf("error resolving catalog tag %s: %w", tag, err)
+		}
+	}
+
+	return Schema{
+		Measurement: measurement,
+		Layout:      layout,
+		Tags:        tags,
+		CatalogTags: catalogTags,
+	}, nil
+}
+
+// tags resolves static and catalog tags for station.
+func (s Schema) tags(station api.Station) map[string]string {
+	resolved := make(map[string]string, len(s.Tags)+len(s.CatalogTags)+1)
+	maps.Copy(resolved, s.Tags)
+
+	for tag, attribute := range s.CatalogTags {
+		value, _ := station.Attribute(attribute)
+		resolved[tag] = value
+	}
+	resolved[stationTag] = strings.ToUpper(station.Code)
+
+	return resolved
+}
+
+func newPoint(measurement string, tags map[string]string, t time.Time) *influxdb.Point {
+	point := influxdb.NewPointWithMeasurement(measurement).
+		SetTimestamp(t)
+
+	for k, v := range tags {
+		point.SetTag(k, v)
+	}
+
+	return point
+}
+
+// Points builds the influxdb points for latestMetrics according to the
+// schema, sorted by timestamp and measurement so that the output is
+// deterministic.
+func (s Schema) Points(station api.Station, latestMetrics api.WeatherStats) []*influxdb.Point {
+	tags := s.tags(station)
+
+	var points []*influxdb.Point
+	if s.Layout == LayoutNarrow {
+		points = s.narrowPoints(tags, latestMetrics)
+	} else {
+		points = s.widePoints(tags, latestMetrics)
+	}
+
+	slices.SortFunc(points, func(a, b *influxdb.Point) int {
+		if c := a.Values.Timestamp.Compare(b.Values.Timestamp); c != 0 {
+			return c
+		}
+		return strings.Compare(a.Values.MeasurementName, b.Values.MeasurementName)
+	})
+
+	return points
+}
+
+func (s Schema) widePoints(tags map[string]string, latestMetrics api.WeatherStats) []*influxdb.Point {
+	maxNum := 0
+	for _, v := range variables {
+		maxNum = max(maxNum, len(v.series(latestMetrics)))
+	}
+
+	points := make(map[time.Time]*influxdb.Point, maxNum)
+	for _, v := range variables {
+		for _, stat := range v.series(latestMetrics) {
+			point, ok := points[stat.Time()]
+			if !ok {
+				point = newPoint(s.Measurement, tags, stat.Time())
+			}
+
+			point.
+				SetField(v.field, stat.Value())
+
+			points[stat.Time()] = point
+		}
+	}
+
+	return slices.Collect(maps.Values(points))
+}
+
+func (s Schema) narrowPoints(tags map[string]string, latestMetrics api.WeatherStats) []*influxdb.Point {
+	points := make([]*influxdb.Point, 0, len(variables)*len(latestMetrics.Temperature()))
+	for _, v := range variables {
+		measurement := s.Measurement + "_" + v.field
+		for _, stat := range v.series(latestMetrics) {
+			point := newPoint(measurement, tags, stat.Time()).
+				SetField(narrowField, stat.Value())
+
+			points = append(points, point)
+		}
+	}
+
+	return points
+}
+
+// LineProtocol encodes points as newline separated line protocol.
+func LineProtocol(points []*influxdb.Point, precision lineprotocol.Precision) ([]byte, error) {
+	buf := make([]byte, 0, 128*len(points))
+	for _, point := range points {
+		line, err := point.MarshalBinary(precision)
+		if err != nil {
+			return nil, fmt.Errorf("error encoding point: %w", err)
+		}
+		buf = append(buf, line...)
+	}
+
+	return buf, nil
+}
@@ -1,7 +1,39 @@
 package metrics
 
 import (
+	"context"
+
 	"github.com/go-playground/validator/v10"
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
 )
 
 var Validate = validator.New(validator.WithRequiredStructEnabled())
+
+// StationStats carries the weather stats fetched for a station together with
+// the station they belong to.
+type StationStats struct {
+	Station api.Station
+	Stats   api.WeatherStats
+}
+
+// Sink is the destination of fetched weather stats. Write may be called
+// concurrently for different stations.
+type Sink interface {
+	Name() string
+	Write(ctx context.Context, stats StationStats) error
+	Close() error
+}
+
+// StationDeleter is implemented by sinks keeping per station state, e.g.
+// gauges, that must go when a station is removed. Delete is called once the
+// writes of the station are over and before any new one, it may block.
+type StationDeleter interface {
+	Delete(station string)
+}
+
+// FetchObserver is implemented by sinks reporting the upstream health of a
+// station, it is told when fetching the station fails. A successful fetch is
+// followed by a Write.
+type FetchObserver interface {
+	FetchFailed(ctx context.Context, station string, err error)
+}
@@ -0,0 +1,441 @@
+package mqtt_metrics
+
+import (
+	"context"
+	"crypto/tls"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	paho "github.com/eclipse/paho.mqtt.golang"
+	"github.com/go-playground/validator/v10"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+	"wouldgo.me/meteotrentino-exporter/pkg/secret"
+)
+
+const (
+	DefaultClientId        = "meteotrentino-exporter"
+	DefaultTopicPrefix     = "meteotrentino"
+	DefaultDiscoveryPrefix = "homeassistant"
+
+	online  = "online"
+	offline = "offline"
+)
+
+var (
+	_ metrics.Sink           = (*MqttMetrics)(nil)
+	_ metrics.StationDeleter = (*MqttMetrics)(nil)
+	_ metrics.FetchObserver  = (*MqttMetrics)(nil)
+)
+
+// variable is a weather variable published by the sink, with its Home
+// Assistant device class and unit.
+type variable struct {
+	name        string
+	deviceClass string
+	unit        string
+	series      func(api.WeatherStats) []api.WeatherStat
+}
+
+var variables = []variable{
+	{"temperature", "temperature", "°C", api.WeatherStats.Temperature},
+	{"humidity", "humidity", "%", api.WeatherStats.Humidity},
+	{"precipitation", "precipitation", "mm", api.WeatherStats.Precipitation},
+	{"radiation", "irradiance", "W/m²", api.WeatherStats.Radiation},
+}
+
+type MetricsConfig struct {
+	Logger *zap.Logger `validate:"required"`
+
+	// Url is the broker, e.g. tcp://localhost:1883 or ssl://localhost:8883.
+	Url string `validate:"required,url"`
+	// ClientId defaults to DefaultClientId, it must be unique on the broker.
+	ClientId string
+	Username string
+	Password secret.Secret
+	// TLSConfig is used by ssl, tls, mqtts and wss brokers.
+	TLSConfig *tls.Config
+
+	// TopicPrefix defaults to DefaultTopicPrefix.
+	TopicPrefix string
+	Qos         byte `validate:"lte=2"`
+
+	// Discovery publishes the Home Assistant discovery configs below
+	// DiscoveryPrefix, which defaults to DefaultDiscoveryPrefix.
+	Discovery       bool
+	DiscoveryPrefix string
+
+	// Timeout bounds connecting, deleting and closing, writes are bounded
+	// by the write context.
+	Timeout time.Duration
+}
+
+// MqttMetrics publishes the latest observation of every variable of a
+// station as a retained JSON message to <prefix>/<station>/<variable>.
+//
+// Every station has an availability topic, offline while fetching it fails,
+// and the exporter has <prefix>/status, offline through the last will when it
+// goes away. Home Assistant discovery configs use both.
+type MqttMetrics struct {
+	logger *zap.Logger
+	client paho.Client
+
+	prefix          string
+	qos             byte
+	discovery       bool
+	discoveryPrefix string
+	timeout         time.Duration
+
+	// mu guards discovered, the stations whose discovery configs have been
+	// published since the last connection.
+	mu         sync.Mutex
+	discovered map[string]bool
+}
+
+// payload is the state of a variable.
+type payload struct {
+	Value float64   `json:"value"`
+	Time  time.Time `json:"time"`
+	Unit  string    `json:"unit"`
+}
+
+func NewMqttMetrics(opts MetricsConfig) (*MqttMetrics, error) {
+	err := metrics.Validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return nil, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return nil, errors.Join(errs...)
+		}
+
+		return nil, err
+	}
+
+	clientId := DefaultClientId
+	if opts.ClientId != "" {
+		clientId = opts.ClientId
+	}
+
+	prefix := DefaultTopicPrefix
+	if opts.TopicPrefix != "" {
+		prefix = strings.TrimSuffix(opts.TopicPrefix, "/")
+	}
+
+	discoveryPrefix := DefaultDiscoveryPrefix
+	if opts.DiscoveryPrefix != "" {
+		discoveryPrefix = strings.TrimSuffix(opts.DiscoveryPrefix, "/")
+	}
+
+	timeout := 10 * time.Second
+	if opts.Timeout != 0 {
+		timeout = opts.Timeout
+	}
+
+	m := &MqttMetrics{
+		logger:          opts.Logger,
+		prefix:          prefix,
+		qos:             opts.Qos,
+		discovery:       opts.Discovery,
+		discoveryPrefix: discoveryPrefix,
+		timeout:         timeout,
+		discovered:      make(map[string]bool),
+	}
+
+	clientOpts := paho.NewClientOptions().
+		AddBroker(opts.Url).
+		SetClientID(clientId).
+		SetTLSConfig(opts.TLSConfig).
+		SetConnectTimeout(timeout).
+		SetAutoReconnect(true).
+		SetConnectRetry(true).
+		SetOrderMatters(false).
+		SetWill(m.statusTopic(), offline, opts.Qos, true).
+		SetOnConnectHandler(m.onConnect).
+		SetConnectionLostHandler(func(_ paho.Client, err error) {
+			m.logger.Warn("mqtt connection lost", zap.Error(err))
+		})
+
+	if opts.Username != "" || !opts.Password.IsZero() {
+		username, password := opts.Username, opts.Password
+		// the password is read on every connection, following its file
+		clientOpts.SetCredentialsProvider(func() (string, string) {
+			value, err := password.Value()
+			if err != nil {
+				m.logger.Error("error reading mqtt password", zap.Error(err))
+			}
+			return username, value
+		})
+	}
+
+	m.client = paho.NewClient(clientOpts)
+
+	// with ConnectRetry the token completes on the first attempt, further
+	// ones go on in the background
+	token := m.client.Connect()
+	if !token.WaitTimeout(timeout) {
+		m.logger.Warn("mqtt broker not connected yet, retrying in the background", zap.String("url", secret.RedactUrl(opts.Url)))
+	} else if err := token.Error(); err != nil {
+		m.client.Disconnect(0)
+		return nil, fmt.Errorf("error connecting to mqtt broker: %w", err)
+	}
+
+	return m, nil
+}
+
+func (m *MqttMetrics) Name() string {
+	return "mqtt"
+}
+
+// onConnect marks the exporter online and has the discovery configs
+// published again, the broker may have lost them.
+func (m *MqttMetrics) onConnect(client paho.Client) {
+	m.logger.Info("connected to mqtt broker")
+
+	m.mu.Lock()
+	clear(m.discovered)
+	m.mu.Unlock()
+
+	// the handler runs on its own goroutine, waiting does not block paho
+	token := client.Publish(m.statusTopic(), m.qos, true, online)
+	if token.WaitTimeout(m.timeout) && token.Error() != nil {
+		m.logger.Error("error publishing mqtt status", zap.Error(token.Error()))
+	}
+}
+
+func (m *MqttMetrics) statusTopic() string {
+	return m.prefix + "/status"
+}
+
+func (m *MqttMetrics) stationTopic(station string) string {
+	return m.prefix + "/" + station
+}
+
+func (m *MqttMetrics) availabilityTopic(station string) string {
+	return m.stationTopic(station) + "/availability"
+}
+
+func (m *MqttMetrics) discoveryTopic(station, variable string) string {
+	return fmt.Sprintf("%s/sensor/meteotrentino_%s/%s/config", m.discoveryPrefix, strings.ToLower(station), variable)
+}
+
+// message is a retained message to publish.
+type message struct {
+	topic   string
+	payload []byte
+}
+
+// Write publishes the latest observation of every variable of the station
+// and marks it online, preceded by its discovery configs the first time.
+func (m *MqttMetrics) Write(ctx context.Context, stats metrics.StationStats) error {
+	station := strings.ToUpper(stats.Station.Code)
+
+	var messages []message
+	if m.discovery && !m.isDiscovered(station) {
+		configs, err := m.discoveryConfigs(stats.Station)
+		if err != nil {
+			return err
+		}
+		messages = append(messages, configs...)
+	}
+
+	for _, v := range variables {
+		series := v.series(stats.Stats)
+		if len(series) == 0 {
+			continue
+		}
+
+		last := series[len(series)-1]
+		body, err := json.Marshal(payload{
+			Value: last.Value(),
+			Time:  last.Time().UTC(),
+			Unit:  v.unit,
+		})
+		if err != nil {
+			return fmt.Errorf("error encoding %s: %w", v.name, err)
+		}
+
+		messages = append(messages, message{m.stationTopic(station) + "/" + v.name, body})
+	}
+	messages = append(messages, message{m.availabilityTopic(station), []byte(online)})
+
+	err := m.publish(ctx, messages...)
+	if err != nil {
+		return err
+	}
+
+	if m.discovery {
+		m.mu.Lock()
+		m.discovered[station] = true
+		m.mu.Unlock()
+	}
+
+	return nil
+}
+
+// FetchFailed marks the station offline, its sensors become unavailable
+// until the next successful write.
+func (m *MqttMetrics) FetchFailed(ctx context.Context, station string, _ error) {
+	station = strings.ToUpper(station)
+
+	err := m.publish(ctx, message{m.availabilityTopic(station), []byte(offline)})
+	if err != nil {
+		m.logger.Error("error publishing station availability", zap.String("station", station), zap.Error(err))
+	}
+}
+
+func (m *MqttMetrics) isDiscovered(station string) bool {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	return m.discovered[station]
+}
+
+// discoveryConfig is a Home Assistant MQTT discovery config of a sensor.
+type discoveryConfig struct {
+	Name              string         `json:"name"`
+	UniqueId          string         `json:"unique_id"`
+	ObjectId          string         `json:"object_id"`
+	StateTopic        string         `json:"state_topic"`
+	ValueTemplate     string         `json:"value_template"`
+	DeviceClass       string         `json:"device_class"`
+	UnitOfMeasurement string         `json:"unit_of_measurement"`
+	StateClass        string         `json:"state_class"`
+	Availability      []availability `json:"availability"`
+	AvailabilityMode  string         `json:"availability_mode"`
+	Device            device         `json:"device"`
+}
+
+type availability struct {
+	Topic string `json:"topic"`
+}
+
+type device struct {
+	Identifiers  []string `json:"identifiers"`
+	Name         string   `json:"name"`
+	Manufacturer string   `json:"manufacturer"`
+	Model        string   `json:"model"`
+}
+
+func (m *MqttMetrics) discoveryConfigs(station api.Station) ([]message, error) {
+	code := strings.ToUpper(station.Code)
+	id := "meteotrentino_" + strings.ToLower(code)
+
+	name := station.Name
+	if name == "" {
+		name = code
+	}
+
+	messages := make([]message, 0, len(variables))
+	for _, v := range variables {
+		body, err := json.Marshal(discoveryConfig{
+			Name:              v.name,
+			UniqueId:          id + "_" + v.name,
+			ObjectId:          id + "_" + v.name,
+			StateTopic:        m.stationTopic(code) + "/" + v.name,
+			ValueTemplate:     "{{ value_json.value }}",
+			DeviceClass:       v.deviceClass,
+			UnitOfMeasurement: v.unit,
+			StateClass:        "measurement",
+			Availability: []availability{
+				{m.statusTopic()},
+				{m.availabilityTopic(code)},
+			},
+			AvailabilityMode: "all",
+			Device: device{
+				Identifiers:  []string{id},
+				Name:         name,
+				Manufacturer: "Meteotrentino",
+				Model:        code,
+			},
+		})
+		if err != nil {
+			return nil, fmt.Errorf("error encoding %s discovery config: %w", v.name, err)
+		}
+
+		messages = append(messages, message{m.discoveryTopic(code, v.name), body})
+	}
+
+	return messages, nil
+}
+
+// publish publishes the retained messages, waiting for the broker to
+// acknowledge them unless ctx is done first.
+func (m *MqttMetrics) publish(ctx context.Context, messages ...message) error {
+	tokens := make([]paho.Token, 0, len(messages))
+	for _, msg := range messages {
+		tokens = append(tokens, m.client.Publish(msg.topic, m.qos, true, msg.payload))
+	}
+
+	errs := make([]error, 0, len(tokens))
+	for i, token := range tokens {
+		select {
+		case <-token.Done():
+			if err := token.Error(); err != nil {
+				errs = append(errs, fmt.Errorf("error publishing %s: %w", messages[i].topic, err))
+			}
+		case <-ctx.Done():
+			return fmt.Errorf("error publishing %s: %w", messages[i].topic, ctx.Err())
+		}
+	}
+
+	return errors.Join(errs...)
+}
+
+// Delete clears the retained messages of a station no longer exported,
+// removing its sensors from Home Assistant.
+func (m *MqttMetrics) Delete(station string) {
+	station = strings.ToUpper(station)
+
+	m.mu.Lock()
+	delete(m.discovered, station)
+	m.mu.Unlock()
+
+	messages := make([]message, 0, 2*len(variables)+1)
+	for _, v := range variables {
+		messages = append(messages, message{m.stationTopic(station) + "/" + v.name, nil})
+		if m.discovery {
+			messages = append(messages, message{m.discoveryTopic(station, v.name), nil})
+		}
+	}
+	messages = append(messages, message{m.availabilityTopic(station), nil})
+
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	err := m.publish(ctx, messages...)
+	if err != nil {
+		m.logger.Error("error deleting station topics", zap.String("station", station), zap.Error(err))
+		return
+	}
+	m.logger.Info("deleted station topics", zap.String("station", station))
+}
+
+// Close marks the exporter offline and disconnects, the broker does not
+// send the last will on a clean disconnection.
+func (m *MqttMetrics) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+	defer cancel()
+
+	// IsConnected holds while paho reconnects too, publishing would wait
+	// for the whole timeout
+	var err error
+	if m.client.IsConnectionOpen() {
+		err = m.publish(ctx, message{m.statusTopic(), []byte(offline)})
+	}
+
+	m.client.Disconnect(uint(m.timeout.Milliseconds()))
+	return err
+}
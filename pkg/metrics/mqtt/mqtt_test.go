@@ -0,0 +1,426 @@
+package mqtt_metrics_test
+
+import (
+	"context"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+	mqtt_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/mqtt"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics/mqtt/mqtttest"
+	"wouldgo.me/meteotrentino-exporter/pkg/secret"
+)
+
+type stat struct {
+	time  time.Time
+	value float64
+}
+
+func (s stat) Time() time.Time { return s.time }
+func (s stat) Value() float64  { return s.value }
+
+type stats struct {
+	temperature []api.WeatherStat
+	humidity    []api.WeatherStat
+}
+
+func (s stats) Temperature() []api.WeatherStat   { return s.temperature }
+func (s stats) Humidity() []api.WeatherStat      { return s.humidity }
+func (s stats) Precipitation() []api.WeatherStat { return nil }
+func (s stats) Radiation() []api.WeatherStat     { return nil }
+func (s stats) Wind() []api.WindStat             { return nil }
+
+var at = time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+
+func rovereto() metrics.StationStats {
+	return metrics.StationStats{
+		Station: api.Station{Code: "t0147", Name: "Rovereto"},
+		Stats: stats{
+			temperature: []api.WeatherStat{stat{at.Add(-15 * time.Minute), 12.5}, stat{at, 12.9}},
+			humidity:    []api.WeatherStat{stat{at, 71}},
+		},
+	}
+}
+
+func config(broker *mqtttest.Broker) mqtt_metrics.MetricsConfig {
+	return mqtt_metrics.MetricsConfig{
+		Logger:    zap.NewNop(),
+		Url:       broker.URL(),
+		Qos:       1,
+		Discovery: true,
+		Timeout:   5 * time.Second,
+	}
+}
+
+func newMetrics(t *testing.T, broker *mqtttest.Broker) *mqtt_metrics.MqttMetrics {
+	t.Helper()
+
+	m, err := mqtt_metrics.NewMqttMetrics(config(broker))
+	if err != nil {
+		t.Fatalf("NewMqttMetrics() error = %v", err)
+	}
+
+	return m
+}
+
+func newBroker(t *testing.T) *mqtttest.Broker {
+	t.Helper()
+
+	return newBrokerConfig(t, mqtttest.BrokerConfig{})
+}
+
+func newBrokerConfig(t *testing.T, opts mqtttest.BrokerConfig) *mqtttest.Broker {
+	t.Helper()
+
+	broker, err := mqtttest.NewBroker(opts)
+	if err != nil {
+		t.Fatalf("NewBroker() error = %v", err)
+	}
+	t.Cleanup(func() { _ = broker.Close() })
+
+	return broker
+}
+
+// retained waits for topic to hold want, the broker acknowledges a publish
+// before every subscriber, retained messages included, sees it.
+func retained(t *testing.T, broker *mqtttest.Broker, topic, want string) {
+	t.Helper()
+
+	var got []byte
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		var ok bool
+		got, ok = broker.Retained()[topic]
+		if ok && string(got) == want {
+			return
+		}
+	}
+
+	t.Errorf("retained %s = %q, want %q", topic, got, want)
+}
+
+// absent waits for topic to hold no retained message.
+func absent(t *testing.T, broker *mqtttest.Broker, topic string) {
+	t.Helper()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(10 * time.Millisecond) {
+		if _, ok := broker.Retained()[topic]; !ok {
+			return
+		}
+	}
+
+	t.Errorf("retained %s = %q, want none", topic, broker.Retained()[topic])
+}
+
+func TestWrite(t *testing.T) {
+	broker := newBroker(t)
+	m := newMetrics(t, broker)
+	defer func() { _ = m.Close() }()
+
+	err := m.Write(context.Background(), rovereto())
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	retained(t, broker, "meteotrentino/status", "online")
+	retained(t, broker, "meteotrentino/T0147/availability", "online")
+	retained(t, broker, "meteotrentino/T0147/temperature", `{"value":12.9,"time":"2026-10-18T10:00:00Z","unit":"°C"}`)
+	retained(t, broker, "meteotrentino/T0147/humidity", `{"value":71,"time":"2026-10-18T10:00:00Z","unit":"%"}`)
+
+	// variables without observations are not published
+	if _, ok := broker.Retained()["meteotrentino/T0147/radiation"]; ok {
+		t.Errorf("radiation published without observations")
+	}
+}
+
+func TestWriteDiscovery(t *testing.T) {
+	broker := newBroker(t)
+	m := newMetrics(t, broker)
+	defer func() { _ = m.Close() }()
+
+	err := m.Write(context.Background(), rovereto())
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	topic := "homeassistant/sensor/meteotrentino_t0147/temperature/config"
+	retained(t, broker, "meteotrentino/T0147/availability", "online")
+
+	payload, ok := broker.Retained()[topic]
+	if !ok {
+		t.Fatalf("no discovery config on %s", topic)
+	}
+
+	var config struct {
+		Name              string `json:"name"`
+		UniqueId          string `json:"unique_id"`
+		StateTopic        string `json:"state_topic"`
+		ValueTemplate     string `json:"value_template"`
+		DeviceClass       string `json:"device_class"`
+		UnitOfMeasurement string `json:"unit_of_measurement"`
+		Availability      []struct {
+			Topic string `json:"topic"`
+		} `json:"availability"`
+		AvailabilityMode string `json:"availability_mode"`
+		Device           struct {
+			Identifiers []string `json:"identifiers"`
+			Name        string   `json:"name"`
+		} `json:"device"`
+	}
+	err = json.Unmarshal(payload, &config)
+	if err != nil {
+		t.Fatalf("error decoding discovery config %s: %v", payload, err)
+	}
+
+	if config.UniqueId != "meteotrentino_t0147_temperature" ||
+		config.StateTopic != "meteotrentino/T0147/temperature" ||
+		config.ValueTemplate != "{{ value_json.value }}" ||
+		config.DeviceClass != "temperature" ||
+		config.UnitOfMeasurement != "°C" ||
+		config.AvailabilityMode != "all" ||
+		config.Device.Name != "Rovereto" ||
+		len(config.Device.Identifiers) != 1 || config.Device.Identifiers[0] != "meteotrentino_t0147" {
+		t.Errorf("discovery config = %s", payload)
+	}
+
+	if len(config.Availability) != 2 ||
+		config.Availability[0].Topic != "meteotrentino/status" ||
+		config.Availability[1].Topic != "meteotrentino/T0147/availability" {
+		t.Errorf("availability = %+v, want the exporter status and the station availability", config.Availability)
+	}
+
+	// every variable is discovered, observed or not
+	for _, variable := range []string{"humidity", "precipitation", "radiation"} {
+		if _, ok := broker.Retained()["homeassistant/sensor/meteotrentino_t0147/"+variable+"/config"]; !ok {
+			t.Errorf("no discovery config for %s", variable)
+		}
+	}
+}
+
+func TestFetchFailed(t *testing.T) {
+	broker := newBroker(t)
+	m := newMetrics(t, broker)
+	defer func() { _ = m.Close() }()
+	ctx := context.Background()
+
+	err := m.Write(ctx, rovereto())
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	retained(t, broker, "meteotrentino/T0147/availability", "online")
+
+	m.FetchFailed(ctx, "t0147", errors.New("upstream down"))
+	retained(t, broker, "meteotrentino/T0147/availability", "offline")
+	// the last observation stays, marked unavailable
+	retained(t, broker, "meteotrentino/T0147/temperature", `{"value":12.9,"time":"2026-10-18T10:00:00Z","unit":"°C"}`)
+
+	err = m.Write(ctx, rovereto())
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	retained(t, broker, "meteotrentino/T0147/availability", "online")
+}
+
+func TestClose(t *testing.T) {
+	broker := newBroker(t)
+	m := newMetrics(t, broker)
+
+	err := m.Write(context.Background(), rovereto())
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	retained(t, broker, "meteotrentino/status", "online")
+
+	err = m.Close()
+	if err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	retained(t, broker, "meteotrentino/status", "offline")
+}
+
+func TestAuth(t *testing.T) {
+	broker := newBrokerConfig(t, mqtttest.BrokerConfig{Username: "exporter", Password: "s3cret"})
+
+	tests := []struct {
+		name     string
+		password string
+		wantErr  bool
+	}{
+		{"accepted", "s3cret", false},
+		{"refused", "wrong", true},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := config(broker)
+			opts.ClientId = "exporter-" + tt.name
+			opts.Username = "exporter"
+			opts.Password = secret.New(tt.password)
+			// a refused client retries until the timeout
+			opts.Timeout = 500 * time.Millisecond
+
+			m, err := mqtt_metrics.NewMqttMetrics(opts)
+			if err == nil {
+				defer func() { _ = m.Close() }()
+
+				ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+				defer cancel()
+				err = m.Write(ctx, rovereto())
+			}
+			if (err != nil) != tt.wantErr {
+				t.Errorf("error = %v, want error %t", err, tt.wantErr)
+			}
+		})
+	}
+}
+
+// selfSigned returns a certificate for 127.0.0.1 and the file of its PEM.
+func selfSigned(t *testing.T) (tls.Certificate, string) {
+	t.Helper()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatalf("error generating key: %v", err)
+	}
+
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "mqtttest"},
+		IPAddresses:           []net.IP{net.IPv4(127, 0, 0, 1)},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		t.Fatalf("error creating certificate: %v", err)
+	}
+
+	caFile := filepath.Join(t.TempDir(), "ca.pem")
+	err = os.WriteFile(caFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0o600)
+	if err != nil {
+		t.Fatalf("error writing certificate: %v", err)
+	}
+
+	return tls.Certificate{Certificate: [][]byte{der}, PrivateKey: key}, caFile
+}
+
+func TestTLS(t *testing.T) {
+	cert, caFile := selfSigned(t)
+	broker := newBrokerConfig(t, mqtttest.BrokerConfig{
+		TLSConfig: &tls.Config{MinVersion: tls.VersionTLS12, Certificates: []tls.Certificate{cert}},
+	})
+
+	tlsConfig, err := mqtt_metrics.NewTLSConfig(caFile, "", "", false)
+	if err != nil {
+		t.Fatalf("NewTLSConfig() error = %v", err)
+	}
+
+	opts := config(broker)
+	opts.TLSConfig = tlsConfig
+	m, err := mqtt_metrics.NewMqttMetrics(opts)
+	if err != nil {
+		t.Fatalf("NewMqttMetrics() error = %v", err)
+	}
+	defer func() { _ = m.Close() }()
+
+	err = m.Write(context.Background(), rovereto())
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	retained(t, broker, "meteotrentino/T0147/availability", "online")
+}
+
+func TestReconnect(t *testing.T) {
+	broker := newBroker(t)
+	m := newMetrics(t, broker)
+	defer func() { _ = m.Close() }()
+	ctx := context.Background()
+
+	err := m.Write(ctx, rovereto())
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	retained(t, broker, "meteotrentino/status", "online")
+
+	// the broker comes back without the retained messages
+	broker.ClearRetained()
+	broker.Disconnect()
+
+	// the exporter is marked online again on reconnection
+	retained(t, broker, "meteotrentino/status", "online")
+
+	// and the discovery configs are published again with the next write
+	err = m.Write(ctx, rovereto())
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	retained(t, broker, "meteotrentino/T0147/availability", "online")
+	if _, ok := broker.Retained()["homeassistant/sensor/meteotrentino_t0147/temperature/config"]; !ok {
+		t.Errorf("no discovery config after reconnecting")
+	}
+}
+
+func TestDelete(t *testing.T) {
+	broker := newBroker(t)
+	m := newMetrics(t, broker)
+	defer func() { _ = m.Close() }()
+
+	err := m.Write(context.Background(), rovereto())
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	retained(t, broker, "meteotrentino/T0147/availability", "online")
+
+	m.Delete("t0147")
+
+	for _, topic := range []string{
+		"meteotrentino/T0147/availability",
+		"meteotrentino/T0147/temperature",
+		"meteotrentino/T0147/humidity",
+		"homeassistant/sensor/meteotrentino_t0147/temperature/config",
+		"homeassistant/sensor/meteotrentino_t0147/radiation/config",
+	} {
+		absent(t, broker, topic)
+	}
+	// the exporter itself stays online
+	retained(t, broker, "meteotrentino/status", "online")
+}
+
+func TestCloseDisconnected(t *testing.T) {
+	// closed by the test, not by a cleanup
+	broker, err := mqtttest.NewBroker(mqtttest.BrokerConfig{})
+	if err != nil {
+		t.Fatalf("NewBroker() error = %v", err)
+	}
+	m := newMetrics(t, broker)
+
+	err = broker.Close()
+	if err != nil {
+		t.Fatalf("Close() broker error = %v", err)
+	}
+
+	// paho is reconnecting, the offline status cannot be published
+	start := time.Now()
+	_ = m.Close()
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Close() took %s while disconnected", elapsed)
+	}
+}
@@ -0,0 +1,116 @@
+// Package mqtttest provides an in-process MQTT broker standing in for
+// Mosquitto, exposing the retained messages published to it.
+package mqtttest
+
+import (
+	"crypto/tls"
+	"fmt"
+	"slices"
+	"strings"
+
+	mqtt "github.com/mochi-mqtt/server/v2"
+	"github.com/mochi-mqtt/server/v2/hooks/auth"
+	"github.com/mochi-mqtt/server/v2/listeners"
+	"github.com/mochi-mqtt/server/v2/packets"
+)
+
+// BrokerConfig configures a Broker. Username and Password, when set, are the
+// only credentials accepted. TLSConfig makes the broker listen with TLS.
+type BrokerConfig struct {
+	Username  string
+	Password  string
+	TLSConfig *tls.Config
+}
+
+// Broker is an MQTT broker listening on a random local port.
+type Broker struct {
+	server   *mqtt.Server
+	listener *listeners.TCP
+	scheme   string
+}
+
+func NewBroker(opts BrokerConfig) (*Broker, error) {
+	server := mqtt.New(nil)
+
+	var err error
+	if opts.Username != "" {
+		err = server.AddHook(new(auth.Hook), &auth.Options{
+			Ledger: &auth.Ledger{
+				Auth: auth.AuthRules{
+					{Username: auth.RString(opts.Username), Password: auth.RString(opts.Password), Allow: true},
+				},
+			},
+		})
+	} else {
+		err = server.AddHook(new(auth.AllowHook), nil)
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error adding auth hook: %w", err)
+	}
+
+	scheme := "tcp"
+	if opts.TLSConfig != nil {
+		scheme = "ssl"
+	}
+
+	listener := listeners.NewTCP(listeners.Config{
+		ID:        "mqtttest",
+		Address:   "127.0.0.1:0",
+		TLSConfig: opts.TLSConfig,
+	})
+	err = server.AddListener(listener)
+	if err != nil {
+		return nil, fmt.Errorf("error adding listener: %w", err)
+	}
+
+	err = server.Serve()
+	if err != nil {
+		return nil, fmt.Errorf("error serving: %w", err)
+	}
+
+	return &Broker{
+		server:   server,
+		listener: listener,
+		scheme:   scheme,
+	}, nil
+}
+
+// URL is the broker url, e.g. tcp://127.0.0.1:41883.
+func (b *Broker) URL() string {
+	return b.scheme + "://" + b.listener.Address()
+}
+
+// Retained returns the retained message of every topic, $SYS ones aside.
+func (b *Broker) Retained() map[string][]byte {
+	retained := make(map[string][]byte)
+	for _, pk := range b.server.Topics.Retained.GetAll() {
+		if !strings.HasPrefix(pk.TopicName, "$") {
+			retained[pk.TopicName] = slices.Clone(pk.Payload)
+		}
+	}
+
+	return retained
+}
+
+// ClearRetained drops every retained message, standing in for a broker
+// restarted without persistence.
+func (b *Broker) ClearRetained() {
+	for _, pk := range b.server.Topics.Retained.GetAll() {
+		pk.Payload = nil
+		b.server.Topics.RetainMessage(pk)
+	}
+}
+
+// Disconnect drops the connected clients without closing the broker, e.g. to
+// exercise reconnections and last wills.
+func (b *Broker) Disconnect() {
+	for _, cl := range b.server.Clients.GetAll() {
+		if !cl.Net.Inline {
+			b.server.DisconnectClient(cl, packets.ErrAdministrativeAction)
+		}
+	}
+}
+
+func (b *Broker) Close() error {
+	return b.server.Close()
+}
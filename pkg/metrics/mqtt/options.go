@@ -0,0 +1,137 @@
+package mqtt_metrics
+
+import (
+	"errors"
+	"flag"
+	"strconv"
+
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	"wouldgo.me/meteotrentino-exporter/pkg/options"
+)
+
+const (
+	urlEnv                = "MQTT_URL"
+	clientIdEnv           = "MQTT_CLIENT_ID"
+	usernameEnv           = "MQTT_USERNAME"
+	passwordEnv           = "MQTT_PASSWORD"
+	caFileEnv             = "MQTT_CA_FILE"
+	certFileEnv           = "MQTT_CERT_FILE"
+	keyFileEnv            = "MQTT_KEY_FILE"
+	insecureSkipVerifyEnv = "MQTT_INSECURE_SKIP_VERIFY"
+	topicPrefixEnv        = "MQTT_TOPIC_PREFIX"
+	qosEnv                = "MQTT_QOS"
+	discoveryEnv          = "MQTT_DISCOVERY"
+	discoveryPrefixEnv    = "MQTT_DISCOVERY_PREFIX"
+)
+
+type MqttOptions struct {
+	fs                                              *flag.FlagSet
+	env                                             options.Env
+	url, clientId, username, password, passwordFile *string
+	caFile, certFile, keyFile, insecureSkipVerify   *string
+	topicPrefix, qos, discovery, discoveryPrefix    *string
+}
+
+func NewMqttOptions(fs *flag.FlagSet, env options.Env) *MqttOptions {
+	var url, clientId, username, password, passwordFile string
+	var caFile, certFile, keyFile, insecureSkipVerify string
+	var topicPrefix, qos, discovery, discoveryPrefix string
+	fs.StringVar(&url, "mqtt-url", "", "mqtt broker the observations are published to, e.g. tcp://localhost:1883 or ssl://localhost:8883, disabled if empty")
+	fs.StringVar(&clientId, "mqtt-client-id", DefaultClientId, "mqtt client id, unique on the broker (default: "+DefaultClientId+")")
+	fs.StringVar(&username, "mqtt-username", "", "mqtt username")
+	fs.StringVar(&password, "mqtt-password", "", "mqtt password, visible in the process list: prefer --mqtt-password-file")
+	fs.StringVar(&passwordFile, "mqtt-password-file", "", "file holding the mqtt password, read again on every connection")
+	fs.StringVar(&caFile, "mqtt-ca-file", "", "PEM certificates trusted besides the system ones for the mqtt broker")
+	fs.StringVar(&certFile, "mqtt-cert-file", "", "PEM client certificate presented to the mqtt broker, with --mqtt-key-file")
+	fs.StringVar(&keyFile, "mqtt-key-file", "", "PEM key of the mqtt client certificate")
+	fs.StringVar(&insecureSkipVerify, "mqtt-insecure-skip-verify", "false", "skip the verification of the mqtt broker certificate")
+	fs.StringVar(&topicPrefix, "mqtt-topic-prefix", DefaultTopicPrefix, "mqtt topic every station is published below (default: "+DefaultTopicPrefix+")")
+	fs.StringVar(&qos, "mqtt-qos", "0", "mqtt quality of service, 0, 1 or 2 (default: 0)")
+	fs.StringVar(&discovery, "mqtt-discovery", "false", "publish the Home Assistant mqtt discovery configs of the stations")
+	fs.StringVar(&discoveryPrefix, "mqtt-discovery-prefix", DefaultDiscoveryPrefix, "Home Assistant mqtt discovery prefix (default: "+DefaultDiscoveryPrefix+")")
+
+	return &MqttOptions{
+		fs,
+		env,
+		&url,
+		&clientId,
+		&username,
+		&password,
+		&passwordFile,
+		&caFile,
+		&certFile,
+		&keyFile,
+		&insecureSkipVerify,
+		&topicPrefix,
+		&qos,
+		&discovery,
+		&discoveryPrefix,
+	}
+}
+
+// Apply overrides the mqtt sink of c, creating it when its url is set. Its
+// other settings only apply to a sink enabled this way or by the
+// configuration file.
+func (mo *MqttOptions) Apply(c *config.Config) error {
+	if v, ok := options.Override(mo.fs, "mqtt-url", mo.url, mo.env, urlEnv); ok && v != "" {
+		if c.Sinks.Mqtt == nil {
+			c.Sinks.Mqtt = &config.Mqtt{}
+		}
+		c.Sinks.Mqtt.Url = v
+	}
+
+	sink := c.Sinks.Mqtt
+	if sink == nil {
+		return nil
+	}
+
+	if v, ok := options.Override(mo.fs, "mqtt-client-id", mo.clientId, mo.env, clientIdEnv); ok {
+		sink.ClientId = v
+	}
+	if v, ok := options.Override(mo.fs, "mqtt-username", mo.username, mo.env, usernameEnv); ok {
+		sink.Username = v
+	}
+	if v, ok := options.OverrideSecret(mo.fs, "mqtt-password", mo.password, mo.passwordFile, mo.env, passwordEnv); ok {
+		sink.Password = v
+	}
+
+	if v, ok := options.Override(mo.fs, "mqtt-ca-file", mo.caFile, mo.env, caFileEnv); ok {
+		sink.CaFile = v
+	}
+	if v, ok := options.Override(mo.fs, "mqtt-cert-file", mo.certFile, mo.env, certFileEnv); ok {
+		sink.CertFile = v
+	}
+	if v, ok := options.Override(mo.fs, "mqtt-key-file", mo.keyFile, mo.env, keyFileEnv); ok {
+		sink.KeyFile = v
+	}
+	if v, ok := options.Override(mo.fs, "mqtt-insecure-skip-verify", mo.insecureSkipVerify, mo.env, insecureSkipVerifyEnv); ok {
+		insecure, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.Join(options.ErrWrongParam("mqtt-insecure-skip-verify"), err)
+		}
+		sink.InsecureSkipVerify = insecure
+	}
+
+	if v, ok := options.Override(mo.fs, "mqtt-topic-prefix", mo.topicPrefix, mo.env, topicPrefixEnv); ok {
+		sink.TopicPrefix = v
+	}
+	if v, ok := options.Override(mo.fs, "mqtt-qos", mo.qos, mo.env, qosEnv); ok {
+		qos, err := strconv.ParseUint(v, 10, 8)
+		if err != nil {
+			return errors.Join(options.ErrWrongParam("mqtt-qos"), err)
+		}
+		sink.Qos = byte(qos)
+	}
+	if v, ok := options.Override(mo.fs, "mqtt-discovery", mo.discovery, mo.env, discoveryEnv); ok {
+		discovery, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.Join(options.ErrWrongParam("mqtt-discovery"), err)
+		}
+		sink.Discovery = discovery
+	}
+	if v, ok := options.Override(mo.fs, "mqtt-discovery-prefix", mo.discoveryPrefix, mo.env, discoveryPrefixEnv); ok {
+		sink.DiscoveryPrefix = v
+	}
+
+	return nil
+}
@@ -0,0 +1,51 @@
+package mqtt_metrics
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"fmt"
+	"os"
+)
+
+var ErrNoCertificates = errors.New("no certificates found")
+
+// NewTLSConfig builds the TLS configuration of the broker connection, trusting
+// the PEM certificates of caFile besides the system ones and presenting the
+// client certificate of certFile and keyFile. It is nil when nothing is set.
+func NewTLSConfig(caFile, certFile, keyFile string, insecureSkipVerify bool) (*tls.Config, error) {
+	if caFile == "" && certFile == "" && !insecureSkipVerify {
+		return nil, nil
+	}
+
+	conf := &tls.Config{
+		MinVersion:         tls.VersionTLS12,
+		InsecureSkipVerify: insecureSkipVerify,
+	}
+
+	if caFile != "" {
+		pem, err := os.ReadFile(caFile)
+		if err != nil {
+			return nil, fmt.Errorf("error reading ca file: %w", err)
+		}
+
+		pool, err := x509.SystemCertPool()
+		if err != nil {
+			pool = x509.NewCertPool()
+		}
+		if !pool.AppendCertsFromPEM(pem) {
+			return nil, fmt.Errorf("error reading ca file %s: %w", caFile, ErrNoCertificates)
+		}
+		conf.RootCAs = pool
+	}
+
+	if certFile != "" {
+		cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+		if err != nil {
+			return nil, fmt.Errorf("error loading client certificate: %w", err)
+		}
+		conf.Certificates = []tls.Certificate{cert}
+	}
+
+	return conf, nil
+}
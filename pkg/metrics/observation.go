@@ -0,0 +1,116 @@
+package metrics
+
+import (
+	"time"
+	_ "time/tzdata"
+
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+)
+
+// MaxAge is how older than the observation a variable may be to still be
+// part of it.
+const MaxAge = time.Hour
+
+// Location is the local time of the stations, daily totals reset at its
+// midnight.
+var Location = func() *time.Location {
+	l, err := time.LoadLocation("Europe/Rome")
+	if err != nil {
+		panic(err)
+	}
+	return l
+}()
+
+// Observation is the latest observation of a station, in metric units as
+// fetched, for the sinks sending one reading at a time. Missing variables
+// are nil.
+type Observation struct {
+	Time time.Time
+
+	// Temperature is in celsius, Humidity in percent and Radiation in W/m².
+	Temperature *float64
+	Humidity    *float64
+	Radiation   *float64
+
+	// WindDirection is in degrees, WindSpeed and WindGust in m/s.
+	WindDirection *float64
+	WindSpeed     *float64
+	WindGust      *float64
+
+	// RainHour is the precipitation of the last hour, RainDay the one since
+	// local midnight, both in mm.
+	RainHour *float64
+	RainDay  *float64
+}
+
+// NewObservation builds the observation of the latest time found in stats,
+// ok is false when there is none.
+func NewObservation(stats api.WeatherStats) (obs Observation, ok bool) {
+	temperature := stats.Temperature()
+	humidity := stats.Humidity()
+	precipitation := stats.Precipitation()
+	radiation := stats.Radiation()
+	wind := stats.Wind()
+
+	for _, series := range [][]api.WeatherStat{temperature, humidity, precipitation, radiation} {
+		if len(series) > 0 && series[len(series)-1].Time().After(obs.Time) {
+			obs.Time = series[len(series)-1].Time()
+		}
+	}
+	if len(wind) > 0 && wind[len(wind)-1].Time().After(obs.Time) {
+		obs.Time = wind[len(wind)-1].Time()
+	}
+	if obs.Time.IsZero() {
+		return obs, false
+	}
+
+	obs.Temperature = latest(obs.Time, temperature)
+	obs.Humidity = latest(obs.Time, humidity)
+	obs.Radiation = latest(obs.Time, radiation)
+
+	if len(wind) > 0 {
+		last := wind[len(wind)-1]
+		if obs.Time.Sub(last.Time()) <= MaxAge {
+			direction, speed, gust := last.Direction(), last.Speed(), last.Gust()
+			obs.WindDirection, obs.WindSpeed, obs.WindGust = &direction, &speed, &gust
+		}
+	}
+
+	if latest(obs.Time, precipitation) != nil {
+		midnight := obs.Time.In(Location)
+		midnight = time.Date(midnight.Year(), midnight.Month(), midnight.Day(), 0, 0, 0, 0, Location)
+
+		obs.RainHour = sum(precipitation, obs.Time.Add(-time.Hour), obs.Time)
+		// the first interval of the day ends after midnight
+		obs.RainDay = sum(precipitation, midnight, obs.Time)
+	}
+
+	return obs, true
+}
+
+// latest is the last value of series, nil when older than MaxAge before at.
+func latest(at time.Time, series []api.WeatherStat) *float64 {
+	if len(series) == 0 {
+		return nil
+	}
+
+	last := series[len(series)-1]
+	if at.Sub(last.Time()) > MaxAge {
+		return nil
+	}
+
+	value := last.Value()
+	return &value
+}
+
+// sum adds the values of series in (from, to].
+func sum(series []api.WeatherStat, from, to time.Time) *float64 {
+	var total float64
+	for _, stat := range series {
+		if stat.Time().After(from) && !stat.Time().After(to) {
+			total += stat.Value()
+		}
+	}
+
+	return &total
+}
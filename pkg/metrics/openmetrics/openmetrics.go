@@ -0,0 +1,235 @@
+package openmetrics_metrics
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+)
+
+const (
+	// Stdout is the dir selecting the standard output, without splitting.
+	Stdout = "-"
+
+	DefaultBlockDuration = 2 * time.Hour
+
+	filePrefix = "meteotrentino-"
+	fileLayout = "20060102T150405Z"
+)
+
+var _ metrics.Sink = (*OpenMetrics)(nil)
+
+// family is a metric family of the prometheus sink.
+type family struct {
+	name, help string
+	series     func(api.WeatherStats) []api.WeatherStat
+}
+
+var families = []family{
+	{"humidity_percent", "Current relative humidity in percent", api.WeatherStats.Humidity},
+	{"precipitation_mm", "Current precipitation in millimeters", api.WeatherStats.Precipitation},
+	{"radiation_watts_per_square_meter", "Current radiation in watts per square meter", api.WeatherStats.Radiation},
+	{"temperature_celsius", "Current temperature in celsius", api.WeatherStats.Temperature},
+}
+
+type MetricsConfig struct {
+	Logger *zap.Logger `validate:"required"`
+
+	// Dir receives a file per block, or is Stdout.
+	Dir string `validate:"required"`
+	// BlockDuration is the span of every file, aligned to it, as promtool
+	// creates a block per file at most.
+	BlockDuration time.Duration `validate:"gte=0"`
+	// From and To bound the observations kept, when set.
+	From, To time.Time
+}
+
+// OpenMetrics collects the observations of every write and, on Close, writes
+// them as OpenMetrics text with explicit timestamps, for promtool tsdb
+// create-blocks-from openmetrics. Metric names are the ones of the prometheus
+// sink.
+type OpenMetrics struct {
+	logger   *zap.Logger
+	dir      string
+	block    time.Duration
+	from, to time.Time
+
+	mu sync.Mutex
+	// samples holds the observations by family, station and time
+	samples map[string]map[string]map[time.Time]float64
+}
+
+func NewOpenMetrics(opts MetricsConfig) (*OpenMetrics, error) {
+	err := metrics.Validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return nil, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return nil, errors.Join(errs...)
+		}
+
+		return nil, err
+	}
+
+	block := DefaultBlockDuration
+	if opts.BlockDuration != 0 {
+		block = opts.BlockDuration
+	}
+
+	samples := make(map[string]map[string]map[time.Time]float64, len(families))
+	for _, f := range families {
+		samples[f.name] = make(map[string]map[time.Time]float64)
+	}
+
+	return &OpenMetrics{
+		logger:  opts.Logger,
+		dir:     opts.Dir,
+		block:   block,
+		from:    opts.From,
+		to:      opts.To,
+		samples: samples,
+	}, nil
+}
+
+func (m *OpenMetrics) Name() string {
+	return "openmetrics"
+}
+
+// Write collects the observations of the station within the range.
+func (m *OpenMetrics) Write(ctx context.Context, stats metrics.StationStats) error {
+	station := strings.ToUpper(stats.Station.Code)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, f := range families {
+		observations := m.samples[f.name][station]
+		if observations == nil {
+			observations = make(map[time.Time]float64)
+			m.samples[f.name][station] = observations
+		}
+
+		for _, stat := range f.series(stats.Stats) {
+			t := stat.Time().UTC()
+			if (!m.from.IsZero() && t.Before(m.from)) || (!m.to.IsZero() && !t.Before(m.to)) {
+				continue
+			}
+			observations[t] = stat.Value()
+		}
+	}
+
+	return nil
+}
+
+// blocks lists the start of every block holding observations.
+func (m *OpenMetrics) blocks() []time.Time {
+	seen := make(map[time.Time]bool)
+	for _, stations := range m.samples {
+		for _, observations := range stations {
+			for t := range observations {
+				seen[t.Truncate(m.block)] = true
+			}
+		}
+	}
+
+	blocks := make([]time.Time, 0, len(seen))
+	for start := range seen {
+		blocks = append(blocks, start)
+	}
+	slices.SortFunc(blocks, time.Time.Compare)
+	return blocks
+}
+
+// encode writes the observations from start to end, excluded, terminated by
+// the # EOF line.
+func (m *OpenMetrics) encode(w io.Writer, start, end time.Time) error {
+	bw := bufio.NewWriter(w)
+	for _, f := range families {
+		stations := m.samples[f.name]
+
+		_, _ = fmt.Fprintf(bw, "# HELP %s %s\n# TYPE %s gauge\n", f.name, f.help, f.name)
+		for _, station := range slices.Sorted(maps.Keys(stations)) {
+			times := make([]time.Time, 0, len(stations[station]))
+			for t := range stations[station] {
+				if (start.IsZero() || !t.Before(start)) && (end.IsZero() || t.Before(end)) {
+					times = append(times, t)
+				}
+			}
+			slices.SortFunc(times, time.Time.Compare)
+
+			for _, t := range times {
+				_, _ = fmt.Fprintf(bw, "%s{station=%q} %s %s\n", f.name, station,
+					strconv.FormatFloat(stations[station][t], 'g', -1, 64),
+					strconv.FormatFloat(float64(t.UnixMilli())/1000, 'f', -1, 64))
+			}
+		}
+	}
+
+	_, _ = io.WriteString(bw, "# EOF\n")
+	return bw.Flush()
+}
+
+// Close writes the observations collected, a file per block in the output
+// directory, or all of them to the standard output.
+func (m *OpenMetrics) Close() error {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	if m.dir == Stdout {
+		return m.encode(os.Stdout, time.Time{}, time.Time{})
+	}
+
+	err := os.MkdirAll(m.dir, 0o755)
+	if err != nil {
+		return fmt.Errorf("error creating output directory: %w", err)
+	}
+
+	for _, start := range m.blocks() {
+		path := filepath.Join(m.dir, filePrefix+start.Format(fileLayout)+".om")
+		m.logger.Info("writing block", zap.String("path", path), zap.Time("start", start))
+
+		err := m.writeFile(path, start, start.Add(m.block))
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (m *OpenMetrics) writeFile(path string, start, end time.Time) error {
+	f, err := os.Create(path)
+	if err != nil {
+		return fmt.Errorf("error creating block file: %w", err)
+	}
+
+	err = m.encode(f, start, end)
+	if err != nil {
+		_ = f.Close()
+		return fmt.Errorf("error writing block file: %w", err)
+	}
+
+	return f.Close()
+}
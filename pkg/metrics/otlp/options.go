@@ -0,0 +1,61 @@
+package otlp_metrics
+
+import (
+	"flag"
+
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	"wouldgo.me/meteotrentino-exporter/pkg/options"
+)
+
+const (
+	endpointEnv    = "OTLP_ENDPOINT"
+	protocolEnv    = "OTLP_PROTOCOL"
+	temporalityEnv = "OTLP_TEMPORALITY"
+)
+
+type OtlpOptions struct {
+	fs                              *flag.FlagSet
+	env                             options.Env
+	endpoint, protocol, temporality *string
+}
+
+func NewOtlpOptions(fs *flag.FlagSet, env options.Env) *OtlpOptions {
+	var endpoint, protocol, temporality string
+	fs.StringVar(&endpoint, "otlp-endpoint", "", "OpenTelemetry collector url receiving the observations as metrics, e.g. http://localhost:4317, disabled if empty")
+	fs.StringVar(&protocol, "otlp-protocol", string(ProtocolGrpc), "OTLP protocol: grpc or http (default: grpc)")
+	fs.StringVar(&temporality, "otlp-temporality", string(TemporalityCumulative), "precipitation temporality: cumulative or delta (default: cumulative)")
+
+	return &OtlpOptions{
+		fs,
+		env,
+		&endpoint,
+		&protocol,
+		&temporality,
+	}
+}
+
+// Apply overrides the otlp sink of c, creating it when its endpoint is set.
+// Its other settings only apply to a sink enabled this way or by the
+// configuration file.
+func (oo *OtlpOptions) Apply(c *config.Config) error {
+	if v, ok := options.Override(oo.fs, "otlp-endpoint", oo.endpoint, oo.env, endpointEnv); ok && v != "" {
+		if c.Sinks.Otlp == nil {
+			c.Sinks.Otlp = &config.Otlp{}
+		}
+		c.Sinks.Otlp.Endpoint = v
+	}
+
+	sink := c.Sinks.Otlp
+	if sink == nil {
+		return nil
+	}
+
+	if v, ok := options.Override(oo.fs, "otlp-protocol", oo.protocol, oo.env, protocolEnv); ok {
+		sink.Protocol = v
+	}
+	if v, ok := options.Override(oo.fs, "otlp-temporality", oo.temporality, oo.env, temporalityEnv); ok {
+		sink.Temporality = v
+	}
+
+	return nil
+}
@@ -0,0 +1,294 @@
+package otlp_metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetricgrpc"
+	"go.opentelemetry.io/otel/exporters/otlp/otlpmetric/otlpmetrichttp"
+	"go.opentelemetry.io/otel/sdk/instrumentation"
+	sdkmetric "go.opentelemetry.io/otel/sdk/metric"
+	"go.opentelemetry.io/otel/sdk/metric/metricdata"
+	"go.opentelemetry.io/otel/sdk/resource"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+	"wouldgo.me/meteotrentino-exporter/pkg/tracing"
+)
+
+type Protocol string
+
+const (
+	ProtocolGrpc Protocol = "grpc"
+	ProtocolHttp Protocol = "http"
+)
+
+type Temporality string
+
+const (
+	TemporalityCumulative Temporality = "cumulative"
+	TemporalityDelta      Temporality = "delta"
+)
+
+const (
+	serviceName = "meteotrentino-exporter"
+	scopeName   = "wouldgo.me/meteotrentino-exporter/pkg/metrics/otlp"
+)
+
+var (
+	_ metrics.Sink           = (*OtlpMetrics)(nil)
+	_ metrics.StationDeleter = (*OtlpMetrics)(nil)
+)
+
+type MetricsConfig struct {
+	Logger *zap.Logger `validate:"required"`
+
+	// Endpoint is the collector url, e.g. http://localhost:4317 for grpc or
+	// http://localhost:4318 for http, plain http disables TLS.
+	Endpoint    string      `validate:"required,url"`
+	Protocol    Protocol    `validate:"required,oneof=grpc http"`
+	Temporality Temporality `validate:"required,oneof=cumulative delta"`
+}
+
+// OtlpMetrics pushes the observations to an OpenTelemetry collector, each
+// with its own timestamp. Only the observations newer than the last pushed
+// ones are sent, the first observation of a station is the baseline of its
+// precipitation sum and is not pushed.
+type OtlpMetrics struct {
+	logger      *zap.Logger
+	exporter    sdkmetric.Exporter
+	temporality metricdata.Temporality
+
+	mu       sync.Mutex
+	stations map[string]stationState
+}
+
+// stationState tracks what was pushed for a station.
+type stationState struct {
+	// last is the time of the last observation pushed, per variable
+	last map[string]time.Time
+	// start and total are the start time and the running sum of the
+	// cumulative precipitation
+	start time.Time
+	total float64
+}
+
+func NewOtlpMetrics(ctx context.Context, opts MetricsConfig) (*OtlpMetrics, error) {
+	err := metrics.Validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return nil, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return nil, errors.Join(errs...)
+		}
+
+		return nil, err
+	}
+
+	var exporter sdkmetric.Exporter
+	switch opts.Protocol {
+	case ProtocolGrpc:
+		exporter, err = otlpmetricgrpc.New(ctx, otlpmetricgrpc.WithEndpointURL(opts.Endpoint))
+	case ProtocolHttp:
+		exporter, err = otlpmetrichttp.New(ctx, otlpmetrichttp.WithEndpointURL(opts.Endpoint))
+	}
+	if err != nil {
+		return nil, fmt.Errorf("error creating otlp exporter: %w", err)
+	}
+
+	temporality := metricdata.CumulativeTemporality
+	if opts.Temporality == TemporalityDelta {
+		temporality = metricdata.DeltaTemporality
+	}
+
+	return &OtlpMetrics{
+		logger:      opts.Logger,
+		exporter:    exporter,
+		temporality: temporality,
+		stations:    make(map[string]stationState),
+	}, nil
+}
+
+func (m *OtlpMetrics) Name() string {
+	return "otlp"
+}
+
+// fresh returns the observations of series after last.
+func fresh(series []api.WeatherStat, last time.Time) []api.WeatherStat {
+	for i, stat := range series {
+		if stat.Time().After(last) {
+			return series[i:]
+		}
+	}
+
+	return nil
+}
+
+func gauge(name, description, unit string, series []api.WeatherStat) metricdata.Metrics {
+	points := make([]metricdata.DataPoint[float64], 0, len(series))
+	for _, stat := range series {
+		points = append(points, metricdata.DataPoint[float64]{
+			Time:  stat.Time(),
+			Value: stat.Value(),
+		})
+	}
+
+	return metricdata.Metrics{
+		Name:        name,
+		Description: description,
+		Unit:        unit,
+		Data:        metricdata.Gauge[float64]{DataPoints: points},
+	}
+}
+
+// precipitation sums the fresh observations of series on state. A delta
+// point spans from the observation before it, a cumulative one from the
+// baseline observation.
+func (m *OtlpMetrics) precipitation(series []api.WeatherStat, state *stationState) (metricdata.Metrics, bool) {
+	last, seen := state.last["precipitation"]
+	if !seen {
+		if len(series) == 0 {
+			return metricdata.Metrics{}, false
+		}
+
+		last = series[0].Time()
+		state.start, state.total = last, 0
+		state.last["precipitation"] = last
+	}
+
+	series = fresh(series, last)
+	if len(series) == 0 {
+		return metricdata.Metrics{}, false
+	}
+
+	points := make([]metricdata.DataPoint[float64], 0, len(series))
+	for _, stat := range series {
+		point := metricdata.DataPoint[float64]{
+			StartTime: last,
+			Time:      stat.Time(),
+			Value:     stat.Value(),
+		}
+
+		if m.temporality == metricdata.CumulativeTemporality {
+			state.total += stat.Value()
+			point.StartTime, point.Value = state.start, state.total
+		}
+
+		points = append(points, point)
+		last = stat.Time()
+	}
+	state.last["precipitation"] = last
+
+	return metricdata.Metrics{
+		Name:        "weather.precipitation",
+		Description: "Precipitation",
+		Unit:        "mm",
+		Data: metricdata.Sum[float64]{
+			DataPoints:  points,
+			Temporality: m.temporality,
+			IsMonotonic: true,
+		},
+	}, true
+}
+
+func resourceOf(station api.Station) *resource.Resource {
+	attributes := []attribute.KeyValue{
+		attribute.String("service.name", serviceName),
+		tracing.StationKey.String(strings.ToUpper(station.Code)),
+	}
+	if station.Name != "" {
+		attributes = append(attributes, attribute.String("meteotrentino.station.name", station.Name))
+	}
+
+	return resource.NewSchemaless(attributes...)
+}
+
+// Write pushes the observations of the station newer than the last pushed,
+// the station is the resource of the metrics.
+func (m *OtlpMetrics) Write(ctx context.Context, stats metrics.StationStats) error {
+	station := strings.ToUpper(stats.Station.Code)
+
+	// the state moves on only once the collector accepts the metrics
+	m.mu.Lock()
+	state := m.stations[station]
+	m.mu.Unlock()
+	state.last = maps.Clone(state.last)
+	if state.last == nil {
+		state.last = make(map[string]time.Time)
+	}
+
+	data := make([]metricdata.Metrics, 0, 7)
+	for _, g := range []struct {
+		variable, name, description, unit string
+		series                            []api.WeatherStat
+	}{
+		{"temperature", "weather.temperature", "Air temperature", "Cel", stats.Stats.Temperature()},
+		{"humidity", "weather.humidity", "Relative humidity", "%", stats.Stats.Humidity()},
+		{"radiation", "weather.radiation", "Global radiation", "W/m2", stats.Stats.Radiation()},
+		{"wind_speed", "weather.wind.speed", "Wind speed", "m/s", api.WindSpeed(stats.Stats)},
+		{"wind_gust", "weather.wind.gust", "Wind gust", "m/s", api.WindGust(stats.Stats)},
+		{"wind_direction", "weather.wind.direction", "Wind direction", "deg", api.WindDirection(stats.Stats)},
+	} {
+		series := fresh(g.series, state.last[g.variable])
+		if len(series) == 0 {
+			continue
+		}
+
+		data = append(data, gauge(g.name, g.description, g.unit, series))
+		state.last[g.variable] = series[len(series)-1].Time()
+	}
+
+	if precipitation, ok := m.precipitation(stats.Stats.Precipitation(), &state); ok {
+		data = append(data, precipitation)
+	}
+
+	if len(data) == 0 {
+		m.logger.Debug("no new observations", zap.String("station", station))
+	} else {
+		err := m.exporter.Export(ctx, &metricdata.ResourceMetrics{
+			Resource: resourceOf(stats.Station),
+			ScopeMetrics: []metricdata.ScopeMetrics{{
+				Scope:   instrumentation.Scope{Name: scopeName},
+				Metrics: data,
+			}},
+		})
+		if err != nil {
+			return fmt.Errorf("error exporting otlp metrics: %w", err)
+		}
+	}
+
+	m.mu.Lock()
+	m.stations[station] = state
+	m.mu.Unlock()
+	return nil
+}
+
+// Delete forgets what was pushed for a station no longer exported.
+func (m *OtlpMetrics) Delete(station string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.stations, strings.ToUpper(station))
+}
+
+func (m *OtlpMetrics) Close() error {
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+
+	return m.exporter.Shutdown(ctx)
+}
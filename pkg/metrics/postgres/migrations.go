@@ -0,0 +1,144 @@
+package postgres_metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+)
+
+// migrations create and upgrade the schema, the version of the schema is
+// the number of migrations applied. Migrations are never edited once
+// released, new ones are appended. %[1]s is the schema.
+var migrations = []string{
+	`CREATE SCHEMA IF NOT EXISTS %[1]s;
+
+CREATE TABLE %[1]s.stations (
+	code       text PRIMARY KEY,
+	name       text,
+	short_name text,
+	elevation  double precision,
+	latitude   double precision,
+	longitude  double precision,
+	updated_at timestamptz NOT NULL DEFAULT now()
+);
+
+CREATE TABLE %[1]s.observations (
+	station  text NOT NULL REFERENCES %[1]s.stations (code) ON DELETE CASCADE,
+	variable text NOT NULL,
+	time     timestamptz NOT NULL,
+	value    double precision NOT NULL,
+	PRIMARY KEY (station, variable, time)
+);
+
+CREATE INDEX observations_time_idx ON %[1]s.observations (time DESC);`,
+}
+
+// Version is the schema version the sink writes to.
+var Version = len(migrations)
+
+var ErrSchemaOutdated = errors.New("postgres schema outdated, run the migrate command")
+
+// migrationsTable keeps the applied migrations.
+const migrationsTable = "schema_migrations"
+
+// lockId serializes concurrent migrations, e.g. of replicas starting
+// together.
+const lockId = 0x6d7465 // "mte"
+
+// Migrate brings the schema to Version, applying the missing migrations in
+// a single transaction. With timescale the observations table is turned
+// into a TimescaleDB hypertable, the extension must be available.
+func Migrate(ctx context.Context, logger *zap.Logger, pool *pgxpool.Pool, schema string, timescale bool) error {
+	tx, err := pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting migration: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	_, err = tx.Exec(ctx, "SELECT pg_advisory_xact_lock($1)", lockId)
+	if err != nil {
+		return fmt.Errorf("error locking migrations: %w", err)
+	}
+
+	s := pgx.Identifier{schema}.Sanitize()
+	_, err = tx.Exec(ctx, fmt.Sprintf(`CREATE SCHEMA IF NOT EXISTS %[1]s;
+CREATE TABLE IF NOT EXISTS %[1]s.%[2]s (
+	version    integer PRIMARY KEY,
+	applied_at timestamptz NOT NULL DEFAULT now()
+);`, s, migrationsTable))
+	if err != nil {
+		return fmt.Errorf("error creating migrations table: %w", err)
+	}
+
+	var version int
+	err = tx.QueryRow(ctx, fmt.Sprintf("SELECT coalesce(max(version), 0) FROM %s.%s", s, migrationsTable)).Scan(&version)
+	if err != nil {
+		return fmt.Errorf("error reading schema version: %w", err)
+	}
+
+	if version > Version {
+		return fmt.Errorf("postgres schema version %d is newer than %d, upgrade the exporter", version, Version)
+	}
+
+	for i := version; i < Version; i++ {
+		logger.Info("applying postgres migration", zap.Int("version", i+1))
+
+		_, err = tx.Exec(ctx, fmt.Sprintf(migrations[i], s))
+		if err != nil {
+			return fmt.Errorf("error applying migration %d: %w", i+1, err)
+		}
+
+		_, err = tx.Exec(ctx, fmt.Sprintf("INSERT INTO %s.%s (version) VALUES ($1)", s, migrationsTable), i+1)
+		if err != nil {
+			return fmt.Errorf("error recording migration %d: %w", i+1, err)
+		}
+	}
+
+	if timescale {
+		logger.Info("creating timescaledb hypertable")
+
+		// both are no-ops once done, existing rows are moved into chunks and
+		// the time index of the first migration stands for the default one
+		_, err = tx.Exec(ctx, "CREATE EXTENSION IF NOT EXISTS timescaledb")
+		if err != nil {
+			return fmt.Errorf("error creating timescaledb extension: %w", err)
+		}
+
+		_, err = tx.Exec(ctx, `SELECT create_hypertable($1::text::regclass, 'time',
+	if_not_exists => TRUE, migrate_data => TRUE, create_default_indexes => FALSE)`,
+			pgx.Identifier{schema, "observations"}.Sanitize())
+		if err != nil {
+			return fmt.Errorf("error creating hypertable: %w", err)
+		}
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("error committing migration: %w", err)
+	}
+
+	return nil
+}
+
+// schemaVersion reads the version of the schema, 0 when it was never
+// migrated. It needs no privilege but reading the migrations table.
+func schemaVersion(ctx context.Context, pool *pgxpool.Pool, schema string) (int, error) {
+	var exists bool
+	err := pool.QueryRow(ctx, "SELECT to_regclass($1) IS NOT NULL",
+		pgx.Identifier{schema, migrationsTable}.Sanitize()).Scan(&exists)
+	if err != nil {
+		return 0, err
+	}
+	if !exists {
+		return 0, nil
+	}
+
+	var version int
+	err = pool.QueryRow(ctx, fmt.Sprintf("SELECT coalesce(max(version), 0) FROM %s",
+		pgx.Identifier{schema, migrationsTable}.Sanitize())).Scan(&version)
+	return version, err
+}
@@ -0,0 +1,85 @@
+package postgres_metrics
+
+import (
+	"errors"
+	"flag"
+	"strconv"
+
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	"wouldgo.me/meteotrentino-exporter/pkg/options"
+)
+
+const (
+	urlEnv       = "POSTGRES_URL"
+	passwordEnv  = "POSTGRES_PASSWORD"
+	schemaEnv    = "POSTGRES_SCHEMA"
+	migrateEnv   = "POSTGRES_MIGRATE"
+	timescaleEnv = "POSTGRES_TIMESCALE"
+)
+
+type PostgresOptions struct {
+	fs                                                      *flag.FlagSet
+	env                                                     options.Env
+	url, password, passwordFile, schema, migrate, timescale *string
+}
+
+func NewPostgresOptions(fs *flag.FlagSet, env options.Env) *PostgresOptions {
+	var url, password, passwordFile, schema, migrate, timescale string
+	fs.StringVar(&url, "postgres-url", "", "postgres connection string the observations are written to, e.g. postgres://meteotrentino@localhost:5432/weather, disabled if empty")
+	fs.StringVar(&password, "postgres-password", "", "postgres password, visible in the process list: prefer --postgres-password-file")
+	fs.StringVar(&passwordFile, "postgres-password-file", "", "file holding the postgres password, read again on every connection")
+	fs.StringVar(&schema, "postgres-schema", DefaultSchema, "postgres schema holding the tables (default: "+DefaultSchema+")")
+	fs.StringVar(&migrate, "postgres-migrate", "false", "migrate the postgres schema on start instead of requiring the migrate command")
+	fs.StringVar(&timescale, "postgres-timescale", "false", "turn the observations into a TimescaleDB hypertable when migrating")
+
+	return &PostgresOptions{
+		fs,
+		env,
+		&url,
+		&password,
+		&passwordFile,
+		&schema,
+		&migrate,
+		&timescale,
+	}
+}
+
+// Apply overrides the postgres sink of c, creating it when its url is set.
+// Its other settings only apply to a sink enabled this way or by the
+// configuration file.
+func (po *PostgresOptions) Apply(c *config.Config) error {
+	if v, ok := options.Override(po.fs, "postgres-url", po.url, po.env, urlEnv); ok && v != "" {
+		if c.Sinks.Postgres == nil {
+			c.Sinks.Postgres = &config.Postgres{}
+		}
+		c.Sinks.Postgres.Url = v
+	}
+
+	sink := c.Sinks.Postgres
+	if sink == nil {
+		return nil
+	}
+
+	if v, ok := options.OverrideSecret(po.fs, "postgres-password", po.password, po.passwordFile, po.env, passwordEnv); ok {
+		sink.Password = v
+	}
+	if v, ok := options.Override(po.fs, "postgres-schema", po.schema, po.env, schemaEnv); ok {
+		sink.Schema = v
+	}
+	if v, ok := options.Override(po.fs, "postgres-migrate", po.migrate, po.env, migrateEnv); ok {
+		migrate, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.Join(options.ErrWrongParam("postgres-migrate"), err)
+		}
+		sink.Migrate = migrate
+	}
+	if v, ok := options.Override(po.fs, "postgres-timescale", po.timescale, po.env, timescaleEnv); ok {
+		timescale, err := strconv.ParseBool(v)
+		if err != nil {
+			return errors.Join(options.ErrWrongParam("postgres-timescale"), err)
+		}
+		sink.Timescale = timescale
+	}
+
+	return nil
+}
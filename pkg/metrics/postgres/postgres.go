@@ -0,0 +1,250 @@
+package postgres_metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/jackc/pgx/v5"
+	"github.com/jackc/pgx/v5/pgxpool"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+	"wouldgo.me/meteotrentino-exporter/pkg/secret"
+)
+
+const DefaultSchema = "meteotrentino"
+
+var _ metrics.Sink = (*PostgresMetrics)(nil)
+
+type MetricsConfig struct {
+	Logger *zap.Logger `validate:"required"`
+	// Url is a postgres connection string, e.g.
+	// postgres://meteotrentino@localhost:5432/weather?sslmode=disable
+	Url string `validate:"required"`
+	// Password overrides the one of Url, it is read on every connection.
+	Password secret.Secret
+	// Schema holds the tables, it defaults to DefaultSchema.
+	Schema string
+	// Migrate brings the schema to Version on start, with Timescale the
+	// observations become a TimescaleDB hypertable. Otherwise the schema
+	// must already be at Version.
+	Migrate   bool
+	Timescale bool
+}
+
+// PostgresMetrics writes the observations of every station to PostgreSQL, a
+// row per station, variable and time. Rows already written are updated, so
+// the overlapping 24h windows of every fetch are written idempotently.
+type PostgresMetrics struct {
+	logger *zap.Logger
+	pool   *pgxpool.Pool
+
+	stations     string
+	observations string
+}
+
+// columns of the observations table, in copy order.
+var columns = []string{"station", "variable", "time", "value"}
+
+func NewPostgresMetrics(ctx context.Context, opts MetricsConfig) (*PostgresMetrics, error) {
+	err := metrics.Validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return nil, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return nil, errors.Join(errs...)
+		}
+
+		return nil, err
+	}
+
+	pool, err := NewPool(ctx, opts.Url, opts.Password)
+	if err != nil {
+		return nil, err
+	}
+
+	schema := DefaultSchema
+	if opts.Schema != "" {
+		schema = opts.Schema
+	}
+
+	if opts.Migrate {
+		err = Migrate(ctx, opts.Logger, pool, schema, opts.Timescale)
+	} else {
+		err = checkVersion(ctx, pool, schema)
+	}
+	if err != nil {
+		pool.Close()
+		return nil, err
+	}
+
+	return &PostgresMetrics{
+		logger:       opts.Logger,
+		pool:         pool,
+		stations:     pgx.Identifier{schema, "stations"}.Sanitize(),
+		observations: pgx.Identifier{schema, "observations"}.Sanitize(),
+	}, nil
+}
+
+// NewPool connects to url, with password, when set, replacing the one of
+// url on every connection.
+func NewPool(ctx context.Context, url string, password secret.Secret) (*pgxpool.Pool, error) {
+	conf, err := pgxpool.ParseConfig(url)
+	if err != nil {
+		return nil, fmt.Errorf("error parsing postgres url: %w", err)
+	}
+
+	if !password.IsZero() {
+		conf.BeforeConnect = func(_ context.Context, conf *pgx.ConnConfig) error {
+			value, err := password.Value()
+			if err != nil {
+				return fmt.Errorf("error reading postgres password: %w", err)
+			}
+			conf.Password = value
+			return nil
+		}
+	}
+
+	pool, err := pgxpool.NewWithConfig(ctx, conf)
+	if err != nil {
+		return nil, fmt.Errorf("error creating postgres pool: %w", err)
+	}
+
+	err = pool.Ping(ctx)
+	if err != nil {
+		pool.Close()
+		return nil, fmt.Errorf("error connecting to postgres: %w", err)
+	}
+
+	return pool, nil
+}
+
+func checkVersion(ctx context.Context, pool *pgxpool.Pool, schema string) error {
+	version, err := schemaVersion(ctx, pool, schema)
+	if err != nil {
+		return fmt.Errorf("error reading schema version: %w", err)
+	}
+
+	if version != Version {
+		return fmt.Errorf("%w: version %d, expected %d", ErrSchemaOutdated, version, Version)
+	}
+
+	return nil
+}
+
+func (m *PostgresMetrics) Name() string {
+	return "postgres"
+}
+
+// Write upserts the station and copies its observations to a staging table,
+// merged into the observations in the same transaction.
+func (m *PostgresMetrics) Write(ctx context.Context, stats metrics.StationStats) error {
+	code := strings.ToUpper(stats.Station.Code)
+	rows := observationRows(code, stats.Stats)
+
+	tx, err := m.pool.Begin(ctx)
+	if err != nil {
+		return fmt.Errorf("error starting transaction: %w", err)
+	}
+	defer func() { _ = tx.Rollback(ctx) }()
+
+	// catalog attributes are only known when the catalog is queried, they
+	// are kept otherwise
+	s := stats.Station
+	var elevation, latitude, longitude *float64
+	if s.Name != "" {
+		elevation, latitude, longitude = &s.Elevation, &s.Latitude, &s.Longitude
+	}
+	_, err = tx.Exec(ctx, fmt.Sprintf(`INSERT INTO %[1]s AS s (code, name, short_name, elevation, latitude, longitude)
+VALUES ($1, nullif($2, ''), nullif($3, ''), $4, $5, $6)
+ON CONFLICT (code) DO UPDATE SET
+	name = coalesce(excluded.name, s.name),
+	short_name = coalesce(excluded.short_name, s.short_name),
+	elevation = coalesce(excluded.elevation, s.elevation),
+	latitude = coalesce(excluded.latitude, s.latitude),
+	longitude = coalesce(excluded.longitude, s.longitude),
+	updated_at = now()`, m.stations),
+		code, s.Name, s.ShortName, elevation, latitude, longitude)
+	if err != nil {
+		return fmt.Errorf("error writing station %s: %w", code, err)
+	}
+
+	if len(rows) > 0 {
+		_, err = tx.Exec(ctx, fmt.Sprintf(
+			"CREATE TEMPORARY TABLE observations_staging (LIKE %s INCLUDING DEFAULTS) ON COMMIT DROP", m.observations))
+		if err != nil {
+			return fmt.Errorf("error creating staging table: %w", err)
+		}
+
+		_, err = tx.CopyFrom(ctx, pgx.Identifier{"observations_staging"}, columns, pgx.CopyFromRows(rows))
+		if err != nil {
+			return fmt.Errorf("error copying observations of %s: %w", code, err)
+		}
+
+		// a row can only be upserted once per statement, and rows rewritten
+		// with the same value are left alone, sparing dead tuples
+		tag, err := tx.Exec(ctx, fmt.Sprintf(`INSERT INTO %[1]s AS o (station, variable, time, value)
+SELECT DISTINCT ON (station, variable, time) station, variable, time, value FROM observations_staging
+ON CONFLICT (station, variable, time) DO UPDATE SET value = excluded.value
+WHERE o.value IS DISTINCT FROM excluded.value`, m.observations))
+		if err != nil {
+			return fmt.Errorf("error merging observations of %s: %w", code, err)
+		}
+
+		m.logger.Debug("written observations",
+			zap.String("station", code), zap.Int("copied", len(rows)), zap.Int64("changed", tag.RowsAffected()))
+	}
+
+	err = tx.Commit(ctx)
+	if err != nil {
+		return fmt.Errorf("error committing observations of %s: %w", code, err)
+	}
+
+	return nil
+}
+
+// observationRows flattens stats into rows of columns, wind is split in a
+// variable per component.
+func observationRows(code string, stats api.WeatherStats) [][]any {
+	var rows [][]any
+
+	for _, series := range []struct {
+		variable string
+		stats    []api.WeatherStat
+	}{
+		{"temperature", stats.Temperature()},
+		{"humidity", stats.Humidity()},
+		{"precipitation", stats.Precipitation()},
+		{"radiation", stats.Radiation()},
+	} {
+		for _, stat := range series.stats {
+			rows = append(rows, []any{code, series.variable, stat.Time(), stat.Value()})
+		}
+	}
+
+	for _, wind := range stats.Wind() {
+		rows = append(rows,
+			[]any{code, "wind_speed", wind.Time(), wind.Speed()},
+			[]any{code, "wind_gust", wind.Time(), wind.Gust()},
+			[]any{code, "wind_direction", wind.Time(), wind.Direction()},
+		)
+	}
+
+	return rows
+}
+
+func (m *PostgresMetrics) Close() error {
+	m.pool.Close()
+	return nil
+}
@@ -2,49 +2,44 @@ package prometheus_metrics
 
 import (
 	"flag"
-	"fmt"
-	"os"
 
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
 	"wouldgo.me/meteotrentino-exporter/pkg/options"
 )
 
-var (
-	metricsServerEnv, metricsServerEnvSet = os.LookupEnv("METRICS_SERVER")
+const (
+	metricsServerEnv = "METRICS_SERVER"
+	webConfigEnv     = "WEB_CONFIG_FILE"
 )
 
 type PrometheusOptions struct {
-	*options.Options
-	metricsServer *string
+	fs                       *flag.FlagSet
+	env                      options.Env
+	metricsServer, webConfig *string
 }
 
-type PrometheusConfig struct {
-	*options.Config
-	MetricsServer string
-}
-
-func NewPrometheusOptions() *PrometheusOptions {
-	opts := options.NewOptions()
-	var metricsServer string
-	flag.StringVar(&metricsServer, "metrics-server", ":3000", "metrics server binding addresse <ip>:<port> (default: :3000)")
+func NewPrometheusOptions(fs *flag.FlagSet, env options.Env) *PrometheusOptions {
+	var metricsServer, webConfig string
+	fs.StringVar(&metricsServer, "metrics-server", ":3000", "metrics server binding addresse <ip>:<port>, disabled if empty (default: :3000)")
+	fs.StringVar(&webConfig, "web.config.file", "", "prometheus exporter-toolkit web configuration file, enabling TLS and basic auth")
 
 	return &PrometheusOptions{
-		opts,
+		fs,
+		env,
 		&metricsServer,
+		&webConfig,
 	}
 }
 
-func (po *PrometheusOptions) Read() (*PrometheusConfig, error) {
-	conf, err := po.Options.Read()
-	if err != nil {
-		return nil, fmt.Errorf("error on parsing prometheus metrics options: %w", err)
+// Apply overrides the server section of c.
+func (po *PrometheusOptions) Apply(c *config.Config) error {
+	if v, ok := options.Override(po.fs, "metrics-server", po.metricsServer, po.env, metricsServerEnv); ok {
+		c.Server.Address = v
 	}
 
-	if metricsServerEnvSet {
-		po.metricsServer = &metricsServerEnv
+	if v, ok := options.Override(po.fs, "web.config.file", po.webConfig, po.env, webConfigEnv); ok {
+		c.Server.WebConfig = v
 	}
 
-	return &PrometheusConfig{
-		conf,
-		*po.metricsServer,
-	}, nil
+	return nil
 }
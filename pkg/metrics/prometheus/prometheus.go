@@ -1,36 +1,50 @@
 package prometheus_metrics
 
 import (
+	"context"
 	"errors"
 	"fmt"
 	"net/http"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/go-playground/validator/v10"
 	"github.com/prometheus/client_golang/prometheus"
 	"github.com/prometheus/client_golang/prometheus/promhttp"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
 	"go.uber.org/zap"
 	"wouldgo.me/meteotrentino-exporter/pkg/api"
 	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+	"wouldgo.me/meteotrentino-exporter/pkg/tracing"
+)
+
+var (
+	_ metrics.Sink           = (*PrometheusMetrics)(nil)
+	_ metrics.StationDeleter = (*PrometheusMetrics)(nil)
 )
 
 type MetricsConfig struct {
-	Api    api.MeteoTrentino `validate:"required"`
-	Logger *zap.Logger       `validate:"required"`
+	Logger *zap.Logger `validate:"required"`
 
 	TimeoutDuration time.Duration
 }
 
 type PrometheusMetrics struct {
 	reg     *prometheus.Registry
-	api     api.MeteoTrentino
 	logger  *zap.Logger
 	timeout time.Duration
 
-	temperature   prometheus.Gauge
-	humidity      prometheus.Gauge
-	precipitation prometheus.Gauge
-	radiation     prometheus.Gauge
+	temperature   *prometheus.GaugeVec
+	humidity      *prometheus.GaugeVec
+	precipitation *prometheus.GaugeVec
+	radiation     *prometheus.GaugeVec
+
+	// rounds holds the span of the last write of every station, linked from
+	// the scrapes serving it.
+	mu     sync.Mutex
+	rounds map[string]trace.SpanContext
 }
 
 func NewPrometheusMetrics(opts MetricsConfig) (*PrometheusMetrics, error) {
@@ -56,25 +70,25 @@ func NewPrometheusMetrics(opts MetricsConfig) (*PrometheusMetrics, error) {
 	reg := prometheus.NewRegistry()
 	m := &PrometheusMetrics{
 		reg:     reg,
-		api:     opts.Api,
 		logger:  opts.Logger,
 		timeout: opts.TimeoutDuration,
-		temperature: prometheus.NewGauge(prometheus.GaugeOpts{
+		rounds:  make(map[string]trace.SpanContext),
+		temperature: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "temperature_celsius",
 			Help: "Current temperature in celsius",
-		}),
-		humidity: prometheus.NewGauge(prometheus.GaugeOpts{
+		}, []string{"station"}),
+		humidity: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "humidity_percent",
 			Help: "Current relative humidity in percent",
-		}),
-		precipitation: prometheus.NewGauge(prometheus.GaugeOpts{
+		}, []string{"station"}),
+		precipitation: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "precipitation_mm",
 			Help: "Current precipitation in millimeters",
-		}),
-		radiation: prometheus.NewGauge(prometheus.GaugeOpts{
+		}, []string{"station"}),
+		radiation: prometheus.NewGaugeVec(prometheus.GaugeOpts{
 			Name: "radiation_watts_per_square_meter",
 			Help: "Current radiation in watts per square meter",
-		}),
+		}, []string{"station"}),
 	}
 
 	reg.MustRegister(
@@ -87,41 +101,86 @@ func NewPrometheusMetrics(opts MetricsConfig) (*PrometheusMetrics, error) {
 	return m, nil
 }
 
-func (m *PrometheusMetrics) updateMetrics(latestMetrics api.WeatherStats) error {
-	temp := latestMetrics.Temperature()
-	hum := latestMetrics.Humidity()
-	prec := latestMetrics.Precipitation()
-	rad := latestMetrics.Radiation()
+// Registry exposes the registry holding the weather gauges, so that other
+// collectors can be served along with them.
+func (m *PrometheusMetrics) Registry() *prometheus.Registry {
+	return m.reg
+}
+
+func (m *PrometheusMetrics) Name() string {
+	return "prometheus"
+}
+
+// Write sets the gauges of the station to the latest observation of each
+// variable, series without observations leave their gauge untouched.
+func (m *PrometheusMetrics) Write(ctx context.Context, stats metrics.StationStats) error {
+	station := strings.ToUpper(stats.Station.Code)
+
+	if sc := trace.SpanContextFromContext(ctx); sc.IsValid() {
+		m.mu.Lock()
+		m.rounds[station] = sc
+		m.mu.Unlock()
+	}
+
+	for gauge, series := range map[*prometheus.GaugeVec][]api.WeatherStat{
+		m.temperature:   stats.Stats.Temperature(),
+		m.humidity:      stats.Stats.Humidity(),
+		m.precipitation: stats.Stats.Precipitation(),
+		m.radiation:     stats.Stats.Radiation(),
+	} {
+		if len(series) == 0 {
+			m.logger.Debug("no observations", zap.String("station", station))
+			continue
+		}
 
-	m.temperature.Set(temp[len(temp)-1].Value())
-	m.humidity.Set(hum[len(hum)-1].Value())
-	m.precipitation.Set(prec[len(prec)-1].Value())
-	m.radiation.Set(rad[len(rad)-1].Value())
+		gauge.WithLabelValues(station).Set(series[len(series)-1].Value())
+	}
 
 	return nil
 }
 
+// Delete drops the gauges of a station no longer exported.
+func (m *PrometheusMetrics) Delete(station string) {
+	labels := prometheus.Labels{"station": strings.ToUpper(station)}
+	m.temperature.Delete(labels)
+	m.humidity.Delete(labels)
+	m.precipitation.Delete(labels)
+	m.radiation.Delete(labels)
+
+	m.mu.Lock()
+	delete(m.rounds, strings.ToUpper(station))
+	m.mu.Unlock()
+}
+
+// Handler serves the gauges. When the request is traced, its span links to
+// the last polling round of every station, whose values it serves.
 func (m *PrometheusMetrics) Handler() http.Handler {
 	promHandler := promhttp.HandlerFor(m.reg, promhttp.HandlerOpts{
 		Registry: m.reg,
 	})
 
-	h := http.HandlerFunc(func(rsp http.ResponseWriter, req *http.Request) {
-		latestStats, err := m.api.FetchData(req.Context())
-		if err != nil {
-			m.logger.Error("error fetching data", zap.Error(err))
-		}
-
-		err = m.updateMetrics(latestStats)
-		if err != nil {
-			m.logger.Error("error updating metrics", zap.Error(err))
+	linked := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		span := trace.SpanFromContext(r.Context())
+		if span.IsRecording() {
+			m.mu.Lock()
+			for station, sc := range m.rounds {
+				span.AddLink(trace.Link{
+					SpanContext: sc,
+					Attributes:  []attribute.KeyValue{tracing.StationKey.String(station)},
+				})
+			}
+			m.mu.Unlock()
 		}
 
-		promHandler.ServeHTTP(rsp, req)
+		promHandler.ServeHTTP(w, r)
 	})
 
-	return http.TimeoutHandler(h, m.timeout, fmt.Sprintf(
+	return http.TimeoutHandler(linked, m.timeout, fmt.Sprintf(
 		"Exceeded configured timeout of %v.\n",
 		m.timeout,
 	))
 }
+
+func (m *PrometheusMetrics) Close() error {
+	return nil
+}
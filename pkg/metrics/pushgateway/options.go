@@ -0,0 +1,88 @@
+package pushgateway_metrics
+
+import (
+	"flag"
+	"fmt"
+
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	"wouldgo.me/meteotrentino-exporter/pkg/options"
+)
+
+const (
+	urlEnv      = "PUSHGATEWAY_URL"
+	jobEnv      = "PUSHGATEWAY_JOB"
+	methodEnv   = "PUSHGATEWAY_METHOD"
+	groupingEnv = "PUSHGATEWAY_GROUPING"
+	usernameEnv = "PUSHGATEWAY_USERNAME"
+	passwordEnv = "PUSHGATEWAY_PASSWORD"
+)
+
+type PushgatewayOptions struct {
+	fs                                                           *flag.FlagSet
+	env                                                          options.Env
+	url, job, method, grouping, username, password, passwordFile *string
+}
+
+func NewPushgatewayOptions(fs *flag.FlagSet, env options.Env) *PushgatewayOptions {
+	var url, job, method, grouping, username, password, passwordFile string
+	fs.StringVar(&url, "pushgateway-url", "", "pushgateway url the metrics of every station are pushed to after each fetch, disabled if empty")
+	fs.StringVar(&job, "pushgateway-job", DefaultJob, "pushgateway job (default: meteotrentino)")
+	fs.StringVar(&method, "pushgateway-method", string(MethodPut), "pushgateway method: put replaces the whole station group, post only the pushed metrics (default: put)")
+	fs.StringVar(&grouping, "pushgateway-grouping", "", "pushgateway grouping labels added to the station one as comma separated key=value pairs, e.g. site=rovereto")
+	fs.StringVar(&username, "pushgateway-username", "", "pushgateway basic auth username")
+	fs.StringVar(&password, "pushgateway-password", "", "pushgateway basic auth password, visible in the process list: prefer --pushgateway-password-file")
+	fs.StringVar(&passwordFile, "pushgateway-password-file", "", "file holding the pushgateway basic auth password, read again when it changes")
+
+	return &PushgatewayOptions{
+		fs,
+		env,
+		&url,
+		&job,
+		&method,
+		&grouping,
+		&username,
+		&password,
+		&passwordFile,
+	}
+}
+
+// Apply overrides the pushgateway sink of c, creating it when its url is
+// set. Its other settings only apply to a sink enabled this way or by the
+// configuration file.
+func (po *PushgatewayOptions) Apply(c *config.Config) error {
+	if v, ok := options.Override(po.fs, "pushgateway-url", po.url, po.env, urlEnv); ok && v != "" {
+		if c.Sinks.Pushgateway == nil {
+			c.Sinks.Pushgateway = &config.Pushgateway{}
+		}
+		c.Sinks.Pushgateway.Url = v
+	}
+
+	sink := c.Sinks.Pushgateway
+	if sink == nil {
+		return nil
+	}
+
+	if v, ok := options.Override(po.fs, "pushgateway-job", po.job, po.env, jobEnv); ok {
+		sink.Job = v
+	}
+	if v, ok := options.Override(po.fs, "pushgateway-method", po.method, po.env, methodEnv); ok {
+		sink.Method = v
+	}
+
+	if v, ok := options.Override(po.fs, "pushgateway-grouping", po.grouping, po.env, groupingEnv); ok {
+		grouping, err := options.ParseKeyValues(v)
+		if err != nil {
+			return fmt.Errorf("error on parsing pushgateway grouping: %w", err)
+		}
+		sink.Grouping = grouping
+	}
+
+	if v, ok := options.Override(po.fs, "pushgateway-username", po.username, po.env, usernameEnv); ok {
+		sink.Username = v
+	}
+	if v, ok := options.OverrideSecret(po.fs, "pushgateway-password", po.password, po.passwordFile, po.env, passwordEnv); ok {
+		sink.Password = v
+	}
+
+	return nil
+}
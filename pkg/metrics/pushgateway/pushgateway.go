@@ -0,0 +1,253 @@
+package pushgateway_metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/prometheus/client_golang/prometheus"
+	"github.com/prometheus/client_golang/prometheus/push"
+	dto "github.com/prometheus/client_model/go"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+	prometheus_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/prometheus"
+	"wouldgo.me/meteotrentino-exporter/pkg/secret"
+)
+
+type Method string
+
+const (
+	// MethodPut replaces all the metrics of the station group.
+	MethodPut Method = "put"
+	// MethodPost replaces only the metrics of the group with the same name.
+	MethodPost Method = "post"
+
+	DefaultJob = "meteotrentino"
+
+	stationLabel = "station"
+)
+
+var (
+	_ metrics.Sink           = (*PushgatewayMetrics)(nil)
+	_ metrics.StationDeleter = (*PushgatewayMetrics)(nil)
+)
+
+type MetricsConfig struct {
+	Logger *zap.Logger `validate:"required"`
+	// Prometheus holds the gauges pushed, it is written before every push.
+	Prometheus *prometheus_metrics.PrometheusMetrics `validate:"required"`
+
+	Url string `validate:"required,url"`
+	// Job defaults to DefaultJob and Method to MethodPut.
+	Job    string
+	Method Method `validate:"omitempty,oneof=put post"`
+	// Grouping labels are added to the grouping key of every station.
+	Grouping map[string]string
+
+	Username string
+	Password secret.Secret
+
+	// Timeout bounds the deletion of a group, pushes are bounded by the
+	// write context.
+	Timeout time.Duration
+}
+
+// PushgatewayMetrics pushes the metrics of a station, as held by the
+// prometheus sink, to a pushgateway after every fetch. Every station has its
+// own group, keyed by job and station.
+type PushgatewayMetrics struct {
+	logger     *zap.Logger
+	prometheus *prometheus_metrics.PrometheusMetrics
+	client     *http.Client
+
+	url      string
+	job      string
+	method   Method
+	grouping map[string]string
+
+	username string
+	password secret.Secret
+}
+
+func NewPushgatewayMetrics(opts MetricsConfig) (*PushgatewayMetrics, error) {
+	err := metrics.Validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return nil, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return nil, errors.Join(errs...)
+		}
+
+		return nil, err
+	}
+
+	if _, ok := opts.Grouping[stationLabel]; ok {
+		return nil, fmt.Errorf("reserved grouping label %q", stationLabel)
+	}
+
+	job := DefaultJob
+	if opts.Job != "" {
+		job = opts.Job
+	}
+
+	method := MethodPut
+	if opts.Method != "" {
+		method = opts.Method
+	}
+
+	timeout := 10 * time.Second
+	if opts.Timeout != 0 {
+		timeout = opts.Timeout
+	}
+
+	return &PushgatewayMetrics{
+		logger:     opts.Logger,
+		prometheus: opts.Prometheus,
+		client: &http.Client{
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+			Timeout:   timeout,
+		},
+		url:      opts.Url,
+		job:      job,
+		method:   method,
+		grouping: opts.Grouping,
+		username: opts.Username,
+		password: opts.Password,
+	}, nil
+}
+
+func (m *PushgatewayMetrics) Name() string {
+	return "pushgateway"
+}
+
+// pusher returns the pusher of the group of station.
+func (m *PushgatewayMetrics) pusher(station string) (*push.Pusher, error) {
+	pusher := push.New(m.url, m.job).
+		Client(m.client).
+		Grouping(stationLabel, station).
+		Gatherer(stationGatherer{m.prometheus.Registry(), station})
+
+	for _, name := range slices.Sorted(maps.Keys(m.grouping)) {
+		pusher = pusher.Grouping(name, m.grouping[name])
+	}
+
+	if m.username != "" {
+		password, err := m.password.Value()
+		if err != nil {
+			return nil, fmt.Errorf("error reading pushgateway password: %w", err)
+		}
+		pusher = pusher.BasicAuth(m.username, password)
+	}
+
+	return pusher, nil
+}
+
+// Write updates the gauges of the prometheus sink and pushes the metrics of
+// the station.
+func (m *PushgatewayMetrics) Write(ctx context.Context, stats metrics.StationStats) error {
+	station := strings.ToUpper(stats.Station.Code)
+
+	err := m.prometheus.Write(ctx, stats)
+	if err != nil {
+		return err
+	}
+
+	pusher, err := m.pusher(station)
+	if err != nil {
+		return err
+	}
+
+	if m.method == MethodPost {
+		err = pusher.AddContext(ctx)
+	} else {
+		err = pusher.PushContext(ctx)
+	}
+	if err != nil {
+		return fmt.Errorf("error pushing to pushgateway: %w", err)
+	}
+
+	return nil
+}
+
+// DeleteGroup deletes the group of a decommissioned station from the
+// pushgateway.
+func (m *PushgatewayMetrics) DeleteGroup(station string) error {
+	pusher, err := m.pusher(strings.ToUpper(station))
+	if err != nil {
+		return err
+	}
+
+	err = pusher.Delete()
+	if err != nil {
+		return fmt.Errorf("error deleting pushgateway group: %w", err)
+	}
+
+	return nil
+}
+
+// Delete deletes the group of a station no longer exported.
+func (m *PushgatewayMetrics) Delete(station string) {
+	err := m.DeleteGroup(station)
+	if err != nil {
+		m.logger.Error("error deleting station group", zap.String("station", station), zap.Error(err))
+		return
+	}
+	m.logger.Info("deleted station group", zap.String("station", station))
+}
+
+func (m *PushgatewayMetrics) Close() error {
+	m.client.CloseIdleConnections()
+	return nil
+}
+
+// stationGatherer gathers the metrics of a station without their station
+// label, which the pushgateway takes from the grouping key.
+type stationGatherer struct {
+	gatherer prometheus.Gatherer
+	station  string
+}
+
+func (g stationGatherer) Gather() ([]*dto.MetricFamily, error) {
+	families, err := g.gatherer.Gather()
+	if err != nil {
+		return nil, err
+	}
+
+	gathered := families[:0]
+	for _, family := range families {
+		kept := family.Metric[:0]
+		for _, metric := range family.Metric {
+			i := slices.IndexFunc(metric.Label, func(l *dto.LabelPair) bool {
+				return l.GetName() == stationLabel
+			})
+			if i < 0 || metric.Label[i].GetValue() != g.station {
+				continue
+			}
+
+			metric.Label = slices.Delete(metric.Label, i, i+1)
+			kept = append(kept, metric)
+		}
+
+		if len(kept) > 0 {
+			family.Metric = kept
+			gathered = append(gathered, family)
+		}
+	}
+
+	return gathered, nil
+}
@@ -0,0 +1,103 @@
+package pws_metrics
+
+import (
+	"bytes"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type Network string
+
+const (
+	// NetworkWunderground is the Weather Underground PWS upload protocol,
+	// in imperial units.
+	NetworkWunderground Network = "wunderground"
+	// NetworkWindy is the Windy stations API, in metric units.
+	NetworkWindy Network = "windy"
+
+	DefaultWundergroundUrl = "https://weatherstation.wunderground.com/weatherstation/updateweatherstation.php"
+	DefaultWindyUrl        = "https://stations.windy.com/api/v2/observation/update"
+)
+
+// network maps an observation to the query of an upload.
+type network struct {
+	url string
+	// id and password are the parameters of the station credentials
+	id, password string
+	params       func(obs observation) url.Values
+	// accepted tells if the response body of a 2xx upload is a success
+	accepted func(body []byte) bool
+}
+
+var networks = map[Network]network{
+	NetworkWunderground: {
+		url:      DefaultWundergroundUrl,
+		id:       "ID",
+		password: "PASSWORD",
+		params:   wundergroundParams,
+		// failures are 200 too, e.g. INVALIDPASSWORDID|Password or key
+		// and/or id are incorrect
+		accepted: func(body []byte) bool {
+			return bytes.HasPrefix(bytes.TrimSpace(body), []byte("success"))
+		},
+	},
+	NetworkWindy: {
+		url:      DefaultWindyUrl,
+		id:       "id",
+		password: "PASSWORD",
+		params:   windyParams,
+		accepted: func([]byte) bool { return true },
+	},
+}
+
+func format(v float64) string {
+	return strconv.FormatFloat(v, 'f', 2, 64)
+}
+
+func set(params url.Values, key string, value *float64, convert func(float64) float64) {
+	if value == nil {
+		return
+	}
+
+	v := *value
+	if convert != nil {
+		v = convert(v)
+	}
+	params.Set(key, format(v))
+}
+
+func wundergroundParams(obs observation) url.Values {
+	params := url.Values{}
+	params.Set("action", "updateraw")
+	params.Set("softwaretype", userAgent)
+	params.Set("dateutc", obs.Time.UTC().Format(time.DateTime))
+
+	set(params, "tempf", obs.Temperature, fahrenheit)
+	set(params, "humidity", obs.Humidity, nil)
+	set(params, "dewptf", obs.dewPoint, fahrenheit)
+	set(params, "rainin", obs.RainHour, inches)
+	set(params, "dailyrainin", obs.RainDay, inches)
+	set(params, "solarradiation", obs.Radiation, nil)
+	set(params, "winddir", obs.WindDirection, nil)
+	set(params, "windspeedmph", obs.WindSpeed, mph)
+	set(params, "windgustmph", obs.WindGust, mph)
+
+	return params
+}
+
+func windyParams(obs observation) url.Values {
+	params := url.Values{}
+	params.Set("time", obs.Time.UTC().Format(time.RFC3339))
+
+	set(params, "temp", obs.Temperature, nil)
+	set(params, "humidity", obs.Humidity, nil)
+	set(params, "dewpoint", obs.dewPoint, nil)
+	set(params, "precip", obs.RainHour, nil)
+	set(params, "solarradiation", obs.Radiation, nil)
+	set(params, "winddir", obs.WindDirection, nil)
+	set(params, "wind", obs.WindSpeed, nil)
+	set(params, "gust", obs.WindGust, nil)
+
+	return params
+}
@@ -0,0 +1,53 @@
+package pws_metrics
+
+import (
+	"math"
+
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+)
+
+// observation is what is uploaded for a station, the latest observation and
+// the dew point derived from it.
+type observation struct {
+	metrics.Observation
+
+	dewPoint *float64
+}
+
+// newObservation builds the observation of the latest time found in stats,
+// ok is false when there is none.
+func newObservation(stats api.WeatherStats) (observation, bool) {
+	latest, ok := metrics.NewObservation(stats)
+	if !ok {
+		return observation{}, false
+	}
+
+	obs := observation{Observation: latest}
+	if obs.Temperature != nil && obs.Humidity != nil && *obs.Humidity > 0 {
+		dewPoint := dewPoint(*obs.Temperature, *obs.Humidity)
+		obs.dewPoint = &dewPoint
+	}
+
+	return obs, true
+}
+
+// dewPoint approximates the dew point in celsius with the Magnus formula.
+func dewPoint(celsius, humidity float64) float64 {
+	const b, c = 17.62, 243.12
+
+	gamma := math.Log(humidity/100) + b*celsius/(c+celsius)
+	return c * gamma / (b - gamma)
+}
+
+func fahrenheit(celsius float64) float64 {
+	return celsius*9/5 + 32
+}
+
+func mph(metersPerSecond float64) float64 {
+	return metersPerSecond * 2.236936
+}
+
+func inches(mm float64) float64 {
+	return mm / 25.4
+}
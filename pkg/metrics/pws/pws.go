@@ -0,0 +1,197 @@
+package pws_metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+	"wouldgo.me/meteotrentino-exporter/pkg/secret"
+)
+
+const userAgent = "meteotrentino-exporter"
+
+var (
+	_ metrics.Sink           = (*PwsMetrics)(nil)
+	_ metrics.StationDeleter = (*PwsMetrics)(nil)
+
+	ErrRejected = errors.New("upload rejected")
+)
+
+// Station holds the credentials of a station on the network.
+type Station struct {
+	Id       string        `validate:"required"`
+	Password secret.Secret `validate:"required"`
+}
+
+type MetricsConfig struct {
+	Logger  *zap.Logger `validate:"required"`
+	Network Network     `validate:"required,oneof=wunderground windy"`
+	// Url defaults to the upload url of the network.
+	Url string `validate:"omitempty,url"`
+	// Stations maps the code of the stations mirrored to their credentials,
+	// the others are not uploaded.
+	Stations map[string]Station `validate:"required,min=1,dive"`
+}
+
+// PwsMetrics mirrors stations to a personal weather station network, the
+// latest observation of a station is uploaded when newer than the last one
+// accepted.
+type PwsMetrics struct {
+	logger   *zap.Logger
+	client   *http.Client
+	name     Network
+	network  network
+	url      string
+	stations map[string]Station
+
+	mu   sync.Mutex
+	sent map[string]time.Time
+}
+
+func NewPwsMetrics(opts MetricsConfig) (*PwsMetrics, error) {
+	err := metrics.Validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return nil, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return nil, errors.Join(errs...)
+		}
+
+		return nil, err
+	}
+
+	network := networks[opts.Network]
+	uploadUrl := network.url
+	if opts.Url != "" {
+		uploadUrl = opts.Url
+	}
+
+	stations := make(map[string]Station, len(opts.Stations))
+	for code, station := range opts.Stations {
+		stations[strings.ToUpper(code)] = station
+	}
+
+	return &PwsMetrics{
+		logger: opts.Logger,
+		// not traced with otelhttp, the spans would record the password in
+		// the query of the url
+		client:   &http.Client{},
+		name:     opts.Network,
+		network:  network,
+		url:      uploadUrl,
+		stations: stations,
+		sent:     make(map[string]time.Time),
+	}, nil
+}
+
+func (m *PwsMetrics) Name() string {
+	return string(m.name)
+}
+
+// Write uploads the latest observation of a mirrored station, unless it was
+// already accepted.
+func (m *PwsMetrics) Write(ctx context.Context, stats metrics.StationStats) error {
+	code := strings.ToUpper(stats.Station.Code)
+
+	station, ok := m.stations[code]
+	if !ok {
+		return nil
+	}
+
+	obs, ok := newObservation(stats.Stats)
+	if !ok {
+		return nil
+	}
+
+	m.mu.Lock()
+	sent := m.sent[code]
+	m.mu.Unlock()
+
+	if !obs.Time.After(sent) {
+		m.logger.Debug("no new observation to upload", zap.String("station", code), zap.Time("time", obs.Time))
+		return nil
+	}
+
+	err := m.upload(ctx, station, obs)
+	if err != nil {
+		return fmt.Errorf("error uploading %s to %s: %w", code, m.name, err)
+	}
+
+	m.mu.Lock()
+	m.sent[code] = obs.Time
+	m.mu.Unlock()
+
+	return nil
+}
+
+func (m *PwsMetrics) upload(ctx context.Context, station Station, obs observation) error {
+	password, err := station.Password.Value()
+	if err != nil {
+		return fmt.Errorf("error reading password: %w", err)
+	}
+
+	params := m.network.params(obs)
+	params.Set(m.network.id, station.Id)
+	params.Set(m.network.password, password)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, m.url+"?"+params.Encode(), nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("User-Agent", userAgent)
+
+	response, err := m.client.Do(req)
+	if err != nil {
+		// the url error would leak the password in the query
+		var urlErr *url.Error
+		if errors.As(err, &urlErr) {
+			return urlErr.Err
+		}
+		return err
+	}
+
+	defer func() {
+		err := response.Body.Close()
+		if err != nil {
+			m.logger.Warn("error closing body", zap.Error(err))
+		}
+	}()
+
+	body, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+	if response.StatusCode/100 != 2 || !m.network.accepted(body) {
+		return fmt.Errorf("%w: %d: %s", ErrRejected, response.StatusCode, bytes.TrimSpace(body))
+	}
+
+	return nil
+}
+
+// Delete forgets the uploads of a station no longer exported.
+func (m *PwsMetrics) Delete(station string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sent, strings.ToUpper(station))
+}
+
+func (m *PwsMetrics) Close() error {
+	m.client.CloseIdleConnections()
+	return nil
+}
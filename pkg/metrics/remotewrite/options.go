@@ -0,0 +1,93 @@
+package remotewrite_metrics
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"strconv"
+
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	"wouldgo.me/meteotrentino-exporter/pkg/options"
+)
+
+const (
+	urlEnv         = "REMOTE_WRITE_URL"
+	bearerTokenEnv = "REMOTE_WRITE_BEARER_TOKEN"
+	headersEnv     = "REMOTE_WRITE_HEADERS"
+	labelsEnv      = "REMOTE_WRITE_LABELS"
+	maxRetriesEnv  = "REMOTE_WRITE_MAX_RETRIES"
+)
+
+type RemoteWriteOptions struct {
+	fs                                                        *flag.FlagSet
+	env                                                       options.Env
+	url, bearerToken, bearerTokenFile, headers, labels, retry *string
+}
+
+func NewRemoteWriteOptions(fs *flag.FlagSet, env options.Env) *RemoteWriteOptions {
+	var url, bearerToken, bearerTokenFile, headers, labels, retry string
+	fs.StringVar(&url, "remote-write-url", "", "prometheus remote write url receiving every observation, e.g. http://localhost:9090/api/v1/write, disabled if empty")
+	fs.StringVar(&bearerToken, "remote-write-bearer-token", "", "remote write bearer token, visible in the process list: prefer --remote-write-bearer-token-file")
+	fs.StringVar(&bearerTokenFile, "remote-write-bearer-token-file", "", "file holding the remote write bearer token, read again when it changes")
+	fs.StringVar(&headers, "remote-write-headers", "", "remote write request headers as comma separated key=value pairs, e.g. X-Scope-OrgID=weather")
+	fs.StringVar(&labels, "remote-write-labels", "", "remote write labels added to every series as comma separated key=value pairs, e.g. site=rovereto")
+	fs.StringVar(&retry, "remote-write-max-retries", strconv.Itoa(defaultMaxRetries), "remote write retries on network errors, 5xx and 429 responses (default: 3)")
+
+	return &RemoteWriteOptions{
+		fs,
+		env,
+		&url,
+		&bearerToken,
+		&bearerTokenFile,
+		&headers,
+		&labels,
+		&retry,
+	}
+}
+
+// Apply overrides the remote write sink of c, creating it when its url is
+// set. Its other settings only apply to a sink enabled this way or by the
+// configuration file.
+func (ro *RemoteWriteOptions) Apply(c *config.Config) error {
+	if v, ok := options.Override(ro.fs, "remote-write-url", ro.url, ro.env, urlEnv); ok && v != "" {
+		if c.Sinks.RemoteWrite == nil {
+			c.Sinks.RemoteWrite = &config.RemoteWrite{}
+		}
+		c.Sinks.RemoteWrite.Url = v
+	}
+
+	sink := c.Sinks.RemoteWrite
+	if sink == nil {
+		return nil
+	}
+
+	if v, ok := options.OverrideSecret(ro.fs, "remote-write-bearer-token", ro.bearerToken, ro.bearerTokenFile, ro.env, bearerTokenEnv); ok {
+		sink.BearerToken = v
+	}
+
+	if v, ok := options.Override(ro.fs, "remote-write-headers", ro.headers, ro.env, headersEnv); ok {
+		headers, err := options.ParseKeyValues(v)
+		if err != nil {
+			return fmt.Errorf("error on parsing remote write headers: %w", err)
+		}
+		sink.Headers = headers
+	}
+
+	if v, ok := options.Override(ro.fs, "remote-write-labels", ro.labels, ro.env, labelsEnv); ok {
+		labels, err := options.ParseKeyValues(v)
+		if err != nil {
+			return fmt.Errorf("error on parsing remote write labels: %w", err)
+		}
+		sink.Labels = labels
+	}
+
+	if v, ok := options.Override(ro.fs, "remote-write-max-retries", ro.retry, ro.env, maxRetriesEnv); ok {
+		retry, err := strconv.Atoi(v)
+		if err != nil {
+			return errors.Join(options.ErrWrongParam("remote-write-max-retries"), err)
+		}
+		sink.MaxRetries = retry
+	}
+
+	return nil
+}
@@ -0,0 +1,158 @@
+package remotewrite_metrics
+
+import (
+	"errors"
+	"math"
+
+	"google.golang.org/protobuf/encoding/protowire"
+)
+
+var ErrMalformed = errors.New("malformed write request")
+
+// WriteRequest is the prometheus.WriteRequest message of the remote write 1.0
+// protocol, limited to the series and their samples.
+type WriteRequest struct {
+	Timeseries []TimeSeries
+}
+
+type TimeSeries struct {
+	Labels  []Label
+	Samples []Sample
+}
+
+type Label struct {
+	Name, Value string
+}
+
+type Sample struct {
+	Value float64
+	// Timestamp is in milliseconds since the epoch.
+	Timestamp int64
+}
+
+// Marshal encodes r in the protobuf wire format.
+func (r *WriteRequest) Marshal() []byte {
+	var b []byte
+	for _, ts := range r.Timeseries {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, ts.marshal())
+	}
+
+	return b
+}
+
+func (ts *TimeSeries) marshal() []byte {
+	var b []byte
+	for _, l := range ts.Labels {
+		var lb []byte
+		lb = protowire.AppendTag(lb, 1, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.Name)
+		lb = protowire.AppendTag(lb, 2, protowire.BytesType)
+		lb = protowire.AppendString(lb, l.Value)
+
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, lb)
+	}
+
+	for _, s := range ts.Samples {
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.Fixed64Type)
+		sb = protowire.AppendFixed64(sb, math.Float64bits(s.Value))
+		sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.Timestamp))
+
+		b = protowire.AppendTag(b, 2, protowire.BytesType)
+		b = protowire.AppendBytes(b, sb)
+	}
+
+	return b
+}
+
+// Unmarshal decodes a WriteRequest in the protobuf wire format, fields other
+// than series, labels and samples are skipped.
+func (r *WriteRequest) Unmarshal(b []byte) error {
+	r.Timeseries = r.Timeseries[:0]
+	return fields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		if num != 1 || typ != protowire.BytesType {
+			return nil
+		}
+
+		var ts TimeSeries
+		err := ts.unmarshal(v)
+		if err != nil {
+			return err
+		}
+		r.Timeseries = append(r.Timeseries, ts)
+		return nil
+	})
+}
+
+func (ts *TimeSeries) unmarshal(b []byte) error {
+	return fields(b, func(num protowire.Number, typ protowire.Type, v []byte) error {
+		switch {
+		case num == 1 && typ == protowire.BytesType:
+			var l Label
+			err := fields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch num {
+				case 1:
+					l.Name = string(v)
+				case 2:
+					l.Value = string(v)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Labels = append(ts.Labels, l)
+		case num == 2 && typ == protowire.BytesType:
+			var s Sample
+			err := fields(v, func(num protowire.Number, typ protowire.Type, v []byte) error {
+				switch {
+				case num == 1 && typ == protowire.Fixed64Type:
+					bits, _ := protowire.ConsumeFixed64(v)
+					s.Value = math.Float64frombits(bits)
+				case num == 2 && typ == protowire.VarintType:
+					ms, _ := protowire.ConsumeVarint(v)
+					s.Timestamp = int64(ms)
+				}
+				return nil
+			})
+			if err != nil {
+				return err
+			}
+			ts.Samples = append(ts.Samples, s)
+		}
+		return nil
+	})
+}
+
+// fields calls fn with every field of the message in b. Scalar values are
+// handed over still encoded, length delimited ones without their length.
+func fields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte) error) error {
+	for len(b) > 0 {
+		num, typ, n := protowire.ConsumeTag(b)
+		if n < 0 {
+			return ErrMalformed
+		}
+		b = b[n:]
+
+		m := protowire.ConsumeFieldValue(num, typ, b)
+		if m < 0 {
+			return ErrMalformed
+		}
+
+		v := b[:m]
+		if typ == protowire.BytesType {
+			v, _ = protowire.ConsumeBytes(v)
+		}
+
+		err := fn(num, typ, v)
+		if err != nil {
+			return err
+		}
+		b = b[m:]
+	}
+
+	return nil
+}
@@ -0,0 +1,291 @@
+package remotewrite_metrics
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/klauspost/compress/snappy"
+	"go.opentelemetry.io/contrib/instrumentation/net/http/otelhttp"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+	"wouldgo.me/meteotrentino-exporter/pkg/secret"
+)
+
+const (
+	defaultMaxRetries   = 3
+	defaultRetryBackoff = 500 * time.Millisecond
+	maxRetryBackoff     = 30 * time.Second
+
+	userAgent = "meteotrentino-exporter"
+)
+
+var (
+	_ metrics.Sink           = (*RemoteWriteMetrics)(nil)
+	_ metrics.StationDeleter = (*RemoteWriteMetrics)(nil)
+
+	// errRetryable marks failures worth sending the same request again.
+	errRetryable = errors.New("retryable remote write failure")
+)
+
+type MetricsConfig struct {
+	Logger *zap.Logger `validate:"required"`
+	Url    string      `validate:"required,url"`
+
+	BearerToken secret.Secret
+	// Headers are added to every request, e.g. X-Scope-OrgID for Mimir.
+	Headers map[string]string
+	// Labels are added to every series.
+	Labels map[string]string
+
+	MaxRetries   int `validate:"gte=0"`
+	RetryBackoff time.Duration
+}
+
+// RemoteWriteMetrics pushes every observation with its own timestamp to a
+// prometheus remote write endpoint. The observations already accepted are
+// not sent again, so the overlapping history of every fetch is pushed once.
+type RemoteWriteMetrics struct {
+	logger *zap.Logger
+	client *http.Client
+	url    string
+
+	token   secret.Secret
+	headers map[string]string
+	labels  []Label
+
+	maxRetries int
+	backoff    time.Duration
+
+	mu sync.Mutex
+	// sent is the time of the last sample sent, per station and metric
+	sent map[string]map[string]time.Time
+}
+
+func NewRemoteWriteMetrics(opts MetricsConfig) (*RemoteWriteMetrics, error) {
+	err := metrics.Validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return nil, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return nil, errors.Join(errs...)
+		}
+
+		return nil, err
+	}
+
+	labels := make([]Label, 0, len(opts.Labels))
+	for _, name := range slices.Sorted(maps.Keys(opts.Labels)) {
+		if name == "__name__" || name == "station" {
+			return nil, fmt.Errorf("reserved label %q", name)
+		}
+		labels = append(labels, Label{name, opts.Labels[name]})
+	}
+
+	maxRetries := defaultMaxRetries
+	if opts.MaxRetries != 0 {
+		maxRetries = opts.MaxRetries
+	}
+
+	backoff := defaultRetryBackoff
+	if opts.RetryBackoff != 0 {
+		backoff = opts.RetryBackoff
+	}
+
+	return &RemoteWriteMetrics{
+		logger: opts.Logger,
+		client: &http.Client{
+			Transport: otelhttp.NewTransport(http.DefaultTransport),
+		},
+		url:        opts.Url,
+		token:      opts.BearerToken,
+		headers:    opts.Headers,
+		labels:     labels,
+		maxRetries: maxRetries,
+		backoff:    backoff,
+		sent:       make(map[string]map[string]time.Time),
+	}, nil
+}
+
+func (m *RemoteWriteMetrics) Name() string {
+	return "remotewrite"
+}
+
+// series builds the series of the metric called name, with the samples of
+// stats after last.
+func (m *RemoteWriteMetrics) series(name, station string, stats []api.WeatherStat, last time.Time) (TimeSeries, time.Time) {
+	labels := make([]Label, 0, len(m.labels)+2)
+	labels = append(labels, Label{"__name__", name})
+	labels = append(labels, m.labels...)
+	labels = append(labels, Label{"station", station})
+	// remote write wants the labels sorted by name
+	slices.SortFunc(labels, func(a, b Label) int {
+		return strings.Compare(a.Name, b.Name)
+	})
+
+	ts := TimeSeries{Labels: labels}
+	for _, stat := range stats {
+		if !stat.Time().After(last) {
+			continue
+		}
+
+		ts.Samples = append(ts.Samples, Sample{
+			Value:     stat.Value(),
+			Timestamp: stat.Time().UnixMilli(),
+		})
+		last = stat.Time()
+	}
+
+	return ts, last
+}
+
+// Write sends the observations of the station newer than the ones already
+// sent, with the metric names of the prometheus sink.
+func (m *RemoteWriteMetrics) Write(ctx context.Context, stats metrics.StationStats) error {
+	station := strings.ToUpper(stats.Station.Code)
+
+	m.mu.Lock()
+	sent := maps.Clone(m.sent[station])
+	m.mu.Unlock()
+	if sent == nil {
+		sent = make(map[string]time.Time)
+	}
+
+	var request WriteRequest
+	for name, series := range map[string][]api.WeatherStat{
+		"temperature_celsius":              stats.Stats.Temperature(),
+		"humidity_percent":                 stats.Stats.Humidity(),
+		"precipitation_mm":                 stats.Stats.Precipitation(),
+		"radiation_watts_per_square_meter": stats.Stats.Radiation(),
+	} {
+		ts, last := m.series(name, station, series, sent[name])
+		if len(ts.Samples) == 0 {
+			continue
+		}
+
+		request.Timeseries = append(request.Timeseries, ts)
+		sent[name] = last
+	}
+
+	if len(request.Timeseries) == 0 {
+		m.logger.Debug("no new observations", zap.String("station", station))
+		return nil
+	}
+
+	err := m.send(ctx, snappy.Encode(nil, request.Marshal()))
+	if err != nil && errors.Is(err, errRetryable) {
+		// sent again with the next write
+		return err
+	}
+
+	// a rejected request would be rejected again, it is not sent twice
+	m.mu.Lock()
+	m.sent[station] = sent
+	m.mu.Unlock()
+	return err
+}
+
+// send posts the compressed request body, retrying with exponential backoff
+// on network errors, 5xx and 429 responses.
+func (m *RemoteWriteMetrics) send(ctx context.Context, body []byte) error {
+	backoff := m.backoff
+	for attempt := 0; ; attempt++ {
+		err := m.post(ctx, body)
+		if err == nil || !errors.Is(err, errRetryable) || attempt == m.maxRetries {
+			return err
+		}
+
+		m.logger.Warn("retrying remote write",
+			zap.Int("attempt", attempt+1), zap.Duration("backoff", backoff), zap.Error(err))
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(backoff):
+		}
+
+		backoff = min(2*backoff, maxRetryBackoff)
+	}
+}
+
+func (m *RemoteWriteMetrics) post(ctx context.Context, body []byte) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+
+	for name, value := range m.headers {
+		req.Header.Set(name, value)
+	}
+	req.Header.Set("Content-Encoding", "snappy")
+	req.Header.Set("Content-Type", "application/x-protobuf")
+	req.Header.Set("User-Agent", userAgent)
+	req.Header.Set("X-Prometheus-Remote-Write-Version", "0.1.0")
+
+	if !m.token.IsZero() {
+		token, err := m.token.Value()
+		if err != nil {
+			return fmt.Errorf("error reading remote write bearer token: %w", err)
+		}
+		req.Header.Set("Authorization", "Bearer "+token)
+	}
+
+	response, err := m.client.Do(req)
+	if err != nil {
+		if ctx.Err() != nil {
+			return err
+		}
+		return fmt.Errorf("%w: %w", errRetryable, err)
+	}
+
+	defer func() {
+		err := response.Body.Close()
+		if err != nil {
+			m.logger.Warn("error closing body", zap.Error(err))
+		}
+	}()
+
+	if response.StatusCode/100 == 2 {
+		_, _ = io.Copy(io.Discard, response.Body)
+		return nil
+	}
+
+	message, _ := io.ReadAll(io.LimitReader(response.Body, 512))
+	err = fmt.Errorf("remote write responded %d: %s", response.StatusCode, bytes.TrimSpace(message))
+	if response.StatusCode/100 == 5 || response.StatusCode == http.StatusTooManyRequests {
+		return fmt.Errorf("%w: %w", errRetryable, err)
+	}
+
+	return err
+}
+
+// Delete forgets the samples sent for a station no longer exported.
+func (m *RemoteWriteMetrics) Delete(station string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	delete(m.sent, strings.ToUpper(station))
+}
+
+func (m *RemoteWriteMetrics) Close() error {
+	m.client.CloseIdleConnections()
+	return nil
+}
@@ -0,0 +1,190 @@
+package remotewrite_metrics_test
+
+import (
+	"context"
+	"net/http"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+	remotewrite_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/remotewrite"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics/remotewrite/remotewritetest"
+	"wouldgo.me/meteotrentino-exporter/pkg/secret"
+)
+
+type stat struct {
+	time  time.Time
+	value float64
+}
+
+func (s stat) Time() time.Time { return s.time }
+func (s stat) Value() float64  { return s.value }
+
+// stats holds temperatures only, the other series are empty.
+type stats []api.WeatherStat
+
+func (s stats) Temperature() []api.WeatherStat   { return s }
+func (s stats) Humidity() []api.WeatherStat      { return nil }
+func (s stats) Precipitation() []api.WeatherStat { return nil }
+func (s stats) Radiation() []api.WeatherStat     { return nil }
+func (s stats) Wind() []api.WindStat             { return nil }
+
+var at = time.Date(2026, 10, 18, 10, 0, 0, 0, time.UTC)
+
+func temperatures(values ...float64) metrics.StationStats {
+	s := make(stats, 0, len(values))
+	for i, v := range values {
+		s = append(s, stat{at.Add(time.Duration(i) * 15 * time.Minute), v})
+	}
+
+	return metrics.StationStats{Station: api.Station{Code: "t0147"}, Stats: s}
+}
+
+func newMetrics(t *testing.T, receiver *remotewritetest.Receiver, maxRetries int) *remotewrite_metrics.RemoteWriteMetrics {
+	t.Helper()
+
+	m, err := remotewrite_metrics.NewRemoteWriteMetrics(remotewrite_metrics.MetricsConfig{
+		Logger:       zap.NewNop(),
+		Url:          receiver.URL,
+		BearerToken:  secret.New("token"),
+		Headers:      map[string]string{"X-Scope-OrgID": "tenant"},
+		Labels:       map[string]string{"site": "rovereto"},
+		MaxRetries:   maxRetries,
+		RetryBackoff: time.Millisecond,
+	})
+	if err != nil {
+		t.Fatalf("NewRemoteWriteMetrics() error = %v", err)
+	}
+	t.Cleanup(func() { _ = m.Close() })
+
+	return m
+}
+
+const series = `temperature_celsius{site="rovereto",station="T0147"}`
+
+func TestWrite(t *testing.T) {
+	receiver := remotewritetest.NewReceiver()
+	defer receiver.Close()
+	m := newMetrics(t, receiver, 0)
+
+	err := m.Write(context.Background(), temperatures(12.5, 12.9))
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+
+	samples := receiver.Series()[series]
+	if len(samples) != 2 {
+		t.Fatalf("received %v, want 2 samples of %s", receiver.Series(), series)
+	}
+	if samples[0].Value != 12.5 || samples[0].Timestamp != at.UnixMilli() {
+		t.Errorf("first sample = %+v, want 12.5 at %d", samples[0], at.UnixMilli())
+	}
+	if samples[1].Value != 12.9 || samples[1].Timestamp != at.Add(15*time.Minute).UnixMilli() {
+		t.Errorf("second sample = %+v, want 12.9 at %d", samples[1], at.Add(15*time.Minute).UnixMilli())
+	}
+
+	req := receiver.Requests()[0]
+	for header, want := range map[string]string{
+		"Content-Encoding":                  "snappy",
+		"Content-Type":                      "application/x-protobuf",
+		"X-Prometheus-Remote-Write-Version": "0.1.0",
+		"Authorization":                     "Bearer token",
+		"X-Scope-OrgID":                     "tenant",
+	} {
+		if got := req.Header.Get(header); got != want {
+			t.Errorf("header %s = %q, want %q", header, got, want)
+		}
+	}
+}
+
+func TestWriteSendsNewSamplesOnce(t *testing.T) {
+	receiver := remotewritetest.NewReceiver()
+	defer receiver.Close()
+	m := newMetrics(t, receiver, 0)
+	ctx := context.Background()
+
+	for _, stats := range []metrics.StationStats{
+		temperatures(12.5, 12.9),
+		// the next fetch overlaps the previous one
+		temperatures(12.5, 12.9),
+		temperatures(12.5, 12.9, 13.2),
+	} {
+		err := m.Write(ctx, stats)
+		if err != nil {
+			t.Fatalf("Write() error = %v", err)
+		}
+	}
+
+	// the receiver rejects resent samples, a rejection would fail a write
+	if got := len(receiver.Requests()); got != 2 {
+		t.Errorf("sent %d requests, want 2", got)
+	}
+	if got := len(receiver.Series()[series]); got != 3 {
+		t.Errorf("received %d samples, want 3", got)
+	}
+
+	m.Delete("T0147")
+	err := m.Write(ctx, temperatures(12.5))
+	if err == nil {
+		t.Errorf("Write() after Delete error = nil, want the rejection of the resent sample")
+	}
+}
+
+func TestWriteRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		statuses   []int
+		wantErr    bool
+		requests   int
+		samples    int
+	}{
+		{"server error", 3, []int{http.StatusServiceUnavailable}, false, 2, 1},
+		{"too many requests", 3, []int{http.StatusTooManyRequests, http.StatusTooManyRequests}, false, 3, 1},
+		{"retries exhausted", 1, []int{http.StatusInternalServerError, http.StatusBadGateway}, true, 2, 0},
+		{"client error", 3, []int{http.StatusBadRequest}, true, 1, 0},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			receiver := remotewritetest.NewReceiver()
+			defer receiver.Close()
+			m := newMetrics(t, receiver, tt.maxRetries)
+
+			receiver.Fail(tt.statuses...)
+			err := m.Write(context.Background(), temperatures(12.5))
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Write() error = %v, want error %t", err, tt.wantErr)
+			}
+			if got := len(receiver.Requests()); got != tt.requests {
+				t.Errorf("sent %d requests, want %d", got, tt.requests)
+			}
+			if got := len(receiver.Series()[series]); got != tt.samples {
+				t.Errorf("received %d samples, want %d", got, tt.samples)
+			}
+		})
+	}
+}
+
+func TestWriteResendsAfterRetriesExhausted(t *testing.T) {
+	receiver := remotewritetest.NewReceiver()
+	defer receiver.Close()
+	m := newMetrics(t, receiver, 1)
+	ctx := context.Background()
+
+	receiver.Fail(http.StatusServiceUnavailable, http.StatusServiceUnavailable)
+	err := m.Write(ctx, temperatures(12.5))
+	if err == nil {
+		t.Fatalf("Write() error = nil, want the exhausted retries")
+	}
+
+	err = m.Write(ctx, temperatures(12.5))
+	if err != nil {
+		t.Fatalf("Write() error = %v", err)
+	}
+	if got := len(receiver.Series()[series]); got != 1 {
+		t.Errorf("received %d samples, want 1", got)
+	}
+}
@@ -0,0 +1,141 @@
+// Package remotewritetest provides a stand-in prometheus remote write
+// endpoint, to exercise the remote write sink without a prometheus.
+package remotewritetest
+
+import (
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"slices"
+	"strings"
+	"sync"
+
+	"github.com/klauspost/compress/snappy"
+	remotewrite_metrics "wouldgo.me/meteotrentino-exporter/pkg/metrics/remotewrite"
+)
+
+// Receiver is a remote write endpoint keeping the samples it receives in
+// memory. Like prometheus, it rejects with 400 the samples not newer than
+// the last one of their series, after storing the others.
+type Receiver struct {
+	*httptest.Server
+
+	mu       sync.Mutex
+	series   map[string][]remotewrite_metrics.Sample
+	requests []*http.Request
+	failures []int
+}
+
+// NewReceiver starts a Receiver listening on a local port, it must be closed
+// after use.
+func NewReceiver() *Receiver {
+	r := &Receiver{
+		series: make(map[string][]remotewrite_metrics.Sample),
+	}
+	r.Server = httptest.NewServer(r)
+	return r
+}
+
+// Fail answers the next requests with the given statuses, one each, e.g.
+// Fail(503, 503) to exercise retries.
+func (r *Receiver) Fail(statuses ...int) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.failures = append(r.failures, statuses...)
+}
+
+// Series returns the samples received for every series, the series are
+// named like temperature_celsius{station="T0147"}.
+func (r *Receiver) Series() map[string][]remotewrite_metrics.Sample {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	series := make(map[string][]remotewrite_metrics.Sample, len(r.series))
+	for name, samples := range r.series {
+		series[name] = slices.Clone(samples)
+	}
+
+	return series
+}
+
+// Requests returns the requests received so far, failed ones included,
+// without their body.
+func (r *Receiver) Requests() []*http.Request {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	return slices.Clone(r.requests)
+}
+
+func (r *Receiver) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	r.requests = append(r.requests, req.Clone(req.Context()))
+	if len(r.failures) > 0 {
+		status := r.failures[0]
+		r.failures = r.failures[1:]
+		http.Error(w, http.StatusText(status), status)
+		return
+	}
+
+	if req.Method != http.MethodPost || req.Header.Get("Content-Encoding") != "snappy" {
+		http.Error(w, "expected a snappy encoded POST", http.StatusBadRequest)
+		return
+	}
+
+	compressed, err := io.ReadAll(req.Body)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	data, err := snappy.Decode(nil, compressed)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var request remotewrite_metrics.WriteRequest
+	err = request.Unmarshal(data)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	rejected := 0
+	for _, ts := range request.Timeseries {
+		name := seriesName(ts.Labels)
+		for _, sample := range ts.Samples {
+			stored := r.series[name]
+			if len(stored) > 0 && sample.Timestamp <= stored[len(stored)-1].Timestamp {
+				rejected++
+				continue
+			}
+			r.series[name] = append(stored, sample)
+		}
+	}
+
+	if rejected > 0 {
+		http.Error(w, fmt.Sprintf("%d out of order samples", rejected), http.StatusBadRequest)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func seriesName(labels []remotewrite_metrics.Label) string {
+	var name string
+	pairs := make([]string, 0, len(labels))
+	for _, l := range labels {
+		if l.Name == "__name__" {
+			name = l.Value
+			continue
+		}
+		pairs = append(pairs, fmt.Sprintf("%s=%q", l.Name, l.Value))
+	}
+
+	return name + "{" + strings.Join(pairs, ",") + "}"
+}
@@ -0,0 +1,40 @@
+package textfile_metrics
+
+import (
+	"flag"
+
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	"wouldgo.me/meteotrentino-exporter/pkg/options"
+)
+
+const pathEnv = "TEXTFILE_PATH"
+
+type TextfileOptions struct {
+	fs   *flag.FlagSet
+	env  options.Env
+	path *string
+}
+
+func NewTextfileOptions(fs *flag.FlagSet, env options.Env) *TextfileOptions {
+	var path string
+	fs.StringVar(&path, "textfile-path", "", "file in the node_exporter textfile collector directory the metrics are written to, ending in .prom, disabled if empty")
+
+	return &TextfileOptions{
+		fs,
+		env,
+		&path,
+	}
+}
+
+// Apply overrides the textfile sink of c, creating it when its env var or
+// flag is set.
+func (to *TextfileOptions) Apply(c *config.Config) error {
+	if v, ok := options.Override(to.fs, "textfile-path", to.path, to.env, pathEnv); ok {
+		if c.Sinks.Textfile == nil {
+			c.Sinks.Textfile = &config.Textfile{}
+		}
+		c.Sinks.Textfile.Path = v
+	}
+
+	return nil
+}
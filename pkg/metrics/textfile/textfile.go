@@ -0,0 +1,190 @@
+package textfile_metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+)
+
+// namespace prefixes every metric, keeping them apart from the node_exporter
+// ones.
+const namespace = "meteotrentino"
+
+var (
+	_ metrics.Sink           = (*TextfileMetrics)(nil)
+	_ metrics.StationDeleter = (*TextfileMetrics)(nil)
+)
+
+type MetricsConfig struct {
+	Logger *zap.Logger `validate:"required"`
+	// Path is the file in the node_exporter textfile collector directory,
+	// which only reads files ending in .prom.
+	Path string `validate:"required,endswith=.prom"`
+}
+
+// TextfileMetrics writes the latest observation of every station to a file
+// read by the node_exporter textfile collector. The collector does not accept
+// timestamps, the time of every observation is a gauge of its own.
+type TextfileMetrics struct {
+	logger *zap.Logger
+	path   string
+
+	// mu serializes the writes of the file
+	mu  sync.Mutex
+	reg *prometheus.Registry
+
+	temperature   *prometheus.GaugeVec
+	humidity      *prometheus.GaugeVec
+	precipitation *prometheus.GaugeVec
+	radiation     *prometheus.GaugeVec
+
+	observation *prometheus.GaugeVec
+	lastSuccess *prometheus.GaugeVec
+}
+
+func NewTextfileMetrics(opts MetricsConfig) (*TextfileMetrics, error) {
+	err := metrics.Validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return nil, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return nil, errors.Join(errs...)
+		}
+
+		return nil, err
+	}
+
+	reg := prometheus.NewRegistry()
+	m := &TextfileMetrics{
+		logger: opts.Logger,
+		path:   opts.Path,
+		reg:    reg,
+		temperature: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "temperature_celsius",
+			Help:      "Current temperature in celsius",
+		}, []string{"station"}),
+		humidity: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "humidity_percent",
+			Help:      "Current relative humidity in percent",
+		}, []string{"station"}),
+		precipitation: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "precipitation_mm",
+			Help:      "Current precipitation in millimeters",
+		}, []string{"station"}),
+		radiation: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "radiation_watts_per_square_meter",
+			Help:      "Current radiation in watts per square meter",
+		}, []string{"station"}),
+		observation: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "observation_timestamp_seconds",
+			Help:      "Unix time of the current observation of a variable",
+		}, []string{"station", "variable"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Namespace: namespace,
+			Name:      "last_success_timestamp_seconds",
+			Help:      "Unix time of the last successful fetch of a station",
+		}, []string{"station"}),
+	}
+
+	reg.MustRegister(
+		m.temperature,
+		m.humidity,
+		m.precipitation,
+		m.radiation,
+		m.observation,
+		m.lastSuccess,
+	)
+
+	return m, nil
+}
+
+func (m *TextfileMetrics) Name() string {
+	return "textfile"
+}
+
+// Write sets the gauges of the station to its latest observations and
+// replaces the file, atomically so the collector never reads half of it.
+func (m *TextfileMetrics) Write(ctx context.Context, stats metrics.StationStats) error {
+	station := strings.ToUpper(stats.Station.Code)
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	for _, g := range []struct {
+		variable string
+		gauge    *prometheus.GaugeVec
+		series   []api.WeatherStat
+	}{
+		{"temperature", m.temperature, stats.Stats.Temperature()},
+		{"humidity", m.humidity, stats.Stats.Humidity()},
+		{"precipitation", m.precipitation, stats.Stats.Precipitation()},
+		{"radiation", m.radiation, stats.Stats.Radiation()},
+	} {
+		if len(g.series) == 0 {
+			continue
+		}
+
+		last := g.series[len(g.series)-1]
+		g.gauge.WithLabelValues(station).Set(last.Value())
+		m.observation.WithLabelValues(station, g.variable).Set(float64(last.Time().Unix()))
+	}
+	m.lastSuccess.WithLabelValues(station).SetToCurrentTime()
+
+	return m.flush()
+}
+
+// flush writes the gauges to a temporary file, renamed over the file once
+// complete. It must be called holding mu.
+func (m *TextfileMetrics) flush() error {
+	err := prometheus.WriteToTextfile(m.path, m.reg)
+	if err != nil {
+		return fmt.Errorf("error writing textfile: %w", err)
+	}
+
+	return nil
+}
+
+// Delete drops the gauges of a station no longer exported from the file.
+func (m *TextfileMetrics) Delete(station string) {
+	labels := prometheus.Labels{"station": strings.ToUpper(station)}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+
+	m.temperature.Delete(labels)
+	m.humidity.Delete(labels)
+	m.precipitation.Delete(labels)
+	m.radiation.Delete(labels)
+	m.observation.DeletePartialMatch(labels)
+	m.lastSuccess.Delete(labels)
+
+	err := m.flush()
+	if err != nil {
+		m.logger.Error("error removing station from textfile", zap.String("station", station), zap.Error(err))
+	}
+}
+
+func (m *TextfileMetrics) Close() error {
+	return nil
+}
@@ -0,0 +1,61 @@
+package tsdb_metrics
+
+import (
+	"errors"
+	"flag"
+	"time"
+
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	"wouldgo.me/meteotrentino-exporter/pkg/options"
+)
+
+const (
+	dirEnv       = "TSDB_DIR"
+	retentionEnv = "TSDB_RETENTION"
+)
+
+type TsdbOptions struct {
+	fs             *flag.FlagSet
+	env            options.Env
+	dir, retention *string
+}
+
+func NewTsdbOptions(fs *flag.FlagSet, env options.Env) *TsdbOptions {
+	var dir, retention string
+	fs.StringVar(&dir, "tsdb-dir", "", "directory of the embedded time-series store keeping the observation history, disabled if empty")
+	fs.StringVar(&retention, "tsdb-retention", "0", "how long the embedded store keeps the observations, forever if 0 (default: 0)")
+
+	return &TsdbOptions{
+		fs,
+		env,
+		&dir,
+		&retention,
+	}
+}
+
+// Apply overrides the tsdb sink of c, creating it when its directory is set.
+// Its other settings only apply to a sink enabled this way or by the
+// configuration file.
+func (to *TsdbOptions) Apply(c *config.Config) error {
+	if v, ok := options.Override(to.fs, "tsdb-dir", to.dir, to.env, dirEnv); ok && v != "" {
+		if c.Sinks.Tsdb == nil {
+			c.Sinks.Tsdb = &config.Tsdb{}
+		}
+		c.Sinks.Tsdb.Dir = v
+	}
+
+	sink := c.Sinks.Tsdb
+	if sink == nil {
+		return nil
+	}
+
+	if v, ok := options.Override(to.fs, "tsdb-retention", to.retention, to.env, retentionEnv); ok {
+		retention, err := time.ParseDuration(v)
+		if err != nil || retention < 0 {
+			return errors.Join(options.ErrWrongParam("tsdb-retention"), err)
+		}
+		sink.Retention = retention
+	}
+
+	return nil
+}
@@ -0,0 +1,119 @@
+package tsdb_metrics
+
+import (
+	"fmt"
+	"strings"
+	"time"
+
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+	"wouldgo.me/meteotrentino-exporter/pkg/tsdb"
+)
+
+type storedStat struct {
+	time  time.Time
+	value float64
+}
+
+func (s *storedStat) Time() time.Time {
+	return s.time
+}
+
+func (s *storedStat) Value() float64 {
+	return s.value
+}
+
+type storedWind struct {
+	time                   time.Time
+	speed, gust, direction float64
+}
+
+func (s *storedWind) Time() time.Time {
+	return s.time
+}
+
+func (s *storedWind) Speed() float64 {
+	return s.speed
+}
+
+func (s *storedWind) Gust() float64 {
+	return s.gust
+}
+
+func (s *storedWind) Direction() float64 {
+	return s.direction
+}
+
+type storedStats struct {
+	series map[string][]api.WeatherStat
+	wind   []api.WindStat
+}
+
+func (s *storedStats) Temperature() []api.WeatherStat {
+	return s.series["temperature"]
+}
+
+func (s *storedStats) Humidity() []api.WeatherStat {
+	return s.series["humidity"]
+}
+
+func (s *storedStats) Precipitation() []api.WeatherStat {
+	return s.series["precipitation"]
+}
+
+func (s *storedStats) Radiation() []api.WeatherStat {
+	return s.series["radiation"]
+}
+
+func (s *storedStats) Wind() []api.WindStat {
+	return s.wind
+}
+
+// Stats reads back the stored observations of a station in [from, to] as
+// fetched, e.g. to restore the state of the sinks on restart. Downsampled
+// ranges yield the average of their buckets, wind only the times with all
+// of its components.
+func Stats(db *tsdb.DB, station string, from, to time.Time) (api.WeatherStats, error) {
+	station = strings.ToUpper(station)
+	stats := &storedStats{series: make(map[string][]api.WeatherStat)}
+	var speed []tsdb.Point
+	gust := make(map[time.Time]float64)
+	direction := make(map[time.Time]float64)
+
+	for _, variable := range Variables {
+		points, err := db.Query(station, variable, from, to, tsdb.QueryOptions{})
+		if err != nil {
+			return nil, fmt.Errorf("error querying %s of %s: %w", variable, station, err)
+		}
+
+		switch variable {
+		case "wind_speed":
+			speed = points
+		case "wind_gust":
+			for _, p := range points {
+				gust[p.Time] = p.Value
+			}
+		case "wind_direction":
+			for _, p := range points {
+				direction[p.Time] = p.Value
+			}
+		default:
+			for _, p := range points {
+				stats.series[variable] = append(stats.series[variable], &storedStat{time: p.Time, value: p.Value})
+			}
+		}
+	}
+
+	for _, p := range speed {
+		g, ok := gust[p.Time]
+		if !ok {
+			continue
+		}
+		d, ok := direction[p.Time]
+		if !ok {
+			continue
+		}
+		stats.wind = append(stats.wind, &storedWind{time: p.Time, speed: p.Value, gust: g, direction: d})
+	}
+
+	return stats, nil
+}
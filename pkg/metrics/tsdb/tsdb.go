@@ -0,0 +1,138 @@
+package tsdb_metrics
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+	"wouldgo.me/meteotrentino-exporter/pkg/tsdb"
+)
+
+var _ metrics.Sink = (*TsdbMetrics)(nil)
+
+// Variables are the series stored for every station, wind is split in a
+// variable per component.
+var Variables = []string{
+	"temperature",
+	"humidity",
+	"precipitation",
+	"radiation",
+	"wind_speed",
+	"wind_gust",
+	"wind_direction",
+}
+
+type MetricsConfig struct {
+	Logger *zap.Logger `validate:"required"`
+	DB     *tsdb.DB    `validate:"required"`
+
+	// CompactInterval, when set, compacts DB in the background every
+	// interval, until Close.
+	CompactInterval time.Duration `validate:"gte=0"`
+}
+
+// TsdbMetrics stores the observations of every station in the embedded
+// time-series store.
+type TsdbMetrics struct {
+	logger *zap.Logger
+	db     *tsdb.DB
+
+	// stop and compacting end the background compaction of db.
+	stop       context.CancelFunc
+	compacting sync.WaitGroup
+}
+
+func NewTsdbMetrics(opts MetricsConfig) (*TsdbMetrics, error) {
+	err := metrics.Validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return nil, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return nil, errors.Join(errs...)
+		}
+
+		return nil, err
+	}
+
+	m := &TsdbMetrics{
+		logger: opts.Logger,
+		db:     opts.DB,
+		stop:   func() {},
+	}
+
+	if opts.CompactInterval != 0 {
+		var ctx context.Context
+		ctx, m.stop = context.WithCancel(context.Background())
+		m.compacting.Go(func() {
+			m.db.Run(ctx, opts.CompactInterval)
+		})
+	}
+
+	return m, nil
+}
+
+// DB is the store written, for queries.
+func (m *TsdbMetrics) DB() *tsdb.DB {
+	return m.db
+}
+
+func (m *TsdbMetrics) Name() string {
+	return "tsdb"
+}
+
+func (m *TsdbMetrics) Write(ctx context.Context, stats metrics.StationStats) error {
+	code := strings.ToUpper(stats.Station.Code)
+
+	for variable, points := range Points(stats.Stats) {
+		err := m.db.Append(code, variable, points)
+		if err != nil {
+			return fmt.Errorf("error storing %s of %s: %w", variable, code, err)
+		}
+	}
+
+	return nil
+}
+
+// Points flattens stats into the points of every variable.
+func Points(stats api.WeatherStats) map[string][]tsdb.Point {
+	series := map[string][]tsdb.Point{}
+	for variable, stats := range map[string][]api.WeatherStat{
+		"temperature":   stats.Temperature(),
+		"humidity":      stats.Humidity(),
+		"precipitation": stats.Precipitation(),
+		"radiation":     stats.Radiation(),
+	} {
+		for _, stat := range stats {
+			series[variable] = append(series[variable], tsdb.Point{Time: stat.Time(), Value: stat.Value()})
+		}
+	}
+
+	for _, wind := range stats.Wind() {
+		series["wind_speed"] = append(series["wind_speed"], tsdb.Point{Time: wind.Time(), Value: wind.Speed()})
+		series["wind_gust"] = append(series["wind_gust"], tsdb.Point{Time: wind.Time(), Value: wind.Gust()})
+		series["wind_direction"] = append(series["wind_direction"], tsdb.Point{Time: wind.Time(), Value: wind.Direction()})
+	}
+
+	return series
+}
+
+func (m *TsdbMetrics) Close() error {
+	m.stop()
+	m.compacting.Wait()
+	return m.db.Close()
+}
@@ -6,80 +6,292 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 
 	"go.uber.org/zap"
 	"go.uber.org/zap/zapcore"
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	"wouldgo.me/meteotrentino-exporter/pkg/secret"
 )
 
 var (
 	ErrMissingStation = errors.New("missing station value")
+)
+
+// ConfigEnv names the configuration file, also for the commands registering
+// their own config flag instead of the common ones.
+const ConfigEnv = "CONFIG_FILE"
+
+const (
+	watchEnv    = "CONFIG_WATCH"
+	stationEnv  = "STATION"
+	intervalEnv = "INTERVAL"
 
-	stationEnv, stationEnvSet = os.LookupEnv("STATION")
+	logEnvEnv   = "LOG_ENV"
+	logLevelEnv = "LOG_LEVEL"
 
-	logEnvEnv, logEnvEnvSet     = os.LookupEnv("LOG_ENV")
-	logLevelEnv, logLevelEnvSet = os.LookupEnv("LOG_LEVEL")
+	adminServerEnv = "ADMIN_SERVER"
 )
 
+// Env resolves the env vars read by the options. Prefix is prepended to
+// every name, e.g. METEO_ turns STATION into METEO_STATION, and Lookup
+// replaces os.LookupEnv. The zero value reads the process environment.
+type Env struct {
+	Prefix string
+	Lookup func(key string) (string, bool)
+}
+
+func (e Env) LookupEnv(key string) (string, bool) {
+	if e.Lookup == nil {
+		return os.LookupEnv(e.Prefix + key)
+	}
+
+	return e.Lookup(e.Prefix + key)
+}
+
 func ErrWrongParam(param string) error {
 	return fmt.Errorf("wrong parameter value for %s", param)
 }
 
-type Options struct {
-	station, logEnv, logLevel *string
+// ParseKeyValues parses a comma separated list of key=value pairs, as used
+// by tags and labels flags, e.g. "site=rovereto,team=ops".
+func ParseKeyValues(s string) (map[string]string, error) {
+	toReturn := make(map[string]string)
+	for pair := range strings.SplitSeq(s, ",") {
+		pair = strings.TrimSpace(pair)
+		if pair == "" {
+			continue
+		}
+
+		key, value, found := strings.Cut(pair, "=")
+		key = strings.TrimSpace(key)
+		if !found || key == "" {
+			return nil, fmt.Errorf("malformed key=value pair %q", pair)
+		}
+
+		toReturn[key] = strings.TrimSpace(value)
+	}
+
+	return toReturn, nil
+}
+
+// Override resolves a setting following the precedence file, env, flags: it
+// returns the flag value when the flag was explicitly set, otherwise the
+// value of the env var key when set. ok is false when neither is, and the
+// value from the file, or its default, stands.
+func Override(fs *flag.FlagSet, name string, flagValue *string, env Env, key string) (string, bool) {
+	explicit := false
+	fs.Visit(func(f *flag.Flag) {
+		if f.Name == name {
+			explicit = true
+		}
+	})
+
+	if explicit {
+		return *flagValue, true
+	}
+
+	return env.LookupEnv(key)
 }
 
-type Config struct {
-	Station string
+// OverrideSecret resolves a secret like Override, the flag name and env key
+// have a -file and _FILE variant reading the secret from a file. At the same
+// precedence level the file wins.
+func OverrideSecret(fs *flag.FlagSet, name string, flagValue, fileFlagValue *string, env Env, key string) (secret.Secret, bool) {
+	explicit := make(map[string]bool, 2)
+	fs.Visit(func(f *flag.Flag) {
+		explicit[f.Name] = true
+	})
 
-	Log *zap.Logger
+	switch {
+	case explicit[name+"-file"]:
+		return secret.FromFile(*fileFlagValue), true
+	case explicit[name]:
+		return secret.New(*flagValue), true
+	}
+
+	if path, ok := env.LookupEnv(key + "_FILE"); ok {
+		return secret.FromFile(path), true
+	}
+	if value, ok := env.LookupEnv(key); ok {
+		return secret.New(value), true
+	}
+
+	return secret.Secret{}, false
 }
 
-func NewOptions() *Options {
-	var station, logEnv, logLevel string
+// LogOptions holds the logging flags, shared by every command.
+type LogOptions struct {
+	fs               *flag.FlagSet
+	env              Env
+	logEnv, logLevel *string
+}
 
-	flag.StringVar(&station, "station", "", "station code, you can find them looking here: https://content.meteotrentino.it/dati-meteo/stazioni/dati-meteo.html")
+func NewLogOptions(fs *flag.FlagSet, env Env) *LogOptions {
+	var logEnv, logLevel string
 
-	flag.StringVar(&logEnv, "log-env", "development", "logging enviroment type: production, development (default: development)")
-	flag.StringVar(&logLevel, "log-level", "debug", "logging level: info, debug, error, ... (default: debug)")
+	fs.StringVar(&logEnv, "log-env", "development", "logging enviroment type: production, development (default: development)")
+	fs.StringVar(&logLevel, "log-level", "debug", "logging level: info, debug, error, ... (default: debug)")
 
-	return &Options{
-		&station,
+	return &LogOptions{
+		fs,
+		env,
 		&logEnv,
 		&logLevel,
 	}
 }
 
-func (o *Options) Read() (*Config, error) {
-	flag.Parse()
+// Apply overrides the logging section of c with env vars and flags, it must
+// be called once the flag set is parsed.
+func (lo *LogOptions) Apply(c *config.Config) error {
+	if v, ok := Override(lo.fs, "log-env", lo.logEnv, lo.env, logEnvEnv); ok {
+		c.Logging.Env = v
+	}
 
-	if stationEnvSet {
-		o.station = &stationEnv
+	if v, ok := Override(lo.fs, "log-level", lo.logLevel, lo.env, logLevelEnv); ok {
+		c.Logging.Level = v
 	}
 
-	if logEnvEnvSet {
-		o.logEnv = &logEnvEnv
+	return nil
+}
+
+type Options struct {
+	*LogOptions
+	fs                               *flag.FlagSet
+	env                              Env
+	config, watch, station, interval *string
+}
+
+// NewOptions registers the common flags on fs, env vars are resolved through
+// env.
+func NewOptions(fs *flag.FlagSet, env Env) *Options {
+	var configPath, watch, station, interval string
+
+	fs.StringVar(&configPath, "config", "", "yaml configuration file, env vars and then flags take precedence over it")
+	fs.StringVar(&watch, "config-watch", "10s", "how often the configuration file is checked for changes to reload, disabled if 0 (default: 10s)")
+	fs.StringVar(&station, "station", "", "station code, or comma separated codes, you can find them looking here: https://content.meteotrentino.it/dati-meteo/stazioni/dati-meteo.html")
+	fs.StringVar(&interval, "interval", "15m", "polling interval, meteotrentino updates data every 15m (default: 15m)")
+
+	return &Options{
+		NewLogOptions(fs, env),
+		fs,
+		env,
+		&configPath,
+		&watch,
+		&station,
+		&interval,
 	}
+}
 
-	if logLevelEnvSet {
-		o.logLevel = &logLevelEnv
+// ConfigPath is the configuration file, empty when there is none.
+func (o *Options) ConfigPath() string {
+	path, _ := Override(o.fs, "config", o.config, o.env, ConfigEnv)
+	return path
+}
+
+// ConfigWatch is how often the configuration file is checked for changes.
+func (o *Options) ConfigWatch() (time.Duration, error) {
+	v := *o.watch
+	if override, ok := Override(o.fs, "config-watch", o.watch, o.env, watchEnv); ok {
+		v = override
+	}
+
+	watch, err := time.ParseDuration(v)
+	if err != nil || watch < 0 {
+		return 0, errors.Join(ErrWrongParam("config-watch"), err)
 	}
 
-	if *o.station == "" {
-		return nil, ErrMissingStation
+	return watch, nil
+}
+
+// Load reads the configuration file, when given, and overrides it with env
+// vars and flags. It must be called once the flag set is parsed, the other
+// options of the command are applied afterwards.
+func (o *Options) Load() (*config.Config, error) {
+	c := config.Default()
+	if path := o.ConfigPath(); path != "" {
+		var err error
+		c, err = config.Load(path)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	err := o.Apply(c)
+	if err != nil {
+		return nil, err
+	}
+
+	return c, nil
+}
+
+// Apply overrides stations, interval and logging of c with env vars and
+// flags. A station set this way replaces the stations of the file.
+func (o *Options) Apply(c *config.Config) error {
+	if v, ok := Override(o.fs, "station", o.station, o.env, stationEnv); ok {
+		c.Stations = c.Stations[:0]
+		for code := range strings.SplitSeq(v, ",") {
+			code = strings.TrimSpace(code)
+			if code != "" {
+				c.Stations = append(c.Stations, config.Station{Code: code})
+			}
+		}
 	}
 
-	logger, err := log(*o.logEnv, *o.logLevel)
+	if v, ok := Override(o.fs, "interval", o.interval, o.env, intervalEnv); ok {
+		interval, err := time.ParseDuration(v)
+		if err != nil || interval <= 0 {
+			return errors.Join(ErrWrongParam("interval"), err)
+		}
+		c.Interval = interval
+	}
+
+	if len(c.Stations) == 0 {
+		return ErrMissingStation
+	}
+
+	return o.LogOptions.Apply(c)
+}
+
+// AdminOptions holds the flags of the admin listener.
+type AdminOptions struct {
+	fs          *flag.FlagSet
+	env         Env
+	adminServer *string
+}
+
+func NewAdminOptions(fs *flag.FlagSet, env Env) *AdminOptions {
+	var adminServer string
+	fs.StringVar(&adminServer, "admin-server", "", "admin server binding address <ip>:<port>, serving pprof, config dump, log level and upstream payloads, disabled if empty")
+
+	return &AdminOptions{
+		fs,
+		env,
+		&adminServer,
+	}
+}
+
+// Apply overrides the admin address of c.
+func (ao *AdminOptions) Apply(c *config.Config) error {
+	if v, ok := Override(ao.fs, "admin-server", ao.adminServer, ao.env, adminServerEnv); ok {
+		c.Admin.Address = v
+	}
+
+	return nil
+}
+
+// NewLogger builds the logger described by the logging section, its level
+// can be changed at runtime through the returned one.
+func NewLogger(l config.Logging) (*zap.Logger, zap.AtomicLevel, error) {
+	logger, level, err := log(l.Env, l.Level)
 	if err != nil {
-		return nil, fmt.Errorf("error logger creation: %w", err)
+		return nil, level, fmt.Errorf("error logger creation: %w", err)
 	}
 
-	return &Config{
-		Station: *o.station,
-		Log:     logger,
-	}, nil
+	return logger, level, nil
 }
 
-func log(env, level string) (*zap.Logger, error) {
+func log(env, level string) (*zap.Logger, zap.AtomicLevel, error) {
 	var encoder zapcore.Encoder
 
 	if strings.EqualFold(env, "production") {
@@ -93,11 +305,11 @@ func log(env, level string) (*zap.Logger, error) {
 	//writer := bufio.NewWriter(os.Stderr)
 	ws := zapcore.AddSync(os.Stderr)
 
-	logLevel, err := zapcore.ParseLevel(level)
+	logLevel, err := zap.ParseAtomicLevel(level)
 	if err != nil {
-		return nil, fmt.Errorf("error level string not valid: %w", err)
+		return nil, logLevel, fmt.Errorf("error level string not valid: %w", err)
 	}
 
 	core := zapcore.NewCore(encoder, ws, logLevel)
-	return zap.New(core), nil
+	return zap.New(core), logLevel, nil
 }
@@ -1,8 +0,0 @@
-//go:build !profile
-
-package options
-
-import "go.uber.org/zap"
-
-func RunProfiler(addr string, logger *zap.Logger) {
-}
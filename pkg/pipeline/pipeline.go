@@ -0,0 +1,607 @@
+package pipeline
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.opentelemetry.io/otel"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/api"
+	"wouldgo.me/meteotrentino-exporter/pkg/metrics"
+	"wouldgo.me/meteotrentino-exporter/pkg/tracing"
+)
+
+var (
+	validate = validator.New(validator.WithRequiredStructEnabled())
+	tracer   = otel.Tracer("wouldgo.me/meteotrentino-exporter/pkg/pipeline")
+
+	ErrSinkPanic = errors.New("sink panicked")
+)
+
+const defaultSinkTimeout = 30 * time.Second
+
+// Station is a station fetched by the pipeline together with its client.
+// Interval overrides the pipeline one, Variables restricts what reaches the
+// sinks.
+type Station struct {
+	Station api.Station       `validate:"required"`
+	Api     api.MeteoTrentino `validate:"required"`
+
+	Interval  time.Duration
+	Variables []string
+}
+
+// Sink is a sink fed by the pipeline, each write is bounded by Timeout.
+type Sink struct {
+	Sink    metrics.Sink `validate:"required"`
+	Timeout time.Duration
+}
+
+// Hook observes the weather stats fetched for a station, before they are
+// written to the sinks. Hooks must not retain stats past the call.
+type Hook func(ctx context.Context, stats metrics.StationStats)
+
+type PipelineConfig struct {
+	Logger   *zap.Logger `validate:"required"`
+	Stations []Station   `validate:"required,min=1,dive"`
+	Sinks    []Sink      `validate:"required,min=1,dive"`
+	Hooks    []Hook
+
+	Interval   time.Duration
+	Registerer prometheus.Registerer
+}
+
+// Pipeline fetches the weather stats of every station on its interval and
+// fans them out to all the sinks. A failing, slow or panicking sink does not
+// affect the others. Stations and sinks can be added and removed while the
+// pipeline runs.
+type Pipeline struct {
+	logger   *zap.Logger
+	interval time.Duration
+	hooks    []Hook
+
+	mu       sync.Mutex
+	ctx      context.Context
+	running  sync.WaitGroup
+	stations map[string]*stationEntry
+	sinks    []*sinkEntry
+
+	writeErrors *prometheus.CounterVec
+	lastSuccess *prometheus.GaugeVec
+	registerer  prometheus.Registerer
+}
+
+// stationEntry is a station of the pipeline. done is set while its loop runs,
+// or while it waits for the one it replaces, and closed once that is over.
+type stationEntry struct {
+	Station
+	stop chan struct{}
+	done chan struct{}
+}
+
+func newStationEntry(station Station) *stationEntry {
+	return &stationEntry{station, make(chan struct{}), nil}
+}
+
+// sinkEntry tracks the writes in flight, so that a removed sink is closed
+// only once they are over.
+type sinkEntry struct {
+	Sink
+	inflight sync.WaitGroup
+}
+
+func NewPipeline(opts PipelineConfig) (*Pipeline, error) {
+	err := validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return nil, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return nil, errors.Join(errs...)
+		}
+
+		return nil, err
+	}
+
+	interval := 15 * time.Minute
+	if opts.Interval != 0 {
+		interval = opts.Interval
+	}
+
+	p := &Pipeline{
+		logger:   opts.Logger,
+		interval: interval,
+		hooks:    opts.Hooks,
+		stations: make(map[string]*stationEntry, len(opts.Stations)),
+		sinks:    make([]*sinkEntry, 0, len(opts.Sinks)),
+		writeErrors: prometheus.NewCounterVec(prometheus.CounterOpts{
+			Name: "sink_write_errors_total",
+			Help: "Failed writes of weather stats to a sink",
+		}, []string{"sink", "station"}),
+		lastSuccess: prometheus.NewGaugeVec(prometheus.GaugeOpts{
+			Name: "sink_last_success_timestamp_seconds",
+			Help: "Unix time of the last successful write of weather stats to a sink",
+		}, []string{"sink", "station"}),
+	}
+
+	for _, station := range opts.Stations {
+		p.stations[code(station)] = newStationEntry(station)
+	}
+	for _, sink := range opts.Sinks {
+		p.sinks = append(p.sinks, &sinkEntry{Sink: sink})
+	}
+
+	if opts.Registerer != nil {
+		p.registerer = opts.Registerer
+		err = errors.Join(
+			opts.Registerer.Register(p.writeErrors),
+			opts.Registerer.Register(p.lastSuccess),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error registering pipeline metrics: %w", err)
+		}
+	}
+
+	return p, nil
+}
+
+func code(station Station) string {
+	return strings.ToUpper(station.Station.Code)
+}
+
+// RunOnce fetches every station and writes the results to every sink, the
+// returned error joins all fetch and sink failures.
+func (p *Pipeline) RunOnce(ctx context.Context) error {
+	p.mu.Lock()
+	stations := make([]Station, 0, len(p.stations))
+	for _, entry := range p.stations {
+		stations = append(stations, entry.Station)
+	}
+	p.mu.Unlock()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(stations))
+
+	for i, station := range stations {
+		wg.Go(func() {
+			errs[i] = p.runStation(ctx, station)
+		})
+	}
+
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (p *Pipeline) runStation(ctx context.Context, station Station) (err error) {
+	code := code(station)
+
+	// the root of a polling round, the fetch and the writes are below it
+	ctx, span := tracer.Start(ctx, "pipeline.station", trace.WithAttributes(
+		tracing.StationKey.String(code),
+	))
+	defer func() { tracing.End(span, err) }()
+
+	stats, err := station.Api.FetchData(ctx)
+	if err != nil {
+		p.logger.Error("error fetching data", zap.String("station", code), zap.Error(err))
+		p.fetchFailed(ctx, code, err)
+		return fmt.Errorf("error fetching %s: %w", code, err)
+	}
+
+	stationStats := metrics.StationStats{
+		Station: station.Station,
+		Stats:   api.SelectVariables(stats, station.Variables),
+	}
+
+	for _, hook := range p.hooks {
+		p.observe(ctx, hook, stationStats)
+	}
+
+	return p.fanOut(ctx, stationStats)
+}
+
+// fetchFailed tells the sinks observing the upstream health that fetching
+// the station failed.
+func (p *Pipeline) fetchFailed(ctx context.Context, code string, err error) {
+	sinks := p.acquireSinks()
+	for _, sink := range sinks {
+		if observer, ok := sink.Sink.Sink.(metrics.FetchObserver); ok {
+			observer.FetchFailed(ctx, code, err)
+		}
+		sink.inflight.Done()
+	}
+}
+
+func (p *Pipeline) observe(ctx context.Context, hook Hook, stats metrics.StationStats) {
+	defer func() {
+		if r := recover(); r != nil {
+			p.logger.Error("hook panicked",
+				zap.String("station", strings.ToUpper(stats.Station.Code)), zap.Any("panic", r))
+		}
+	}()
+
+	hook(ctx, stats)
+}
+
+// acquireSinks snapshots the sinks, marking a write in flight on each.
+func (p *Pipeline) acquireSinks() []*sinkEntry {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	sinks := slices.Clone(p.sinks)
+	for _, sink := range sinks {
+		sink.inflight.Add(1)
+	}
+
+	return sinks
+}
+
+func (p *Pipeline) fanOut(ctx context.Context, stats metrics.StationStats) error {
+	sinks := p.acquireSinks()
+
+	var wg sync.WaitGroup
+	errs := make([]error, len(sinks))
+
+	for i, sink := range sinks {
+		wg.Go(func() {
+			defer sink.inflight.Done()
+			errs[i] = p.write(ctx, sink.Sink, stats)
+		})
+	}
+
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+func (p *Pipeline) write(ctx context.Context, sink Sink, stats metrics.StationStats) (err error) {
+	name := sink.Sink.Name()
+	code := strings.ToUpper(stats.Station.Code)
+	logger := p.logger.With(zap.String("sink", name), zap.String("station", code))
+
+	timeout := defaultSinkTimeout
+	if sink.Timeout != 0 {
+		timeout = sink.Timeout
+	}
+
+	innerCtx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+
+	innerCtx, span := tracer.Start(innerCtx, "sink.write", trace.WithAttributes(
+		attribute.String("sink", name),
+		tracing.StationKey.String(code),
+	))
+
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %s: %v", ErrSinkPanic, name, r)
+		}
+		tracing.End(span, err)
+
+		if err != nil {
+			logger.Error("error writing to sink", zap.Error(err))
+			p.writeErrors.WithLabelValues(name, code).Inc()
+			return
+		}
+
+		p.lastSuccess.WithLabelValues(name, code).SetToCurrentTime()
+	}()
+
+	logger.Debug("writing to sink")
+	err = sink.Sink.Write(innerCtx, stats)
+	if err != nil {
+		return fmt.Errorf("error writing %s to %s: %w", code, name, err)
+	}
+
+	return nil
+}
+
+// Run fetches every station right away and then every interval, the
+// station one when set, until ctx is done.
+func (p *Pipeline) Run(ctx context.Context) {
+	p.mu.Lock()
+	p.ctx = ctx
+	for _, entry := range p.stations {
+		p.start(entry)
+	}
+	p.mu.Unlock()
+
+	<-ctx.Done()
+	p.running.Wait()
+}
+
+// start runs the loop of entry, if the pipeline is running and entry is
+// not already running or waiting. It must be called holding mu.
+func (p *Pipeline) start(entry *stationEntry) {
+	if p.ctx == nil || p.ctx.Err() != nil || entry.done != nil {
+		return
+	}
+
+	done := make(chan struct{})
+	entry.done = done
+	p.running.Go(func() {
+		defer close(done)
+		p.runEvery(p.ctx, entry)
+	})
+}
+
+func (p *Pipeline) runEvery(ctx context.Context, entry *stationEntry) {
+	interval := p.interval
+	if entry.Interval != 0 {
+		interval = entry.Interval
+	}
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		// a stopped station completes the fetch in flight
+		err := p.runStation(ctx, entry.Station)
+		if err != nil {
+			p.logger.Warn("pipeline round completed with errors",
+				zap.String("station", code(entry.Station)), zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-entry.stop:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// Stations lists the stations being fetched.
+func (p *Pipeline) Stations() []Station {
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	stations := make([]Station, 0, len(p.stations))
+	for _, entry := range p.stations {
+		stations = append(stations, entry.Station)
+	}
+
+	return stations
+}
+
+// AddStation adds station, replacing the one with the same code. When the
+// variables change, the new station starts once the sinks have dropped the
+// state of the old one.
+func (p *Pipeline) AddStation(station Station) {
+	code := code(station)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	entry := newStationEntry(station)
+	old, ok := p.stations[code]
+	p.stations[code] = entry
+
+	if !ok {
+		p.start(entry)
+		return
+	}
+
+	p.retire(code, old, entry, !slices.Equal(old.Variables, station.Variables))
+}
+
+// RemoveStation stops fetching the station with code, its fetch in flight,
+// if any, completes.
+func (p *Pipeline) RemoveStation(code string) {
+	code = strings.ToUpper(code)
+
+	p.mu.Lock()
+	defer p.mu.Unlock()
+
+	old, ok := p.stations[code]
+	if !ok {
+		return
+	}
+
+	delete(p.stations, code)
+	p.retire(code, old, nil, true)
+}
+
+// retire stops the loop of old and waits, in the background, for its fetch
+// in flight to be over. Then, when drop is set, the sinks drop their per
+// station state, which a late write of old could otherwise bring back, and
+// next, if any and not replaced in the meantime, starts. It must be called
+// holding mu.
+func (p *Pipeline) retire(code string, old, next *stationEntry, drop bool) {
+	close(old.stop)
+	prev := old.done
+	if next != nil {
+		next.done = make(chan struct{})
+	}
+
+	p.running.Go(func() {
+		if prev != nil {
+			<-prev
+		}
+		if drop {
+			p.deleteStation(code)
+		}
+		if next == nil {
+			return
+		}
+
+		p.mu.Lock()
+		defer p.mu.Unlock()
+
+		if p.stations[code] != next {
+			// the station replacing next waits for this
+			close(next.done)
+			return
+		}
+
+		next.done = nil
+		p.start(next)
+	})
+}
+
+// deleteStation drops the per station state of the sinks.
+func (p *Pipeline) deleteStation(code string) {
+	sinks := p.acquireSinks()
+	for _, sink := range sinks {
+		if deleter, ok := sink.Sink.Sink.(metrics.StationDeleter); ok {
+			deleter.Delete(code)
+		}
+		sink.inflight.Done()
+	}
+
+	p.writeErrors.DeletePartialMatch(prometheus.Labels{"station": code})
+	p.lastSuccess.DeletePartialMatch(prometheus.Labels{"station": code})
+}
+
+// AddSink adds sink, replacing and closing the one with the same name.
+func (p *Pipeline) AddSink(sink Sink) error {
+	p.mu.Lock()
+	old := p.removeSink(sink.Sink.Name())
+	p.sinks = append(p.sinks, &sinkEntry{Sink: sink})
+	p.mu.Unlock()
+
+	return p.closeSink(old)
+}
+
+// RemoveSink removes and closes the sink called name, once its writes in
+// flight are over.
+func (p *Pipeline) RemoveSink(name string) error {
+	p.mu.Lock()
+	old := p.removeSink(name)
+	p.mu.Unlock()
+
+	if old != nil {
+		p.writeErrors.DeletePartialMatch(prometheus.Labels{"sink": name})
+		p.lastSuccess.DeletePartialMatch(prometheus.Labels{"sink": name})
+	}
+
+	return p.closeSink(old)
+}
+
+func (p *Pipeline) removeSink(name string) *sinkEntry {
+	index := slices.IndexFunc(p.sinks, func(sink *sinkEntry) bool {
+		return sink.Sink.Sink.Name() == name
+	})
+	if index < 0 {
+		return nil
+	}
+
+	old := p.sinks[index]
+	p.sinks = slices.Delete(p.sinks, index, index+1)
+	return old
+}
+
+func (p *Pipeline) closeSink(sink *sinkEntry) error {
+	if sink == nil {
+		return nil
+	}
+
+	sink.inflight.Wait()
+	err := sink.Sink.Sink.Close()
+	if err != nil {
+		return fmt.Errorf("error closing %s: %w", sink.Sink.Sink.Name(), err)
+	}
+
+	return nil
+}
+
+// Close closes every sink, once its writes in flight are over, and
+// unregisters the pipeline metrics, so that a new pipeline can register
+// them again.
+func (p *Pipeline) Close() error {
+	p.mu.Lock()
+	sinks := p.sinks
+	p.sinks = nil
+	p.mu.Unlock()
+
+	if p.registerer != nil {
+		p.registerer.Unregister(p.writeErrors)
+		p.registerer.Unregister(p.lastSuccess)
+	}
+
+	errs := make([]error, 0, len(sinks))
+	for _, sink := range sinks {
+		errs = append(errs, p.closeSink(sink))
+	}
+
+	return errors.Join(errs...)
+}
+
+type StationOptions struct {
+	Code   string      `validate:"required"`
+	Logger *zap.Logger `validate:"required"`
+
+	// Catalog is optional, when given the station details are looked up
+	// there. It is fetched once for all the stations built.
+	Catalog   []api.Station
+	Interval  time.Duration
+	Variables []string
+
+	BaseUrl     string
+	Timeout     time.Duration
+	KeepPayload bool
+}
+
+// NewStation builds the pipeline station described by opts.
+func NewStation(opts StationOptions) (Station, error) {
+	err := validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return Station{}, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return Station{}, errors.Join(errs...)
+		}
+
+		return Station{}, err
+	}
+
+	station := api.Station{Code: strings.ToUpper(opts.Code)}
+	if opts.Catalog != nil {
+		station, err = api.FindStation(opts.Catalog, opts.Code)
+		if err != nil {
+			return Station{}, fmt.Errorf("error looking up station %s: %w", opts.Code, err)
+		}
+	}
+
+	meteo, err := api.NewMeteoTrentino(api.MeteoTrentinoOptions{
+		StationCode:     station.Code,
+		Logger:          opts.Logger,
+		BaseUrl:         opts.BaseUrl,
+		TimeoutDuration: opts.Timeout,
+		KeepPayload:     opts.KeepPayload,
+	})
+	if err != nil {
+		return Station{}, fmt.Errorf("error creating meteo trentino client: %w", err)
+	}
+
+	return Station{
+		Station:   station,
+		Api:       meteo,
+		Interval:  opts.Interval,
+		Variables: opts.Variables,
+	}, nil
+}
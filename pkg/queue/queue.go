@@ -0,0 +1,804 @@
+package queue
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+var (
+	validate = validator.New(validator.WithRequiredStructEnabled())
+
+	ErrCorrupted = errors.New("corrupted record")
+	ErrClosed    = errors.New("queue closed")
+)
+
+const (
+	segmentExt = ".seg"
+	cursorFile = "cursor"
+
+	// length (4) + crc32 (4) + unix nano timestamp (8)
+	headerSize = 16
+)
+
+// Deliver hands a record over to a sink, a nil error acknowledges it. An
+// error wrapped with Permanent drops the record instead of retrying it.
+type Deliver func(ctx context.Context, record []byte) error
+
+type permanentError struct {
+	err error
+}
+
+func (e *permanentError) Error() string {
+	return e.err.Error()
+}
+
+func (e *permanentError) Unwrap() error {
+	return e.err
+}
+
+// Permanent marks err, returned by a Deliver, as one no retry can fix, e.g.
+// the sink rejecting the record as malformed.
+func Permanent(err error) error {
+	if err == nil {
+		return nil
+	}
+	return &permanentError{err}
+}
+
+// IsPermanent tells if err was marked with Permanent.
+func IsPermanent(err error) bool {
+	var permanent *permanentError
+	return errors.As(err, &permanent)
+}
+
+type QueueOptions struct {
+	Dir    string      `validate:"required"`
+	Logger *zap.Logger `validate:"required"`
+
+	// Name identifies the queue in metrics and logs, e.g. the sink name.
+	Name       string
+	Registerer prometheus.Registerer
+
+	SegmentSize int64 `validate:"gte=0"`
+	MaxSize     int64 `validate:"gte=0"`
+	MaxAge      time.Duration
+
+	InitialBackoff time.Duration
+	MaxBackoff     time.Duration
+	MaxRetries     int `validate:"gte=0"`
+}
+
+type segment struct {
+	seq     uint64
+	size    int64
+	records int
+}
+
+type cursor struct {
+	seq    uint64
+	offset int64
+}
+
+// Queue is a disk backed FIFO of opaque records. Records are appended to
+// the newest segment file and drained from the oldest one, the position of
+// the first undelivered record is kept in a cursor file, so a restart
+// resumes where the previous run stopped.
+type Queue struct {
+	dir    string
+	name   string
+	logger *zap.Logger
+
+	segmentSize int64
+	maxSize     int64
+	maxAge      time.Duration
+
+	initialBackoff time.Duration
+	maxBackoff     time.Duration
+	maxRetries     int
+
+	mu       sync.Mutex
+	drainMu  sync.Mutex
+	closed   bool
+	segments []*segment
+	cursor   cursor
+	active   *os.File
+
+	depth     prometheus.Gauge
+	size      prometheus.Gauge
+	dropped   prometheus.Counter
+	rejected  prometheus.Counter
+	corrupted prometheus.Counter
+	failures  prometheus.Counter
+
+	registerer prometheus.Registerer
+	registered []prometheus.Collector
+}
+
+func NewQueue(opts QueueOptions) (*Queue, error) {
+	err := validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return nil, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return nil, errors.Join(errs...)
+		}
+
+		return nil, err
+	}
+
+	err = os.MkdirAll(opts.Dir, 0o750)
+	if err != nil {
+		return nil, fmt.Errorf("error creating queue directory: %w", err)
+	}
+
+	name := opts.Name
+	if name == "" {
+		name = filepath.Base(opts.Dir)
+	}
+
+	labels := prometheus.Labels{"queue": name}
+	q := &Queue{
+		dir:            opts.Dir,
+		name:           name,
+		logger:         opts.Logger.With(zap.String("queue", name)),
+		segmentSize:    8 * 1024 * 1024,
+		maxSize:        256 * 1024 * 1024,
+		maxAge:         opts.MaxAge,
+		initialBackoff: time.Second,
+		maxBackoff:     time.Minute,
+		maxRetries:     5,
+		depth: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "queue_records",
+			Help:        "Number of records waiting in the write-ahead queue",
+			ConstLabels: labels,
+		}),
+		size: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name:        "queue_size_bytes",
+			Help:        "Size in bytes of the records waiting in the write-ahead queue",
+			ConstLabels: labels,
+		}),
+		dropped: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "queue_dropped_records_total",
+			Help:        "Records dropped from the write-ahead queue because of size or age caps",
+			ConstLabels: labels,
+		}),
+		rejected: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "queue_rejected_records_total",
+			Help:        "Records dropped from the write-ahead queue because the sink rejected them for good",
+			ConstLabels: labels,
+		}),
+		corrupted: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "queue_corrupted_records_total",
+			Help:        "Records of the write-ahead queue skipped because they failed their checksum",
+			ConstLabels: labels,
+		}),
+		failures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name:        "queue_delivery_failures_total",
+			Help:        "Failed attempts to deliver a record of the write-ahead queue",
+			ConstLabels: labels,
+		}),
+	}
+
+	if opts.SegmentSize != 0 {
+		q.segmentSize = opts.SegmentSize
+	}
+	if opts.MaxSize != 0 {
+		q.maxSize = opts.MaxSize
+	}
+	if opts.InitialBackoff != 0 {
+		q.initialBackoff = opts.InitialBackoff
+	}
+	if opts.MaxBackoff != 0 {
+		q.maxBackoff = opts.MaxBackoff
+	}
+	if opts.MaxRetries != 0 {
+		q.maxRetries = opts.MaxRetries
+	}
+
+	// the cap drops whole segments, never the one being appended to
+	if q.maxSize < q.segmentSize {
+		return nil, fmt.Errorf("queue max size %d is below the segment size %d", q.maxSize, q.segmentSize)
+	}
+
+	if opts.Registerer != nil {
+		q.registerer = opts.Registerer
+		for _, c := range []prometheus.Collector{q.depth, q.size, q.dropped, q.rejected, q.corrupted, q.failures} {
+			err = opts.Registerer.Register(c)
+			if err != nil {
+				q.unregister()
+				return nil, fmt.Errorf("error registering queue metrics: %w", err)
+			}
+			q.registered = append(q.registered, c)
+		}
+	}
+
+	err = q.open()
+	if err != nil {
+		q.unregister()
+		return nil, err
+	}
+
+	return q, nil
+}
+
+func (q *Queue) segmentPath(seq uint64) string {
+	return filepath.Join(q.dir, fmt.Sprintf("%016x%s", seq, segmentExt))
+}
+
+// open loads segments and cursor from disk, a torn record at the tail of a
+// segment (e.g. after a crash) is truncated away. Corrupted records are kept,
+// to be skipped when drained.
+func (q *Queue) open() error {
+	entries, err := os.ReadDir(q.dir)
+	if err != nil {
+		return fmt.Errorf("error reading queue directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		if entry.IsDir() || !strings.HasSuffix(name, segmentExt) {
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, segmentExt), 16, 64)
+		if err != nil {
+			q.logger.Warn("ignoring unknown file in queue directory", zap.String("file", name))
+			continue
+		}
+
+		q.segments = append(q.segments, &segment{seq: seq})
+	}
+
+	slices.SortFunc(q.segments, func(a, b *segment) int {
+		if a.seq < b.seq {
+			return -1
+		}
+		if a.seq > b.seq {
+			return 1
+		}
+		return 0
+	})
+
+	err = q.readCursor()
+	if err != nil {
+		return err
+	}
+
+	for _, s := range q.segments {
+		valid, records, err := q.scan(s.seq)
+		if err != nil {
+			return err
+		}
+
+		info, err := os.Stat(q.segmentPath(s.seq))
+		if err != nil {
+			return fmt.Errorf("error reading segment: %w", err)
+		}
+
+		if valid < info.Size() {
+			q.logger.Warn("truncating torn segment tail",
+				zap.Uint64("segment", s.seq),
+				zap.Int64("valid", valid),
+				zap.Int64("size", info.Size()),
+			)
+			err = os.Truncate(q.segmentPath(s.seq), valid)
+			if err != nil {
+				return fmt.Errorf("error truncating segment: %w", err)
+			}
+		}
+
+		s.size = valid
+		s.records = records
+	}
+
+	if len(q.segments) == 0 {
+		q.segments = append(q.segments, &segment{seq: 1})
+	}
+
+	// segments before the cursor were already delivered
+	for len(q.segments) > 1 && q.segments[0].seq < q.cursor.seq {
+		err = q.removeOldest()
+		if err != nil {
+			return err
+		}
+	}
+
+	// the cursor may point to a segment already removed
+	if q.cursor.seq != q.segments[0].seq {
+		q.cursor = cursor{seq: q.segments[0].seq}
+
+		_, q.segments[0].records, err = q.scan(q.cursor.seq)
+		if err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+
+	last := q.segments[len(q.segments)-1]
+	q.active, err = os.OpenFile(q.segmentPath(last.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("error opening active segment: %w", err)
+	}
+
+	q.updateMetrics()
+	return nil
+}
+
+// scan walks a segment returning the offset after the last whole record
+// and the number of records not yet delivered.
+func (q *Queue) scan(seq uint64) (int64, int, error) {
+	f, err := os.Open(q.segmentPath(seq))
+	if err != nil {
+		return 0, 0, fmt.Errorf("error opening segment: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return 0, 0, fmt.Errorf("error reading segment: %w", err)
+	}
+
+	var offset int64
+	records := 0
+	for {
+		_, payload, err := readRecord(f, info.Size()-offset)
+		if err != nil && !errors.Is(err, ErrCorrupted) {
+			return offset, records, nil
+		}
+
+		if seq > q.cursor.seq || (seq == q.cursor.seq && offset >= q.cursor.offset) {
+			records++
+		}
+		offset += int64(headerSize + len(payload))
+	}
+}
+
+// readRecord reads a record from r, holding at most size bytes. A record
+// failing its checksum is returned with ErrCorrupted, along with its payload
+// to skip it, one longer than size with io.ErrUnexpectedEOF.
+func readRecord(r io.Reader, size int64) (time.Time, []byte, error) {
+	var header [headerSize]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	length := binary.BigEndian.Uint32(header[0:4])
+	sum := binary.BigEndian.Uint32(header[4:8])
+	ts := int64(binary.BigEndian.Uint64(header[8:16]))
+
+	if int64(length) > size-headerSize {
+		return time.Time{}, nil, io.ErrUnexpectedEOF
+	}
+
+	payload := make([]byte, length)
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return time.Time{}, nil, err
+	}
+
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write(header[8:16])
+	_, _ = crc.Write(payload)
+	if crc.Sum32() != sum {
+		return time.Time{}, payload, ErrCorrupted
+	}
+
+	return time.Unix(0, ts), payload, nil
+}
+
+func encodeRecord(ts time.Time, payload []byte) []byte {
+	buf := make([]byte, headerSize+len(payload))
+	binary.BigEndian.PutUint32(buf[0:4], uint32(len(payload)))
+	binary.BigEndian.PutUint64(buf[8:16], uint64(ts.UnixNano()))
+	copy(buf[headerSize:], payload)
+
+	crc := crc32.NewIEEE()
+	_, _ = crc.Write(buf[8:])
+	binary.BigEndian.PutUint32(buf[4:8], crc.Sum32())
+
+	return buf
+}
+
+func (q *Queue) readCursor() error {
+	data, err := os.ReadFile(filepath.Join(q.dir, cursorFile))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil
+	}
+	if err != nil {
+		return fmt.Errorf("error reading queue cursor: %w", err)
+	}
+
+	_, err = fmt.Sscanf(string(data), "%x %d", &q.cursor.seq, &q.cursor.offset)
+	if err != nil {
+		q.logger.Warn("ignoring malformed queue cursor", zap.Error(err))
+		q.cursor = cursor{}
+	}
+
+	return nil
+}
+
+func (q *Queue) writeCursor() error {
+	path := filepath.Join(q.dir, cursorFile)
+	tmp := path + ".tmp"
+
+	err := os.WriteFile(tmp, fmt.Appendf(nil, "%x %d", q.cursor.seq, q.cursor.offset), 0o640)
+	if err != nil {
+		return fmt.Errorf("error writing queue cursor: %w", err)
+	}
+
+	return os.Rename(tmp, path)
+}
+
+// pending returns depth and size of the records after the cursor.
+func (q *Queue) pending() (int, int64) {
+	records := 0
+	var size int64
+	for _, s := range q.segments {
+		if s.seq < q.cursor.seq {
+			continue
+		}
+
+		records += s.records
+		size += s.size
+		if s.seq == q.cursor.seq {
+			size -= q.cursor.offset
+		}
+	}
+
+	return records, size
+}
+
+func (q *Queue) updateMetrics() {
+	records, size := q.pending()
+	q.depth.Set(float64(records))
+	q.size.Set(float64(size))
+}
+
+// Len returns the number of records waiting to be delivered.
+func (q *Queue) Len() int {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	records, _ := q.pending()
+	return records
+}
+
+// Append durably stores record at the tail of the queue.
+func (q *Queue) Append(record []byte) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return ErrClosed
+	}
+
+	last := q.segments[len(q.segments)-1]
+	if last.size >= q.segmentSize {
+		err := q.rotate()
+		if err != nil {
+			return err
+		}
+		last = q.segments[len(q.segments)-1]
+	}
+
+	buf := encodeRecord(time.Now(), record)
+	_, err := q.active.Write(buf)
+	if err != nil {
+		return fmt.Errorf("error appending to queue: %w", err)
+	}
+
+	err = q.active.Sync()
+	if err != nil {
+		return fmt.Errorf("error syncing queue: %w", err)
+	}
+
+	last.size += int64(len(buf))
+	last.records++
+
+	err = q.enforceMaxSize()
+	if err != nil {
+		return err
+	}
+
+	q.updateMetrics()
+	return nil
+}
+
+func (q *Queue) rotate() error {
+	err := q.active.Close()
+	if err != nil {
+		return fmt.Errorf("error closing active segment: %w", err)
+	}
+
+	next := &segment{seq: q.segments[len(q.segments)-1].seq + 1}
+	q.active, err = os.OpenFile(q.segmentPath(next.seq), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("error opening active segment: %w", err)
+	}
+
+	q.segments = append(q.segments, next)
+	return nil
+}
+
+// enforceMaxSize drops the oldest segments, never the active one, until the
+// queue fits its size cap.
+func (q *Queue) enforceMaxSize() error {
+	for len(q.segments) > 1 {
+		_, size := q.pending()
+		if size <= q.maxSize {
+			return nil
+		}
+
+		oldest := q.segments[0]
+		dropped := oldest.records
+		if oldest.seq < q.cursor.seq {
+			dropped = 0
+		}
+
+		q.logger.Warn("queue over size cap, dropping oldest segment",
+			zap.Uint64("segment", oldest.seq),
+			zap.Int("records", dropped),
+		)
+
+		err := q.removeOldest()
+		if err != nil {
+			return err
+		}
+		q.dropped.Add(float64(dropped))
+	}
+
+	return nil
+}
+
+func (q *Queue) removeOldest() error {
+	oldest := q.segments[0]
+	err := os.Remove(q.segmentPath(oldest.seq))
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing segment: %w", err)
+	}
+
+	q.segments = q.segments[1:]
+	if q.cursor.seq <= oldest.seq {
+		q.cursor = cursor{seq: q.segments[0].seq}
+		return q.writeCursor()
+	}
+
+	return nil
+}
+
+// next reads the first undelivered record, ok is false when the queue is
+// empty. Corrupted records are skipped, along with the rest of their segment
+// when their length can't be trusted.
+func (q *Queue) next() (time.Time, []byte, bool, error) {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	for {
+		if q.closed {
+			return time.Time{}, nil, false, ErrClosed
+		}
+
+		current := q.segments[0]
+		if q.cursor.offset < current.size {
+			f, err := os.Open(q.segmentPath(current.seq))
+			if err != nil {
+				return time.Time{}, nil, false, fmt.Errorf("error opening segment: %w", err)
+			}
+
+			_, err = f.Seek(q.cursor.offset, io.SeekStart)
+			if err != nil {
+				_ = f.Close()
+				return time.Time{}, nil, false, fmt.Errorf("error seeking segment: %w", err)
+			}
+
+			ts, payload, err := readRecord(f, current.size-q.cursor.offset)
+			_ = f.Close()
+			switch {
+			case err == nil:
+				return ts, payload, true, nil
+			case errors.Is(err, ErrCorrupted):
+				q.logger.Warn("skipping corrupted record",
+					zap.Uint64("segment", current.seq),
+					zap.Int64("offset", q.cursor.offset),
+				)
+				q.corrupted.Inc()
+				q.cursor.offset += int64(headerSize + len(payload))
+				current.records--
+			case errors.Is(err, io.EOF), errors.Is(err, io.ErrUnexpectedEOF):
+				q.logger.Warn("skipping corrupted segment tail",
+					zap.Uint64("segment", current.seq),
+					zap.Int64("offset", q.cursor.offset),
+					zap.Int("records", current.records),
+				)
+				q.corrupted.Add(float64(current.records))
+				q.cursor.offset = current.size
+				current.records = 0
+			default:
+				return time.Time{}, nil, false, fmt.Errorf("error reading segment %d: %w", current.seq, err)
+			}
+
+			err = q.writeCursor()
+			if err != nil {
+				return time.Time{}, nil, false, err
+			}
+			q.updateMetrics()
+			continue
+		}
+
+		if len(q.segments) == 1 {
+			return time.Time{}, nil, false, nil
+		}
+
+		err := q.removeOldest()
+		if err != nil {
+			return time.Time{}, nil, false, err
+		}
+	}
+}
+
+// ack moves the cursor past a record of the given payload size.
+func (q *Queue) ack(payloadSize int) error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	q.cursor.offset += int64(headerSize + payloadSize)
+	q.segments[0].records--
+
+	defer q.updateMetrics()
+	return q.writeCursor()
+}
+
+func (q *Queue) backoff(attempt int) time.Duration {
+	d := q.initialBackoff << attempt
+	if d <= 0 || d > q.maxBackoff {
+		return q.maxBackoff
+	}
+
+	return d
+}
+
+// Drain delivers the queued records in order. A failing delivery is retried
+// with exponential backoff, once retries are exhausted Drain gives up and
+// the record, and all the following ones, are kept for the next call.
+// Records failing with a Permanent error, and those older than the age cap,
+// are dropped.
+func (q *Queue) Drain(ctx context.Context, deliver Deliver) error {
+	q.drainMu.Lock()
+	defer q.drainMu.Unlock()
+
+	for {
+		ts, payload, ok, err := q.next()
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return nil
+		}
+
+		if q.maxAge != 0 && time.Since(ts) > q.maxAge {
+			q.logger.Warn("dropping record older than age cap", zap.Time("appended", ts))
+			q.dropped.Inc()
+
+			err = q.ack(len(payload))
+			if err != nil {
+				return err
+			}
+			continue
+		}
+
+		err = q.deliver(ctx, deliver, payload)
+		if IsPermanent(err) {
+			q.logger.Warn("dropping record rejected by the sink", zap.Time("appended", ts), zap.Error(err))
+			q.rejected.Inc()
+		} else if err != nil {
+			return err
+		}
+
+		err = q.ack(len(payload))
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (q *Queue) deliver(ctx context.Context, deliver Deliver, payload []byte) error {
+	var err error
+	for attempt := 0; attempt <= q.maxRetries; attempt++ {
+		err = deliver(ctx, payload)
+		if err == nil {
+			return nil
+		}
+		q.failures.Inc()
+
+		if IsPermanent(err) {
+			return err
+		}
+		if attempt == q.maxRetries {
+			break
+		}
+
+		wait := q.backoff(attempt)
+		q.logger.Warn("error delivering record, retrying",
+			zap.Int("attempt", attempt+1),
+			zap.Duration("backoff", wait),
+			zap.Error(err),
+		)
+
+		select {
+		case <-ctx.Done():
+			return errors.Join(err, ctx.Err())
+		case <-time.After(wait):
+		}
+	}
+
+	return fmt.Errorf("giving up delivering record after %d attempts: %w", q.maxRetries+1, err)
+}
+
+// Run drains the queue right away and then every interval, until ctx is
+// done.
+func (q *Queue) Run(ctx context.Context, interval time.Duration, deliver Deliver) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := q.Drain(ctx, deliver)
+		if err != nil && !errors.Is(err, ErrClosed) && ctx.Err() == nil {
+			q.logger.Error("error draining queue", zap.Int("pending", q.Len()), zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (q *Queue) Close() error {
+	q.mu.Lock()
+	defer q.mu.Unlock()
+
+	if q.closed {
+		return nil
+	}
+	q.closed = true
+
+	// a queue reopened on reload registers its metrics again
+	q.unregister()
+
+	return q.active.Close()
+}
+
+// unregister drops the metrics registered so far, only those: a failed
+// registration may be due to another queue holding the same metrics.
+func (q *Queue) unregister() {
+	for _, c := range q.registered {
+		q.registerer.Unregister(c)
+	}
+	q.registered = nil
+}
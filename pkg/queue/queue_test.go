@@ -0,0 +1,359 @@
+package queue_test
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"testing"
+	"time"
+
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/queue"
+)
+
+// headerSize is the size of the header preceding every record on disk.
+const headerSize = 16
+
+func newQueue(t *testing.T, opts queue.QueueOptions) *queue.Queue {
+	t.Helper()
+
+	opts.Logger = zap.NewNop()
+	opts.InitialBackoff = time.Millisecond
+	opts.MaxBackoff = time.Millisecond
+
+	q, err := queue.NewQueue(opts)
+	if err != nil {
+		t.Fatalf("NewQueue() error = %v", err)
+	}
+	t.Cleanup(func() { _ = q.Close() })
+
+	return q
+}
+
+func appendAll(t *testing.T, q *queue.Queue, records ...string) {
+	t.Helper()
+
+	for _, record := range records {
+		err := q.Append([]byte(record))
+		if err != nil {
+			t.Fatalf("Append(%s) error = %v", record, err)
+		}
+	}
+}
+
+// drain drains q delivering every record successfully, and returns them.
+func drain(t *testing.T, q *queue.Queue) []string {
+	t.Helper()
+
+	var got []string
+	err := q.Drain(context.Background(), func(_ context.Context, record []byte) error {
+		got = append(got, string(record))
+		return nil
+	})
+	if err != nil {
+		t.Fatalf("Drain() error = %v", err)
+	}
+
+	return got
+}
+
+// segment is the path of the first segment of a queue in dir.
+func segment(dir string) string {
+	return filepath.Join(dir, fmt.Sprintf("%016x.seg", 1))
+}
+
+// value returns the value of the queue metric called name in reg.
+func value(t *testing.T, reg *prometheus.Registry, name string) float64 {
+	t.Helper()
+
+	families, err := reg.Gather()
+	if err != nil {
+		t.Fatalf("Gather() error = %v", err)
+	}
+
+	for _, family := range families {
+		if family.GetName() != name {
+			continue
+		}
+
+		metric := family.GetMetric()[0]
+		if metric.GetCounter() != nil {
+			return metric.GetCounter().GetValue()
+		}
+		return metric.GetGauge().GetValue()
+	}
+
+	t.Fatalf("metric %s not registered", name)
+	return 0
+}
+
+func TestDrain(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	q := newQueue(t, queue.QueueOptions{Dir: t.TempDir(), Registerer: reg})
+
+	appendAll(t, q, "a", "b", "c")
+	if got := value(t, reg, "queue_records"); got != 3 {
+		t.Errorf("queue_records = %v, want 3", got)
+	}
+
+	got := drain(t, q)
+	if !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("drained %v, want [a b c]", got)
+	}
+	if q.Len() != 0 {
+		t.Errorf("Len() = %d after draining, want 0", q.Len())
+	}
+	if got := value(t, reg, "queue_size_bytes"); got != 0 {
+		t.Errorf("queue_size_bytes = %v, want 0", got)
+	}
+}
+
+func TestReplayAfterReopen(t *testing.T) {
+	dir := t.TempDir()
+	q := newQueue(t, queue.QueueOptions{Dir: dir, MaxRetries: 1})
+
+	appendAll(t, q, "a", "b", "c")
+
+	var delivered []string
+	err := q.Drain(context.Background(), func(_ context.Context, record []byte) error {
+		if string(record) == "b" {
+			return errors.New("sink down")
+		}
+		delivered = append(delivered, string(record))
+		return nil
+	})
+	if err == nil {
+		t.Fatalf("Drain() error = nil, want the exhausted retries")
+	}
+	if !slices.Equal(delivered, []string{"a"}) {
+		t.Errorf("delivered %v before the failure, want [a]", delivered)
+	}
+
+	err = q.Close()
+	if err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	q = newQueue(t, queue.QueueOptions{Dir: dir})
+	if q.Len() != 2 {
+		t.Errorf("Len() = %d after reopening, want 2", q.Len())
+	}
+
+	got := drain(t, q)
+	if !slices.Equal(got, []string{"b", "c"}) {
+		t.Errorf("drained %v after reopening, want [b c]", got)
+	}
+}
+
+func TestTornTail(t *testing.T) {
+	dir := t.TempDir()
+	q := newQueue(t, queue.QueueOptions{Dir: dir})
+
+	appendAll(t, q, "a", "b")
+	err := q.Close()
+	if err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// a crash in the middle of an append leaves half a record behind
+	f, err := os.OpenFile(segment(dir), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		t.Fatalf("error opening segment: %v", err)
+	}
+	_, err = f.Write([]byte{0, 0, 0, 9, 1, 2, 3})
+	_ = f.Close()
+	if err != nil {
+		t.Fatalf("error tearing segment: %v", err)
+	}
+
+	q = newQueue(t, queue.QueueOptions{Dir: dir})
+	if q.Len() != 2 {
+		t.Errorf("Len() = %d after reopening, want 2", q.Len())
+	}
+
+	// appends go after the whole records
+	appendAll(t, q, "c")
+	got := drain(t, q)
+	if !slices.Equal(got, []string{"a", "b", "c"}) {
+		t.Errorf("drained %v, want [a b c]", got)
+	}
+}
+
+func TestCorruptedRecord(t *testing.T) {
+	dir := t.TempDir()
+	q := newQueue(t, queue.QueueOptions{Dir: dir})
+
+	appendAll(t, q, "a", "b", "c")
+	err := q.Close()
+	if err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// flip the payload of b, whose length stays trustworthy
+	data, err := os.ReadFile(segment(dir))
+	if err != nil {
+		t.Fatalf("error reading segment: %v", err)
+	}
+	data[2*headerSize+1] ^= 0xff
+	err = os.WriteFile(segment(dir), data, 0o640)
+	if err != nil {
+		t.Fatalf("error writing segment: %v", err)
+	}
+
+	reg := prometheus.NewRegistry()
+	q = newQueue(t, queue.QueueOptions{Dir: dir, Registerer: reg})
+
+	got := drain(t, q)
+	if !slices.Equal(got, []string{"a", "c"}) {
+		t.Errorf("drained %v, want [a c]", got)
+	}
+	if got := value(t, reg, "queue_corrupted_records_total"); got != 1 {
+		t.Errorf("queue_corrupted_records_total = %v, want 1", got)
+	}
+}
+
+func TestMaxSize(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	// every segment holds two records of 16 bytes
+	q := newQueue(t, queue.QueueOptions{
+		Dir:         t.TempDir(),
+		Registerer:  reg,
+		SegmentSize: 64,
+		MaxSize:     128,
+	})
+
+	records := make([]string, 10)
+	for i := range records {
+		records[i] = fmt.Sprintf("record-%09d", i)
+	}
+	appendAll(t, q, records...)
+
+	dropped := value(t, reg, "queue_dropped_records_total")
+	if dropped == 0 {
+		t.Fatalf("queue_dropped_records_total = 0, want the oldest records dropped")
+	}
+	if got := value(t, reg, "queue_size_bytes"); got > 128 {
+		t.Errorf("queue_size_bytes = %v, want at most 128", got)
+	}
+
+	// the newest records are kept, in order
+	got := drain(t, q)
+	if want := records[int(dropped):]; !slices.Equal(got, want) {
+		t.Errorf("drained %v, want %v", got, want)
+	}
+}
+
+func TestMaxSizeBelowSegmentSize(t *testing.T) {
+	_, err := queue.NewQueue(queue.QueueOptions{
+		Dir:         t.TempDir(),
+		Logger:      zap.NewNop(),
+		SegmentSize: 64,
+		MaxSize:     32,
+	})
+	if err == nil {
+		t.Errorf("NewQueue() error = nil, want the size cap rejected")
+	}
+}
+
+func TestMaxAge(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	q := newQueue(t, queue.QueueOptions{Dir: t.TempDir(), Registerer: reg, MaxAge: 10 * time.Millisecond})
+
+	appendAll(t, q, "a")
+	time.Sleep(20 * time.Millisecond)
+	appendAll(t, q, "b")
+
+	got := drain(t, q)
+	if !slices.Equal(got, []string{"b"}) {
+		t.Errorf("drained %v, want [b]", got)
+	}
+	if got := value(t, reg, "queue_dropped_records_total"); got != 1 {
+		t.Errorf("queue_dropped_records_total = %v, want 1", got)
+	}
+}
+
+func TestDrainRetries(t *testing.T) {
+	tests := []struct {
+		name       string
+		maxRetries int
+		failures   int
+		err        error
+		wantErr    bool
+		attempts   int
+		drained    []string
+		pending    int
+		rejected   float64
+	}{
+		{"recovers", 3, 2, errors.New("sink down"), false, 4, []string{"a", "b"}, 0, 0},
+		{"retries exhausted", 2, 5, errors.New("sink down"), true, 3, nil, 2, 0},
+		{"permanent", 3, 1, queue.Permanent(errors.New("malformed")), false, 2, []string{"b"}, 0, 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			reg := prometheus.NewRegistry()
+			q := newQueue(t, queue.QueueOptions{Dir: t.TempDir(), Registerer: reg, MaxRetries: tt.maxRetries})
+			appendAll(t, q, "a", "b")
+
+			attempts := 0
+			var drained []string
+			err := q.Drain(context.Background(), func(_ context.Context, record []byte) error {
+				attempts++
+				if attempts <= tt.failures {
+					return tt.err
+				}
+				drained = append(drained, string(record))
+				return nil
+			})
+			if (err != nil) != tt.wantErr {
+				t.Errorf("Drain() error = %v, want error %t", err, tt.wantErr)
+			}
+			if attempts != tt.attempts {
+				t.Errorf("made %d attempts, want %d", attempts, tt.attempts)
+			}
+			if !slices.Equal(drained, tt.drained) {
+				t.Errorf("drained %v, want %v", drained, tt.drained)
+			}
+			if q.Len() != tt.pending {
+				t.Errorf("Len() = %d, want %d", q.Len(), tt.pending)
+			}
+			if got := value(t, reg, "queue_rejected_records_total"); got != tt.rejected {
+				t.Errorf("queue_rejected_records_total = %v, want %v", got, tt.rejected)
+			}
+		})
+	}
+}
+
+func TestNewQueueRegistrationFailure(t *testing.T) {
+	reg := prometheus.NewRegistry()
+	q := newQueue(t, queue.QueueOptions{Dir: t.TempDir(), Name: "influxdb", Registerer: reg})
+
+	// the same name registers the same metrics
+	_, err := queue.NewQueue(queue.QueueOptions{
+		Dir:        t.TempDir(),
+		Logger:     zap.NewNop(),
+		Name:       "influxdb",
+		Registerer: reg,
+	})
+	if err == nil {
+		t.Fatalf("NewQueue() error = nil, want the duplicate registration")
+	}
+
+	// the failed queue leaves the metrics of the first one alone
+	appendAll(t, q, "a")
+	if got := value(t, reg, "queue_records"); got != 1 {
+		t.Errorf("queue_records = %v, want 1", got)
+	}
+
+	err = q.Close()
+	if err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// and nothing behind, a new queue registers again
+	newQueue(t, queue.QueueOptions{Dir: t.TempDir(), Name: "influxdb", Registerer: reg})
+}
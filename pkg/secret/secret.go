@@ -0,0 +1,118 @@
+package secret
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strings"
+
+	"gopkg.in/yaml.v3"
+)
+
+const redacted = "<redacted>"
+
+var ErrEmpty = errors.New("empty secret")
+
+// Secret is a credential, given inline or read from a file following the
+// *_FILE convention of Docker and Kubernetes secrets. A file is read on every
+// Value call, so rotated secrets are picked up without a restart.
+//
+// A Secret never prints, logs or marshals its value: it shows as <redacted>,
+// or as the path of its file.
+type Secret struct {
+	value string
+	file  string
+}
+
+// New returns the inline secret value.
+func New(value string) Secret {
+	return Secret{value: value}
+}
+
+// FromFile returns the secret stored in the file at path.
+func FromFile(path string) Secret {
+	return Secret{file: path}
+}
+
+// IsZero tells if the secret is unset.
+func (s Secret) IsZero() bool {
+	return s.value == "" && s.file == ""
+}
+
+// File is the path of the secret file, empty for inline secrets.
+func (s Secret) File() string {
+	return s.file
+}
+
+// Value returns the secret, reading its file when it has one. Surrounding
+// whitespace, like the trailing newline of most secret files, is trimmed.
+func (s Secret) Value() (string, error) {
+	if s.file == "" {
+		if s.value == "" {
+			return "", ErrEmpty
+		}
+		return s.value, nil
+	}
+
+	data, err := os.ReadFile(s.file)
+	if err != nil {
+		return "", fmt.Errorf("error reading secret: %w", err)
+	}
+
+	value := strings.TrimSpace(string(data))
+	if value == "" {
+		return "", fmt.Errorf("%w: %s", ErrEmpty, s.file)
+	}
+
+	return value, nil
+}
+
+func (s Secret) String() string {
+	if s.file != "" {
+		return "file:" + s.file
+	}
+	if s.value == "" {
+		return ""
+	}
+	return redacted
+}
+
+func (s Secret) GoString() string {
+	return s.String()
+}
+
+type fileSecret struct {
+	File string `yaml:"file" json:"file"`
+}
+
+// UnmarshalYAML accepts an inline value, token: abc, or a file, token:
+// {file: /run/secrets/token}.
+func (s *Secret) UnmarshalYAML(node *yaml.Node) error {
+	if node.Kind == yaml.ScalarNode {
+		*s = New(node.Value)
+		return nil
+	}
+
+	var f fileSecret
+	err := node.Decode(&f)
+	if err != nil {
+		return err
+	}
+	*s = FromFile(f.File)
+	return nil
+}
+
+func (s Secret) MarshalYAML() (any, error) {
+	if s.file != "" {
+		return fileSecret{s.file}, nil
+	}
+	return s.String(), nil
+}
+
+func (s Secret) MarshalJSON() ([]byte, error) {
+	if s.file != "" {
+		return json.Marshal(fileSecret{s.file})
+	}
+	return json.Marshal(s.String())
+}
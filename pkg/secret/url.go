@@ -0,0 +1,51 @@
+package secret
+
+import (
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// redactedUrl hides the passwords of urls as url.URL.Redacted does, the
+// brackets of redacted would be escaped in them.
+const redactedUrl = "xxxxx"
+
+// passwordParam matches the password of a keyword/value connection string,
+// e.g. host=db password='s3cret', quoted or not.
+var passwordParam = regexp.MustCompile(`(?i)(\bpassword\s*=\s*)('(?:[^'\\]|\\.)*'|\S+)`)
+
+// RedactUrl hides the credentials of the url s to log or show it: the
+// password of its userinfo and of a password query parameter, or of a
+// keyword/value connection string like those of postgres. Anything else is
+// kept as is.
+func RedactUrl(s string) string {
+	u, err := url.Parse(s)
+	if err != nil || u.Scheme == "" {
+		return passwordParam.ReplaceAllString(s, "${1}"+redactedUrl)
+	}
+
+	query := u.Query()
+	for key := range query {
+		if strings.EqualFold(key, "password") {
+			query.Set(key, redactedUrl)
+			u.RawQuery = query.Encode()
+		}
+	}
+
+	return u.Redacted()
+}
+
+// RedactValues returns a copy of values, e.g. http headers, with every value
+// hidden, nil when values is.
+func RedactValues(values map[string]string) map[string]string {
+	if values == nil {
+		return nil
+	}
+
+	r := make(map[string]string, len(values))
+	for key := range values {
+		r[key] = redacted
+	}
+
+	return r
+}
@@ -0,0 +1,51 @@
+package tracing
+
+import (
+	"errors"
+	"flag"
+	"strconv"
+
+	"wouldgo.me/meteotrentino-exporter/pkg/config"
+	"wouldgo.me/meteotrentino-exporter/pkg/options"
+)
+
+const (
+	tracingEndpointEnv    = "TRACING_ENDPOINT"
+	tracingSampleRatioEnv = "TRACING_SAMPLE_RATIO"
+)
+
+type TracingOptions struct {
+	fs                    *flag.FlagSet
+	env                   options.Env
+	endpoint, sampleRatio *string
+}
+
+func NewTracingOptions(fs *flag.FlagSet, env options.Env) *TracingOptions {
+	var endpoint, sampleRatio string
+	fs.StringVar(&endpoint, "tracing-endpoint", "", "OTLP/HTTP collector url receiving the traces, e.g. http://localhost:4318, disabled if empty")
+	fs.StringVar(&sampleRatio, "tracing-sample-ratio", "1", "ratio of the polling rounds traced, between 0 and 1 (default: 1)")
+
+	return &TracingOptions{
+		fs,
+		env,
+		&endpoint,
+		&sampleRatio,
+	}
+}
+
+// Apply overrides the tracing section of c.
+func (to *TracingOptions) Apply(c *config.Config) error {
+	if v, ok := options.Override(to.fs, "tracing-endpoint", to.endpoint, to.env, tracingEndpointEnv); ok {
+		c.Tracing.Endpoint = v
+	}
+
+	if v, ok := options.Override(to.fs, "tracing-sample-ratio", to.sampleRatio, to.env, tracingSampleRatioEnv); ok {
+		ratio, err := strconv.ParseFloat(v, 64)
+		if err != nil || ratio < 0 || ratio > 1 {
+			return errors.Join(options.ErrWrongParam("tracing-sample-ratio"), err)
+		}
+		c.Tracing.SampleRatio = ratio
+	}
+
+	return nil
+}
@@ -0,0 +1,87 @@
+package tracing
+
+import (
+	"context"
+	"errors"
+	"fmt"
+
+	"github.com/go-playground/validator/v10"
+	"go.opentelemetry.io/otel/attribute"
+	"go.opentelemetry.io/otel/codes"
+	"go.opentelemetry.io/otel/exporters/otlp/otlptrace/otlptracehttp"
+	"go.opentelemetry.io/otel/sdk/resource"
+	sdktrace "go.opentelemetry.io/otel/sdk/trace"
+	"go.opentelemetry.io/otel/trace"
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/secret"
+)
+
+const serviceName = "meteotrentino-exporter"
+
+// StationKey is the span attribute holding the station code.
+const StationKey = attribute.Key("meteotrentino.station")
+
+var validate = validator.New(validator.WithRequiredStructEnabled())
+
+type TracingConfig struct {
+	Logger *zap.Logger `validate:"required"`
+	// Endpoint is the OTLP/HTTP collector url, plain http disables TLS.
+	Endpoint string `validate:"required,url"`
+
+	SampleRatio float64 `validate:"gte=0,lte=1"`
+	Version     string
+}
+
+// NewTracerProvider returns a provider exporting spans in batches to the
+// OTLP endpoint. Sampling follows the parent span, when there is one, and
+// SampleRatio otherwise. It must be shut down to flush the last spans.
+func NewTracerProvider(ctx context.Context, opts TracingConfig) (*sdktrace.TracerProvider, error) {
+	err := validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return nil, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return nil, errors.Join(errs...)
+		}
+
+		return nil, err
+	}
+
+	exporter, err := otlptracehttp.New(ctx, otlptracehttp.WithEndpointURL(opts.Endpoint))
+	if err != nil {
+		return nil, fmt.Errorf("error creating otlp exporter: %w", err)
+	}
+
+	res, err := resource.Merge(resource.Default(), resource.NewSchemaless(
+		attribute.String("service.name", serviceName),
+		attribute.String("service.version", opts.Version),
+	))
+	if err != nil {
+		return nil, fmt.Errorf("error creating tracing resource: %w", err)
+	}
+
+	opts.Logger.Info("exporting traces", zap.String("endpoint", secret.RedactUrl(opts.Endpoint)), zap.Float64("sample_ratio", opts.SampleRatio))
+	return sdktrace.NewTracerProvider(
+		sdktrace.WithBatcher(exporter),
+		sdktrace.WithResource(res),
+		sdktrace.WithSampler(sdktrace.ParentBased(sdktrace.TraceIDRatioBased(opts.SampleRatio))),
+	), nil
+}
+
+// End ends span, marking it as failed when err is set.
+func End(span trace.Span, err error) {
+	if err != nil {
+		span.RecordError(err)
+		span.SetStatus(codes.Error, err.Error())
+	}
+
+	span.End()
+}
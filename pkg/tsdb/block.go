@@ -0,0 +1,320 @@
+package tsdb
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"maps"
+	"os"
+	"slices"
+	"strings"
+)
+
+var ErrCorrupted = errors.New("corrupted block")
+
+const (
+	blockExt   = ".block"
+	blockMagic = "MTSB"
+
+	blockVersion = 1
+)
+
+// seriesKey names the observations of a variable of a station.
+type seriesKey struct {
+	station  string
+	variable string
+}
+
+func (k seriesKey) compare(o seriesKey) int {
+	if c := strings.Compare(k.station, o.station); c != 0 {
+		return c
+	}
+	return strings.Compare(k.variable, o.variable)
+}
+
+// blockSeries locates the chunk of a series in the data section of a block.
+type blockSeries struct {
+	mint, maxt     int64
+	count          int
+	offset, length int64
+	crc            uint32
+}
+
+// block is an immutable file holding the samples of every series in
+// [start, end), raw when resolution is 0 and downsampled to buckets of
+// resolution seconds otherwise. Only its index is kept in memory, chunks are
+// read on query.
+//
+// The file starts with the magic, the version and the length prefixed index,
+// followed by its crc32, and then the chunks, each checked by the crc32
+// kept in the index.
+type block struct {
+	seq        uint64
+	path       string
+	start, end int64
+	resolution int64
+	size       int64
+	dataOffset int64
+	series     map[seriesKey]blockSeries
+}
+
+func (b *block) raw() bool {
+	return b.resolution == 0
+}
+
+// overlaps reports whether the block may hold samples in [from, to].
+func (b *block) overlaps(from, to int64) bool {
+	return b.start <= to && from < b.end
+}
+
+// writeBlock writes the samples of every series to path through a
+// temporary file, so a crash never leaves a partial block behind.
+func writeBlock(path string, start, end, resolution int64, data map[seriesKey][]sample) error {
+	keys := slices.SortedFunc(maps.Keys(data), seriesKey.compare)
+
+	var index, chunks []byte
+	index = binary.AppendVarint(index, start)
+	index = binary.AppendVarint(index, end)
+	index = binary.AppendVarint(index, resolution)
+	index = binary.AppendUvarint(index, uint64(len(keys)))
+	for _, key := range keys {
+		samples := data[key]
+		chunk := encodeChunk(samples, resolution == 0)
+
+		index = appendString(index, key.station)
+		index = appendString(index, key.variable)
+		index = binary.AppendVarint(index, samples[0].t)
+		index = binary.AppendVarint(index, samples[len(samples)-1].t)
+		index = binary.AppendUvarint(index, uint64(len(samples)))
+		index = binary.AppendUvarint(index, uint64(len(chunks)))
+		index = binary.AppendUvarint(index, uint64(len(chunk)))
+		index = binary.BigEndian.AppendUint32(index, crc32.ChecksumIEEE(chunk))
+
+		chunks = append(chunks, chunk...)
+	}
+
+	buf := append([]byte(blockMagic), blockVersion)
+	buf = binary.AppendUvarint(buf, uint64(len(index)))
+	buf = append(buf, index...)
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(index))
+	buf = append(buf, chunks...)
+
+	return writeFile(path, buf)
+}
+
+// writeFile replaces path with data durably.
+func writeFile(path string, data []byte) error {
+	tmp := path + ".tmp"
+	f, err := os.OpenFile(tmp, os.O_CREATE|os.O_WRONLY|os.O_TRUNC, 0o640)
+	if err != nil {
+		return err
+	}
+
+	_, err = f.Write(data)
+	if err == nil {
+		err = f.Sync()
+	}
+	err = errors.Join(err, f.Close())
+	if err != nil {
+		_ = os.Remove(tmp)
+		return err
+	}
+
+	return os.Rename(tmp, path)
+}
+
+func appendString(b []byte, s string) []byte {
+	b = binary.AppendUvarint(b, uint64(len(s)))
+	return append(b, s...)
+}
+
+// openBlock reads the index of the block at path.
+func openBlock(path string, seq uint64) (*block, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	info, err := f.Stat()
+	if err != nil {
+		return nil, err
+	}
+
+	r := bufio.NewReader(f)
+	header := make([]byte, len(blockMagic)+1)
+	_, err = io.ReadFull(r, header)
+	if err != nil || string(header[:len(blockMagic)]) != blockMagic {
+		return nil, fmt.Errorf("%w: bad magic", ErrCorrupted)
+	}
+	if header[len(blockMagic)] != blockVersion {
+		return nil, fmt.Errorf("%w: unknown version %d", ErrCorrupted, header[len(blockMagic)])
+	}
+
+	length, err := binary.ReadUvarint(r)
+	if err != nil || int64(length) > info.Size() {
+		return nil, fmt.Errorf("%w: bad index length", ErrCorrupted)
+	}
+
+	index := make([]byte, length+4)
+	_, err = io.ReadFull(r, index)
+	if err != nil {
+		return nil, fmt.Errorf("%w: short index", ErrCorrupted)
+	}
+	if crc32.ChecksumIEEE(index[:length]) != binary.BigEndian.Uint32(index[length:]) {
+		return nil, fmt.Errorf("%w: index checksum mismatch", ErrCorrupted)
+	}
+
+	b := &block{
+		seq:        seq,
+		path:       path,
+		size:       info.Size(),
+		dataOffset: int64(len(header)) + int64(uvarintLen(length)) + int64(len(index)),
+		series:     make(map[seriesKey]blockSeries),
+	}
+
+	d := decoder{b: index[:length]}
+	b.start = d.varint()
+	b.end = d.varint()
+	b.resolution = d.varint()
+	for n := d.uvarint(); n > 0 && d.err == nil; n-- {
+		key := seriesKey{station: d.string(), variable: d.string()}
+		s := blockSeries{
+			mint:   d.varint(),
+			maxt:   d.varint(),
+			count:  int(d.uvarint()),
+			offset: int64(d.uvarint()),
+			length: int64(d.uvarint()),
+			crc:    d.uint32(),
+		}
+		if b.dataOffset+s.offset+s.length > b.size {
+			return nil, fmt.Errorf("%w: chunk out of bounds", ErrCorrupted)
+		}
+		b.series[key] = s
+	}
+	if d.err != nil {
+		return nil, fmt.Errorf("%w: %w", ErrCorrupted, d.err)
+	}
+
+	return b, nil
+}
+
+func uvarintLen(v uint64) int {
+	return len(binary.AppendUvarint(nil, v))
+}
+
+// read decodes the samples of a series, nil when the block has none.
+func (b *block) read(key seriesKey) ([]sample, error) {
+	s, ok := b.series[key]
+	if !ok {
+		return nil, nil
+	}
+
+	f, err := os.Open(b.path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	return b.readChunk(f, s)
+}
+
+func (b *block) readChunk(f *os.File, s blockSeries) ([]sample, error) {
+	chunk := make([]byte, s.length)
+	_, err := f.ReadAt(chunk, b.dataOffset+s.offset)
+	if err != nil {
+		return nil, fmt.Errorf("error reading chunk: %w", err)
+	}
+	if crc32.ChecksumIEEE(chunk) != s.crc {
+		return nil, fmt.Errorf("%w: chunk checksum mismatch in %s", ErrCorrupted, b.path)
+	}
+
+	return decodeChunk(chunk, s.count, b.raw())
+}
+
+// readAll decodes the samples of every series, for compaction.
+func (b *block) readAll() (map[seriesKey][]sample, error) {
+	f, err := os.Open(b.path)
+	if err != nil {
+		return nil, err
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	data := make(map[seriesKey][]sample, len(b.series))
+	for key, s := range b.series {
+		data[key], err = b.readChunk(f, s)
+		if err != nil {
+			return nil, err
+		}
+	}
+
+	return data, nil
+}
+
+// decoder reads the fields of an index, keeping the first error.
+type decoder struct {
+	b   []byte
+	err error
+}
+
+func (d *decoder) varint() int64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Varint(d.b)
+	if n <= 0 {
+		d.err = errTruncated
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) uvarint() uint64 {
+	if d.err != nil {
+		return 0
+	}
+	v, n := binary.Uvarint(d.b)
+	if n <= 0 {
+		d.err = errTruncated
+		return 0
+	}
+	d.b = d.b[n:]
+	return v
+}
+
+func (d *decoder) string() string {
+	n := d.uvarint()
+	if d.err != nil {
+		return ""
+	}
+	if uint64(len(d.b)) < n {
+		d.err = errTruncated
+		return ""
+	}
+	s := string(d.b[:n])
+	d.b = d.b[n:]
+	return s
+}
+
+func (d *decoder) uint32() uint32 {
+	if d.err != nil {
+		return 0
+	}
+	if len(d.b) < 4 {
+		d.err = errTruncated
+		return 0
+	}
+	v := binary.BigEndian.Uint32(d.b)
+	d.b = d.b[4:]
+	return v
+}
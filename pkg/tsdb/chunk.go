@@ -0,0 +1,289 @@
+package tsdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"math/bits"
+)
+
+var errTruncated = errors.New("truncated data")
+
+// bitWriter appends single bits to a byte slice, the last byte is padded
+// with zeros.
+type bitWriter struct {
+	b    []byte
+	free uint8
+}
+
+func (w *bitWriter) writeBit(bit bool) {
+	if w.free == 0 {
+		w.b = append(w.b, 0)
+		w.free = 8
+	}
+	w.free--
+	if bit {
+		w.b[len(w.b)-1] |= 1 << w.free
+	}
+}
+
+func (w *bitWriter) writeBits(v uint64, n int) {
+	for i := n - 1; i >= 0; i-- {
+		w.writeBit(v&(1<<i) != 0)
+	}
+}
+
+type bitReader struct {
+	b   []byte
+	pos int
+}
+
+func (r *bitReader) readBit() (bool, error) {
+	if r.pos >= len(r.b)*8 {
+		return false, errTruncated
+	}
+	bit := r.b[r.pos/8]&(1<<(7-r.pos%8)) != 0
+	r.pos++
+	return bit, nil
+}
+
+func (r *bitReader) readBits(n int) (uint64, error) {
+	var v uint64
+	for range n {
+		bit, err := r.readBit()
+		if err != nil {
+			return 0, err
+		}
+		v <<= 1
+		if bit {
+			v |= 1
+		}
+	}
+	return v, nil
+}
+
+// encodeFloats compresses values xoring each with the previous one, as in
+// Facebook's Gorilla: repeated and slowly changing values, the common case
+// of weather observations, take a few bits each.
+func encodeFloats(values []float64) []byte {
+	var w bitWriter
+	if len(values) == 0 {
+		return nil
+	}
+
+	prev := math.Float64bits(values[0])
+	w.writeBits(prev, 64)
+
+	leading, trailing := -1, 0
+	for _, value := range values[1:] {
+		cur := math.Float64bits(value)
+		xor := cur ^ prev
+		prev = cur
+
+		if xor == 0 {
+			w.writeBit(false)
+			continue
+		}
+		w.writeBit(true)
+
+		l := min(bits.LeadingZeros64(xor), 31)
+		t := bits.TrailingZeros64(xor)
+
+		// the meaningful bits fit the previous window
+		if leading >= 0 && l >= leading && t >= trailing {
+			w.writeBit(false)
+			w.writeBits(xor>>trailing, 64-leading-trailing)
+			continue
+		}
+
+		leading, trailing = l, t
+		significant := 64 - l - t
+		w.writeBit(true)
+		w.writeBits(uint64(l), 5)
+		// 64 significant bits do not fit 6 bits, they are written as 0
+		w.writeBits(uint64(significant&63), 6)
+		w.writeBits(xor>>t, significant)
+	}
+
+	return w.b
+}
+
+func decodeFloats(b []byte, n int) ([]float64, error) {
+	if n == 0 {
+		return nil, nil
+	}
+
+	r := bitReader{b: b}
+	prev, err := r.readBits(64)
+	if err != nil {
+		return nil, err
+	}
+
+	values := make([]float64, 0, n)
+	values = append(values, math.Float64frombits(prev))
+
+	leading, trailing := 0, 0
+	for len(values) < n {
+		changed, err := r.readBit()
+		if err != nil {
+			return nil, err
+		}
+		if changed {
+			window, err := r.readBit()
+			if err != nil {
+				return nil, err
+			}
+			if window {
+				l, err := r.readBits(5)
+				if err != nil {
+					return nil, err
+				}
+				significant, err := r.readBits(6)
+				if err != nil {
+					return nil, err
+				}
+				if significant == 0 {
+					significant = 64
+				}
+				leading, trailing = int(l), 64-int(l)-int(significant)
+			}
+
+			xor, err := r.readBits(64 - leading - trailing)
+			if err != nil {
+				return nil, err
+			}
+			prev ^= xor << trailing
+		}
+
+		values = append(values, math.Float64frombits(prev))
+	}
+
+	return values, nil
+}
+
+// encodeTimes writes the first time, the first delta and then the delta of
+// deltas as varints, a single byte each for regularly spaced observations.
+func encodeTimes(times []int64) []byte {
+	var b []byte
+	var prev, delta int64
+	for i, t := range times {
+		switch i {
+		case 0:
+			b = binary.AppendVarint(b, t)
+		case 1:
+			delta = t - prev
+			b = binary.AppendVarint(b, delta)
+		default:
+			d := t - prev
+			b = binary.AppendVarint(b, d-delta)
+			delta = d
+		}
+		prev = t
+	}
+
+	return b
+}
+
+func decodeTimes(b []byte, n int) ([]int64, error) {
+	times := make([]int64, 0, n)
+	var prev, delta int64
+	for i := range n {
+		v, read := binary.Varint(b)
+		if read <= 0 {
+			return nil, errTruncated
+		}
+		b = b[read:]
+
+		switch i {
+		case 0:
+			prev = v
+		case 1:
+			delta = v
+			prev += delta
+		default:
+			delta += v
+			prev += delta
+		}
+		times = append(times, prev)
+	}
+
+	return times, nil
+}
+
+// encodeChunk compresses samples sorted by time: the times, then a column
+// of values for raw samples or the min, max, sum and count columns of
+// downsampled ones. Every column is prefixed by its length.
+func encodeChunk(samples []sample, raw bool) []byte {
+	times := make([]int64, len(samples))
+	columns := 4
+	if raw {
+		columns = 1
+	}
+	values := make([][]float64, columns)
+	for i, s := range samples {
+		times[i] = s.t
+		if raw {
+			values[0] = append(values[0], s.sum)
+			continue
+		}
+		values[0] = append(values[0], s.min)
+		values[1] = append(values[1], s.max)
+		values[2] = append(values[2], s.sum)
+		values[3] = append(values[3], s.count)
+	}
+
+	encoded := [][]byte{encodeTimes(times)}
+	for _, column := range values {
+		encoded = append(encoded, encodeFloats(column))
+	}
+
+	var b []byte
+	for _, column := range encoded {
+		b = binary.AppendUvarint(b, uint64(len(column)))
+		b = append(b, column...)
+	}
+
+	return b
+}
+
+func decodeChunk(b []byte, n int, raw bool) ([]sample, error) {
+	columns := 5
+	if raw {
+		columns = 2
+	}
+
+	parts := make([][]byte, columns)
+	for i := range parts {
+		length, read := binary.Uvarint(b)
+		if read <= 0 || uint64(len(b)-read) < length {
+			return nil, errTruncated
+		}
+		parts[i] = b[read : read+int(length)]
+		b = b[read+int(length):]
+	}
+
+	times, err := decodeTimes(parts[0], n)
+	if err != nil {
+		return nil, fmt.Errorf("error decoding times: %w", err)
+	}
+
+	values := make([][]float64, columns-1)
+	for i := range values {
+		values[i], err = decodeFloats(parts[i+1], n)
+		if err != nil {
+			return nil, fmt.Errorf("error decoding values: %w", err)
+		}
+	}
+
+	samples := make([]sample, n)
+	for i, t := range times {
+		if raw {
+			samples[i] = rawSample(t, values[0][i])
+			continue
+		}
+		samples[i] = sample{t: t, min: values[0][i], max: values[1][i], sum: values[2][i], count: values[3][i]}
+	}
+
+	return samples, nil
+}
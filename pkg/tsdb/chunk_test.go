@@ -0,0 +1,120 @@
+package tsdb
+
+import (
+	"math"
+	"slices"
+	"testing"
+)
+
+func TestFloatsRoundTrip(t *testing.T) {
+	tests := []struct {
+		name   string
+		values []float64
+	}{
+		{"empty", nil},
+		{"single", []float64{12.5}},
+		{"repeated", []float64{71, 71, 71, 71}},
+		{"slowly changing", []float64{12.5, 12.6, 12.6, 12.9, 13.2, 12.8, 12.1}},
+		{"shrinking window", []float64{0.1, 1e6, 1e6 + 1, 1e6 + 2, 0.1}},
+		{"negative and zero", []float64{-3.2, 0, -0, 4.1, -273.15}},
+		{"special", []float64{math.Inf(1), math.NaN(), math.Inf(-1), math.MaxFloat64, math.SmallestNonzeroFloat64}},
+		// the xor of these has no leading nor trailing zeros, 64 significant
+		// bits written as 0
+		{"64 significant bits", []float64{0, math.Float64frombits(0x8000000000000001), 0}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeFloats(encodeFloats(tt.values), len(tt.values))
+			if err != nil {
+				t.Fatalf("decodeFloats() error = %v", err)
+			}
+
+			if len(got) != len(tt.values) {
+				t.Fatalf("decodeFloats() = %v, want %v", got, tt.values)
+			}
+			for i := range got {
+				// bits compare NaN and the sign of zero too
+				if math.Float64bits(got[i]) != math.Float64bits(tt.values[i]) {
+					t.Errorf("value %d = %v, want %v", i, got[i], tt.values[i])
+				}
+			}
+		})
+	}
+}
+
+func TestDecodeFloatsTruncated(t *testing.T) {
+	b := encodeFloats([]float64{12.5, 12.9, 13.2})
+
+	_, err := decodeFloats(b[:len(b)-2], 3)
+	if err == nil {
+		t.Errorf("decodeFloats() error = nil, want the truncation")
+	}
+}
+
+func TestTimesRoundTrip(t *testing.T) {
+	tests := []struct {
+		name  string
+		times []int64
+	}{
+		{"empty", nil},
+		{"single", []int64{1792317600}},
+		{"regular", []int64{1792317600, 1792318500, 1792319400, 1792320300}},
+		{"irregular", []int64{1792317600, 1792318500, 1792318560, 1792321200, 1792321201}},
+		{"before the epoch", []int64{-86400, -900, 0, 900}},
+		{"decreasing", []int64{1792320300, 1792319400, 1792317600}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeTimes(encodeTimes(tt.times), len(tt.times))
+			if err != nil {
+				t.Fatalf("decodeTimes() error = %v", err)
+			}
+
+			if !slices.Equal(got, tt.times) {
+				t.Errorf("decodeTimes() = %v, want %v", got, tt.times)
+			}
+		})
+	}
+}
+
+func TestDecodeTimesTruncated(t *testing.T) {
+	b := encodeTimes([]int64{1792317600, 1792318500, 1792319400})
+
+	_, err := decodeTimes(b, 4)
+	if err == nil {
+		t.Errorf("decodeTimes() error = nil, want the truncation")
+	}
+}
+
+func TestChunkRoundTrip(t *testing.T) {
+	tests := []struct {
+		name    string
+		raw     bool
+		samples []sample
+	}{
+		{"raw", true, []sample{
+			rawSample(1792317600, 12.5),
+			rawSample(1792318500, 12.9),
+			rawSample(1792319400, 12.9),
+		}},
+		{"downsampled", false, []sample{
+			{t: 1792317600, min: 12.5, max: 13.2, sum: 51.1, count: 4},
+			{t: 1792321200, min: 11.8, max: 12.4, sum: 48.4, count: 4},
+		}},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := decodeChunk(encodeChunk(tt.samples, tt.raw), len(tt.samples), tt.raw)
+			if err != nil {
+				t.Fatalf("decodeChunk() error = %v", err)
+			}
+
+			if !slices.Equal(got, tt.samples) {
+				t.Errorf("decodeChunk() = %v, want %v", got, tt.samples)
+			}
+		})
+	}
+}
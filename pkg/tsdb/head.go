@@ -0,0 +1,278 @@
+package tsdb
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+	"os"
+	"slices"
+
+	"go.uber.org/zap"
+)
+
+const (
+	walFile = "wal"
+
+	// length (4) + crc32 (4)
+	walHeaderSize = 8
+)
+
+// head keeps in memory the raw samples newer than the blocks, the ones
+// every fetch writes again. Appends are logged to a write-ahead log first,
+// replayed on open, which is rewritten with just the samples left once
+// older ones are cut into blocks.
+type head struct {
+	path   string
+	logger *zap.Logger
+	wal    *os.File
+
+	series map[seriesKey]map[int64]float64
+	// records counts the wal records written since the last checkpoint,
+	// stale is set when samples logged there were cut.
+	records int
+	stale   bool
+}
+
+// openHead replays the wal at path and opens it for appends, unless
+// readOnly.
+func openHead(path string, logger *zap.Logger, readOnly bool) (*head, error) {
+	h := &head{
+		path:   path,
+		logger: logger,
+		series: make(map[seriesKey]map[int64]float64),
+	}
+
+	valid, err := h.replay()
+	if err != nil {
+		return nil, err
+	}
+	if readOnly {
+		return h, nil
+	}
+
+	h.wal, err = os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return nil, fmt.Errorf("error opening wal: %w", err)
+	}
+
+	info, err := h.wal.Stat()
+	if err != nil {
+		_ = h.wal.Close()
+		return nil, fmt.Errorf("error reading wal: %w", err)
+	}
+
+	// a torn record at the tail, e.g. after a crash, is truncated away
+	if valid < info.Size() {
+		logger.Warn("truncating torn wal tail", zap.Int64("valid", valid), zap.Int64("size", info.Size()))
+		err = h.wal.Truncate(valid)
+		if err != nil {
+			_ = h.wal.Close()
+			return nil, fmt.Errorf("error truncating wal: %w", err)
+		}
+	}
+
+	return h, nil
+}
+
+// replay applies the records of the wal, returning the offset after the
+// last valid one.
+func (h *head) replay() (int64, error) {
+	f, err := os.Open(h.path)
+	if errors.Is(err, os.ErrNotExist) {
+		return 0, nil
+	}
+	if err != nil {
+		return 0, fmt.Errorf("error opening wal: %w", err)
+	}
+	defer func() {
+		_ = f.Close()
+	}()
+
+	var offset int64
+	for {
+		payload, err := readWalRecord(f)
+		if err != nil {
+			return offset, nil
+		}
+
+		key, samples, err := decodeWalRecord(payload)
+		if err != nil {
+			return offset, nil
+		}
+
+		h.apply(key, samples)
+		h.records++
+		offset += int64(walHeaderSize + len(payload))
+	}
+}
+
+func readWalRecord(r io.Reader) ([]byte, error) {
+	var header [walHeaderSize]byte
+	_, err := io.ReadFull(r, header[:])
+	if err != nil {
+		return nil, err
+	}
+
+	payload := make([]byte, binary.BigEndian.Uint32(header[0:4]))
+	_, err = io.ReadFull(r, payload)
+	if err != nil {
+		return nil, err
+	}
+
+	if crc32.ChecksumIEEE(payload) != binary.BigEndian.Uint32(header[4:8]) {
+		return nil, ErrCorrupted
+	}
+
+	return payload, nil
+}
+
+// encodeWalRecord frames the samples of a series as a wal record.
+func encodeWalRecord(key seriesKey, samples []sample) []byte {
+	payload := appendString(nil, key.station)
+	payload = appendString(payload, key.variable)
+	payload = binary.AppendUvarint(payload, uint64(len(samples)))
+	for _, s := range samples {
+		payload = binary.AppendVarint(payload, s.t)
+		payload = binary.BigEndian.AppendUint64(payload, math.Float64bits(s.sum))
+	}
+
+	buf := binary.BigEndian.AppendUint32(nil, uint32(len(payload)))
+	buf = binary.BigEndian.AppendUint32(buf, crc32.ChecksumIEEE(payload))
+	return append(buf, payload...)
+}
+
+func decodeWalRecord(payload []byte) (seriesKey, []sample, error) {
+	d := decoder{b: payload}
+	key := seriesKey{station: d.string(), variable: d.string()}
+
+	n := d.uvarint()
+	if d.err != nil || n > uint64(len(d.b)) {
+		return key, nil, ErrCorrupted
+	}
+
+	samples := make([]sample, 0, n)
+	for range n {
+		t := d.varint()
+		if d.err != nil || len(d.b) < 8 {
+			return key, nil, ErrCorrupted
+		}
+		samples = append(samples, rawSample(t, math.Float64frombits(binary.BigEndian.Uint64(d.b))))
+		d.b = d.b[8:]
+	}
+
+	return key, samples, nil
+}
+
+func (h *head) apply(key seriesKey, samples []sample) {
+	series, ok := h.series[key]
+	if !ok {
+		series = make(map[int64]float64, len(samples))
+		h.series[key] = series
+	}
+
+	for _, s := range samples {
+		series[s.t] = s.sum
+	}
+}
+
+// append logs the samples of a series and then adds them, replacing the
+// ones at the same time.
+func (h *head) append(key seriesKey, samples []sample) error {
+	_, err := h.wal.Write(encodeWalRecord(key, samples))
+	if err != nil {
+		return fmt.Errorf("error appending to wal: %w", err)
+	}
+
+	err = h.wal.Sync()
+	if err != nil {
+		return fmt.Errorf("error syncing wal: %w", err)
+	}
+
+	h.apply(key, samples)
+	h.records++
+	return nil
+}
+
+// query returns the samples of a series in [from, to] sorted by time.
+func (h *head) query(key seriesKey, from, to int64) []sample {
+	var samples []sample
+	for t, v := range h.series[key] {
+		if t >= from && t <= to {
+			samples = append(samples, rawSample(t, v))
+		}
+	}
+
+	slices.SortFunc(samples, compareSamples)
+	return samples
+}
+
+// cut removes and returns the samples older than boundary.
+func (h *head) cut(boundary int64) map[seriesKey][]sample {
+	cut := make(map[seriesKey][]sample)
+	for key, series := range h.series {
+		for t, v := range series {
+			if t < boundary {
+				cut[key] = append(cut[key], rawSample(t, v))
+				delete(series, t)
+				h.stale = true
+			}
+		}
+		if len(series) == 0 {
+			delete(h.series, key)
+		}
+	}
+
+	for _, samples := range cut {
+		slices.SortFunc(samples, compareSamples)
+	}
+
+	return cut
+}
+
+// checkpoint rewrites the wal with a record per series of the head, when
+// it holds more records than that or samples already cut.
+func (h *head) checkpoint() error {
+	if !h.stale && h.records <= len(h.series) {
+		return nil
+	}
+
+	var buf []byte
+	for key := range h.series {
+		buf = append(buf, encodeWalRecord(key, h.query(key, math.MinInt64, math.MaxInt64))...)
+	}
+
+	err := writeFile(h.path, buf)
+	if err != nil {
+		return fmt.Errorf("error writing wal checkpoint: %w", err)
+	}
+
+	// the old file was replaced, appends go to the new one
+	wal, err := os.OpenFile(h.path, os.O_WRONLY|os.O_APPEND, 0o640)
+	if err != nil {
+		return fmt.Errorf("error opening wal: %w", err)
+	}
+	_ = h.wal.Close()
+
+	h.wal = wal
+	h.records = len(h.series)
+	h.stale = false
+	return nil
+}
+
+func (h *head) samples() int {
+	n := 0
+	for _, series := range h.series {
+		n += len(series)
+	}
+	return n
+}
+
+func (h *head) close() error {
+	if h.wal == nil {
+		return nil
+	}
+	return h.wal.Close()
+}
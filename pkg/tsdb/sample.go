@@ -0,0 +1,79 @@
+package tsdb
+
+import (
+	"cmp"
+	"time"
+)
+
+// sample is an observation, or the aggregate of the observations of a
+// bucket once downsampled. A raw observation is its own aggregate, with
+// count 1.
+type sample struct {
+	t                    int64
+	min, max, sum, count float64
+}
+
+func rawSample(t int64, v float64) sample {
+	return sample{t: t, min: v, max: v, sum: v, count: 1}
+}
+
+func compareSamples(a, b sample) int {
+	return cmp.Compare(a.t, b.t)
+}
+
+// merge aggregates s and o, keeping the time of s.
+func (s sample) merge(o sample) sample {
+	return sample{
+		t:     s.t,
+		min:   min(s.min, o.min),
+		max:   max(s.max, o.max),
+		sum:   s.sum + o.sum,
+		count: s.count + o.count,
+	}
+}
+
+func (s sample) value(aggregate Aggregate) float64 {
+	switch aggregate {
+	case AggregateMin:
+		return s.min
+	case AggregateMax:
+		return s.max
+	case AggregateSum:
+		return s.sum
+	case AggregateCount:
+		return s.count
+	default:
+		return s.sum / s.count
+	}
+}
+
+// downsample aggregates samples sorted by time in buckets of resolution
+// seconds, each at the start of its bucket.
+func downsample(samples []sample, resolution int64) []sample {
+	var buckets []sample
+	for _, s := range samples {
+		bucket := alignDown(s.t, resolution)
+		if len(buckets) > 0 && buckets[len(buckets)-1].t == bucket {
+			buckets[len(buckets)-1] = buckets[len(buckets)-1].merge(s)
+			continue
+		}
+
+		s.t = bucket
+		buckets = append(buckets, s)
+	}
+
+	return buckets
+}
+
+// alignDown rounds t down to a multiple of d, before the epoch too.
+func alignDown(t, d int64) int64 {
+	m := t % d
+	if m < 0 {
+		m += d
+	}
+	return t - m
+}
+
+func seconds(d time.Duration) int64 {
+	return int64(d / time.Second)
+}
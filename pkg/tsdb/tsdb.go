@@ -0,0 +1,724 @@
+package tsdb
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"maps"
+	"math"
+	"os"
+	"path/filepath"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-playground/validator/v10"
+	"github.com/prometheus/client_golang/prometheus"
+	"go.uber.org/zap"
+)
+
+var (
+	validate = validator.New(validator.WithRequiredStructEnabled())
+
+	ErrClosed     = errors.New("tsdb closed")
+	ErrReadOnly   = errors.New("tsdb opened read-only")
+	ErrResolution = fmt.Errorf("downsample resolution must be whole seconds dividing %s", CompactDuration)
+)
+
+const (
+	// BlockDuration is the range of the blocks cut from the head.
+	BlockDuration = 2 * time.Hour
+	// CompactDuration is the range the blocks are merged into, and
+	// downsampled once complete.
+	CompactDuration = 24 * time.Hour
+	// DefaultHeadWindow keeps in the head the 24h meteotrentino serves, which
+	// every fetch writes again.
+	DefaultHeadWindow = 24 * time.Hour
+)
+
+// Aggregate picks the value of a point out of the observations it stands
+// for, when downsampled or queried with a step.
+type Aggregate string
+
+const (
+	AggregateAvg   Aggregate = "avg"
+	AggregateMin   Aggregate = "min"
+	AggregateMax   Aggregate = "max"
+	AggregateSum   Aggregate = "sum"
+	AggregateCount Aggregate = "count"
+)
+
+// Downsample replaces the observations older than After with their
+// aggregates over buckets of Resolution.
+type Downsample struct {
+	After      time.Duration `validate:"gt=0"`
+	Resolution time.Duration `validate:"gt=0"`
+}
+
+type Options struct {
+	Dir    string      `validate:"required"`
+	Logger *zap.Logger `validate:"required"`
+
+	Registerer prometheus.Registerer
+
+	// Retention drops the blocks older than it, data is kept forever when 0.
+	Retention  time.Duration `validate:"gte=0"`
+	Downsample []Downsample  `validate:"dive"`
+	// HeadWindow defaults to DefaultHeadWindow.
+	HeadWindow time.Duration `validate:"gte=0"`
+	// ReadOnly opens the store for queries only, e.g. the one of a running
+	// exporter: nothing on disk is changed, Append and Compact fail with
+	// ErrReadOnly.
+	ReadOnly bool
+}
+
+// Point is an observation, or an aggregate of observations, at Time.
+type Point struct {
+	Time  time.Time
+	Value float64
+}
+
+type QueryOptions struct {
+	// Step aggregates the points in buckets of Step, the stored resolution
+	// is returned when 0.
+	Step time.Duration
+	// Aggregate defaults to AggregateAvg.
+	Aggregate Aggregate
+}
+
+// Series describes the stored observations of a variable of a station.
+type Series struct {
+	Station  string
+	Variable string
+	From     time.Time
+	To       time.Time
+}
+
+// DB stores the observations of every station and variable on disk, with
+// no external dependency. Appends go to an in-memory head backed by a
+// write-ahead log, Compact cuts the samples older than the head window into
+// immutable blocks compressed with delta of delta times and xor'd values,
+// merges them by day, downsamples and drops them following the policies.
+// Queries read the head and the blocks in range, a sample written again
+// replaces the older one at the same time.
+type DB struct {
+	dir        string
+	logger     *zap.Logger
+	retention  time.Duration
+	headWindow time.Duration
+	downsample []Downsample
+	readOnly   bool
+
+	mu      sync.RWMutex
+	closed  bool
+	head    *head
+	blocks  []*block
+	nextSeq uint64
+
+	blocksGauge        prometheus.Gauge
+	sizeGauge          prometheus.Gauge
+	headSamples        prometheus.Gauge
+	compactions        prometheus.Counter
+	compactionFailures prometheus.Counter
+
+	registerer prometheus.Registerer
+}
+
+func NewDB(opts Options) (*DB, error) {
+	err := validate.Struct(opts)
+	if err != nil {
+		var invalidValidationError *validator.InvalidValidationError
+		if errors.As(err, &invalidValidationError) {
+			return nil, err
+		}
+
+		var validateErrs validator.ValidationErrors
+		if errors.As(err, &validateErrs) {
+			errs := make([]error, len(validateErrs))
+			for _, e := range validateErrs {
+				errs = append(errs, e)
+			}
+			return nil, errors.Join(errs...)
+		}
+
+		return nil, err
+	}
+
+	for _, policy := range opts.Downsample {
+		if policy.Resolution%time.Second != 0 || CompactDuration%policy.Resolution != 0 {
+			return nil, fmt.Errorf("%w, got %s", ErrResolution, policy.Resolution)
+		}
+	}
+
+	if !opts.ReadOnly {
+		err = os.MkdirAll(opts.Dir, 0o750)
+		if err != nil {
+			return nil, fmt.Errorf("error creating tsdb directory: %w", err)
+		}
+	}
+
+	db := &DB{
+		dir:        opts.Dir,
+		logger:     opts.Logger.With(zap.String("tsdb", opts.Dir)),
+		retention:  opts.Retention,
+		headWindow: DefaultHeadWindow,
+		downsample: opts.Downsample,
+		readOnly:   opts.ReadOnly,
+		nextSeq:    1,
+		blocksGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tsdb_blocks",
+			Help: "Number of blocks of the local time-series store",
+		}),
+		sizeGauge: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tsdb_blocks_size_bytes",
+			Help: "Size in bytes of the blocks of the local time-series store",
+		}),
+		headSamples: prometheus.NewGauge(prometheus.GaugeOpts{
+			Name: "tsdb_head_samples",
+			Help: "Number of samples in the head of the local time-series store",
+		}),
+		compactions: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tsdb_compactions_total",
+			Help: "Compactions of the local time-series store",
+		}),
+		compactionFailures: prometheus.NewCounter(prometheus.CounterOpts{
+			Name: "tsdb_compaction_failures_total",
+			Help: "Failed compactions of the local time-series store",
+		}),
+	}
+
+	if opts.HeadWindow != 0 {
+		db.headWindow = opts.HeadWindow
+	}
+
+	if opts.Registerer != nil {
+		db.registerer = opts.Registerer
+		err = errors.Join(
+			opts.Registerer.Register(db.blocksGauge),
+			opts.Registerer.Register(db.sizeGauge),
+			opts.Registerer.Register(db.headSamples),
+			opts.Registerer.Register(db.compactions),
+			opts.Registerer.Register(db.compactionFailures),
+		)
+		if err != nil {
+			return nil, fmt.Errorf("error registering tsdb metrics: %w", err)
+		}
+	}
+
+	err = db.open()
+	if err != nil {
+		db.unregister()
+		return nil, err
+	}
+
+	return db, nil
+}
+
+func (db *DB) blockPath(seq uint64) string {
+	return filepath.Join(db.dir, fmt.Sprintf("%016x%s", seq, blockExt))
+}
+
+// open loads the block indexes and replays the wal. Temporary files of an
+// interrupted write are removed, corrupted blocks are set aside, unless
+// read-only, when they are just skipped.
+func (db *DB) open() error {
+	entries, err := os.ReadDir(db.dir)
+	if err != nil {
+		return fmt.Errorf("error reading tsdb directory: %w", err)
+	}
+
+	for _, entry := range entries {
+		name := entry.Name()
+		path := filepath.Join(db.dir, name)
+		if entry.IsDir() {
+			continue
+		}
+
+		if strings.HasSuffix(name, ".tmp") {
+			if db.readOnly {
+				continue
+			}
+			err = os.Remove(path)
+			if err != nil {
+				return fmt.Errorf("error removing temporary file: %w", err)
+			}
+			continue
+		}
+
+		if !strings.HasSuffix(name, blockExt) {
+			if name != walFile {
+				db.logger.Warn("ignoring unknown file in tsdb directory", zap.String("file", name))
+			}
+			continue
+		}
+
+		seq, err := strconv.ParseUint(strings.TrimSuffix(name, blockExt), 16, 64)
+		if err != nil {
+			db.logger.Warn("ignoring unknown file in tsdb directory", zap.String("file", name))
+			continue
+		}
+		db.nextSeq = max(db.nextSeq, seq+1)
+
+		b, err := openBlock(path, seq)
+		if errors.Is(err, ErrCorrupted) && db.readOnly {
+			db.logger.Error("skipping corrupted block", zap.String("block", name), zap.Error(err))
+			continue
+		}
+		if errors.Is(err, ErrCorrupted) {
+			db.logger.Error("setting corrupted block aside", zap.String("block", name), zap.Error(err))
+			err = os.Rename(path, path+".corrupted")
+			if err != nil {
+				return fmt.Errorf("error setting corrupted block aside: %w", err)
+			}
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("error opening block %s: %w", name, err)
+		}
+
+		db.blocks = append(db.blocks, b)
+	}
+
+	slices.SortFunc(db.blocks, func(a, b *block) int {
+		if a.seq < b.seq {
+			return -1
+		}
+		if a.seq > b.seq {
+			return 1
+		}
+		return 0
+	})
+
+	db.head, err = openHead(filepath.Join(db.dir, walFile), db.logger, db.readOnly)
+	if err != nil {
+		return err
+	}
+
+	db.updateMetrics()
+	return nil
+}
+
+func (db *DB) updateMetrics() {
+	var size int64
+	for _, b := range db.blocks {
+		size += b.size
+	}
+
+	db.blocksGauge.Set(float64(len(db.blocks)))
+	db.sizeGauge.Set(float64(size))
+	db.headSamples.Set(float64(db.head.samples()))
+}
+
+// Append stores the points of a variable of a station, replacing the ones
+// already stored at the same time.
+func (db *DB) Append(station, variable string, points []Point) error {
+	if len(points) == 0 {
+		return nil
+	}
+
+	samples := make([]sample, len(points))
+	for i, p := range points {
+		samples[i] = rawSample(p.Time.Unix(), p.Value)
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	err := db.head.append(seriesKey{station: station, variable: variable}, samples)
+	if err != nil {
+		return err
+	}
+
+	db.headSamples.Set(float64(db.head.samples()))
+	return nil
+}
+
+// Query returns the points of a variable of a station in [from, to] sorted
+// by time, a zero from or to leaves the range open on that side.
+func (db *DB) Query(station, variable string, from, to time.Time, opts QueryOptions) ([]Point, error) {
+	start, end := int64(math.MinInt64), int64(math.MaxInt64)
+	if !from.IsZero() {
+		start = from.Unix()
+	}
+	if !to.IsZero() {
+		end = to.Unix()
+	}
+
+	key := seriesKey{station: station, variable: variable}
+
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	if db.closed {
+		return nil, ErrClosed
+	}
+
+	// blocks are sorted by seq, so newer samples replace older ones
+	merged := make(map[int64]sample)
+	for _, b := range db.blocks {
+		s, ok := b.series[key]
+		if !ok || !b.overlaps(start, end) || s.maxt < start || s.mint > end {
+			continue
+		}
+
+		samples, err := b.read(key)
+		if err != nil {
+			return nil, fmt.Errorf("error reading block %016x: %w", b.seq, err)
+		}
+		for _, s := range samples {
+			if s.t >= start && s.t <= end {
+				merged[s.t] = s
+			}
+		}
+	}
+	for _, s := range db.head.query(key, start, end) {
+		merged[s.t] = s
+	}
+
+	samples := make([]sample, 0, len(merged))
+	for _, s := range merged {
+		samples = append(samples, s)
+	}
+	slices.SortFunc(samples, compareSamples)
+
+	if step := seconds(opts.Step); step > 0 {
+		samples = downsample(samples, step)
+	}
+
+	points := make([]Point, len(samples))
+	for i, s := range samples {
+		points[i] = Point{Time: time.Unix(s.t, 0), Value: s.value(opts.Aggregate)}
+	}
+
+	return points, nil
+}
+
+// Series lists the stored series sorted by station and variable.
+func (db *DB) Series() []Series {
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+
+	ranges := make(map[seriesKey][2]int64)
+	extend := func(key seriesKey, mint, maxt int64) {
+		r, ok := ranges[key]
+		if !ok {
+			ranges[key] = [2]int64{mint, maxt}
+			return
+		}
+		ranges[key] = [2]int64{min(r[0], mint), max(r[1], maxt)}
+	}
+
+	for _, b := range db.blocks {
+		for key, s := range b.series {
+			extend(key, s.mint, s.maxt)
+		}
+	}
+	for key, series := range db.head.series {
+		for t := range series {
+			extend(key, t, t)
+		}
+	}
+
+	series := make([]Series, 0, len(ranges))
+	for key, r := range ranges {
+		series = append(series, Series{
+			Station:  key.station,
+			Variable: key.variable,
+			From:     time.Unix(r[0], 0),
+			To:       time.Unix(r[1], 0),
+		})
+	}
+
+	slices.SortFunc(series, func(a, b Series) int {
+		return seriesKey{a.Station, a.Variable}.compare(seriesKey{b.Station, b.Variable})
+	})
+	return series
+}
+
+// Compact cuts the head samples older than the head window into blocks,
+// merges the blocks of the same day and resolution, downsamples the
+// complete days old enough and drops the blocks past the retention, as of
+// now.
+func (db *DB) Compact(now time.Time) error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	err := db.compact(now)
+	if err != nil {
+		db.compactionFailures.Inc()
+	}
+	db.compactions.Inc()
+	db.updateMetrics()
+
+	return err
+}
+
+func (db *DB) compact(now time.Time) error {
+	boundary := alignDown(now.Add(-db.headWindow).Unix(), seconds(BlockDuration))
+
+	err := db.cut(boundary)
+	if err != nil {
+		return err
+	}
+
+	err = db.merge()
+	if err != nil {
+		return err
+	}
+
+	err = db.downsampleBlocks(now, boundary)
+	if err != nil {
+		return err
+	}
+
+	if db.retention > 0 {
+		oldest := now.Add(-db.retention).Unix()
+		for _, b := range slices.Clone(db.blocks) {
+			if b.end <= oldest {
+				db.logger.Debug("dropping block past retention", zap.Uint64("block", b.seq), zap.Time("end", time.Unix(b.end, 0)))
+				err = db.removeBlock(b)
+				if err != nil {
+					return err
+				}
+			}
+		}
+	}
+
+	return nil
+}
+
+// cut writes the head samples older than boundary in a raw block per
+// BlockDuration range.
+func (db *DB) cut(boundary int64) error {
+	cut := db.head.cut(boundary)
+	if len(cut) == 0 {
+		return db.head.checkpoint()
+	}
+
+	ranges := make(map[int64]map[seriesKey][]sample)
+	for key, samples := range cut {
+		for _, s := range samples {
+			start := alignDown(s.t, seconds(BlockDuration))
+			if ranges[start] == nil {
+				ranges[start] = make(map[seriesKey][]sample)
+			}
+			ranges[start][key] = append(ranges[start][key], s)
+		}
+	}
+
+	for _, start := range slices.Sorted(maps.Keys(ranges)) {
+		err := db.writeBlock(start, start+seconds(BlockDuration), 0, ranges[start])
+		if err != nil {
+			// the samples stay in the head, and in the wal, for the next
+			// compaction
+			for key, samples := range cut {
+				db.head.apply(key, samples)
+			}
+			return err
+		}
+	}
+
+	return db.head.checkpoint()
+}
+
+// merge rewrites the blocks of the same day and resolution as one, newer
+// samples replacing the older ones at the same time.
+func (db *DB) merge() error {
+	type group struct {
+		day        int64
+		resolution int64
+	}
+
+	groups := make(map[group][]*block)
+	for _, b := range db.blocks {
+		g := group{alignDown(b.start, seconds(CompactDuration)), b.resolution}
+		groups[g] = append(groups[g], b)
+	}
+
+	for g, blocks := range groups {
+		if len(blocks) < 2 {
+			continue
+		}
+
+		merged := make(map[seriesKey]map[int64]sample)
+		start, end := blocks[0].start, blocks[0].end
+		for _, b := range blocks {
+			data, err := b.readAll()
+			if err != nil {
+				return fmt.Errorf("error reading block %016x: %w", b.seq, err)
+			}
+			for key, samples := range data {
+				if merged[key] == nil {
+					merged[key] = make(map[int64]sample)
+				}
+				for _, s := range samples {
+					merged[key][s.t] = s
+				}
+			}
+			start, end = min(start, b.start), max(end, b.end)
+		}
+
+		data := make(map[seriesKey][]sample, len(merged))
+		for key, samples := range merged {
+			for _, s := range samples {
+				data[key] = append(data[key], s)
+			}
+			slices.SortFunc(data[key], compareSamples)
+		}
+
+		err := db.writeBlock(start, end, g.resolution, data)
+		if err != nil {
+			return err
+		}
+
+		for _, b := range blocks {
+			err = db.removeBlock(b)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+// downsampleBlocks replaces the blocks of complete days, no longer receiving
+// samples from the head, with their aggregates at the coarsest resolution
+// whose policy applies.
+func (db *DB) downsampleBlocks(now time.Time, boundary int64) error {
+	for _, b := range slices.Clone(db.blocks) {
+		day := alignDown(b.start, seconds(CompactDuration))
+		if day+seconds(CompactDuration) > boundary {
+			continue
+		}
+
+		var resolution int64
+		for _, policy := range db.downsample {
+			if b.end <= now.Add(-policy.After).Unix() {
+				resolution = max(resolution, seconds(policy.Resolution))
+			}
+		}
+		if resolution <= b.resolution {
+			continue
+		}
+
+		data, err := b.readAll()
+		if err != nil {
+			return fmt.Errorf("error reading block %016x: %w", b.seq, err)
+		}
+		for key, samples := range data {
+			data[key] = downsample(samples, resolution)
+		}
+
+		db.logger.Debug("downsampling block",
+			zap.Uint64("block", b.seq),
+			zap.Time("start", time.Unix(b.start, 0)),
+			zap.Duration("resolution", time.Duration(resolution)*time.Second),
+		)
+
+		start := alignDown(b.start, resolution)
+		end := alignDown(b.end+resolution-1, resolution)
+		err = db.writeBlock(start, end, resolution, data)
+		if err != nil {
+			return err
+		}
+
+		err = db.removeBlock(b)
+		if err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func (db *DB) writeBlock(start, end, resolution int64, data map[seriesKey][]sample) error {
+	seq := db.nextSeq
+	path := db.blockPath(seq)
+
+	err := writeBlock(path, start, end, resolution, data)
+	if err != nil {
+		return fmt.Errorf("error writing block: %w", err)
+	}
+
+	b, err := openBlock(path, seq)
+	if err != nil {
+		return fmt.Errorf("error opening written block: %w", err)
+	}
+
+	db.nextSeq++
+	db.blocks = append(db.blocks, b)
+	return nil
+}
+
+func (db *DB) removeBlock(b *block) error {
+	err := os.Remove(b.path)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return fmt.Errorf("error removing block: %w", err)
+	}
+
+	db.blocks = slices.DeleteFunc(db.blocks, func(o *block) bool {
+		return o == b
+	})
+	return nil
+}
+
+// Run compacts the store every interval until ctx is done.
+func (db *DB) Run(ctx context.Context, interval time.Duration) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for {
+		err := db.Compact(time.Now())
+		if err != nil && !errors.Is(err, ErrClosed) {
+			db.logger.Error("error compacting tsdb", zap.Error(err))
+		}
+
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (db *DB) unregister() {
+	if db.registerer != nil {
+		db.registerer.Unregister(db.blocksGauge)
+		db.registerer.Unregister(db.sizeGauge)
+		db.registerer.Unregister(db.headSamples)
+		db.registerer.Unregister(db.compactions)
+		db.registerer.Unregister(db.compactionFailures)
+	}
+}
+
+func (db *DB) Close() error {
+	db.mu.Lock()
+	defer db.mu.Unlock()
+
+	if db.closed {
+		return nil
+	}
+	db.closed = true
+
+	// a store reopened on reload registers its metrics again
+	db.unregister()
+
+	return db.head.close()
+}
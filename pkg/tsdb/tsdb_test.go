@@ -0,0 +1,184 @@
+package tsdb_test
+
+import (
+	"errors"
+	"slices"
+	"testing"
+	"time"
+
+	"go.uber.org/zap"
+	"wouldgo.me/meteotrentino-exporter/pkg/tsdb"
+)
+
+// now is when the tests compact, day is complete and past the head window
+// by then.
+var (
+	now = time.Date(2026, 10, 18, 12, 0, 0, 0, time.UTC)
+	day = time.Date(2026, 10, 10, 0, 0, 0, 0, time.UTC)
+)
+
+func open(t *testing.T, dir string, downsample ...tsdb.Downsample) *tsdb.DB {
+	t.Helper()
+
+	db, err := tsdb.NewDB(tsdb.Options{
+		Dir:        dir,
+		Logger:     zap.NewNop(),
+		Downsample: downsample,
+	})
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	return db
+}
+
+// every returns a point every 15 minutes from start, one per value.
+func every(start time.Time, values ...float64) []tsdb.Point {
+	points := make([]tsdb.Point, len(values))
+	for i, v := range values {
+		points[i] = tsdb.Point{Time: start.Add(time.Duration(i) * 15 * time.Minute), Value: v}
+	}
+
+	return points
+}
+
+func appendPoints(t *testing.T, db *tsdb.DB, points []tsdb.Point) {
+	t.Helper()
+
+	err := db.Append("T0147", "temperature", points)
+	if err != nil {
+		t.Fatalf("Append() error = %v", err)
+	}
+}
+
+func compact(t *testing.T, db *tsdb.DB) {
+	t.Helper()
+
+	err := db.Compact(now)
+	if err != nil {
+		t.Fatalf("Compact() error = %v", err)
+	}
+}
+
+func query(t *testing.T, db *tsdb.DB, opts tsdb.QueryOptions) []tsdb.Point {
+	t.Helper()
+
+	points, err := db.Query("T0147", "temperature", time.Time{}, time.Time{}, opts)
+	if err != nil {
+		t.Fatalf("Query() error = %v", err)
+	}
+
+	return points
+}
+
+func equal(a, b []tsdb.Point) bool {
+	return slices.EqualFunc(a, b, func(a, b tsdb.Point) bool {
+		return a.Time.Equal(b.Time) && a.Value == b.Value
+	})
+}
+
+func TestNewerReplacesOlder(t *testing.T) {
+	dir := t.TempDir()
+	db := open(t, dir)
+
+	// the first write is cut into a block, the second one into another
+	// block of the same day, merged with the first
+	appendPoints(t, db, every(day, 12.5, 12.9, 13.2, 13.0))
+	compact(t, db)
+	appendPoints(t, db, every(day.Add(30*time.Minute), 14.1, 14.4))
+	compact(t, db)
+
+	// and the third one stays in the head, replacing its points
+	recent := now.Add(-time.Hour)
+	appendPoints(t, db, every(recent, 10.1, 10.4))
+	appendPoints(t, db, every(recent, 11.1))
+
+	err := db.Close()
+	if err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+
+	// blocks are read and the head is replayed from the wal
+	db = open(t, dir)
+
+	want := append(every(day, 12.5, 12.9, 14.1, 14.4), every(recent, 11.1, 10.4)...)
+	if got := query(t, db, tsdb.QueryOptions{}); !equal(got, want) {
+		t.Errorf("Query() = %v, want %v", got, want)
+	}
+}
+
+func TestDownsample(t *testing.T) {
+	dir := t.TempDir()
+	db := open(t, dir, tsdb.Downsample{After: 48 * time.Hour, Resolution: time.Hour})
+
+	appendPoints(t, db, every(day, 1, 2, 3, 4, 5, 6, 7, 8))
+	compact(t, db)
+
+	err := db.Close()
+	if err != nil {
+		t.Fatalf("Close() error = %v", err)
+	}
+	db = open(t, dir, tsdb.Downsample{After: 48 * time.Hour, Resolution: time.Hour})
+
+	tests := []struct {
+		aggregate tsdb.Aggregate
+		want      []float64
+	}{
+		{tsdb.AggregateAvg, []float64{2.5, 6.5}},
+		{tsdb.AggregateMin, []float64{1, 5}},
+		{tsdb.AggregateMax, []float64{4, 8}},
+		{tsdb.AggregateSum, []float64{10, 26}},
+		{tsdb.AggregateCount, []float64{4, 4}},
+	}
+
+	for _, tt := range tests {
+		t.Run(string(tt.aggregate), func(t *testing.T) {
+			want := []tsdb.Point{
+				{Time: day, Value: tt.want[0]},
+				{Time: day.Add(time.Hour), Value: tt.want[1]},
+			}
+
+			if got := query(t, db, tsdb.QueryOptions{Aggregate: tt.aggregate}); !equal(got, want) {
+				t.Errorf("Query() = %v, want %v", got, want)
+			}
+		})
+	}
+
+	// a coarser step aggregates the aggregates
+	want := []tsdb.Point{{Time: day, Value: 4.5}}
+	if got := query(t, db, tsdb.QueryOptions{Step: 2 * time.Hour}); !equal(got, want) {
+		t.Errorf("Query() with step = %v, want %v", got, want)
+	}
+}
+
+func TestReadOnly(t *testing.T) {
+	dir := t.TempDir()
+	db := open(t, dir)
+
+	appendPoints(t, db, every(day, 12.5, 12.9))
+	compact(t, db)
+	recent := now.Add(-time.Hour)
+	appendPoints(t, db, every(recent, 10.1))
+
+	// a read-only store sees the blocks and the wal of a store still open
+	ro, err := tsdb.NewDB(tsdb.Options{Dir: dir, Logger: zap.NewNop(), ReadOnly: true})
+	if err != nil {
+		t.Fatalf("NewDB() error = %v", err)
+	}
+	t.Cleanup(func() { _ = ro.Close() })
+
+	want := append(every(day, 12.5, 12.9), every(recent, 10.1)...)
+	if got := query(t, ro, tsdb.QueryOptions{}); !equal(got, want) {
+		t.Errorf("Query() = %v, want %v", got, want)
+	}
+
+	err = ro.Append("T0147", "temperature", every(recent, 11.1))
+	if !errors.Is(err, tsdb.ErrReadOnly) {
+		t.Errorf("Append() error = %v, want %v", err, tsdb.ErrReadOnly)
+	}
+	err = ro.Compact(now)
+	if !errors.Is(err, tsdb.ErrReadOnly) {
+		t.Errorf("Compact() error = %v, want %v", err, tsdb.ErrReadOnly)
+	}
+}